@@ -15,7 +15,11 @@ func newConnection() *sqlx.DB {
 		BrokerAddr:   "localhost:8082",
 		PingEndpoint: "/status/health",
 	}
-	db, err := sqlx.Open("druid", cfg.FormatDSN())
+	dsn, err := cfg.FormatDSN()
+	if err != nil {
+		log.Panic(err)
+	}
+	db, err := sqlx.Open("druid", dsn)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -0,0 +1,287 @@
+// Package bloom implements druid's BloomKFilter, so a set of values built
+// in Go can be tested by the bloom filter extension, with
+// BLOOM_FILTER_TEST(col, ?) in SQL or a native bloom filter, instead of a
+// long IN list. Filters serialize to the same bytes as druid's
+package bloom
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/peak-ai/go-druid/internal/murmur3"
+)
+
+// DefaultFPP is the false positive probability of filters made by New
+const DefaultFPP = 0.05
+
+// seed is the seed druid hashes values with
+const seed = 104729
+
+// nullHash is the hash druid gives null values
+const nullHash = 2862933555777941757
+
+// Filters are made of blocks of 8 longs, a value sets k bits within one
+const (
+	blockSize       = 8
+	blockSizeBits   = 3
+	blockOffsetMask = blockSize - 1
+	bitOffsetMask   = 63
+)
+
+// ErrInvalidFilter is returned when bytes aren't a serialized BloomKFilter
+var ErrInvalidFilter = errors.New("bloom: invalid filter")
+
+// Filter is a BloomKFilter. It's not safe for concurrent use while values
+// are added
+type Filter struct {
+	k    int
+	bits []uint64
+}
+
+// New returns a filter sized for maxEntries values with a false positive
+// probability of DefaultFPP, as druid's BloomKFilter(maxNumEntries) is
+func New(maxEntries int) *Filter {
+	return NewWithFPP(maxEntries, DefaultFPP)
+}
+
+// NewWithFPP returns a filter sized for maxEntries values with a false
+// positive probability of fpp, between 0 and 1 exclusive
+func NewWithFPP(maxEntries int, fpp float64) *Filter {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	if fpp <= 0 || fpp >= 1 {
+		fpp = DefaultFPP
+	}
+
+	n := float64(maxEntries)
+	numBits := int64(-n * math.Log(fpp) / (math.Ln2 * math.Ln2))
+	k := int(math.Max(1, math.Floor(float64(numBits)/n*math.Ln2+0.5)))
+
+	// The longs are padded to whole blocks, by a whole block when they
+	// already are as druid does
+	longs := int(math.Ceil(float64(numBits) / 64))
+	longs += blockSize - longs%blockSize
+	return &Filter{k: k, bits: make([]uint64, longs)}
+}
+
+// Decode deserializes a filter in druid's format: the number of hash
+// functions in a byte, then the number of longs of the bit set and the
+// longs, big endian
+func Decode(b []byte) (*Filter, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("%w: %d bytes is too short", ErrInvalidFilter, len(b))
+	}
+	k, longs := int(b[0]), int(int32(binary.BigEndian.Uint32(b[1:])))
+	if k < 1 || longs < blockSize || longs%blockSize != 0 || len(b)-5 != longs*8 {
+		return nil, fmt.Errorf("%w: %d hash functions and %d longs in %d bytes", ErrInvalidFilter, k, longs, len(b))
+	}
+
+	f := &Filter{k: k, bits: make([]uint64, longs)}
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(b[5+i*8:])
+	}
+	return f, nil
+}
+
+// DecodeString deserializes a base64 encoded filter, as druid's
+// BLOOM_FILTER aggregator returns them
+func DecodeString(s string) (*Filter, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	return Decode(b)
+}
+
+// MarshalBinary serializes the filter in druid's format
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 5+len(f.bits)*8)
+	b[0] = byte(f.k)
+	binary.BigEndian.PutUint32(b[1:], uint32(len(f.bits)))
+	for i, v := range f.bits {
+		binary.BigEndian.PutUint64(b[5+i*8:], v)
+	}
+	return b, nil
+}
+
+// String returns the base64 encoding of the serialized filter, as
+// BLOOM_FILTER_TEST and native bloom filters take it
+func (f *Filter) String() string {
+	b, _ := f.MarshalBinary()
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// MarshalJSON implements json.Marshaler, encoding the filter as its base64
+// string
+func (f *Filter) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + f.String() + `"`), nil
+}
+
+// Value implements driver.Valuer, so a filter is passed as the base64
+// string BLOOM_FILTER_TEST(col, ?) expects
+func (f *Filter) Value() (driver.Value, error) {
+	return f.String(), nil
+}
+
+// Scan implements sql.Scanner, reading the filter a BLOOM_FILTER
+// aggregation returns
+func (f *Filter) Scan(src interface{}) error {
+	var decoded *Filter
+	var err error
+	switch v := src.(type) {
+	case []byte:
+		decoded, err = Decode(v)
+	case string:
+		decoded, err = DecodeString(v)
+	default:
+		return fmt.Errorf("bloom: can't scan %T into a Filter", src)
+	}
+	if err != nil {
+		return err
+	}
+	*f = *decoded
+	return nil
+}
+
+// DimFilter returns a native bloom filter testing dimension against f
+func (f *Filter) DimFilter(dimension string) DimFilter {
+	return DimFilter{Type: "bloom", Dimension: dimension, BloomKFilter: f}
+}
+
+// DimFilter is druid's native bloom filter
+// https://druid.apache.org/docs/latest/development/extensions-core/bloom-filter.html#filtering-native-queries-with-a-bloom-filter
+type DimFilter struct {
+	Type         string  `json:"type"`
+	Dimension    string  `json:"dimension"`
+	BloomKFilter *Filter `json:"bloomKFilter"`
+}
+
+// K returns the number of hash functions
+func (f *Filter) K() int {
+	return f.k
+}
+
+// BitSize returns the number of bits in the filter
+func (f *Filter) BitSize() int {
+	return len(f.bits) * 64
+}
+
+// AddBytes adds a value's bytes
+func (f *Filter) AddBytes(b []byte) {
+	f.addHash(murmur3.Hash64(b, seed))
+}
+
+// AddString adds a string value, as druid tests STRING columns
+func (f *Filter) AddString(s string) {
+	f.AddBytes([]byte(s))
+}
+
+// AddLong adds an integer value, as druid tests LONG columns
+func (f *Filter) AddLong(v int64) {
+	f.addHash(longHash(v))
+}
+
+// AddDouble adds a floating point value, as druid tests DOUBLE and FLOAT
+// columns
+func (f *Filter) AddDouble(v float64) {
+	f.AddLong(int64(math.Float64bits(v)))
+}
+
+// AddNull adds null, so rows whose value is null pass
+func (f *Filter) AddNull() {
+	f.addHash(nullHash)
+}
+
+// TestBytes reports whether a value's bytes may have been added
+func (f *Filter) TestBytes(b []byte) bool {
+	return f.testHash(murmur3.Hash64(b, seed))
+}
+
+// TestString reports whether a string may have been added
+func (f *Filter) TestString(s string) bool {
+	return f.TestBytes([]byte(s))
+}
+
+// TestLong reports whether an integer may have been added
+func (f *Filter) TestLong(v int64) bool {
+	return f.testHash(longHash(v))
+}
+
+// TestDouble reports whether a floating point value may have been added
+func (f *Filter) TestDouble(v float64) bool {
+	return f.TestLong(int64(math.Float64bits(v)))
+}
+
+// TestNull reports whether null may have been added
+func (f *Filter) TestNull() bool {
+	return f.testHash(nullHash)
+}
+
+// Merge adds the values of other, which must be the same size
+func (f *Filter) Merge(other *Filter) error {
+	if other.k != f.k || len(other.bits) != len(f.bits) {
+		return fmt.Errorf("bloom: can't merge a filter of %d hash functions and %d bits into one of %d and %d", other.k, other.BitSize(), f.k, f.BitSize())
+	}
+	for i, v := range other.bits {
+		f.bits[i] |= v
+	}
+	return nil
+}
+
+// addHash sets the k bits of hash within its block, the hashes of each
+// bit derived from two halves of it with Java's int arithmetic
+func (f *Filter) addHash(hash uint64) {
+	f.eachBit(hash, func(word int, bit uint64) bool {
+		f.bits[word] |= bit
+		return true
+	})
+}
+
+func (f *Filter) testHash(hash uint64) bool {
+	return f.eachBit(hash, func(word int, bit uint64) bool {
+		return f.bits[word]&bit != 0
+	})
+}
+
+// eachBit calls fn with the word and bit of the filter for each hash
+// function, stopping when it returns false
+func (f *Filter) eachBit(hash uint64, fn func(word int, bit uint64) bool) bool {
+	hash1, hash2 := int32(hash), int32(hash>>32)
+
+	firstHash := hash1 + hash2
+	if firstHash < 0 {
+		firstHash = ^firstHash
+	}
+	blockBase := int(firstHash) % (len(f.bits) / blockSize) << blockSizeBits
+
+	for i := int32(1); i <= int32(f.k); i++ {
+		combined := hash1 + (i+1)*hash2
+		if combined < 0 {
+			combined = ^combined
+		}
+		word := blockBase + int(combined&blockOffsetMask)
+		bit := uint64(1) << uint(combined>>blockSizeBits&bitOffsetMask)
+		if !fn(word, bit) {
+			return false
+		}
+	}
+	return true
+}
+
+// longHash is Thomas Wang's 64 bit integer hash, with Java's arithmetic
+// shifts, as druid hashes longs
+func longHash(key int64) uint64 {
+	key = ^key + key<<21
+	key ^= key >> 24
+	key = key + key<<3 + key<<8
+	key ^= key >> 14
+	key = key + key<<2 + key<<4
+	key ^= key >> 28
+	key += key << 31
+	return uint64(key)
+}
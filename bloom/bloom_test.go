@@ -0,0 +1,161 @@
+package bloom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSizesAsDruid(t *testing.T) {
+	// BloomKFilter(100000): 623523 bits for 5% false positives, 4 hash
+	// functions, padded to 9744 longs
+	f := New(100000)
+	require.Equal(t, 4, f.K())
+	require.Equal(t, 9744*64, f.BitSize())
+	b, err := f.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, b, 1+4+9744*8)
+
+	// Longs that fill whole blocks still get another
+	f = New(1)
+	require.Equal(t, 4, f.K())
+	require.Equal(t, 8*64, f.BitSize())
+
+	f = NewWithFPP(1000, 0.01)
+	require.Equal(t, 7, f.K())
+	require.Equal(t, 152*64, f.BitSize())
+}
+
+func TestFilterMembership(t *testing.T) {
+	f := New(10000)
+	for i := 0; i < 10000; i++ {
+		f.AddString(fmt.Sprintf("user-%d", i))
+	}
+	f.AddLong(-42)
+	f.AddLong(math.MaxInt64)
+	f.AddDouble(1.5)
+	f.AddBytes([]byte{0xff, 0})
+
+	for i := 0; i < 10000; i++ {
+		require.True(t, f.TestString(fmt.Sprintf("user-%d", i)))
+	}
+	require.True(t, f.TestLong(-42))
+	require.True(t, f.TestLong(math.MaxInt64))
+	require.True(t, f.TestDouble(1.5))
+	require.True(t, f.TestBytes([]byte{0xff, 0}))
+	require.False(t, f.TestNull())
+	f.AddNull()
+	require.True(t, f.TestNull())
+
+	falsePositives := 0
+	for i := 10000; i < 110000; i++ {
+		if f.TestString(fmt.Sprintf("user-%d", i)) {
+			falsePositives++
+		}
+	}
+	require.InDelta(t, DefaultFPP, float64(falsePositives)/100000, 0.01)
+}
+
+func TestSerialization(t *testing.T) {
+	f := New(100)
+	f.AddString("a")
+	f.AddLong(7)
+
+	b, err := f.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, byte(f.K()), b[0])
+	require.Equal(t, []byte{0, 0, 0, 16}, b[1:5])
+
+	decoded, err := Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, f, decoded)
+
+	decoded, err = DecodeString(f.String())
+	require.NoError(t, err)
+	require.Equal(t, f, decoded)
+	require.True(t, decoded.TestString("a"))
+	require.True(t, decoded.TestLong(7))
+
+	var scanned Filter
+	require.NoError(t, scanned.Scan(b))
+	require.Equal(t, f, &scanned)
+	require.NoError(t, scanned.Scan(f.String()))
+	require.Equal(t, f, &scanned)
+	require.Error(t, scanned.Scan(42))
+
+	for name, b := range map[string][]byte{
+		"short":     b[:3],
+		"truncated": b[:len(b)-1],
+		"unaligned": append([]byte{4, 0, 0, 0, 1}, make([]byte, 8)...),
+		"no hashes": append([]byte{0}, b[1:]...),
+	} {
+		_, err := Decode(b)
+		require.True(t, errors.Is(err, ErrInvalidFilter), name)
+	}
+	_, err = DecodeString("not base64!")
+	require.True(t, errors.Is(err, ErrInvalidFilter))
+}
+
+func TestDecodeLayout(t *testing.T) {
+	// Written byte by byte as BloomKFilter.serialize writes to a
+	// DataOutputStream: numHashFunctions, the int numLongs, then each long
+	// of the bit set, all big endian. Bit i of the set is bit i%64 of long
+	// i/64, as in java.util.BitSet
+	b := []byte{
+		3,
+		0, 0, 0, 8,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+	b = append(b, make([]byte, 6*8)...)
+	b = append(b, 0x80, 0, 0, 0, 0, 0, 0, 0x01)
+
+	f, err := Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, 3, f.K())
+	require.Equal(t, 512, f.BitSize())
+	require.Equal(t, uint64(0x0102030405060708), f.bits[0])
+	require.Equal(t, uint64(1)<<63|1, f.bits[7])
+
+	encoded, err := f.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, b, encoded)
+}
+
+func TestParameterAndNativeFilter(t *testing.T) {
+	f := New(10)
+	f.AddString("a")
+
+	v, err := f.Value()
+	require.NoError(t, err)
+	b, err := base64.StdEncoding.DecodeString(v.(string))
+	require.NoError(t, err)
+	decoded, err := Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, f, decoded)
+
+	native, err := json.Marshal(f.DimFilter("user_id"))
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"type":"bloom","dimension":"user_id","bloomKFilter":%q}`, f.String()), string(native))
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(100), New(100)
+	a.AddString("a")
+	b.AddString("b")
+	require.NoError(t, a.Merge(b))
+	require.True(t, a.TestString("a"))
+	require.True(t, a.TestString("b"))
+
+	require.Error(t, a.Merge(New(100000)))
+}
+
+func TestLongHashUsesArithmeticShifts(t *testing.T) {
+	// ~0 is -1, which only Java's sign keeping >> clears with key ^= key >> 24
+	require.Equal(t, uint64(0), longHash(0))
+	require.NotEqual(t, longHash(-1), longHash(1))
+}
@@ -0,0 +1,259 @@
+package dsql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// druidTypePattern matches the native type names druid sends in the
+// typesHeader row
+var druidTypePattern = regexp.MustCompile(`^(STRING|LONG|FLOAT|DOUBLE|ARRAY<.+>|COMPLEX<.+>)$`)
+
+// isDruidTypeName reports whether name is a native type druid sends in the
+// typesHeader row
+func isDruidTypeName(name string) bool {
+	return druidTypePattern.MatchString(name)
+}
+
+// StringArray scans multi-value string dimensions and ARRAY<STRING>
+// columns, null elements become empty strings. It can also be passed as
+// a query parameter
+type StringArray []string
+
+// Scan implements sql.Scanner
+func (a *StringArray) Scan(src interface{}) error {
+	values, err := scanArray(src)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		*a = nil
+		return nil
+	}
+
+	out := make(StringArray, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			out[i] = v
+		case float64:
+			out[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			out[i] = strconv.FormatInt(v, 10)
+		case bool:
+			out[i] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("druid: can't scan array element of type %T into StringArray", v)
+		}
+	}
+	*a = out
+	return nil
+}
+
+// Array scans any multi-value or ARRAY column, keeping nulls. Elements are
+// string, int64, float64, bool or nil. It can also be passed as a query
+// parameter
+type Array []interface{}
+
+// Scan implements sql.Scanner
+func (a *Array) Scan(src interface{}) error {
+	values, err := scanArray(src)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		*a = nil
+		return nil
+	}
+	*a = values
+	return nil
+}
+
+// scanArray converts the driver values rows.Next produces for array
+// columns, or their JSON text, to a slice of elements
+func scanArray(src interface{}) (Array, error) {
+	switch v := src.(type) {
+	case nil:
+		return nil, nil
+	case Array:
+		return v, nil
+	case []interface{}:
+		return Array(v), nil
+	case []string:
+		out := make(Array, len(v))
+		for i, s := range v {
+			out[i] = s
+		}
+		return out, nil
+	case []int64:
+		out := make(Array, len(v))
+		for i, n := range v {
+			out[i] = n
+		}
+		return out, nil
+	case []float64:
+		out := make(Array, len(v))
+		for i, f := range v {
+			out[i] = f
+		}
+		return out, nil
+	case string:
+		return scanArray([]byte(v))
+	case []byte:
+		var values []interface{}
+		if err := decodeJSON(v, &values); err != nil {
+			// A multi-value dimension holding a single value isn't an array
+			return Array{string(v)}, nil
+		}
+		return Array(values), nil
+	default:
+		return nil, fmt.Errorf("druid: can't scan %T into an array", src)
+	}
+}
+
+// arrayValue returns the driver value for an array druid returned, typed
+// by the column's native type when it's known so it scans straight into
+// []string, []int64 or []float64. Arrays holding nulls or mixed types are
+// returned as an Array
+func arrayValue(values []interface{}, druidType string) driver.Value {
+	switch druidType {
+	case "STRING", "ARRAY<STRING>":
+		if out, ok := stringsOf(values); ok {
+			return out
+		}
+	case "ARRAY<LONG>":
+		if out, ok := int64sOf(values); ok {
+			return out
+		}
+	case "ARRAY<DOUBLE>", "ARRAY<FLOAT>":
+		if out, ok := float64sOf(values); ok {
+			return out
+		}
+	case "":
+		if out, ok := stringsOf(values); ok {
+			return out
+		}
+		if out, ok := int64sOf(values); ok {
+			return out
+		}
+		if out, ok := float64sOf(values); ok {
+			return out
+		}
+	}
+	return Array(values)
+}
+
+func stringsOf(values []interface{}) ([]string, bool) {
+	out := make([]string, len(values))
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		out[i] = s
+	}
+	return out, true
+}
+
+func int64sOf(values []interface{}) ([]int64, bool) {
+	out := make([]int64, len(values))
+	for i, v := range values {
+		switch n := v.(type) {
+		case int64:
+			out[i] = n
+		case int:
+			out[i] = int64(n)
+		case int32:
+			out[i] = int64(n)
+		case float64:
+			if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+				return nil, false
+			}
+			out[i] = int64(n)
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+func float64sOf(values []interface{}) ([]float64, bool) {
+	out := make([]float64, len(values))
+	for i, v := range values {
+		switch n := v.(type) {
+		case float64:
+			out[i] = n
+		case float32:
+			out[i] = float64(n)
+		case int64:
+			out[i] = float64(n)
+		case int:
+			out[i] = float64(n)
+		case int32:
+			out[i] = float64(n)
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// isArrayParameter reports whether v is an array query parameter
+func isArrayParameter(v interface{}) bool {
+	switch v.(type) {
+	case []string, StringArray, []int64, []int, []float64, []interface{}, Array:
+		return true
+	}
+	return false
+}
+
+// arrayParameter converts an array query parameter to the elements sent
+// to druid
+func arrayParameter(v interface{}) ([]interface{}, error) {
+	var values []interface{}
+	switch v := v.(type) {
+	case []string:
+		values = make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = s
+		}
+	case StringArray:
+		return arrayParameter([]string(v))
+	case []int64:
+		values = make([]interface{}, len(v))
+		for i, n := range v {
+			values[i] = n
+		}
+	case []int:
+		values = make([]interface{}, len(v))
+		for i, n := range v {
+			values[i] = int64(n)
+		}
+	case []float64:
+		values = make([]interface{}, len(v))
+		for i, f := range v {
+			values[i] = f
+		}
+	case Array:
+		return arrayParameter([]interface{}(v))
+	case []interface{}:
+		values = make([]interface{}, len(v))
+		for i, e := range v {
+			switch e := e.(type) {
+			case nil, string, bool, int64, float64:
+				values[i] = e
+			case int:
+				values[i] = int64(e)
+			default:
+				return nil, fmt.Errorf("unsupported array element type %T", e)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+	return values, nil
+}
@@ -0,0 +1,124 @@
+package dsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrayColumnsScanIntoSlices(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"tags", "counts", "scores", "mixed", "single"}, [][]interface{}{
+		{"STRING", "ARRAY<LONG>", "ARRAY<DOUBLE>", "ARRAY<LONG>", "STRING"},
+		{"VARCHAR", "ARRAY", "ARRAY", "ARRAY", "VARCHAR"},
+		{[]interface{}{"a", "b"}, []interface{}{1, 2}, []interface{}{1, 2.5}, []interface{}{1, nil}, "only"},
+	})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var tags []string
+	var counts []int64
+	var scores []float64
+	var mixed Array
+	var single StringArray
+	require.NoError(t, db.QueryRow("SELECT tags, counts, scores, mixed, single FROM t").Scan(&tags, &counts, &scores, &mixed, &single))
+	require.Equal(t, []string{"a", "b"}, tags)
+	require.Equal(t, []int64{1, 2}, counts)
+	require.Equal(t, []float64{1, 2.5}, scores)
+	require.Equal(t, Array{int64(1), nil}, mixed)
+	require.Equal(t, StringArray{"only"}, single)
+
+	var anyTags StringArray
+	var anyCounts Array
+	require.NoError(t, db.QueryRow("SELECT tags, counts, scores, mixed, single FROM t").Scan(&anyTags, &anyCounts, &scores, &mixed, &single))
+	require.Equal(t, StringArray{"a", "b"}, anyTags)
+	require.Equal(t, Array{int64(1), int64(2)}, anyCounts)
+}
+
+func TestLongsAbove2To53AreExact(t *testing.T) {
+	const big = int64(1<<53 + 1)
+	output, _ := constructMockResults([]interface{}{"id", "ids", "ratio"}, [][]interface{}{
+		{"LONG", "ARRAY<LONG>", "DOUBLE"},
+		{"BIGINT", "ARRAY", "DOUBLE"},
+		{big, []interface{}{big, -big}, 0.5},
+	})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var id int64
+	var ids []int64
+	var ratio float64
+	require.NoError(t, db.QueryRow("SELECT id, ids, ratio FROM t").Scan(&id, &ids, &ratio))
+	require.Equal(t, big, id)
+	require.Equal(t, []int64{big, -big}, ids)
+	require.Equal(t, 0.5, ratio)
+
+	var anyIDs Array
+	require.NoError(t, anyIDs.Scan(`[9007199254740993, 1.5]`))
+	require.Equal(t, Array{big, 1.5}, anyIDs)
+}
+
+func TestArrayValueWithoutTypes(t *testing.T) {
+	require.Equal(t, []string{"a"}, arrayValue([]interface{}{"a"}, ""))
+	require.Equal(t, []int64{1, 2}, arrayValue([]interface{}{float64(1), float64(2)}, ""))
+	require.Equal(t, []float64{1, 2.5}, arrayValue([]interface{}{float64(1), 2.5}, ""))
+	require.Equal(t, Array{"a", nil}, arrayValue([]interface{}{"a", nil}, ""))
+	require.Equal(t, Array{"a", float64(1)}, arrayValue([]interface{}{"a", float64(1)}, "STRING"))
+}
+
+func TestStringArrayScan(t *testing.T) {
+	var a StringArray
+	require.NoError(t, a.Scan(Array{"x", nil, float64(1.5), int64(2), true}))
+	require.Equal(t, StringArray{"x", "", "1.5", "2", "true"}, a)
+
+	require.NoError(t, a.Scan(`["y","z"]`))
+	require.Equal(t, StringArray{"y", "z"}, a)
+
+	require.NoError(t, a.Scan(nil))
+	require.Nil(t, a)
+
+	require.Error(t, a.Scan(Array{map[string]interface{}{}}))
+	require.Error(t, a.Scan(true))
+}
+
+func TestArrayParameters(t *testing.T) {
+	var got queryRequest
+	output, _ := constructMockResults([]interface{}{"n"}, [][]interface{}{{"LONG"}, {"BIGINT"}, {1}})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var n int64
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM t WHERE ARRAY_CONTAINS(tags, ?) AND ARRAY_OVERLAP(counts, ?) AND ARRAY_CONTAINS(x, ?) AND ARRAY_CONTAINS(y, ?)",
+		[]string{"a", "b"}, []int64{1}, StringArray{"c"}, Array{"d", 2, nil}).Scan(&n))
+
+	require.Equal(t, []queryParameter{
+		{Type: "ARRAY", Value: []interface{}{"a", "b"}},
+		{Type: "ARRAY", Value: []interface{}{float64(1)}},
+		{Type: "ARRAY", Value: []interface{}{"c"}},
+		{Type: "ARRAY", Value: []interface{}{"d", float64(2), nil}},
+	}, got.Parameters)
+
+	_, err = db.Query("SELECT 1 WHERE ARRAY_CONTAINS(x, ?)", Array{struct{}{}})
+	require.Error(t, err)
+}
@@ -0,0 +1,444 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrAsyncQueryFailed is returned when an asynchronous query fails or is
+// cancelled
+var ErrAsyncQueryFailed = errors.New("druid: asynchronous query failed")
+
+// defaultAsyncPollInterval is how often asynchronous queries are polled
+// when no interval is given
+const defaultAsyncPollInterval = time.Second
+
+// asyncCancelTimeout bounds cancelling a query whose caller gave up
+const asyncCancelTimeout = 5 * time.Second
+
+// AsyncState is the state of an asynchronous query
+type AsyncState string
+
+// States of asynchronous queries
+const (
+	AsyncAccepted AsyncState = "ACCEPTED"
+	AsyncRunning  AsyncState = "RUNNING"
+	AsyncSuccess  AsyncState = "SUCCESS"
+	AsyncFailed   AsyncState = "FAILED"
+	AsyncCanceled AsyncState = "CANCELED"
+)
+
+// Done reports whether a query in the state has finished, successfully
+// or not
+func (s AsyncState) Done() bool {
+	return s == AsyncSuccess || s == AsyncFailed || s == AsyncCanceled
+}
+
+// AsyncStatus is what druid reports about an asynchronous query
+// https://druid.apache.org/docs/latest/api-reference/sql-api.html#query-from-deep-storage
+type AsyncStatus struct {
+	QueryID    string        `json:"queryId"`
+	State      AsyncState    `json:"state"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	Schema     []AsyncColumn `json:"schema"`
+	DurationMs int64         `json:"durationMs"`
+
+	// Result describes the results of a successful query
+	Result *AsyncResult `json:"result"`
+
+	// ErrorDetails describes why a query failed
+	ErrorDetails *AsyncError `json:"errorDetails"`
+}
+
+// AsyncColumn is a column of an asynchronous query's results
+type AsyncColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	NativeType string `json:"nativeType"`
+}
+
+// AsyncResult describes the results of an asynchronous query, which are
+// split in pages
+type AsyncResult struct {
+	NumTotalRows     int64       `json:"numTotalRows"`
+	TotalSizeInBytes int64       `json:"totalSizeInBytes"`
+	DataSource       string      `json:"dataSource"`
+	Pages            []AsyncPage `json:"pages"`
+}
+
+// AsyncPage describes a page of results
+type AsyncPage struct {
+	ID          int   `json:"id"`
+	NumRows     int64 `json:"numRows"`
+	SizeInBytes int64 `json:"sizeInBytes"`
+}
+
+// AsyncError is the error of a failed asynchronous query
+type AsyncError struct {
+	Error        string                 `json:"error"`
+	ErrorCode    string                 `json:"errorCode"`
+	Persona      string                 `json:"persona"`
+	Category     string                 `json:"category"`
+	ErrorMessage string                 `json:"errorMessage"`
+	Context      map[string]interface{} `json:"context"`
+}
+
+// err returns the error of a query that didn't succeed
+func (s *AsyncStatus) err() error {
+	if s.State == AsyncCanceled {
+		return wrapErr(ErrAsyncQueryFailed, fmt.Errorf("%s: cancelled", s.QueryID))
+	}
+	msg := "no error message"
+	if d := s.ErrorDetails; d != nil {
+		switch {
+		case d.ErrorMessage != "":
+			msg = d.ErrorMessage
+		case d.ErrorCode != "":
+			msg = d.ErrorCode
+		case d.Error != "":
+			msg = d.Error
+		}
+	}
+	return wrapErr(ErrAsyncQueryFailed, fmt.Errorf("%s: %s", s.QueryID, msg))
+}
+
+// AsyncQuery is a handle on a query run by druid's asynchronous statements
+// API, at Config.QueryEndpoint + "/statements". Its results can be read
+// once it has succeeded, page by page, however long it took. Handles are
+// safe for concurrent use
+type AsyncQuery struct {
+	id        string
+	connector *Connector
+
+	// location is the time zone timestamps in results are returned in
+	location *time.Location
+}
+
+// SubmitAsync submits a query to run asynchronously and returns its handle,
+// it doesn't wait for the query to run. Arguments are bound to ?
+// placeholders as they are by db.QueryContext, and the query context set
+// with WithQueryContext is sent with it, e.g. selectDestination set to
+// durableStorage for results too large for the task report
+func SubmitAsync(ctx context.Context, db *sql.DB, query string, args ...interface{}) (*AsyncQuery, error) {
+	conn, err := connectionOf(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	values, err := driverValues(args)
+	if err != nil {
+		return nil, wrapErr(ErrCreatingRequest, err)
+	}
+	request, err := conn.newQueryRequest(ctx, query, values)
+	if err != nil {
+		return nil, wrapErr(ErrCreatingRequest, err)
+	}
+	q, _, err := conn.submitAsync(ctx, request)
+	return q, err
+}
+
+// OpenAsync returns the handle of an asynchronous query submitted earlier,
+// e.g. by another process, from its id
+func OpenAsync(ctx context.Context, db *sql.DB, queryID string) (*AsyncQuery, error) {
+	conn, err := connectionOf(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return &AsyncQuery{id: queryID, connector: conn.connector, location: conn.Cfg.Location}, nil
+}
+
+// ID returns the query's id
+func (q *AsyncQuery) ID() string {
+	return q.id
+}
+
+// Status returns the query's current status
+func (q *AsyncQuery) Status(ctx context.Context) (*AsyncStatus, error) {
+	body, err := q.conn().apiRequest(ctx, http.MethodGet, q.url(""), nil)
+	if err != nil {
+		return nil, wrapErr(ErrMakingRequest, err)
+	}
+	return decodeAsyncStatus(body)
+}
+
+// Wait polls the query's status every interval until it has finished, 0
+// polls every second. It returns ErrAsyncQueryFailed, with druid's error
+// message, when the query failed or was cancelled
+func (q *AsyncQuery) Wait(ctx context.Context, interval time.Duration) (*AsyncStatus, error) {
+	status, err := q.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return q.wait(ctx, status, interval)
+}
+
+// wait polls the query from status until it has finished, passing the
+// report of its MSQ task to the progress callback of ctx after each poll
+func (q *AsyncQuery) wait(ctx context.Context, status *AsyncStatus, interval time.Duration) (*AsyncStatus, error) {
+	if interval <= 0 {
+		interval = defaultAsyncPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	c := q.conn()
+	for {
+		report := c.reportProgress(ctx, q.id)
+		if status.State.Done() {
+			if status.State == AsyncFailed && report != nil && report.Status.ErrorReport != nil {
+				return status, c.failure(ctx, ErrAsyncQueryFailed, q.id, "", report)
+			}
+			if status.State != AsyncSuccess {
+				return status, status.err()
+			}
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		var err error
+		if status, err = q.Status(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+}
+
+// Page returns the rows of a page of results of a successful query, listed
+// in its status, with values converted as rows.Scan receives them
+func (q *AsyncQuery) Page(ctx context.Context, page int) ([][]interface{}, error) {
+	status, err := q.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status.State != AsyncSuccess {
+		if status.State.Done() {
+			return nil, status.err()
+		}
+		return nil, fmt.Errorf("druid: query %s is %s, its results aren't ready", q.id, status.State)
+	}
+
+	values, err := q.fetchPage(ctx, page)
+	if err != nil {
+		return nil, err
+	}
+	r := q.rows(ctx, status, nil)
+	r.resultSet.rows, r.nextPage = toFields(values), nil
+
+	var out [][]interface{}
+	for {
+		dest := make([]driver.Value, len(status.Schema))
+		if err := r.Next(dest); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(dest))
+		for i, v := range dest {
+			row[i] = v
+		}
+		out = append(out, row)
+	}
+}
+
+// Cancel cancels the query if it's still running
+func (q *AsyncQuery) Cancel(ctx context.Context) error {
+	_, err := q.conn().apiRequest(ctx, http.MethodDelete, q.url(""), nil)
+	if err != nil {
+		return wrapErr(ErrMakingRequest, err)
+	}
+	return nil
+}
+
+// conn returns a connection of the query's connector to send requests with
+func (q *AsyncQuery) conn() *connection {
+	return &connection{Client: q.connector.client, Cfg: q.connector.cfg, connector: q.connector}
+}
+
+// url returns the URL of the query in the statements API, followed by path
+func (q *AsyncQuery) url(path string) string {
+	cfg := q.connector.cfg
+	return fmt.Sprintf("%s%s/statements/%s%s", cfg.BrokerAddr, cfg.QueryEndpoint, url.PathEscape(q.id), path)
+}
+
+// fetchPage returns the values of a page of results, or every result when
+// page is negative
+func (q *AsyncQuery) fetchPage(ctx context.Context, page int) ([][]interface{}, error) {
+	params := url.Values{"resultFormat": {"array"}}
+	if page >= 0 {
+		params.Set("page", fmt.Sprint(page))
+	}
+	body, err := q.conn().apiRequest(ctx, http.MethodGet, q.url("/results?"+params.Encode()), nil)
+	if err != nil {
+		return nil, wrapErr(ErrMakingRequest, err)
+	}
+
+	var values [][]interface{}
+	if len(body) == 0 {
+		return values, nil
+	}
+	if err := decodeJSON(body, &values); err != nil {
+		return nil, wrapErr(ErrMakingRequest, fmt.Errorf("decoding results of query %s: %v", q.id, err))
+	}
+	return values, nil
+}
+
+// rows returns rows over the results of a successful query, fetching the
+// pages listed in status one at a time as they're read
+func (q *AsyncQuery) rows(ctx context.Context, status *AsyncStatus, c *connection) *rows {
+	if c == nil {
+		c = q.conn()
+	}
+	columnNames := make([]string, len(status.Schema))
+	druidTypes := make([]string, len(status.Schema))
+	columnTypes := make([]string, len(status.Schema))
+	for i, column := range status.Schema {
+		columnNames[i], druidTypes[i], columnTypes[i] = column.Name, column.NativeType, column.Type
+	}
+	r := c.newRows(columnNames, druidTypes, columnTypes, nil, q.location)
+
+	pages := []int{-1}
+	if status.Result != nil && len(status.Result.Pages) > 0 {
+		pages = pages[:0]
+		for _, page := range status.Result.Pages {
+			pages = append(pages, page.ID)
+		}
+	}
+	r.nextPage = func() ([][]interface{}, error) {
+		if len(pages) == 0 {
+			return nil, nil
+		}
+		page := pages[0]
+		pages = pages[1:]
+		values, err := q.fetchPage(ctx, page)
+		if values == nil && err == nil {
+			values = [][]interface{}{}
+		}
+		return values, err
+	}
+	return r
+}
+
+// submitAsync submits request to the statements API
+func (c *connection) submitAsync(ctx context.Context, request *queryRequest) (*AsyncQuery, *AsyncStatus, error) {
+	queryContext := make(map[string]interface{}, len(request.Context)+1)
+	for k, v := range request.Context {
+		queryContext[k] = v
+	}
+	if _, ok := queryContext["executionMode"]; !ok {
+		queryContext["executionMode"] = "ASYNC"
+	}
+
+	payload, err := json.Marshal(taskRequest{
+		Query:      request.Query,
+		Parameters: request.Parameters,
+		Context:    queryContext,
+	})
+	if err != nil {
+		return nil, nil, wrapErr(ErrRequestForm, err)
+	}
+
+	c.Cfg.logger().Log(LevelDebug, "druid: submitting asynchronous query", "query", c.Cfg.logBody(request.Query))
+	body, err := c.apiRequest(ctx, http.MethodPost, c.Cfg.BrokerAddr+c.Cfg.QueryEndpoint+"/statements", payload)
+	if err != nil {
+		return nil, nil, wrapErr(ErrMakingRequest, err)
+	}
+	status, err := decodeAsyncStatus(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status.QueryID == "" {
+		return nil, nil, wrapErr(ErrMakingRequest, errors.New("no query id in response"))
+	}
+	return &AsyncQuery{id: status.QueryID, connector: c.connector, location: request.location}, status, nil
+}
+
+// queryAsync runs request through the statements API, as db.QueryContext
+// does for a context made with WithAsync
+func (c *connection) queryAsync(ctx context.Context, request *queryRequest, interval time.Duration) (*rows, error) {
+	q, status, err := c.submitAsync(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err = q.wait(ctx, status, interval)
+	if err != nil {
+		if ctx.Err() != nil {
+			cancelCtx, cancel := context.WithTimeout(detachedContext{ctx}, asyncCancelTimeout)
+			defer cancel()
+			if err := q.Cancel(cancelCtx); err != nil {
+				c.Cfg.logger().Log(LevelWarn, "druid: cancelling asynchronous query failed", "query", q.id, "error", c.Cfg.redact(err.Error()))
+			}
+		}
+		return nil, err
+	}
+	return q.rows(ctx, status, c), nil
+}
+
+// decodeAsyncStatus decodes a statements API response
+func decodeAsyncStatus(body []byte) (*AsyncStatus, error) {
+	var status AsyncStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, wrapErr(ErrMakingRequest, fmt.Errorf("decoding query status: %v", err))
+	}
+	return &status, nil
+}
+
+// connectionOf returns a druid connection of db, to reach the connector
+// it was opened from
+func connectionOf(ctx context.Context, db *sql.DB) (*connection, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var c *connection
+	err = conn.Raw(func(driverConn interface{}) error {
+		dc, ok := driverConn.(*connection)
+		if !ok || dc.connector == nil {
+			return fmt.Errorf("druid: %T is not a druid connection", driverConn)
+		}
+		c = &connection{Client: dc.Client, Cfg: dc.Cfg, connector: dc.connector}
+		return nil
+	})
+	return c, err
+}
+
+// driverValues converts query arguments to driver values as database/sql
+// does, keeping slices for ARRAY parameters
+func driverValues(args []interface{}) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if valuer, ok := arg.(driver.Valuer); ok {
+			v, err := valuer.Value()
+			if err != nil {
+				return nil, fmt.Errorf("parameter %d: %v", i+1, err)
+			}
+			arg = v
+		}
+		if isArrayParameter(arg) {
+			values[i] = arg
+			continue
+		}
+		v, err := driver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %d: %v", i+1, err)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,181 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const mockAsyncSchema = `[{"name":"__time","type":"TIMESTAMP","nativeType":"LONG"},{"name":"page","type":"VARCHAR","nativeType":"STRING"},{"name":"added","type":"BIGINT","nativeType":"LONG"}]`
+
+// mockAsyncServer serves the statements API for query-1, which runs for
+// polls status requests before ending in finalState with two pages of
+// results
+func mockAsyncServer(t *testing.T, polls int32, finalState AsyncState, submitted *taskRequest, cancelled *int32) http.HandlerFunc {
+	var seen int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/druid/v2/sql/statements":
+			require.Equal(t, http.MethodPost, r.Method)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(submitted))
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"queryId":"query-1","state":"ACCEPTED","createdAt":"2023-07-26T10:00:00.000Z","durationMs":-1}`))
+		case r.URL.Path == "/druid/v2/sql/statements/query-1" && r.Method == http.MethodDelete:
+			atomic.AddInt32(cancelled, 1)
+			w.WriteHeader(http.StatusAccepted)
+		case r.URL.Path == "/druid/v2/sql/statements/query-1":
+			state := AsyncRunning
+			if atomic.AddInt32(&seen, 1) > polls {
+				state = finalState
+			}
+			switch state {
+			case AsyncSuccess:
+				_, _ = w.Write([]byte(`{"queryId":"query-1","state":"SUCCESS","createdAt":"2023-07-26T10:00:00.000Z","durationMs":1200,
+					"schema":` + mockAsyncSchema + `,
+					"result":{"numTotalRows":3,"totalSizeInBytes":150,"dataSource":"__query_select",
+						"pages":[{"id":0,"numRows":2,"sizeInBytes":100},{"id":1,"numRows":1,"sizeInBytes":50}]}}`))
+			case AsyncFailed:
+				_, _ = w.Write([]byte(`{"queryId":"query-1","state":"FAILED","createdAt":"2023-07-26T10:00:00.000Z","durationMs":30,
+					"errorDetails":{"error":"druidException","errorCode":"general","persona":"USER","category":"RUNTIME_FAILURE","errorMessage":"Too many workers"}}`))
+			default:
+				_, _ = w.Write([]byte(`{"queryId":"query-1","state":"` + string(state) + `","createdAt":"2023-07-26T10:00:00.000Z","durationMs":-1}`))
+			}
+		case r.URL.Path == "/druid/v2/sql/statements/query-1/results":
+			require.Equal(t, "array", r.URL.Query().Get("resultFormat"))
+			switch r.URL.Query().Get("page") {
+			case "0":
+				_, _ = w.Write([]byte(`[["2023-07-26T10:00:00.000Z","Main",10],["2023-07-26T11:00:00.000Z","Druid",20]]`))
+			case "1":
+				_, _ = w.Write([]byte(`[["2023-07-26T12:00:00.000Z","Go",30]]`))
+			default:
+				t.Errorf("unexpected page %q", r.URL.Query().Get("page"))
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func TestQueryAsyncReadsPages(t *testing.T) {
+	var submitted taskRequest
+	var cancelled int32
+	ts, url := startMockServer(mockAsyncServer(t, 2, AsyncSuccess, &submitted, &cancelled))
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx := WithQueryContext(context.Background(), map[string]interface{}{"selectDestination": "durableStorage"})
+	rows, err := db.QueryContext(WithAsync(ctx, time.Millisecond), "SELECT __time, page, added FROM wikipedia WHERE added > ?", 5)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	require.Equal(t, "SELECT __time, page, added FROM wikipedia WHERE added > ?", submitted.Query)
+	require.Equal(t, map[string]interface{}{"selectDestination": "durableStorage", "executionMode": "ASYNC"}, submitted.Context)
+
+	types, err := rows.ColumnTypes()
+	require.NoError(t, err)
+	require.Equal(t, "VARCHAR", types[1].DatabaseTypeName())
+
+	var pages []string
+	var total int64
+	for rows.Next() {
+		var ts time.Time
+		var page string
+		var added int64
+		require.NoError(t, rows.Scan(&ts, &page, &added))
+		require.Equal(t, 2023, ts.Year())
+		pages = append(pages, page)
+		total += added
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"Main", "Druid", "Go"}, pages)
+	require.Equal(t, int64(60), total)
+}
+
+func TestQueryAsyncFailure(t *testing.T) {
+	var submitted taskRequest
+	var cancelled int32
+	ts, url := startMockServer(mockAsyncServer(t, 1, AsyncFailed, &submitted, &cancelled))
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err = db.QueryContext(WithAsync(context.Background(), time.Millisecond), "SELECT 1")
+	require.True(t, errors.Is(err, ErrAsyncQueryFailed))
+	require.Contains(t, err.Error(), "query-1: Too many workers")
+
+	// Giving up cancels the query
+	ts2, url2 := startMockServer(mockAsyncServer(t, 1<<30, AsyncSuccess, &submitted, &cancelled))
+	defer ts2.Close()
+	connector, err = NewConnector(&Config{BrokerAddr: url2})
+	require.NoError(t, err)
+	db2 := sql.OpenDB(connector)
+	defer db2.Close()
+
+	ctx, cancel := context.WithTimeout(WithAsync(context.Background(), time.Millisecond), 20*time.Millisecond)
+	defer cancel()
+	_, err = db2.QueryContext(ctx, "SELECT 1")
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.Equal(t, int32(1), atomic.LoadInt32(&cancelled))
+}
+
+func TestAsyncQueryHandle(t *testing.T) {
+	var submitted taskRequest
+	var cancelled int32
+	ts, url := startMockServer(mockAsyncServer(t, 2, AsyncSuccess, &submitted, &cancelled))
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx := context.Background()
+	q, err := SubmitAsync(ctx, db, "SELECT * FROM wikipedia WHERE page IN (?)", []string{"Main", "Go"})
+	require.NoError(t, err)
+	require.Equal(t, "query-1", q.ID())
+	require.Equal(t, []queryParameter{{Type: "ARRAY", Value: []interface{}{"Main", "Go"}}}, submitted.Parameters)
+
+	status, err := q.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, AsyncRunning, status.State)
+	require.False(t, status.State.Done())
+
+	// Results can't be read before the query has succeeded
+	_, err = q.Page(ctx, 0)
+	require.Error(t, err)
+
+	status, err = q.Wait(ctx, time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, AsyncSuccess, status.State)
+	require.Equal(t, int64(3), status.Result.NumTotalRows)
+	require.Len(t, status.Result.Pages, 2)
+	require.Equal(t, "LONG", status.Schema[0].NativeType)
+
+	page, err := q.Page(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, "Go", page[0][1])
+	require.Equal(t, int64(30), page[0][2])
+	require.IsType(t, time.Time{}, page[0][0])
+
+	opened, err := OpenAsync(ctx, db, "query-1")
+	require.NoError(t, err)
+	require.NoError(t, opened.Cancel(ctx))
+	require.Equal(t, int32(1), atomic.LoadInt32(&cancelled))
+}
@@ -0,0 +1,46 @@
+package dsql
+
+import (
+	"context"
+	"net/http"
+)
+
+// Authenticator adds credentials to every request sent to druid
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(req *http.Request) error
+
+// Authenticate calls f
+func (f AuthenticatorFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// BasicAuth returns an Authenticator sending user and password with HTTP
+// basic authentication, as druid's basic security extension expects
+func BasicAuth(user, password string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) error {
+		req.SetBasicAuth(user, password)
+		return nil
+	})
+}
+
+// PasswordProvider returns the password for a request, e.g. fetched from a
+// secrets vault, so it never has to be stored in a Config or DSN. It's
+// called for every request and should cache the secret if fetching is slow
+type PasswordProvider func(ctx context.Context) (string, error)
+
+// BasicAuthProvider returns an Authenticator sending user with HTTP basic
+// authentication, asking provider for the password at request time
+func BasicAuthProvider(user string, provider PasswordProvider) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) error {
+		password, err := provider(req.Context())
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(user, password)
+		return nil
+	})
+}
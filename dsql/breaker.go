@@ -0,0 +1,239 @@
+package dsql
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting a broker whose circuit
+// breaker has tripped, until its cooldown has passed
+var ErrCircuitOpen = errors.New("druid: circuit breaker is open")
+
+const (
+	// defaultBreakerWindow is how many requests the error rate is computed
+	// over when Config.BreakerWindow is 0
+	defaultBreakerWindow = 20
+
+	// defaultBreakerCooldown is how long a circuit stays open when
+	// Config.BreakerCooldown is 0
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// BreakerState is the state of a broker's circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every request with ErrCircuitOpen
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through to decide whether
+	// the circuit closes again
+	BreakerHalfOpen
+)
+
+// String returns the lower case name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// breakerOutcome is what a request tells a breaker about its broker
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	// outcomeIgnored is for requests abandoned by the caller, which say
+	// nothing about the broker
+	outcomeIgnored
+)
+
+// breakerSet holds a circuit breaker per broker host
+type breakerSet struct {
+	failures int
+	rate     float64
+	window   int
+	cooldown time.Duration
+	onChange func(host string, from, to BreakerState)
+	now      func() time.Time
+
+	mtx      sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+type circuitBreaker struct {
+	state       BreakerState
+	consecutive int
+	outcomes    []bool
+	next        int
+	openedAt    time.Time
+	probing     bool
+}
+
+// newBreakerSet returns the breakers for cfg, or nil when they aren't
+// configured. onChange is called whenever a breaker changes state
+func newBreakerSet(cfg *Config, onChange func(host string, from, to BreakerState)) *breakerSet {
+	if cfg.BreakerFailures <= 0 && cfg.BreakerErrorRate <= 0 {
+		return nil
+	}
+
+	window := cfg.BreakerWindow
+	if window <= 0 {
+		window = defaultBreakerWindow
+	}
+	cooldown := cfg.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &breakerSet{
+		failures: cfg.BreakerFailures,
+		rate:     cfg.BreakerErrorRate,
+		window:   window,
+		cooldown: cooldown,
+		onChange: onChange,
+		now:      time.Now,
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+// allow reports whether a request may be sent to broker. The returned func
+// must be called with the request's outcome once it's known
+func (s *breakerSet) allow(broker string) (done func(breakerOutcome), err error) {
+	host := broker
+	if u, err := url.Parse(broker); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	s.mtx.Lock()
+	b, ok := s.breakers[host]
+	if !ok {
+		b = &circuitBreaker{}
+		s.breakers[host] = b
+	}
+
+	var change *breakerChange
+	if b.state == BreakerOpen && s.now().Sub(b.openedAt) >= s.cooldown {
+		change = s.transition(host, b, BreakerHalfOpen)
+	}
+
+	switch {
+	case b.state == BreakerOpen, b.state == BreakerHalfOpen && b.probing:
+		err = wrapErr(ErrCircuitOpen, fmt.Errorf("broker %s", host))
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+	}
+	s.mtx.Unlock()
+
+	s.notify(change)
+	if err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func(outcome breakerOutcome) {
+		once.Do(func() {
+			s.mtx.Lock()
+			change := s.record(host, b, outcome)
+			s.mtx.Unlock()
+			s.notify(change)
+		})
+	}, nil
+}
+
+// record counts a request's outcome, s.mtx must be held. It returns the
+// state change it caused, if any
+func (s *breakerSet) record(host string, b *circuitBreaker, outcome breakerOutcome) *breakerChange {
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		switch outcome {
+		case outcomeSuccess:
+			b.consecutive = 0
+			b.outcomes = b.outcomes[:0]
+			b.next = 0
+			return s.transition(host, b, BreakerClosed)
+		case outcomeFailure:
+			b.openedAt = s.now()
+			return s.transition(host, b, BreakerOpen)
+		}
+		return nil
+	}
+
+	if outcome == outcomeIgnored || b.state != BreakerClosed {
+		return nil
+	}
+
+	failed := outcome == outcomeFailure
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	if len(b.outcomes) < s.window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % s.window
+	}
+
+	if s.tripped(b) {
+		b.openedAt = s.now()
+		return s.transition(host, b, BreakerOpen)
+	}
+	return nil
+}
+
+// tripped reports whether b's recent failures warrant opening the circuit
+func (s *breakerSet) tripped(b *circuitBreaker) bool {
+	if s.failures > 0 && b.consecutive >= s.failures {
+		return true
+	}
+	if s.rate <= 0 || len(b.outcomes) < s.window {
+		return false
+	}
+
+	failures := 0
+	for _, failed := range b.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures)/float64(len(b.outcomes)) >= s.rate
+}
+
+// breakerChange is a breaker changing state, reported once s.mtx is
+// released so hooks can use the connector without deadlocking
+type breakerChange struct {
+	host     string
+	from, to BreakerState
+}
+
+// transition moves b to state to, s.mtx must be held
+func (s *breakerSet) transition(host string, b *circuitBreaker, to BreakerState) *breakerChange {
+	from := b.state
+	b.state = to
+	if from == to {
+		return nil
+	}
+	return &breakerChange{host: host, from: from, to: to}
+}
+
+// notify reports change to onChange, it must be called without s.mtx held
+func (s *breakerSet) notify(change *breakerChange) {
+	if change != nil && s.onChange != nil {
+		s.onChange(change.host, change.from, change.to)
+	}
+}
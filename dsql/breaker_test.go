@@ -0,0 +1,171 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakerTripsOnConsecutiveFailures(t *testing.T) {
+	s := newBreakerSet(&Config{BreakerFailures: 2, BreakerCooldown: time.Minute}, nil)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	var changes []BreakerState
+	s.onChange = func(host string, from, to BreakerState) {
+		require.Equal(t, "broker:8082", host)
+		changes = append(changes, to)
+	}
+
+	for i := 0; i < 2; i++ {
+		done, err := s.allow("http://broker:8082")
+		require.NoError(t, err)
+		done(outcomeFailure)
+	}
+
+	_, err := s.allow("http://broker:8082")
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+
+	// After the cooldown a single probe is let through
+	now = now.Add(time.Minute)
+	probe, err := s.allow("http://broker:8082")
+	require.NoError(t, err)
+	_, err = s.allow("http://broker:8082")
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+
+	probe(outcomeSuccess)
+	done, err := s.allow("http://broker:8082")
+	require.NoError(t, err)
+	done(outcomeSuccess)
+
+	require.Equal(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}, changes)
+}
+
+func TestBreakerTripsOnErrorRate(t *testing.T) {
+	s := newBreakerSet(&Config{BreakerErrorRate: 0.5, BreakerWindow: 4}, nil)
+
+	outcomes := []breakerOutcome{outcomeSuccess, outcomeFailure, outcomeSuccess, outcomeIgnored, outcomeFailure}
+	for _, outcome := range outcomes {
+		done, err := s.allow("http://broker:8082")
+		require.NoError(t, err)
+		done(outcome)
+	}
+
+	_, err := s.allow("http://broker:8082")
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+
+	_, err = s.allow("http://other:8082")
+	require.NoError(t, err)
+}
+
+func TestQueriesFailFastWhenCircuitIsOpen(t *testing.T) {
+	var requests int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url, BreakerFailures: 3})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err = db.Query("SELECT 1")
+		require.Error(t, err)
+	}
+
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestHangingBrokerTripsBreaker(t *testing.T) {
+	release := make(chan struct{})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer ts.Close()
+	defer close(release)
+
+	var opened int32
+	connector, err := NewConnector(&Config{BrokerAddr: url, BreakerFailures: 2, Timeout: 20 * time.Millisecond},
+		WithHooks(Hooks{BreakerStateChange: func(host string, from, to BreakerState) {
+			if to == BreakerOpen {
+				atomic.AddInt32(&opened, 1)
+			}
+		}}))
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err = db.Query("SELECT 1")
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	}
+	_, err = db.Query("SELECT 1")
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+	require.Equal(t, int32(1), atomic.LoadInt32(&opened))
+}
+
+func TestCancelledQueriesDontTripBreaker(t *testing.T) {
+	release := make(chan struct{})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer ts.Close()
+	defer close(release)
+
+	connector, err := NewConnector(&Config{BrokerAddr: url, BreakerFailures: 1})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err = db.QueryContext(ctx, "SELECT 1")
+		require.True(t, errors.Is(err, context.Canceled), "%v", err)
+	}
+}
+
+func TestBreakerHooksCanQuery(t *testing.T) {
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer ts.Close()
+
+	var db *sql.DB
+	hookErrs := make(chan error, 1)
+	connector, err := NewConnector(&Config{BrokerAddr: url, BreakerFailures: 1},
+		WithHooks(Hooks{BreakerStateChange: func(host string, from, to BreakerState) {
+			// Querying from the hook would deadlock if it ran under the
+			// breaker's lock
+			_, err := db.Query("SELECT 1")
+			hookErrs <- err
+		}}))
+	require.NoError(t, err)
+	db = sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err = db.Query("SELECT 1")
+	require.Error(t, err)
+	select {
+	case err := <-hookErrs:
+		require.True(t, errors.Is(err, ErrCircuitOpen))
+	case <-time.After(5 * time.Second):
+		t.Fatal("breaker hook deadlocked")
+	}
+}
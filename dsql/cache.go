@@ -0,0 +1,354 @@
+package dsql
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheMaxBytes is the in memory budget used when CacheOptions.MaxBytes is 0
+const defaultCacheMaxBytes = 64 << 20
+
+// CacheOptions configures a Cache
+type CacheOptions struct {
+	// TTL is how long a result is served from the cache, it can be
+	// overridden per query with WithCacheTTL. Nothing is cached when it's 0
+	TTL time.Duration
+
+	// MaxBytes is the memory budget of the cache, least recently used
+	// results are evicted once it's exceeded. Defaults to 64MiB
+	MaxBytes int64
+
+	// Dir enables the on-disk tier when set. Every result is also written
+	// here so it survives eviction from memory and process restarts
+	Dir string
+
+	// StaleIfError serves the last good result for a query, however old,
+	// when the broker can't be reached or answers with a 5xx
+	StaleIfError bool
+}
+
+// CacheStats is a snapshot of a cache's counters
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	DiskHits  int64
+	StaleHits int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
+}
+
+// Cache is a client-side cache of query results keyed by the normalized
+// query, its parameters, its query context and the identity it's sent as.
+// A single Cache can be shared by several configs: connectors sending
+// different credentials never see each other's results, and connectors with
+// a custom Authenticator or a PasswordProvider only see their own
+type Cache struct {
+	opts  CacheOptions
+	mtx   sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	stats CacheStats
+	now   func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	body    []byte
+	expires time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.body))
+}
+
+// NewCache returns an empty cache, creating opts.Dir if it doesn't exist
+func NewCache(opts CacheOptions) (*Cache, error) {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaultCacheMaxBytes
+	}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Cache{
+		opts:  opts,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+	}, nil
+}
+
+// Stats returns the cache's counters
+func (c *Cache) Stats() CacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// Purge removes every entry from memory and disk
+func (c *Cache) Purge() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.stats.Bytes = 0
+
+	if c.opts.Dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(c.opts.Dir, "*.cache"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryKey identifies a request sent to broker as identity, two requests
+// with the same key return the same result
+func queryKey(broker, identity string, smile bool, request *queryRequest) string {
+	payload, _ := json.Marshal(struct {
+		Broker     string                 `json:"broker"`
+		Identity   string                 `json:"identity,omitempty"`
+		Smile      bool                   `json:"smile"`
+		Query      string                 `json:"query"`
+		Parameters []queryParameter       `json:"parameters"`
+		Context    map[string]interface{} `json:"context"`
+		Native     bool                   `json:"native,omitempty"`
+	}{broker, identity, smile, normalizeQuery(request.Query), request.Parameters, request.Context, request.native})
+
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the body cached under key. fresh is false when the entry has
+// expired and is only returned because StaleIfError is set
+func (c *Cache) get(key string) (body []byte, fresh bool, ok bool) {
+	entry := c.lookup(key)
+
+	c.mtx.Lock()
+	if entry == nil {
+		c.stats.Misses++
+		c.mtx.Unlock()
+		return nil, false, false
+	}
+	if c.now().Before(entry.expires) {
+		c.stats.Hits++
+		c.mtx.Unlock()
+		return entry.body, true, true
+	}
+	c.stats.Misses++
+	if c.opts.StaleIfError {
+		c.mtx.Unlock()
+		return entry.body, false, true
+	}
+	c.removeLocked(key)
+	c.mtx.Unlock()
+
+	if c.opts.Dir != "" {
+		_ = os.Remove(c.path(key))
+	}
+	return nil, false, false
+}
+
+// lookup finds key in memory, falling back to the disk tier. The file is
+// read without holding the lock so queries don't wait on the filesystem
+func (c *Cache) lookup(key string) *cacheEntry {
+	c.mtx.Lock()
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mtx.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	c.mtx.Unlock()
+
+	if c.opts.Dir == "" {
+		return nil
+	}
+
+	entry, err := c.readFile(key)
+	if err != nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Another query may have cached a newer result while the file was read
+	if el, ok := c.items[key]; ok {
+		return el.Value.(*cacheEntry)
+	}
+	if c.now().Before(entry.expires) {
+		c.stats.DiskHits++
+	}
+	c.insert(entry)
+	return entry
+}
+
+// set caches body under key for ttl
+func (c *Cache) set(key string, body []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{key: key, body: body}
+	c.mtx.Lock()
+	entry.expires = c.now().Add(ttl)
+	c.insert(entry)
+	c.mtx.Unlock()
+
+	if c.opts.Dir != "" {
+		_ = c.writeFile(entry)
+	}
+}
+
+func (c *Cache) insert(entry *cacheEntry) {
+	if el, ok := c.items[entry.key]; ok {
+		c.stats.Bytes -= el.Value.(*cacheEntry).size()
+		c.lru.Remove(el)
+		delete(c.items, entry.key)
+	}
+
+	if entry.size() > c.opts.MaxBytes {
+		return
+	}
+
+	c.items[entry.key] = c.lru.PushFront(entry)
+	c.stats.Bytes += entry.size()
+
+	for c.stats.Bytes > c.opts.MaxBytes {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.items, evicted.key)
+		c.stats.Bytes -= evicted.size()
+		c.stats.Evictions++
+	}
+}
+
+// removeLocked removes key from memory, c.mtx must be held
+func (c *Cache) removeLocked(key string) {
+	if el, ok := c.items[key]; ok {
+		c.stats.Bytes -= el.Value.(*cacheEntry).size()
+		c.lru.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *Cache) recordStale() {
+	c.mtx.Lock()
+	c.stats.StaleHits++
+	c.mtx.Unlock()
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.opts.Dir, key+".cache")
+}
+
+// writeFile stores entry as its expiry in unix nanoseconds followed by the body
+func (c *Cache) writeFile(entry *cacheEntry) error {
+	tmp, err := ioutil.TempFile(c.opts.Dir, "tmp-")
+	if err != nil {
+		return err
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], uint64(entry.expires.UnixNano()))
+	if _, err = tmp.Write(header[:]); err == nil {
+		_, err = tmp.Write(entry.body)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path(entry.key))
+}
+
+func (c *Cache) readFile(key string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		_ = os.Remove(c.path(key))
+		return nil, os.ErrNotExist
+	}
+
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(data[:8])))
+	return &cacheEntry{key: key, body: data[8:], expires: expires}, nil
+}
+
+// normalizeQuery collapses whitespace outside of quoted literals,
+// identifiers and comments, and drops a trailing semicolon, so formatting
+// differences don't produce different cache keys. Comments are kept as they
+// are, along with the newline ending a -- comment, so text after them is
+// never pulled into them
+func normalizeQuery(q string) string {
+	var b strings.Builder
+	runes := []rune(strings.TrimSuffix(strings.TrimSpace(q), ";"))
+	pendingSpace, lineStart := false, false
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			pendingSpace = !lineStart
+			continue
+		}
+		lineStart = false
+		if pendingSpace {
+			b.WriteRune(' ')
+			pendingSpace = false
+		}
+
+		end := i + 1
+		switch {
+		case r == '\'' || r == '"':
+			end = skipPast(runes, i+1, string(r))
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			end = skipPast(runes, i+2, "\n")
+			lineStart = true
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end = skipPast(runes, i+2, "*/")
+		}
+		b.WriteString(string(runes[i:end]))
+		i = end - 1
+	}
+
+	return b.String()
+}
+
+// skipPast returns the index after the first occurrence of delim in runes
+// from start, or len(runes) when there's none
+func skipPast(runes []rune, start int, delim string) int {
+	d := []rune(delim)
+	for i := start; i+len(d) <= len(runes); i++ {
+		if string(runes[i:i+len(d)]) == delim {
+			return i + len(d)
+		}
+	}
+	return len(runes)
+}
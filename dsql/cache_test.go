@@ -0,0 +1,187 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	require.Equal(t, "SELECT a FROM t WHERE b = 'x  y'", normalizeQuery("  SELECT a\n\tFROM   t WHERE b = 'x  y' ; "))
+	require.Equal(t, `SELECT "my  col" FROM t`, normalizeQuery(`SELECT "my  col"   FROM t`))
+
+	// Text after a line comment stays out of it
+	require.Equal(t, "SELECT a FROM t -- all rows\nWHERE b = 1", normalizeQuery("SELECT a FROM t -- all rows\n   WHERE b = 1"))
+	require.NotEqual(t, normalizeQuery("SELECT a FROM t -- x\nWHERE b = 1"), normalizeQuery("SELECT a FROM t -- x WHERE b = 1"))
+	require.Equal(t, "SELECT a /* a  comment */ FROM t", normalizeQuery("SELECT a   /* a  comment */\nFROM t"))
+	require.Equal(t, "SELECT '--' FROM t", normalizeQuery("SELECT '--'\n FROM t"))
+}
+
+func TestCacheExpiresEntries(t *testing.T) {
+	cache, err := NewCache(CacheOptions{TTL: time.Minute})
+	require.NoError(t, err)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.set("k", []byte("body"), time.Minute)
+	body, fresh, ok := cache.get("k")
+	require.True(t, ok)
+	require.True(t, fresh)
+	require.Equal(t, []byte("body"), body)
+
+	now = now.Add(2 * time.Minute)
+	_, _, ok = cache.get("k")
+	require.False(t, ok)
+
+	stats := cache.Stats()
+	require.Equal(t, int64(1), stats.Hits)
+	require.Equal(t, int64(1), stats.Misses)
+	require.Equal(t, 0, stats.Entries)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewCache(CacheOptions{MaxBytes: 20})
+	require.NoError(t, err)
+
+	cache.set("a", []byte("123456789"), time.Minute)
+	cache.set("b", []byte("123456789"), time.Minute)
+	_, _, _ = cache.get("a")
+	cache.set("c", []byte("123456789"), time.Minute)
+
+	_, _, ok := cache.get("b")
+	require.False(t, ok)
+	_, _, ok = cache.get("a")
+	require.True(t, ok)
+
+	stats := cache.Stats()
+	require.Equal(t, int64(1), stats.Evictions)
+	require.Equal(t, int64(20), stats.Bytes)
+}
+
+func TestCacheDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(CacheOptions{Dir: dir})
+	require.NoError(t, err)
+	cache.set("k", []byte("body"), time.Minute)
+
+	reopened, err := NewCache(CacheOptions{Dir: dir})
+	require.NoError(t, err)
+
+	body, fresh, ok := reopened.get("k")
+	require.True(t, ok)
+	require.True(t, fresh)
+	require.Equal(t, []byte("body"), body)
+	require.Equal(t, int64(1), reopened.Stats().DiskHits)
+
+	require.NoError(t, reopened.Purge())
+	_, _, ok = reopened.get("k")
+	require.False(t, ok)
+}
+
+func TestQueryResultsAreCached(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"channel"}, [][]interface{}{{"STRING"}, {"VARCHAR"}, {"#en.wikipedia"}})
+
+	var requests, failing int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	cache, err := NewCache(CacheOptions{TTL: time.Minute, StaleIfError: true})
+	require.NoError(t, err)
+
+	connector, err := NewConnector(&Config{BrokerAddr: url, Cache: cache})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	queryChannel := func(ctx context.Context, q string) (string, error) {
+		var channel string
+		err := db.QueryRowContext(ctx, q).Scan(&channel)
+		return channel, err
+	}
+
+	ctx := context.Background()
+	for _, q := range []string{"SELECT channel FROM wiki", "SELECT channel\n  FROM wiki;"} {
+		channel, err := queryChannel(ctx, q)
+		require.NoError(t, err)
+		require.Equal(t, "#en.wikipedia", channel)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	_, err = queryChannel(WithoutCache(ctx), "SELECT channel FROM wiki")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	_, err = queryChannel(WithQueryContext(ctx, map[string]interface{}{"priority": 1}), "SELECT channel FROM wiki")
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// Expire everything and take the broker down, the stale result is served
+	cache.now = func() time.Time { return time.Now().Add(time.Hour) }
+	atomic.StoreInt32(&failing, 1)
+
+	channel, err := queryChannel(ctx, "SELECT channel FROM wiki")
+	require.NoError(t, err)
+	require.Equal(t, "#en.wikipedia", channel)
+	require.Equal(t, int64(1), cache.Stats().StaleHits)
+}
+
+func TestCacheIsScopedToCredentials(t *testing.T) {
+	var requests int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		user, _, _ := r.BasicAuth()
+		output, _ := constructMockResults([]interface{}{"user"}, [][]interface{}{{"STRING"}, {"VARCHAR"}, {user}})
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	cache, err := NewCache(CacheOptions{TTL: time.Minute})
+	require.NoError(t, err)
+
+	queryUser := func(cfg *Config, opts ...Option) string {
+		cfg.BrokerAddr, cfg.Cache = url, cache
+		connector, err := NewConnector(cfg, opts...)
+		require.NoError(t, err)
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		var user string
+		require.NoError(t, db.QueryRow("SELECT CURRENT_USER").Scan(&user))
+		return user
+	}
+
+	require.Equal(t, "alice", queryUser(&Config{User: "alice", Passwd: "a"}))
+	require.Equal(t, "alice", queryUser(&Config{User: "alice", Passwd: "a"}))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	require.Equal(t, "bob", queryUser(&Config{User: "bob", Passwd: "b"}))
+	require.Equal(t, "alice", queryUser(&Config{User: "alice", Passwd: "wrong"}))
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// Connectors with a custom authenticator only share with themselves
+	auth := WithAuthenticator(BasicAuth("carol", "c"))
+	require.Equal(t, "carol", queryUser(&Config{}, auth))
+	require.Equal(t, "carol", queryUser(&Config{}, auth))
+	require.Equal(t, int32(5), atomic.LoadInt32(&requests))
+
+	// So do connectors with a password provider, whatever their user
+	provider := func(password string) PasswordProvider {
+		return func(context.Context) (string, error) { return password, nil }
+	}
+	require.Equal(t, "alice", queryUser(&Config{User: "alice", PasswordProvider: provider("a")}))
+	require.Equal(t, "alice", queryUser(&Config{User: "alice", PasswordProvider: provider("wrong")}))
+	require.Equal(t, int32(7), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,50 @@
+package dsql
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// isComplexType reports whether a native druid type is a complex type
+// serialized as bytes, i.e COMPLEX<thetaSketch> or COMPLEX<hyperUnique>.
+// Nested JSON columns are complex too but are decoded as JSON instead
+func isComplexType(druidType string) bool {
+	return strings.HasPrefix(druidType, "COMPLEX<") && druidType != druidJSONType
+}
+
+// complexValue returns the bytes of a complex value. Druid sends most of
+// them, such as sketches, as base64 strings and a few as JSON objects,
+// which are returned as their JSON text
+func complexValue(value interface{}) (driver.Value, error) {
+	if s, ok := value.(string); ok {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("druid: decoding complex column: %v", err)
+		}
+		return b, nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("druid: encoding complex column: %v", err)
+	}
+	return b, nil
+}
+
+// ColumnTypeDatabaseTypeName implements driver.RowsColumnTypeDatabaseTypeName.
+// Complex columns report their native type, i.e COMPLEX<thetaSketch>, and
+// others their SQL type, i.e VARCHAR. It's empty when the types aren't
+// known
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	druidType := r.resultSet.druidType(index)
+	if strings.HasPrefix(druidType, "COMPLEX<") {
+		return druidType
+	}
+	if index < len(r.resultSet.columnTypes) {
+		return r.resultSet.columnTypes[index]
+	}
+	return druidType
+}
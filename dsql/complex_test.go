@@ -0,0 +1,51 @@
+package dsql
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComplexColumnsScanAsBytes(t *testing.T) {
+	sketch := []byte{0x02, 0x03, 0x03, 0x00, 0x00, 0x1a, 0xcc, 0x93}
+	output, _ := constructMockResults([]interface{}{"channel", "users", "hist"}, [][]interface{}{
+		{"STRING", "COMPLEX<thetaSketch>", "COMPLEX<approximateHistogram>"},
+		{"VARCHAR", "OTHER", "OTHER"},
+		{"#en", base64.StdEncoding.EncodeToString(sketch), map[string]interface{}{"breaks": []interface{}{1.0}}},
+	})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	rows, err := db.Query("SELECT channel, DS_THETA(user) AS users, hist FROM t GROUP BY 1")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	require.NoError(t, err)
+	require.Equal(t, "VARCHAR", types[0].DatabaseTypeName())
+	require.Equal(t, "COMPLEX<thetaSketch>", types[1].DatabaseTypeName())
+	require.Equal(t, "COMPLEX<approximateHistogram>", types[2].DatabaseTypeName())
+
+	require.True(t, rows.Next())
+	var channel string
+	var users, hist []byte
+	require.NoError(t, rows.Scan(&channel, &users, &hist))
+	require.Equal(t, sketch, users)
+	require.Equal(t, `{"breaks":[1]}`, string(hist))
+	require.False(t, rows.Next())
+	require.NoError(t, rows.Err())
+}
+
+func TestComplexColumnWithInvalidBase64(t *testing.T) {
+	_, err := complexValue("not base64!")
+	require.Error(t, err)
+}
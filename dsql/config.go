@@ -0,0 +1,359 @@
+package dsql
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix prefixes every environment variable LoadConfig reads
+const envPrefix = "DRUID_"
+
+// envContextPrefix prefixes environment variables holding query context
+// entries, the rest of the name is used as the key verbatim
+const envContextPrefix = envPrefix + "CTX_"
+
+// LoadOptions controls where LoadConfig reads settings from
+type LoadOptions struct {
+	// Profile is the section of the profile file to use. Defaults to
+	// $DRUID_PROFILE, or "default"
+	Profile string
+
+	// File is the profile file. Defaults to $DRUID_CONFIG_FILE, or
+	// ~/.druid/config. A missing file is only an error when it was named
+	// explicitly, here or through the environment
+	File string
+
+	// Environ returns the environment as key=value pairs, defaults to os.Environ
+	Environ func() []string
+}
+
+// LoadConfig builds a Config from a profile file and DRUID_* environment
+// variables, the environment taking precedence over the file. Every setting
+// is resolved on its own: a setting from the environment beats one from the
+// environment's DRUID_DSN, which beats the file's, which beats the file's dsn.
+// password and password_file are the same setting, so DRUID_PASSWORD
+// overrides a profile's password_file and the other way around.
+//
+// The profile file is made of [profile] sections of key = value lines, # and ;
+// start comments:
+//
+//	[default]
+//	broker = localhost:8082
+//	user = druid
+//	password_file = ~/.druid/password
+//	timeout = 30s
+//	ctx.priority = 10
+//
+// Recognised keys are dsn (a DSN used as the starting point), broker,
+// brokers (comma separated), user, password, password_file, ctx.<key> for
+// query context entries, and every ParseDSN parameter. Keys are matched
+// ignoring case and underscores so ping_endpoint and pingEndpoint are the same.
+//
+// Environment variables use the same keys upper cased with a DRUID_ prefix,
+// i.e DRUID_BROKER, DRUID_PASSWORD_FILE or DRUID_HEDGE_DELAY, except query
+// context entries which are DRUID_CTX_<key> with the key kept as is.
+// password_file and DRUID_PASSWORD_FILE read the password from a file so
+// secrets mounted by an orchestrator don't need to be in the environment.
+// A leading ~ in file names is expanded with the environment's HOME
+func LoadConfig(opts LoadOptions) (*Config, error) {
+	environ := opts.Environ
+	if environ == nil {
+		environ = os.Environ
+	}
+	vars := environ()
+	env := parseEnviron(vars)
+
+	profile := opts.Profile
+	if profile == "" {
+		profile = env.values["profile"]
+	}
+	explicitProfile := profile != ""
+	if profile == "" {
+		profile = "default"
+	}
+
+	file := opts.File
+	if file == "" {
+		file = env.values["configfile"]
+	}
+	explicitFile := file != ""
+	home := homeDir(vars)
+	if home == "" && opts.Environ == nil {
+		home, _ = os.UserHomeDir()
+	}
+	if file == "" && home != "" {
+		file = filepath.Join(home, ".druid", "config")
+	}
+
+	// Sources from the lowest precedence to the highest
+	var sources []*configSettings
+	if file != "" {
+		sections, err := readProfileFile(expandHome(file, home))
+		switch {
+		case os.IsNotExist(err) && !explicitFile:
+		case err != nil:
+			return nil, fmt.Errorf("druid: reading config file: %v", err)
+		default:
+			section, ok := sections[profile]
+			if !ok && explicitProfile {
+				return nil, fmt.Errorf("druid: profile %q not found in %s", profile, file)
+			}
+			if ok {
+				if err := section.checkKeys(); err != nil {
+					return nil, fmt.Errorf("druid: profile %q in %s: %v", profile, file, err)
+				}
+				sources = append(sources, section)
+			}
+		}
+	}
+	sources = append(sources, env)
+
+	settings := newConfigSettings()
+	for _, source := range sources {
+		if dsn, ok := source.values["dsn"]; ok {
+			fromDSN, err := dsnSettings(dsn)
+			if err != nil {
+				return nil, err
+			}
+			settings.merge(fromDSN)
+		}
+		settings.merge(source)
+	}
+	return settings.config(home)
+}
+
+// configSettings are the raw values read from one source, keyed by
+// normalized name
+type configSettings struct {
+	values  map[string]string
+	context map[string]string
+}
+
+func newConfigSettings() *configSettings {
+	return &configSettings{values: map[string]string{}, context: map[string]string{}}
+}
+
+// dsnSettings breaks a DSN down into the settings it names, so layering it
+// over another source only overrides those
+func dsnSettings(dsn string) (*configSettings, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newConfigSettings()
+	s.values["broker"] = cfg.BrokerAddr
+	s.values["brokers"] = strings.Join(cfg.Brokers, ",")
+	if cfg.User != "" || cfg.Passwd != "" {
+		s.values["user"] = cfg.User
+		s.values["password"] = cfg.Passwd
+	}
+
+	// ParseDSN already checked the parameters
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		params, _ := url.ParseQuery(dsn[i+1:])
+		for name, values := range params {
+			s.set(name, values[0])
+		}
+	}
+	return s, nil
+}
+
+func (s *configSettings) set(key, value string) {
+	if strings.HasPrefix(strings.ToLower(key), queryContextPrefix) {
+		s.context[key[len(queryContextPrefix):]] = value
+		return
+	}
+	s.values[normalizeKey(key)] = value
+}
+
+// checkKeys returns an error for the first key LoadConfig doesn't recognise
+func (s *configSettings) checkKeys() error {
+	known := map[string]bool{
+		"dsn": true, "broker": true, "brokers": true,
+		"user": true, "password": true, "passwordfile": true,
+	}
+	for _, p := range dsnParams {
+		known[normalizeKey(p.name)] = true
+	}
+	for alias := range dsnAliases {
+		known[normalizeKey(alias)] = true
+	}
+
+	for key := range s.values {
+		if !known[key] {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return nil
+}
+
+// merge overrides the settings with every one named in other
+func (s *configSettings) merge(other *configSettings) {
+	_, password := other.values["password"]
+	_, passwordFile := other.values["passwordfile"]
+	if password || passwordFile {
+		delete(s.values, "password")
+		delete(s.values, "passwordfile")
+	}
+
+	for k, v := range other.values {
+		for alias, name := range dsnAliases {
+			if k == normalizeKey(alias) {
+				k = normalizeKey(name)
+			}
+		}
+		s.values[k] = v
+	}
+	for k, v := range other.context {
+		s.context[k] = v
+	}
+}
+
+// config builds a Config from merged settings, home is used to expand ~
+func (s *configSettings) config(home string) (*Config, error) {
+	cfg := &Config{}
+	if broker, ok := s.values["broker"]; ok {
+		cfg.BrokerAddr = broker
+	}
+	if brokers, ok := s.values["brokers"]; ok {
+		cfg.Brokers = nil
+		for _, broker := range strings.Split(brokers, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.Brokers = append(cfg.Brokers, broker)
+			}
+		}
+	}
+	if user, ok := s.values["user"]; ok {
+		cfg.User = user
+	}
+	if password, ok := s.values["password"]; ok {
+		cfg.Passwd = password
+	}
+	if file, ok := s.values["passwordfile"]; ok {
+		secret, err := ioutil.ReadFile(expandHome(file, home))
+		if err != nil {
+			return nil, fmt.Errorf("druid: reading password file: %v", err)
+		}
+		cfg.Passwd = strings.TrimRight(string(secret), "\r\n")
+	}
+
+	for _, p := range dsnParams {
+		key := normalizeKey(p.name)
+		if value, ok := s.values[key]; ok {
+			if err := p.parse(cfg, value); err != nil {
+				return nil, fmt.Errorf("druid: %s: %v", p.name, err)
+			}
+		}
+	}
+
+	for k, v := range s.context {
+		if cfg.QueryContext == nil {
+			cfg.QueryContext = make(map[string]interface{})
+		}
+		value, err := parseContextValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("druid: context %s: %v", k, err)
+		}
+		cfg.QueryContext[k] = value
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("druid: %v", err)
+	}
+	return cfg, nil
+}
+
+// parseEnviron picks the DRUID_* variables out of key=value pairs
+func parseEnviron(environ []string) *configSettings {
+	settings := newConfigSettings()
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := kv[:i], kv[i+1:]
+
+		switch {
+		case strings.HasPrefix(key, envContextPrefix):
+			settings.context[key[len(envContextPrefix):]] = value
+		case strings.HasPrefix(key, envPrefix):
+			settings.values[normalizeKey(key[len(envPrefix):])] = value
+		}
+	}
+	return settings
+}
+
+// readProfileFile parses an INI style profile file into its sections
+func readProfileFile(path string) (map[string]*configSettings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := make(map[string]*configSettings)
+	var current *configSettings
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			current = newConfigSettings()
+			sections[name] = current
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: setting outside of a [profile] section", path, n)
+		}
+		current.set(strings.TrimSpace(line[:i]), unquote(strings.TrimSpace(line[i+1:])))
+	}
+
+	return sections, scanner.Err()
+}
+
+// homeDir returns $HOME from environ
+func homeDir(environ []string) string {
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "HOME=") {
+			return kv[len("HOME="):]
+		}
+	}
+	return ""
+}
+
+// normalizeKey lower cases key and drops underscores and dashes
+func normalizeKey(key string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+}
+
+// unquote strips matching single or double quotes around a value
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// expandHome replaces a leading ~ with home
+func expandHome(path, home string) string {
+	if home == "" || path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
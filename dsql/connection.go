@@ -9,11 +9,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/zencoder/go-smile/smile"
 )
@@ -36,7 +36,7 @@ var (
 )
 
 func wrapErr(a, b error) error {
-	return fmt.Errorf("%v: %v", a, b)
+	return fmt.Errorf("%w: %v", a, b)
 }
 
 type key int
@@ -44,24 +44,60 @@ type key int
 const (
 	transportKey key = iota
 	requestKey
+	queryContextKey
+	noCacheKey
+	cacheTTLKey
+	callerTagKey
+	timeZoneKey
+	taskWaitKey
+	asyncKey
+	taskProgressKey
+	nativeKey
 )
 
 type connection struct {
 	Client    *http.Client
 	Cfg       *Config
+	connector *Connector
 	closeCh   chan struct{}
-	watcherCh chan context.Context
-	errorCh   chan error
-	resultsCh chan []byte
-	requestCh chan *http.Request
 	closed    bool
 	mtx       sync.Mutex
+
+	// ownsConnector is whether the connection was opened by Driver.Open,
+	// in which case closing it closes the connector too
+	ownsConnector bool
 }
 
 type queryRequest struct {
-	Query        string `json:"query"`
-	ResultFormat string `json:"resultFormat"`
-	Header       bool   `json:"header"`
+	Query          string                 `json:"query"`
+	ResultFormat   string                 `json:"resultFormat"`
+	Header         bool                   `json:"header"`
+	TypesHeader    bool                   `json:"typesHeader,omitempty"`
+	SQLTypesHeader bool                   `json:"sqlTypesHeader,omitempty"`
+	Parameters     []queryParameter       `json:"parameters,omitempty"`
+	Context        map[string]interface{} `json:"context,omitempty"`
+
+	// location is the time zone timestamps in the response are returned in
+	location *time.Location
+
+	// native is whether Query is a native JSON query, sent as it is to
+	// Config.NativeEndpoint
+	native bool
+}
+
+// statusError is returned when druid responds with anything other than a 200
+type statusError struct {
+	code int
+
+	// message is the error druid described in the response, if any
+	message string
+}
+
+func (e *statusError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("error making query request to druid, status code: %d: %s", e.code, e.message)
+	}
+	return fmt.Sprintf("error making query request to druid, status code: %d", e.code)
 }
 
 type queryResponse [][]interface{}
@@ -80,7 +116,9 @@ func (c *connection) Close() (err error) {
 	c.closed = true
 	c.mtx.Unlock()
 	close(c.closeCh)
-	c.Client = nil
+	if c.ownsConnector {
+		return c.connector.Close()
+	}
 	return
 }
 
@@ -92,73 +130,121 @@ func (c *connection) Begin() (tx driver.Tx, err error) {
 
 // Ping implmements db.conn.Prepare and hits the health endpoint of a broker
 func (c *connection) Ping(ctx context.Context) error {
-	res, err := c.Client.Get(fmt.Sprintf("%s%s", c.Cfg.BrokerAddr, c.Cfg.PingEndpoint))
-	if err != nil {
-		return wrapErr(ErrPinging, err)
-	}
-	defer res.Body.Close()
+	return c.connector.ping(ctx, c.Cfg.BrokerAddr)
+}
 
-	if res.StatusCode != http.StatusOK {
-		return wrapErr(ErrPinging, err)
+// CheckNamedValue implements driver.NamedValueChecker so slices can be
+// passed as ARRAY parameters, everything else gets the default conversion
+func (c *connection) CheckNamedValue(nv *driver.NamedValue) error {
+	if isArrayParameter(nv.Value) {
+		return nil
 	}
+	return driver.ErrSkip
+}
 
-	return nil
+// Query queries the druid sql api
+func (c *connection) Query(q string, args []driver.Value) (driver.Rows, error) {
+	return c.query(q, args)
 }
 
-func (c *connection) startRequestPipeline() {
-	go func() {
-		for {
-			select {
-			case req := <-c.requestCh:
-				res, err := c.Client.Do(req)
-				if err != nil {
-					c.errorCh <- err
-					return
-				}
+// smile reports whether responses are requested with Jackson Smile encoding
+func (c *connection) smile() bool {
+	return c.Cfg.Smile || maybeEnv("DRUID_SMILE", "false") == "true"
+}
 
-				body, err := ioutil.ReadAll(res.Body)
-				if err != nil {
-					c.errorCh <- err
-				}
+func (c *connection) newQueryRequest(ctx context.Context, q string, args []driver.Value) (*queryRequest, error) {
+	var queryContext map[string]interface{}
+	if len(c.Cfg.QueryContext) > 0 || len(queryContextFrom(ctx)) > 0 {
+		queryContext = make(map[string]interface{})
+		for k, v := range c.Cfg.QueryContext {
+			queryContext[k] = v
+		}
+		for k, v := range queryContextFrom(ctx) {
+			queryContext[k] = v
+		}
+	}
 
-				// @todo do we still want to do this if there was an error above?
-				c.resultsCh <- body
-			case <-c.closeCh:
-				return
-			}
+	zone, err := c.timeZone(ctx, queryContext)
+	if err != nil {
+		return nil, err
+	}
+	if zone != nil {
+		name, err := sqlTimeZoneName(zone)
+		if err != nil {
+			return nil, err
 		}
-	}()
-}
+		if queryContext == nil {
+			queryContext = make(map[string]interface{})
+		}
+		queryContext[sqlTimeZoneKey] = name
+	}
 
-// Query queries the druid sql api
-func (c *connection) Query(q string, args []driver.Value) (driver.Rows, error) {
-	return c.query(q, args)
+	params, err := toQueryParameters(args, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	location := timeZoneFrom(ctx)
+	if location == nil {
+		location = c.Cfg.Location
+	}
+	if location == nil {
+		location = zone
+	}
+
+	return &queryRequest{
+		Query:          q,
+		ResultFormat:   "array",
+		Header:         true,
+		TypesHeader:    true,
+		SQLTypesHeader: true,
+		Parameters:     params,
+		Context:        queryContext,
+		location:       location,
+	}, nil
 }
 
-func (c *connection) makeRequest(q string) (*http.Request, error) {
-	queryURL := fmt.Sprintf("%s%s", c.Cfg.BrokerAddr, c.Cfg.QueryEndpoint)
-	request := &queryRequest{
-		Query:        q,
-		ResultFormat: "array",
-		Header:       true,
+// timeZone returns the zone a query runs in: the one set with WithTimeZone,
+// an sqlTimeZone already in its query context, or Config.TimeZone
+func (c *connection) timeZone(ctx context.Context, queryContext map[string]interface{}) (*time.Location, error) {
+	if zone := timeZoneFrom(ctx); zone != nil {
+		return zone, nil
 	}
+	if name, ok := queryContext[sqlTimeZoneKey].(string); ok {
+		if c.Cfg.TimeZone != nil && c.Cfg.TimeZone.String() == name {
+			return c.Cfg.TimeZone, nil
+		}
+		return loadTimeZone(name)
+	}
+	return c.Cfg.TimeZone, nil
+}
 
-	payload, err := json.Marshal(request)
-	if err != nil {
+func (c *connection) makeRequest(ctx context.Context, broker string, request *queryRequest) (*http.Request, error) {
+	queryURL := fmt.Sprintf("%s%s", broker, c.Cfg.QueryEndpoint)
+
+	var payload []byte
+	var err error
+	if request.native {
+		queryURL, payload = broker+c.Cfg.NativeEndpoint, []byte(request.Query)
+	} else if payload, err = json.Marshal(request); err != nil {
 		return nil, wrapErr(ErrRequestForm, err)
 	}
 
 	req, err := http.NewRequest(http.MethodPost, queryURL, bytes.NewReader(payload))
 	if err != nil {
-		return nil, wrapErr(ErrRequestForm, err)
+		return nil, wrapErr(ErrRequestForm, c.Cfg.redactErr(err))
 	}
 
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
+	if err := c.connector.authenticate(req); err != nil {
+		return nil, wrapErr(ErrRequestForm, err)
+	}
 
 	// Selects whether or not to request as JSON, or Jackson Smile encoding
 	// https://druid.apache.org/docs/latest/querying/querying.html
 	// This might not work with SQL queries...
-	if maybeEnv("DRUID_SMILE", "false") == "true" {
+	if c.smile() && !request.native {
 		req.Header.Set("Accept", "application/x-jackson-smile")
 	}
 
@@ -167,7 +253,7 @@ func (c *connection) makeRequest(q string) (*http.Request, error) {
 
 func (c *connection) parseJSONResponse(body []byte) (queryResponse, error) {
 	var results queryResponse
-	err := json.Unmarshal(body, &results)
+	err := decodeJSON(body, &results)
 	return results, err
 }
 
@@ -177,7 +263,19 @@ func (c *connection) parseSmileResponse(body []byte) (queryResponse, error) {
 		return queryResponse{}, err
 	}
 
-	return decoded.(queryResponse), nil
+	// Smile decodes to the same generic values as JSON, but as []interface{}
+	// rather than a slice of rows
+	values, ok := decoded.([]interface{})
+	if !ok {
+		return queryResponse{}, fmt.Errorf("druid: unexpected smile response of type %T", decoded)
+	}
+	results := make(queryResponse, len(values))
+	for i, v := range values {
+		if results[i], ok = v.([]interface{}); !ok {
+			return queryResponse{}, fmt.Errorf("druid: unexpected smile row of type %T", v)
+		}
+	}
+	return results, nil
 }
 
 func maybeEnv(a, b string) string {
@@ -188,10 +286,10 @@ func maybeEnv(a, b string) string {
 	return val
 }
 
-func (c *connection) parseResponse(body []byte) (r *rows, err error) {
+func (c *connection) parseResponse(body []byte, request *queryRequest) (r *rows, err error) {
 	var results queryResponse
 
-	if maybeEnv("DRUID_SMILE", "false") == "true" {
+	if c.smile() {
 		results, err = c.parseSmileResponse(body)
 	} else {
 		results, err = c.parseJSONResponse(body)
@@ -211,86 +309,288 @@ func (c *connection) parseResponse(body []byte) (r *rows, err error) {
 		columnNames = append(columnNames, val.(string))
 	}
 
+	// The native and SQL types follow the column names, in that order, when
+	// the request asked for them
+	first := 1
+	var druidTypes, columnTypes []string
+	if request.TypesHeader {
+		if druidTypes, err = headerRow("typesHeader", results, first, isDruidTypeName); err != nil {
+			return &rows{}, err
+		}
+		first++
+	}
+	if request.SQLTypesHeader {
+		if columnTypes, err = headerRow("sqlTypesHeader", results, first, isSQLTypeName); err != nil {
+			return &rows{}, err
+		}
+		first++
+	}
+
+	return c.newRows(columnNames, druidTypes, columnTypes, results[first:], request.location), nil
+}
+
+// headerRow returns the type names of results[i], the header row of the
+// given name, or an error when that row is missing or holds anything but
+// one valid type name per column
+func headerRow(name string, results queryResponse, i int, valid func(string) bool) ([]string, error) {
+	if i >= len(results) {
+		return nil, fmt.Errorf("druid: response is missing the %s row", name)
+	}
+	if len(results[i]) != len(results[0]) {
+		return nil, fmt.Errorf("druid: %s row has %d values for %d columns", name, len(results[i]), len(results[0]))
+	}
+
+	types := make([]string, len(results[i]))
+	for j, val := range results[i] {
+		typ, ok := val.(string)
+		if !ok || !valid(typ) {
+			return nil, fmt.Errorf("druid: %s row has %v where a type is expected (column %v)", name, val, results[0][j])
+		}
+		types[j] = typ
+	}
+	return types, nil
+}
+
+// newRows returns rows of values decoded from a response, with the names
+// and types of their columns
+func (c *connection) newRows(columnNames, druidTypes, columnTypes []string, values [][]interface{}, location *time.Location) *rows {
+	return &rows{
+		conn: c,
+		resultSet: resultSet{
+			columnNames: columnNames,
+			rows:        toFields(values),
+			currentRow:  0,
+			dateField:   c.Cfg.DateField,
+			dateFormat:  c.Cfg.DateFormat,
+			columnTypes: columnTypes,
+			druidTypes:  druidTypes,
+			location:    location,
+		},
+	}
+}
+
+// toFields wraps each value of a response's rows in a field
+func toFields(values [][]interface{}) [][]field {
 	var returnedRows [][]field
-	for i := 1; i < len(results); i++ {
+	for _, row := range values {
 		var cols []field
-		for _, val := range results[i] {
+		for _, val := range row {
 			cols = append(cols, field{Value: reflect.ValueOf(val), Type: reflect.TypeOf(val)})
 		}
 		returnedRows = append(returnedRows, cols)
 	}
+	return returnedRows
+}
+
+func (c *connection) query(q string, args []driver.Value) (*rows, error) {
+	return c.queryContext(context.Background(), q, args)
+}
+
+func (c *connection) queryContext(ctx context.Context, q string, args []driver.Value) (*rows, error) {
+	if query, ok := nativeQuery(ctx, q); ok {
+		return c.queryNative(ctx, q, query, args)
+	}
 
-	resultSet := resultSet{
-		columnNames: columnNames,
-		rows:        returnedRows,
-		currentRow:  0,
-		dateField:   c.Cfg.DateField,
-		dateFormat:  c.Cfg.DateFormat,
+	request, err := c.newQueryRequest(ctx, q, args)
+	if err != nil {
+		return &rows{}, wrapErr(ErrCreatingRequest, err)
 	}
 
-	r = &rows{
-		conn:      c,
-		resultSet: resultSet,
+	// Asynchronous queries bound each of their requests by the timeout
+	// instead, as they're meant to outlast it
+	interval, async := asyncWait(ctx)
+	if c.Cfg.Timeout > 0 && !async {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Cfg.Timeout)
+		defer cancel()
+	}
+
+	hooks := c.hooks()
+	if hooks.QueryStart != nil {
+		hooks.QueryStart(ctx, q)
+	}
+	start := time.Now()
+
+	var r *rows
+	if async {
+		r, err = c.queryAsync(ctx, request, interval)
+	} else {
+		var body []byte
+		body, err = c.execute(ctx, request)
+		if err == nil {
+			r, err = c.parseResponse(body, request)
+		}
 	}
 
-	return r, nil
+	if hooks.QueryDone != nil {
+		hooks.QueryDone(ctx, q, time.Since(start), err)
+	}
+	if err != nil && r == nil {
+		return &rows{}, err
+	}
+	return r, err
 }
 
-func (c *connection) query(q string, args []driver.Value) (*rows, error) {
-	req, err := c.makeRequest(q)
+// hooks returns the hooks of the connection's connector
+func (c *connection) hooks() Hooks {
+	if c.connector == nil {
+		return Hooks{}
+	}
+	return c.connector.hooks
+}
+
+// execute returns the response body for request, from the cache when one is
+// configured and holds a usable entry
+func (c *connection) execute(ctx context.Context, request *queryRequest) ([]byte, error) {
+	cache := c.Cfg.Cache
+	if cache == nil || cacheBypassed(ctx) {
+		return c.fetch(ctx, request)
+	}
+
+	key := queryKey(c.Cfg.BrokerAddr, c.connector.cacheIdentity(), c.smile(), request)
+	body, fresh, ok := cache.get(key)
+	if ok && fresh {
+		return body, nil
+	}
+
+	result, err := c.fetch(ctx, request)
 	if err != nil {
-		return &rows{}, err
+		if ok && cache.opts.StaleIfError && isServerFailure(ctx, err) {
+			cache.recordStale()
+			c.Cfg.logger().Log(LevelWarn, "druid: serving stale cached result", "error", c.Cfg.redact(err.Error()))
+			return body, nil
+		}
+		return nil, err
 	}
 
-	res, err := c.Client.Do(req)
+	cache.set(key, result, cacheTTL(ctx, cache.opts.TTL))
+	return result, nil
+}
+
+// fetch sends request to druid. When queries are coalesced, identical
+// requests already in flight share a single response instead
+func (c *connection) fetch(ctx context.Context, request *queryRequest) ([]byte, error) {
+	if c.connector == nil || c.connector.flights == nil {
+		return c.do(ctx, request)
+	}
+
+	// The caller tag is the only value of the context the request depends
+	// on, so callers with different tags don't share a slot of the limiter
+	tag := callerTag(ctx)
+	key := queryKey(c.Cfg.BrokerAddr, c.connector.cacheIdentity(), c.smile(), request) + "\x00" + tag
+	return c.connector.flights.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		if tag != "" {
+			ctx = WithCallerTag(ctx, tag)
+		}
+		return c.do(ctx, request)
+	})
+}
+
+// do sends a query request to druid and returns the response body
+func (c *connection) do(ctx context.Context, request *queryRequest) ([]byte, error) {
+	if limiter := c.Cfg.Limiter; limiter != nil {
+		release, err := limiter.acquire(ctx, request)
+		if err != nil {
+			c.Cfg.logger().Log(LevelWarn, "druid: query rejected by limiter", "error", err.Error())
+			return nil, err
+		}
+		defer release()
+	}
+
+	res, err := c.send(ctx, request)
 	if err != nil {
-		return &rows{}, err
+		return nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return &rows{}, err
+		return nil, err
 	}
 
 	code := res.StatusCode
 	if code != http.StatusOK {
-		log.Println(string(body))
-		return &rows{}, fmt.Errorf("error making query request to druid, status code: %d", code)
+		logger := c.Cfg.logger()
+		logger.Log(LevelError, "druid: query returned an error status", "status", code)
+		logger.Log(LevelDebug, "druid: error response", "status", code, "body", c.Cfg.logBody(string(body)))
+		return nil, &statusError{code: code, message: errorMessage(body)}
 	}
 
-	return c.parseResponse(body)
+	return body, nil
+}
+
+// send returns the response to request once its headers arrive, hedging
+// across brokers when that's enabled. Native queries aren't hedged, as the
+// losing attempt couldn't be cancelled by its SQL query id
+func (c *connection) send(ctx context.Context, request *queryRequest) (*http.Response, error) {
+	if c.connector != nil && c.connector.hedger != nil && !request.native {
+		return c.hedgedRoundTrip(ctx, c.connector.hedger, request)
+	}
+	return c.roundTrip(ctx, c.Cfg.BrokerAddr, request)
 }
 
-func (c *connection) queryContext(ctx context.Context, q string, args []driver.NamedValue) (*rows, error) {
-	req, err := c.makeRequest(q)
+// roundTrip sends request to a single broker
+func (c *connection) roundTrip(ctx context.Context, broker string, request *queryRequest) (*http.Response, error) {
+	req, err := c.makeRequest(ctx, broker, request)
 	if err != nil {
-		return &rows{}, wrapErr(ErrCreatingRequest, err)
+		return nil, wrapErr(ErrCreatingRequest, err)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	logger := c.Cfg.logger()
+	logger.Log(LevelDebug, "druid: sending query", "url", c.Cfg.redact(req.URL.String()), "query", c.Cfg.logBody(request.Query))
 
-	req = req.WithContext(ctx)
+	var done func(breakerOutcome)
+	if c.connector != nil && c.connector.breakers != nil {
+		done, err = c.connector.breakers.allow(broker)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	c.requestCh <- req
-	tr := &http.Transport{}
-	c.Client.Transport = tr
+	res, err := c.Client.Do(req)
+	if err != nil {
+		// A broker that doesn't answer before the deadline is failing, only
+		// a caller giving up says nothing about it
+		if errors.Is(ctx.Err(), context.Canceled) {
+			report(done, outcomeIgnored)
+			return nil, ctx.Err()
+		}
+		report(done, outcomeFailure)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		err = c.Cfg.redactErr(err)
+		logger.Log(LevelError, "druid: query request failed", "error", err.Error())
+		return nil, err
+	}
 
-	var r *rows
+	if res.StatusCode >= http.StatusInternalServerError {
+		report(done, outcomeFailure)
+	} else {
+		report(done, outcomeSuccess)
+	}
 
-	select {
-	case body := <-c.resultsCh:
-		r, err = c.parseResponse(body)
-		if err != nil {
-			return r, err
-		}
-	case err = <-c.errorCh:
-	case <-ctx.Done():
-		err = ctx.Err()
-		return r, err
+	return res, nil
+}
+
+// report passes a request's outcome to its circuit breaker, if there is one
+func report(done func(breakerOutcome), outcome breakerOutcome) {
+	if done != nil {
+		done(outcome)
 	}
+}
 
-	return r, err
+// isServerFailure reports whether err means druid couldn't answer, as opposed
+// to the query being invalid or the caller giving up
+func isServerFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError
+	}
+	return true
 }
 
 // QueryContext -
@@ -300,9 +600,5 @@ func (c *connection) QueryContext(ctx context.Context, q string, args []driver.N
 		return nil, err
 	}
 
-	if ctx.Done() == nil {
-		return c.query(q, vals)
-	}
-
-	return c.queryContext(ctx, q, args)
+	return c.queryContext(ctx, q, vals)
 }
@@ -1,9 +1,15 @@
 package dsql
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
+	"net/http"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestPrepare(t *testing.T) {
@@ -11,7 +17,7 @@ func TestPrepare(t *testing.T) {
 		BrokerAddr:   "localhost:8082",
 		PingEndpoint: "/status/health",
 	}
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -26,7 +32,7 @@ func TestBegin(t *testing.T) {
 		BrokerAddr:   "localhost:8082",
 		PingEndpoint: "/status/health",
 	}
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,3 +41,64 @@ func TestBegin(t *testing.T) {
 		t.Fatal("Expected begin to be unimplemented but it is")
 	}
 }
+
+func TestQuerySendsParametersAndContext(t *testing.T) {
+	var got queryRequest
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		output, _ := constructMockResults([]interface{}{"n"}, [][]interface{}{{"LONG"}, {"BIGINT"}, {1}})
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx := WithQueryContext(context.Background(), map[string]interface{}{"sqlQueryId": "abc"})
+	ts2 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	rows, err := db.QueryContext(ctx, "SELECT COUNT(*) FROM t WHERE a = ? AND b > ? AND __time > ?", "x", 10, ts2)
+	require.NoError(t, err)
+	require.NoError(t, rows.Close())
+
+	require.Equal(t, []queryParameter{
+		{Type: "VARCHAR", Value: "x"},
+		{Type: "BIGINT", Value: float64(10)},
+		{Type: "TIMESTAMP", Value: "2020-01-02 03:04:05.000"},
+	}, got.Parameters)
+	require.Equal(t, map[string]interface{}{"sqlQueryId": "abc"}, got.Context)
+}
+
+func TestResponseHeaderRows(t *testing.T) {
+	var output []byte
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Data that looks like type names is still data
+	output, _ = constructMockResults([]interface{}{"kind"}, [][]interface{}{{"STRING"}, {"VARCHAR"}, {"STRING"}, {"VARCHAR"}})
+	var kinds []string
+	rows, err := db.Query("SELECT kind FROM t")
+	require.NoError(t, err)
+	for rows.Next() {
+		var kind string
+		require.NoError(t, rows.Scan(&kind))
+		kinds = append(kinds, kind)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{"STRING", "VARCHAR"}, kinds)
+
+	output, _ = constructMockResults([]interface{}{"kind"}, [][]interface{}{{"STRING"}, {"a"}})
+	_, err = db.Query("SELECT kind FROM t")
+	require.EqualError(t, err, "druid: sqlTypesHeader row has a where a type is expected (column kind)")
+
+	output, _ = constructMockResults([]interface{}{"kind"}, [][]interface{}{{"STRING"}})
+	_, err = db.Query("SELECT kind FROM t")
+	require.EqualError(t, err, "druid: response is missing the sqlTypesHeader row")
+}
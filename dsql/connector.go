@@ -2,31 +2,317 @@ package dsql
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
-type connector struct {
-	Cfg *Config
+// Connector is a driver.Connector for a druid cluster, use it with
+// sql.OpenDB. Connections opened by a Connector share its http client,
+// result coalescing, hedging and circuit breakers
+type Connector struct {
+	cfg           *Config
+	client        *http.Client
+	ownsTransport bool
+	auth          Authenticator
+	hooks         Hooks
+
+	// identity is who queries are sent as, part of cache keys so cached
+	// results are only served to the credentials that fetched them
+	identity string
+
+	flights  *flightGroup
+	hedger   *hedger
+	breakers *breakerSet
+
+	healthInterval time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+	closeOnce      sync.Once
+}
+
+// NewConnector returns a connector for cfg to be used with sql.OpenDB. Unlike
+// sql.Open it keeps settings that can't be expressed in a DSN, such as
+// Logger, and accepts options to inject an http client, authenticator and hooks
+func NewConnector(cfg *Config, opts ...Option) (*Connector, error) {
+	if cfg == nil {
+		return nil, errors.New("druid: config is nil")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("druid: %v", err)
+	}
+
+	normalized := *cfg
+	normalized.BrokerAddr = withScheme(cfg.BrokerAddr, cfg.UseSSL)
+
+	// Credentials embedded in an address would end up in errors and logs,
+	// so they're moved to User and Passwd
+	var userinfo *url.Userinfo
+	normalized.BrokerAddr, userinfo = stripUserinfo(normalized.BrokerAddr)
+	if userinfo != nil && normalized.User == "" && normalized.PasswordProvider == nil {
+		normalized.User = userinfo.Username()
+		normalized.Passwd, _ = userinfo.Password()
+	}
+
+	normalized.Brokers = make([]string, len(cfg.Brokers))
+	for i, broker := range cfg.Brokers {
+		normalized.Brokers[i], _ = stripUserinfo(withScheme(broker, cfg.UseSSL))
+	}
+	if normalized.PingEndpoint == "" {
+		normalized.PingEndpoint = "/status/health"
+	}
+	if normalized.QueryEndpoint == "" {
+		normalized.QueryEndpoint = "/druid/v2/sql"
+	}
+	if normalized.NativeEndpoint == "" {
+		normalized.NativeEndpoint = "/druid/v2"
+	}
+	if normalized.TaskEndpoint == "" {
+		normalized.TaskEndpoint = "/druid/v2/sql/task"
+	}
+	if normalized.OverlordAddr == "" {
+		normalized.OverlordAddr = normalized.BrokerAddr
+	} else {
+		normalized.OverlordAddr, _ = stripUserinfo(withScheme(cfg.OverlordAddr, cfg.UseSSL))
+	}
+	if normalized.CoordinatorAddr == "" {
+		normalized.CoordinatorAddr = normalized.OverlordAddr
+	} else {
+		normalized.CoordinatorAddr, _ = stripUserinfo(withScheme(cfg.CoordinatorAddr, cfg.UseSSL))
+	}
+
+	c := &Connector{
+		cfg: &normalized,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.client == nil {
+		transport, err := newTransport(&normalized)
+		if err != nil {
+			return nil, err
+		}
+		c.client = &http.Client{Transport: transport}
+		c.ownsTransport = true
+	}
+
+	c.init()
+	return c, nil
+}
+
+// newTransport returns a transport honouring cfg's dial timeout and TLS settings
+func newTransport(cfg *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	if cfg.TLSSkipVerify || cfg.TLSCAFile != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+		if cfg.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("druid: reading tls ca file: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("druid: no certificates found in %s", cfg.TLSCAFile)
+			}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+// init sets up the connector's shared state once its options are applied
+func (c *Connector) init() {
+	cfg := c.cfg
+	switch {
+	case c.auth != nil:
+		// What a custom authenticator sends can't be known, so the
+		// connector's results aren't shared with any other
+		c.identity = "connector:" + newQueryID()
+	case cfg.PasswordProvider != nil:
+		// Neither can the passwords a provider returns, the same user may
+		// be given different ones by the providers of other connectors
+		c.auth = BasicAuthProvider(cfg.User, cfg.PasswordProvider)
+		c.identity = "connector:" + newQueryID()
+	case cfg.User != "":
+		c.auth = BasicAuth(cfg.User, cfg.Passwd)
+		sum := sha256.Sum256([]byte(cfg.User + "\x00" + cfg.Passwd))
+		c.identity = "basic:" + hex.EncodeToString(sum[:])
+	}
+
+	if cfg.CoalesceQueries {
+		c.flights = newFlightGroup()
+	}
+	c.hedger = newHedger(cfg)
+	c.breakers = newBreakerSet(cfg, c.breakerChanged)
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if c.healthInterval > 0 {
+		c.wg.Add(1)
+		go c.healthCheck()
+	}
 }
 
 // Connect implements db.Connector and sets up an http client to druid's sql endpoint
-func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
-	client := &http.Client{}
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
 	connection := &connection{
-		Client:    client,
-		Cfg:       c.Cfg,
+		Client:    c.client,
+		Cfg:       c.cfg,
+		connector: c,
 		closeCh:   make(chan struct{}, 1),
-		watcherCh: make(chan context.Context, 1),
-		errorCh:   make(chan error),
-		resultsCh: make(chan []byte),
-		requestCh: make(chan *http.Request),
 	}
-	connection.startRequestPipeline()
 	return connection, nil
 }
 
 // Driver implements db.Connector and returns a druid driver
-func (c *connector) Driver() (d driver.Driver) {
+func (c *Connector) Driver() (d driver.Driver) {
 	return &Driver{}
 }
+
+// Close stops the connector's background health checks and closes idle
+// connections of the transport it created. An injected http client is
+// left open. sql.DB calls it when it's closed
+func (c *Connector) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.wg.Wait()
+		if c.ownsTransport {
+			c.client.CloseIdleConnections()
+		}
+	})
+	return nil
+}
+
+// brokers returns every broker the connector sends queries to
+func (c *Connector) brokers() []string {
+	return append([]string{c.cfg.BrokerAddr}, c.cfg.Brokers...)
+}
+
+// breakerChanged reports a circuit breaker changing state
+func (c *Connector) breakerChanged(host string, from, to BreakerState) {
+	level := LevelWarn
+	if to == BreakerClosed {
+		level = LevelInfo
+	}
+	c.cfg.logger().Log(level, "druid: circuit breaker changed state", "host", host, "from", from, "to", to)
+	if c.hooks.BreakerStateChange != nil {
+		c.hooks.BreakerStateChange(host, from, to)
+	}
+}
+
+// healthCheck pings every broker until the connector is closed
+func (c *Connector) healthCheck() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, broker := range c.brokers() {
+				err := c.ping(c.ctx, broker)
+				if c.ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					c.cfg.logger().Log(LevelWarn, "druid: broker health check failed", "broker", c.cfg.redact(broker), "error", c.cfg.redact(err.Error()))
+				}
+				if c.hooks.HealthCheck != nil {
+					c.hooks.HealthCheck(broker, err)
+				}
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// ping requests the health endpoint of broker
+func (c *Connector) ping(ctx context.Context, broker string) error {
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, broker+c.cfg.PingEndpoint, nil)
+	if err != nil {
+		return wrapErr(ErrPinging, c.cfg.redactErr(err))
+	}
+	req = req.WithContext(ctx)
+	if err := c.authenticate(req); err != nil {
+		return wrapErr(ErrPinging, err)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return wrapErr(ErrPinging, c.cfg.redactErr(err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return wrapErr(ErrPinging, &statusError{code: res.StatusCode})
+	}
+
+	return nil
+}
+
+// stripUserinfo removes any user:password@ part from addr
+func stripUserinfo(addr string) (string, *url.Userinfo) {
+	u, err := url.Parse(addr)
+	if err != nil || u.User == nil {
+		return addr, nil
+	}
+	userinfo := u.User
+	u.User = nil
+	return u.String(), userinfo
+}
+
+// authenticate adds the connector's credentials to req
+func (c *Connector) authenticate(req *http.Request) error {
+	if c == nil || c.auth == nil {
+		return nil
+	}
+	return c.auth.Authenticate(req)
+}
+
+// cacheIdentity returns who the connector sends queries as, for cache keys
+func (c *Connector) cacheIdentity() string {
+	if c == nil {
+		return ""
+	}
+	return c.identity
+}
+
+// withScheme prefixes addr with http:// or https:// unless it has a scheme
+func withScheme(addr string, useSSL bool) string {
+	if strings.Contains(addr, "://") {
+		return addr
+	}
+	if useSSL {
+		return "https://" + addr
+	}
+	return "http://" + addr
+}
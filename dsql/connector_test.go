@@ -0,0 +1,125 @@
+package dsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func stubResponse(code int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestConnectorIsCloser(t *testing.T) {
+	var _ io.Closer = &Connector{}
+}
+
+func TestConnectorWithTransportAndAuthenticator(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"channel"}, [][]interface{}{{"STRING"}, {"VARCHAR"}, {"#en.wikipedia"}})
+
+	var gotAuth string
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		gotAuth = req.Header.Get("Authorization")
+		return stubResponse(http.StatusOK, output), nil
+	})
+
+	var started, done []string
+	hooks := Hooks{
+		QueryStart: func(ctx context.Context, query string) { started = append(started, query) },
+		QueryDone: func(ctx context.Context, query string, d time.Duration, err error) {
+			require.NoError(t, err)
+			done = append(done, query)
+		},
+	}
+
+	connector, err := NewConnector(&Config{BrokerAddr: "broker:8082"},
+		WithTransport(transport),
+		WithAuthenticator(AuthenticatorFunc(func(req *http.Request) error {
+			req.Header.Set("Authorization", "Bearer token")
+			return nil
+		})),
+		WithHooks(hooks),
+	)
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var channel string
+	require.NoError(t, db.QueryRow("SELECT channel FROM wiki").Scan(&channel))
+	require.Equal(t, "#en.wikipedia", channel)
+	require.Equal(t, "Bearer token", gotAuth)
+	require.Equal(t, []string{"SELECT channel FROM wiki"}, started)
+	require.Equal(t, started, done)
+}
+
+func TestConnectorSendsBasicAuthFromConfig(t *testing.T) {
+	var user, pass string
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		user, pass, _ = req.BasicAuth()
+		return stubResponse(http.StatusOK, nil), nil
+	})
+
+	connector, err := NewConnector(&Config{BrokerAddr: "broker:8082", User: "druid", Passwd: "p@ss/word"}, WithTransport(transport))
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+	require.Equal(t, "druid", user)
+	require.Equal(t, "p@ss/word", pass)
+}
+
+func TestConnectorCloseStopsHealthChecks(t *testing.T) {
+	var mtx sync.Mutex
+	checks := 0
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return stubResponse(http.StatusOK, nil), nil
+	})
+
+	connector, err := NewConnector(&Config{BrokerAddr: "broker:8082", Brokers: []string{"broker2:8082"}},
+		WithTransport(transport),
+		WithHealthCheck(time.Millisecond),
+		WithHooks(Hooks{HealthCheck: func(broker string, err error) {
+			require.NoError(t, err)
+			mtx.Lock()
+			checks++
+			mtx.Unlock()
+		}}),
+	)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return checks >= 2
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, sql.OpenDB(connector).Close())
+	require.NoError(t, connector.Close())
+
+	mtx.Lock()
+	after := checks
+	mtx.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, after, checks)
+}
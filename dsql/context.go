@@ -0,0 +1,160 @@
+package dsql
+
+import (
+	"context"
+	"time"
+)
+
+// WithQueryContext returns a context that sends values as the druid query
+// context of queries run with it, e.g. {"sqlQueryId": "...", "priority": 10}.
+// Values are merged with any set by a parent context, the latest one wins
+func WithQueryContext(ctx context.Context, values map[string]interface{}) context.Context {
+	merged := make(map[string]interface{}, len(values))
+	for k, v := range queryContextFrom(ctx) {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, queryContextKey, merged)
+}
+
+// queryContextFrom returns the druid query context set with WithQueryContext
+func queryContextFrom(ctx context.Context) map[string]interface{} {
+	values, _ := ctx.Value(queryContextKey).(map[string]interface{})
+	return values
+}
+
+// WithoutCache returns a context whose queries neither read from nor write
+// to the result cache
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey, true)
+}
+
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(noCacheKey).(bool)
+	return bypass
+}
+
+// WithCacheTTL returns a context whose query results are cached for ttl
+// instead of the cache's default TTL. A ttl of 0 disables caching the result
+func WithCacheTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, cacheTTLKey, ttl)
+}
+
+func cacheTTL(ctx context.Context, fallback time.Duration) time.Duration {
+	if ttl, ok := ctx.Value(cacheTTLKey).(time.Duration); ok {
+		return ttl
+	}
+	return fallback
+}
+
+// WithCallerTag returns a context whose queries are attributed to tag, so a
+// Limiter using LimitTag can limit each caller separately
+func WithCallerTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, callerTagKey, tag)
+}
+
+func callerTag(ctx context.Context) string {
+	tag, _ := ctx.Value(callerTagKey).(string)
+	return tag
+}
+
+// WithTimeZone returns a context whose queries run in zone instead of
+// Config.TimeZone: druid's sqlTimeZone is set to it, time.Time parameters
+// are sent as literals in it and timestamps are returned in it
+func WithTimeZone(ctx context.Context, zone *time.Location) context.Context {
+	return context.WithValue(ctx, timeZoneKey, zone)
+}
+
+func timeZoneFrom(ctx context.Context) *time.Location {
+	zone, _ := ctx.Value(timeZoneKey).(*time.Location)
+	return zone
+}
+
+// WithTaskWait returns a context whose ExecContext statements, submitted
+// as tasks, are waited for: the task's status is polled every interval
+// until it succeeds or fails, and the number of rows it wrote is returned
+// as RowsAffected. An interval of 0 polls every second
+func WithTaskWait(ctx context.Context, interval time.Duration) context.Context {
+	if interval <= 0 {
+		interval = defaultTaskPollInterval
+	}
+	return context.WithValue(ctx, taskWaitKey, interval)
+}
+
+// taskWait returns the interval to poll tasks at, false when they're not
+// waited for
+func taskWait(ctx context.Context) (time.Duration, bool) {
+	interval, ok := ctx.Value(taskWaitKey).(time.Duration)
+	return interval, ok
+}
+
+// WithTaskProgress returns a context whose MSQ tasks, waited for by
+// ExecContext with WithTaskWait or run as asynchronous queries, pass their
+// report to progress each time they're polled, until they've ended. A
+// failed task's report names the stage it failed in. progress is called
+// synchronously so it should return quickly, e.g. by sending on a buffered
+// channel
+func WithTaskProgress(ctx context.Context, progress func(*TaskReport)) context.Context {
+	return context.WithValue(ctx, taskProgressKey, progress)
+}
+
+func taskProgress(ctx context.Context) func(*TaskReport) {
+	progress, _ := ctx.Value(taskProgressKey).(func(*TaskReport))
+	return progress
+}
+
+// WithAsync returns a context whose queries run through the asynchronous
+// statements API, so they aren't bound by the timeouts of the synchronous
+// endpoint. db.QueryContext submits the query, polls it every interval
+// until it has finished and returns its rows, reading the pages of results
+// as they're scanned. An interval of 0 polls every second. Cancelling the
+// context cancels the query
+func WithAsync(ctx context.Context, interval time.Duration) context.Context {
+	if interval <= 0 {
+		interval = defaultAsyncPollInterval
+	}
+	return context.WithValue(ctx, asyncKey, interval)
+}
+
+// WithNative returns a context whose queries are native JSON queries, sent
+// to Config.NativeEndpoint rather than the SQL endpoint. It's only needed
+// for queries that neither start with { nor have a NATIVE: prefix
+func WithNative(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nativeKey, true)
+}
+
+func nativeFlag(ctx context.Context) bool {
+	native, _ := ctx.Value(nativeKey).(bool)
+	return native
+}
+
+// asyncWait returns the interval to poll asynchronous queries at, false
+// when queries aren't run asynchronously
+func asyncWait(ctx context.Context) (time.Duration, bool) {
+	interval, ok := ctx.Value(asyncKey).(time.Duration)
+	return interval, ok
+}
+
+// detachedContext carries the values of its parent but is never cancelled,
+// used for work shared by several callers that outlives any one of them
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
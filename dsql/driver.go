@@ -13,19 +13,34 @@ func init() {
 	sql.Register("druid", &Driver{})
 }
 
-// Open opens a new connection and implements driver.Driver
+// Open opens a new connection and implements driver.Driver. The connection
+// has a connector of its own, closed along with it. database/sql uses
+// OpenConnector instead, so connections of a sql.DB share theirs
 func (d *Driver) Open(dsn string) (driver.Conn, error) {
-	cfg := ParseDSN(dsn)
-	conn := &connector{
-		Cfg: cfg,
+	connector, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
 	}
-	return conn.Connect(context.Background())
+
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		_ = connector.(*Connector).Close()
+		return nil, err
+	}
+	conn.(*connection).ownsConnector = true
+	return conn, nil
 }
 
 // OpenConnector implements driver.DriverContext
 func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
-	cfg := ParseDSN(dsn)
-	return &connector{
-		Cfg: cfg,
-	}, nil
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return connector, nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -27,6 +28,15 @@ func startMockUnstartedServer(handler http.HandlerFunc) (ts *httptest.Server, ur
 	return ts, "http://" + ts.Listener.Addr().String()
 }
 
+func mustFormatDSN(t *testing.T, cfg *Config) string {
+	t.Helper()
+	dsn, err := cfg.FormatDSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dsn
+}
+
 func constructMockResults(header []interface{}, rows [][]interface{}) (b []byte, err error) {
 	var mockResults [][]interface{}
 	mockResults = append(mockResults, header)
@@ -37,10 +47,27 @@ func constructMockResults(header []interface{}, rows [][]interface{}) (b []byte,
 }
 
 func TestConnect(t *testing.T) {
-	_, err := sql.Open("druid", cfg.FormatDSN())
+	_, err := sql.Open("druid", mustFormatDSN(t, &cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenClosesItsConnector(t *testing.T) {
+	conn, err := (&Driver{}).Open("http://localhost:8082")
 	if err != nil {
 		t.Fatal(err)
 	}
+	connector := conn.(*connection).connector
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connector.ctx.Done():
+	default:
+		t.Fatal("closing the connection should close the connector Open created")
+	}
 }
 
 func TestPing(t *testing.T) {
@@ -51,7 +78,7 @@ func TestPing(t *testing.T) {
 
 	cfg.BrokerAddr = url
 
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,22 +97,23 @@ func TestPingWithError(t *testing.T) {
 	defer ts.Close()
 
 	cfg.BrokerAddr = url
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	err = db.Ping()
-	if err != ErrPinging {
+	if !errors.Is(err, ErrPinging) {
 		t.Fatal("expected ping error but did not receive")
 	}
 }
 
 func TestQuery(t *testing.T) {
 	header := []interface{}{"__time", "added", "channel"}
+	types := [][]interface{}{{"LONG", "LONG", "STRING"}, {"TIMESTAMP", "BIGINT", "VARCHAR"}}
 	mockRows := [][]interface{}{{"2015-09-12T00:46:58.771Z", 36, "#en.wikipedia"}, {"2015-09-12T00:46:58.772Z", 76, "#ca.wikipedia"}}
 
-	output, _ := constructMockResults(header, mockRows)
+	output, _ := constructMockResults(header, append(types, mockRows...))
 	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(output)
 		w.Header().Add("Content-Type", "application/json")
@@ -93,7 +121,7 @@ func TestQuery(t *testing.T) {
 	defer ts.Close()
 
 	cfg.BrokerAddr = url
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -142,8 +170,9 @@ func TestQuery(t *testing.T) {
 
 func TestQueryContextWithCancel(t *testing.T) {
 	header := []interface{}{"__time"}
+	types := [][]interface{}{{"LONG"}, {"TIMESTAMP"}}
 	mockRows := [][]interface{}{{"2015-09-12T00:46:58.771Z"}, {"2015-09-12T00:46:58.772Z"}}
-	output, _ := constructMockResults(header, mockRows)
+	output, _ := constructMockResults(header, append(types, mockRows...))
 	ts, url := startMockUnstartedServer(func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(time.Second * 2)
 		_, _ = w.Write(output)
@@ -154,7 +183,7 @@ func TestQueryContextWithCancel(t *testing.T) {
 
 	cfg.BrokerAddr = url
 
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -176,15 +205,16 @@ func TestQueryContextWithCancel(t *testing.T) {
 
 func TestQueryWithoutCancellation(t *testing.T) {
 	header := []interface{}{"__time"}
+	types := [][]interface{}{{"LONG"}, {"TIMESTAMP"}}
 	mockRows := [][]interface{}{{"2015-09-12T00:46:58.771Z"}, {"2015-09-12T00:46:58.772Z"}}
-	output, _ := constructMockResults(header, mockRows)
+	output, _ := constructMockResults(header, append(types, mockRows...))
 	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write(output)
 		w.Header().Add("Content-Type", "application/json")
 	})
 	defer ts.Close()
 	cfg.BrokerAddr = url
-	db, err := sql.Open("druid", cfg.FormatDSN())
+	db, err := sql.Open("druid", mustFormatDSN(t, &cfg))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1,100 +1,776 @@
 package dsql
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config represents a struct to a druid database
 type Config struct {
-	User          string
-	Passwd        string
-	BrokerAddr    string
+	User       string
+	Passwd     string
+	BrokerAddr string
+
+	// PasswordProvider is asked for the password of every request instead
+	// of using Passwd, so a secret can be fetched from a vault and rotated
+	// without reconnecting. It can't be set through a DSN
+	PasswordProvider PasswordProvider
+
+	// Brokers are further broker addresses queries can be sent to, in the
+	// same form as BrokerAddr
+	Brokers       []string
 	PingEndpoint  string
 	QueryEndpoint string
 
-	// DateFormat for the date field, i.e iso, auto etc
+	// NativeEndpoint is where native JSON queries are sent. Defaults to
+	// /druid/v2
+	NativeEndpoint string
+
+	// TaskEndpoint is where ExecContext submits SQL ingestion statements,
+	// i.e INSERT and REPLACE, as tasks. Defaults to /druid/v2/sql/task
+	TaskEndpoint string
+
+	// OverlordAddr is where the status and reports of tasks are requested,
+	// in the same form as BrokerAddr. Defaults to BrokerAddr, which works
+	// when it's a router
+	OverlordAddr string
+
+	// CoordinatorAddr is where the loading of segments is polled from, in
+	// the same form as BrokerAddr. Defaults to OverlordAddr, which works
+	// when it's a router or a coordinator running as overlord
+	CoordinatorAddr string
+
+	// DateFormat is how DateField columns are decoded: iso (ISO 8601
+	// strings or epoch milliseconds, the default), millis, seconds, or a Go
+	// time layout such as 2006-01-02. TIMESTAMP and DATE columns are always
+	// returned as time.Time, this is for columns druid doesn't type as times
 	DateFormat string
 
-	// DateField field to use as the date field
+	// DateField is a comma separated list of further columns to return as
+	// time.Time, parsed with DateFormat
 	DateField string
 
+	// Location is the time zone timestamps are returned in and times
+	// without an offset are read in. Defaults to TimeZone, or UTC
+	Location *time.Location
+
+	// TimeZone is the zone queries run in. It's sent as druid's sqlTimeZone
+	// so days are bucketed in it, time.Time parameters are sent as literals
+	// in it and timestamps are returned in it. WithTimeZone overrides it for
+	// a single query. UTC when nil. Zones are sent by their IANA name, or
+	// as an offset like +05:30 when they have a fixed one, so time.Local
+	// and zones from time.FixedZone work whatever they're called
+	TimeZone *time.Location
+
 	// Smile is whether smile encoding is enabled or not when
 	// requesting data from Druid
 	Smile bool
 
 	// UseSSL determines whether to use SSL or not
 	UseSSL bool
+
+	// TLSSkipVerify disables verification of the brokers' certificates
+	TLSSkipVerify bool
+
+	// TLSCAFile is a PEM file of certificate authorities trusted to sign the
+	// brokers' certificates, instead of the system pool
+	TLSCAFile string
+
+	// Timeout bounds every request sent to druid, 0 doesn't time out
+	Timeout time.Duration
+
+	// DialTimeout bounds establishing a connection to a broker, 0 uses the
+	// default of 30s
+	DialTimeout time.Duration
+
+	// QueryContext is sent as the druid query context of every query, values
+	// set with WithQueryContext take precedence
+	QueryContext map[string]interface{}
+
+	// Logger receives the driver's log output, nothing is logged when it's nil.
+	// It can't be set through a DSN, use NewConnector with sql.OpenDB instead
+	Logger Logger
+
+	// LogMaxBytes is how much of a query or response body is written at debug
+	// level, 0 uses a default of 1024 bytes and a negative value logs everything
+	LogMaxBytes int
+
+	// Cache caches query results client-side when set, see NewCache
+	Cache *Cache
+
+	// CoalesceQueries makes identical queries that run concurrently on
+	// connections of the same connector share a single request to druid.
+	// The shared request's context carries none of the callers' values, so
+	// an Authenticator or PasswordProvider can't depend on them
+	CoalesceQueries bool
+
+	// HedgeDelay sends a second copy of a query to another broker when the
+	// first hasn't returned headers after this long. Requires Brokers
+	HedgeDelay time.Duration
+
+	// HedgePercentile derives the hedge delay from the observed latency of
+	// recent queries instead, e.g. 0.95. HedgeDelay is used until enough
+	// queries have been seen
+	HedgePercentile float64
+
+	// HedgeBudget is the highest fraction of queries that may be hedged so
+	// a struggling cluster doesn't receive double the load. Defaults to 0.1
+	HedgeBudget float64
+
+	// Limiter bounds how many queries run at once and how quickly they
+	// start when set, see NewLimiter
+	Limiter *Limiter
+
+	// BreakerFailures opens a broker's circuit breaker after this many
+	// consecutive failed requests. Requests to it then fail fast with
+	// ErrCircuitOpen until BreakerCooldown has passed
+	BreakerFailures int
+
+	// BreakerErrorRate opens a broker's circuit breaker once this fraction
+	// of its last BreakerWindow requests have failed, e.g. 0.5
+	BreakerErrorRate float64
+
+	// BreakerWindow is how many recent requests BreakerErrorRate is computed
+	// over, defaults to 20
+	BreakerWindow int
+
+	// BreakerCooldown is how long a circuit stays open before a single probe
+	// request is let through to test the broker, defaults to 30s
+	BreakerCooldown time.Duration
 }
 
-// FormatDSN formats a data source name from a config struct
-func (c *Config) FormatDSN() (dsn string) {
-	if c.BrokerAddr == "" {
-		log.Fatal("druid: you must specify a brokeraddr")
+// ErrInvalidDSN is returned when a data source name can't be parsed
+var ErrInvalidDSN = errors.New("druid: invalid dsn")
+
+// dsnParam maps a DSN query parameter to a Config field
+type dsnParam struct {
+	name   string
+	format func(c *Config) string
+	parse  func(c *Config, value string) error
+
+	// check, when set, reports why format can't represent the field
+	check func(c *Config) error
+}
+
+// dsnParams are the DSN query parameters in the order FormatDSN writes them
+var dsnParams = []dsnParam{
+	stringParam("pingEndpoint", func(c *Config) *string { return &c.PingEndpoint }),
+	stringParam("queryEndpoint", func(c *Config) *string { return &c.QueryEndpoint }),
+	stringParam("nativeEndpoint", func(c *Config) *string { return &c.NativeEndpoint }),
+	stringParam("taskEndpoint", func(c *Config) *string { return &c.TaskEndpoint }),
+	stringParam("overlord", func(c *Config) *string { return &c.OverlordAddr }),
+	stringParam("coordinator", func(c *Config) *string { return &c.CoordinatorAddr }),
+	boolParam("tls", func(c *Config) *bool { return &c.UseSSL }),
+	boolParam("tlsSkipVerify", func(c *Config) *bool { return &c.TLSSkipVerify }),
+	stringParam("tlsCAFile", func(c *Config) *string { return &c.TLSCAFile }),
+	durationParam("timeout", func(c *Config) *time.Duration { return &c.Timeout }),
+	durationParam("dialTimeout", func(c *Config) *time.Duration { return &c.DialTimeout }),
+	stringParam("dateFormat", func(c *Config) *string { return &c.DateFormat }),
+	stringParam("dateField", func(c *Config) *string { return &c.DateField }),
+	locationParam("loc", func(c *Config) **time.Location { return &c.Location }),
+	locationParam("timeZone", func(c *Config) **time.Location { return &c.TimeZone }),
+	boolParam("smile", func(c *Config) *bool { return &c.Smile }),
+	intParam("logMaxBytes", func(c *Config) *int { return &c.LogMaxBytes }),
+	boolParam("coalesce", func(c *Config) *bool { return &c.CoalesceQueries }),
+	durationParam("hedgeDelay", func(c *Config) *time.Duration { return &c.HedgeDelay }),
+	floatParam("hedgePercentile", func(c *Config) *float64 { return &c.HedgePercentile }),
+	floatParam("hedgeBudget", func(c *Config) *float64 { return &c.HedgeBudget }),
+	intParam("breakerFailures", func(c *Config) *int { return &c.BreakerFailures }),
+	floatParam("breakerErrorRate", func(c *Config) *float64 { return &c.BreakerErrorRate }),
+	intParam("breakerWindow", func(c *Config) *int { return &c.BreakerWindow }),
+	durationParam("breakerCooldown", func(c *Config) *time.Duration { return &c.BreakerCooldown }),
+}
+
+// dsnAliases are parameter names accepted for compatibility with older DSNs
+var dsnAliases = map[string]string{
+	"sslenable": "tls",
+}
+
+// queryContextPrefix prefixes DSN parameters holding QueryContext entries
+const queryContextPrefix = "ctx."
+
+func stringParam(name string, field func(c *Config) *string) dsnParam {
+	return dsnParam{
+		name:   name,
+		format: func(c *Config) string { return *field(c) },
+		parse: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
 	}
+}
 
-	var auth string
-	if c.User != "" && c.Passwd != "" {
-		auth = fmt.Sprintf("%s:%s@", c.User, c.Passwd)
+func boolParam(name string, field func(c *Config) *bool) dsnParam {
+	return dsnParam{
+		name: name,
+		format: func(c *Config) string {
+			if *field(c) {
+				return "true"
+			}
+			return ""
+		},
+		parse: func(c *Config, value string) (err error) {
+			*field(c), err = strconv.ParseBool(value)
+			return err
+		},
 	}
+}
 
-	pingEndpoint := c.PingEndpoint
-	if pingEndpoint == "" {
-		pingEndpoint = "/status/health"
+func intParam(name string, field func(c *Config) *int) dsnParam {
+	return dsnParam{
+		name: name,
+		format: func(c *Config) string {
+			if *field(c) == 0 {
+				return ""
+			}
+			return strconv.Itoa(*field(c))
+		},
+		parse: func(c *Config, value string) (err error) {
+			*field(c), err = strconv.Atoi(value)
+			return err
+		},
 	}
+}
 
-	queryEndpoint := c.QueryEndpoint
-	if queryEndpoint == "" {
-		queryEndpoint = "/druid/v2/sql"
+func floatParam(name string, field func(c *Config) *float64) dsnParam {
+	return dsnParam{
+		name: name,
+		format: func(c *Config) string {
+			if *field(c) == 0 {
+				return ""
+			}
+			return strconv.FormatFloat(*field(c), 'g', -1, 64)
+		},
+		parse: func(c *Config, value string) (err error) {
+			*field(c), err = strconv.ParseFloat(value, 64)
+			return err
+		},
 	}
+}
 
-	sslEnabled := "false"
-	if c.UseSSL {
-		sslEnabled = "true"
+func durationParam(name string, field func(c *Config) *time.Duration) dsnParam {
+	return dsnParam{
+		name: name,
+		format: func(c *Config) string {
+			if *field(c) == 0 {
+				return ""
+			}
+			return field(c).String()
+		},
+		parse: func(c *Config, value string) (err error) {
+			*field(c), err = time.ParseDuration(value)
+			return err
+		},
 	}
+}
 
-	return fmt.Sprintf("%s%s?pingEndpoint=%s&queryEndpoint=%s&sslenable=%s", auth, c.BrokerAddr, pingEndpoint, queryEndpoint, sslEnabled)
+func locationParam(name string, field func(c *Config) **time.Location) dsnParam {
+	return dsnParam{
+		name: name,
+		format: func(c *Config) string {
+			if *field(c) == nil {
+				return ""
+			}
+			return (*field(c)).String()
+		},
+		parse: func(c *Config, value string) (err error) {
+			*field(c), err = loadTimeZone(value)
+			return err
+		},
+		check: func(c *Config) error {
+			loc := *field(c)
+			if loc == nil {
+				return nil
+			}
+			loaded, err := loadTimeZone(loc.String())
+			if err != nil || !reflect.DeepEqual(loc, loaded) {
+				return fmt.Errorf("time zone %q doesn't load back as the same zone, use an IANA name or an offset such as +05:30 as its name", loc.String())
+			}
+			return nil
+		},
+	}
+}
+
+// String formats the config as a DSN with the password redacted, so a
+// config can be printed or logged without leaking it. Settings FormatDSN
+// would reject are formatted as well as they can be
+func (c Config) String() string {
+	if c.Passwd != "" {
+		c.Passwd = redacted
+	}
+	dsn, _ := c.formatDSN()
+	return c.redact(dsn)
+}
+
+// GoString redacts the password from %#v output as well
+func (c Config) GoString() string {
+	return "dsql.Config(" + strconv.Quote(c.String()) + ")"
+}
+
+// FormatDSN formats a data source name from a config struct, in the form
+// ParseDSN reads, so ParseDSN returns an equal config. Options left at
+// their zero value are omitted, and Logger, PasswordProvider, Cache and
+// Limiter can't be expressed in a DSN so they're dropped. It returns
+// ErrInvalidDSN for settings a DSN can't carry: brokers with different
+// schemes or paths, credentials in an address, time zones whose name
+// doesn't load back, and query context values of other types than ParseDSN
+// returns. The password is included, use String for output that may be
+// logged
+func (c *Config) FormatDSN() (string, error) {
+	dsn, err := c.formatDSN()
+	if err != nil {
+		return "", wrapErr(ErrInvalidDSN, err)
+	}
+	return dsn, nil
 }
 
-// ParseDSN returns a config struct from a dsn string
-func ParseDSN(dsn string) *Config {
+// formatDSN formats the DSN of c, along with the first reason it doesn't
+// represent c exactly
+func (c *Config) formatDSN() (string, error) {
+	var b strings.Builder
+	var invalid error
+	fail := func(err error) {
+		if invalid == nil {
+			invalid = err
+		}
+	}
+	if err := c.validate(); err != nil {
+		fail(err)
+	}
+
+	scheme, broker := splitScheme(c.BrokerAddr)
+	switch scheme {
+	case "":
+		scheme = "druid"
+	case "http", "https":
+	default:
+		fail(fmt.Errorf("scheme %q of brokeraddr", scheme))
+	}
+	host, path := splitPath(broker)
+	if strings.Contains(host, "@") {
+		fail(errors.New("credentials in brokeraddr, set User and Passwd instead"))
+	}
+
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if c.User != "" || c.Passwd != "" {
+		if c.Passwd != "" {
+			b.WriteString(url.UserPassword(c.User, c.Passwd).String())
+		} else {
+			b.WriteString(url.User(c.User).String())
+		}
+		b.WriteString("@")
+	}
+	b.WriteString(host)
+	brokerScheme, _ := splitScheme(c.BrokerAddr)
+	for _, other := range c.Brokers {
+		otherScheme, rest := splitScheme(other)
+		otherHost, otherPath := splitPath(rest)
+		switch {
+		case otherScheme != brokerScheme || otherPath != path:
+			fail(fmt.Errorf("broker %s doesn't share the scheme and path of brokeraddr", c.redact(other)))
+		case strings.Contains(otherHost, "@"):
+			fail(errors.New("credentials in a broker address, set User and Passwd instead"))
+		}
+		b.WriteString(",")
+		b.WriteString(otherHost)
+	}
+	b.WriteString(path)
+
+	params := make(map[string]string)
+	var names []string
+	for _, p := range dsnParams {
+		if p.check != nil {
+			if err := p.check(c); err != nil {
+				fail(fmt.Errorf("%s: %v", p.name, err))
+			}
+		}
+		if value := p.format(c); value != "" {
+			params[p.name] = value
+			names = append(names, p.name)
+		}
+	}
+
+	var contextKeys []string
+	for k := range c.QueryContext {
+		contextKeys = append(contextKeys, k)
+	}
+	sort.Strings(contextKeys)
+	for _, k := range contextKeys {
+		value, err := formatContextValue(c.QueryContext[k])
+		if err != nil {
+			fail(fmt.Errorf("%s%s: %v", queryContextPrefix, k, err))
+		}
+		params[queryContextPrefix+k] = value
+		names = append(names, queryContextPrefix+k)
+	}
+
+	for i, name := range names {
+		if i == 0 {
+			b.WriteString("?")
+		} else {
+			b.WriteString("&")
+		}
+		b.WriteString(escapeParam(name))
+		b.WriteString("=")
+		b.WriteString(escapeParam(params[name]))
+	}
+
+	return b.String(), invalid
+}
+
+// ParseDSN returns a config struct from a dsn string of the form
+//
+//	[scheme://][user[:password]@]host[:port][,host[:port]...][/path][?param=value&...]
+//
+// scheme is druid, http or https and defaults to druid. An http or https
+// scheme is kept on the broker addresses, with druid the scheme is picked
+// by the tls parameter. user and password must be URL escaped. The first
+// host becomes BrokerAddr and the others Brokers, path applies to all of them.
+//
+// Parameters, all optional:
+//
+//	pingEndpoint      health endpoint used by Ping, default /status/health
+//	queryEndpoint     SQL endpoint, default /druid/v2/sql
+//	nativeEndpoint    native query endpoint, default /druid/v2
+//	taskEndpoint      SQL task endpoint ingestion is submitted to, default /druid/v2/sql/task
+//	overlord          address task statuses and reports are requested from, default the broker
+//	coordinator       address segment loading is polled from, default the overlord
+//	tls               true to use https with the druid scheme (sslenable is accepted too)
+//	tlsSkipVerify     true to skip verifying broker certificates
+//	tlsCAFile         PEM file of trusted certificate authorities
+//	timeout           bound on each request, as a Go duration i.e 30s
+//	dialTimeout       bound on connecting to a broker, as a Go duration
+//	dateFormat        format of the date fields: iso, millis, seconds or a Go layout
+//	dateField         comma separated columns converted to time.Time
+//	loc               time zone timestamps are returned in, i.e Europe/London
+//	timeZone          time zone queries run in, sent as sqlTimeZone, i.e -05:00
+//	smile             true to request Jackson Smile encoded responses
+//	logMaxBytes       bytes of query and response bodies logged at debug level
+//	coalesce          true to share one request between identical concurrent queries
+//	hedgeDelay        delay before hedging a query to another broker
+//	hedgePercentile   latency percentile used as the hedge delay, i.e 0.95
+//	hedgeBudget       highest fraction of queries hedged
+//	breakerFailures   consecutive failures that open a broker's circuit
+//	breakerErrorRate  failure rate that opens a broker's circuit
+//	breakerWindow     requests the failure rate is computed over
+//	breakerCooldown   time a circuit stays open before being probed
+//	ctx.<key>         default query context entry, i.e ctx.priority=10. true
+//	                  and false become booleans, integers int64, other
+//	                  numbers float64, "quoted" values strings with Go
+//	                  escapes, int(10), int32(10), uint64(10), float32(1.5)
+//	                  and the like the named Go type, and anything else a
+//	                  string
+//
+// Unknown or repeated parameters and invalid values are errors.
+func ParseDSN(dsn string) (*Config, error) {
 	cfg := &Config{}
-	u, err := url.Parse(dsn)
+	rest := dsn
+
+	scheme := ""
+	if i := strings.Index(rest, "://"); i >= 0 {
+		scheme, rest = strings.ToLower(rest[:i]), rest[i+3:]
+	} else {
+		rest = strings.TrimPrefix(rest, "//")
+	}
+	switch scheme {
+	case "", "druid":
+		scheme = ""
+	case "http", "https":
+	default:
+		return nil, wrapErr(ErrInvalidDSN, fmt.Errorf("unsupported scheme %q", scheme))
+	}
+
+	rawQuery := ""
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, rawQuery = rest[:i], rest[i+1:]
+	}
+
+	authority, path := splitPath(rest)
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		var userinfo string
+		userinfo, authority = authority[:i], authority[i+1:]
+
+		user, pass := userinfo, ""
+		if j := strings.Index(userinfo, ":"); j >= 0 {
+			user, pass = userinfo[:j], userinfo[j+1:]
+		}
+
+		var err error
+		if cfg.User, err = url.PathUnescape(user); err != nil {
+			return nil, wrapErr(ErrInvalidDSN, fmt.Errorf("user: %v", err))
+		}
+		if cfg.Passwd, err = url.PathUnescape(pass); err != nil {
+			return nil, wrapErr(ErrInvalidDSN, errors.New("password is not correctly escaped"))
+		}
+	}
+
+	prefix := ""
+	if scheme != "" {
+		prefix = scheme + "://"
+	}
+	for i, host := range strings.Split(authority, ",") {
+		if err := validateHost(host); err != nil {
+			return nil, wrapErr(ErrInvalidDSN, err)
+		}
+		if i == 0 {
+			cfg.BrokerAddr = prefix + host + path
+		} else {
+			cfg.Brokers = append(cfg.Brokers, prefix+host+path)
+		}
+	}
+
+	if err := parseDSNParams(cfg, rawQuery); err != nil {
+		return nil, wrapErr(ErrInvalidDSN, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, wrapErr(ErrInvalidDSN, err)
+	}
+
+	return cfg, nil
+}
+
+func parseDSNParams(cfg *Config, rawQuery string) error {
+	values, err := url.ParseQuery(rawQuery)
 	if err != nil {
-		log.Println("dsn:", dsn)
-		log.Fatal("error parsing dsn", err)
+		return err
 	}
 
-	q := u.Query()
+	byName := make(map[string]dsnParam, len(dsnParams))
+	for _, p := range dsnParams {
+		byName[p.name] = p
+	}
+
+	seen := make(map[string]bool)
+	for name, vals := range values {
+		canonical := name
+		if alias, ok := dsnAliases[name]; ok {
+			canonical = alias
+		}
+		if len(vals) > 1 || seen[canonical] {
+			return fmt.Errorf("parameter %q is repeated", name)
+		}
+		seen[canonical] = true
+
+		if strings.HasPrefix(name, queryContextPrefix) && len(name) > len(queryContextPrefix) {
+			if cfg.QueryContext == nil {
+				cfg.QueryContext = make(map[string]interface{})
+			}
+			value, err := parseContextValue(vals[0])
+			if err != nil {
+				return fmt.Errorf("parameter %q: %v", name, err)
+			}
+			cfg.QueryContext[name[len(queryContextPrefix):]] = value
+			continue
+		}
 
-	isHttps := false
-	if ssl, ok := q["sslenable"]; ok {
-		if ssl[0] == "true" {
-			isHttps = true
+		p, ok := byName[canonical]
+		if !ok {
+			return fmt.Errorf("unknown parameter %q", name)
+		}
+		if err := p.parse(cfg, vals[0]); err != nil {
+			return fmt.Errorf("parameter %q: %v", name, err)
 		}
 	}
 
-	u.Scheme = "http"
-	if isHttps {
-		u.Scheme = "https"
+	return nil
+}
 
+// contextConversions are the Go types of query context values a DSN
+// writes as conversions, i.e int(10), as bare numbers are int64 or float64
+var contextConversions = map[string]reflect.Type{}
+
+func init() {
+	for _, v := range []interface{}{int(0), int8(0), int16(0), int32(0), uint(0), uint8(0), uint16(0), uint32(0), uint64(0), float32(0)} {
+		contextConversions[reflect.TypeOf(v).Name()] = reflect.TypeOf(v)
 	}
-	cfg.PingEndpoint = q.Get("pingEndpoint")
-	cfg.QueryEndpoint = q.Get("queryEndpoint")
-	cfg.User = u.User.Username()
-	pass, _ := u.User.Password()
-	cfg.Passwd = pass
+}
 
-	credentials := ""
-	if cfg.User != "" && cfg.Passwd != "" {
-		credentials = fmt.Sprintf("%s:%s@", cfg.User, cfg.Passwd)
+// convertContextValue parses s as a value of type t
+func convertContextValue(t reflect.Type, s string) (interface{}, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Float32:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return nil, err
+		}
+		v.SetFloat(f)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetUint(u)
+	default:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetInt(i)
 	}
+	return v.Interface(), nil
+}
+
+// conversionPattern matches a query context value written as a conversion
+var conversionPattern = regexp.MustCompile(`^([a-z0-9]+)\((.*)\)$`)
 
-	cfg.BrokerAddr = fmt.Sprintf("%s://%s%s%s", u.Scheme, credentials, u.Hostname(), u.Path)
-	if u.Port() != "" {
-		cfg.BrokerAddr = fmt.Sprintf("%s://%s%s:%s%s", u.Scheme, credentials, u.Hostname(), u.Port(), u.Path)
+// parseContextValue converts a query context value from a DSN to the type
+// druid expects: true and false are booleans, integers int64, other numbers
+// float64, int(10) and the like the named Go type, and double quoted values
+// strings with Go escapes. Anything else is a string as it's written
+func parseContextValue(value string) (interface{}, error) {
+	if value == "true" || value == "false" {
+		return value == "true", nil
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", value)
+		}
+		return s, nil
+	}
+	if m := conversionPattern.FindStringSubmatch(value); m != nil {
+		if t, ok := contextConversions[m[1]]; ok {
+			v, err := convertContextValue(t, m[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", value)
+			}
+			return v, nil
+		}
+	}
+	return value, nil
+}
+
+// formatContextValue writes a query context value so parseContextValue
+// returns it with the same type and value
+func formatContextValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if parsed, err := parseContextValue(v); err != nil || parsed != v {
+			return strconv.Quote(v), nil
+		}
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("%v isn't a number druid accepts", v)
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s, nil
+	case float32:
+		return "float32(" + strconv.FormatFloat(float64(v), 'g', -1, 32) + ")", nil
+	case int, int8, int16, int32, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%T(%d)", v, v), nil
+	}
+	return "", fmt.Errorf("values of type %T can't be expressed in a DSN", value)
+}
+
+// validate checks the config's values are within range
+func (c *Config) validate() error {
+	if c.BrokerAddr == "" {
+		return errors.New("you must specify a brokeraddr")
+	}
+
+	if !validDateFormat(c.DateFormat) {
+		return fmt.Errorf("unsupported dateFormat %q", c.DateFormat)
+	}
+
+	for name, d := range map[string]time.Duration{
+		"timeout":         c.Timeout,
+		"dialTimeout":     c.DialTimeout,
+		"hedgeDelay":      c.HedgeDelay,
+		"breakerCooldown": c.BreakerCooldown,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
 	}
 
-	return cfg
+	for name, f := range map[string]float64{
+		"hedgePercentile":  c.HedgePercentile,
+		"hedgeBudget":      c.HedgeBudget,
+		"breakerErrorRate": c.BreakerErrorRate,
+	} {
+		if f < 0 || f > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	}
+
+	if c.BreakerFailures < 0 || c.BreakerWindow < 0 {
+		return errors.New("breakerFailures and breakerWindow must not be negative")
+	}
+
+	return nil
+}
+
+// validateHost checks host is a hostname or IP with an optional numeric port
+func validateHost(host string) error {
+	if host == "" {
+		return errors.New("missing broker address")
+	}
+
+	name, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return fmt.Errorf("invalid broker address %q", host)
+		}
+		name, port = host[:end+1], strings.TrimPrefix(host[end+1:], ":")
+	} else if i := strings.LastIndex(host, ":"); i >= 0 {
+		name, port = host[:i], host[i+1:]
+	}
+
+	if name == "" || strings.ContainsAny(name, "/?#@ ") {
+		return fmt.Errorf("invalid broker address %q", host)
+	}
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port in broker address %q", host)
+		}
+	}
+	return nil
+}
+
+// escapeParam query escapes s, leaving slashes and colons readable as they're
+// common in endpoints and durations
+func escapeParam(s string) string {
+	return strings.NewReplacer("%2F", "/", "%3A", ":").Replace(url.QueryEscape(s))
+}
+
+// splitScheme splits addr into its scheme, if any, and the remainder
+func splitScheme(addr string) (scheme, rest string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "", addr
+}
+
+// splitPath splits host[:port]/path at the first slash
+func splitPath(addr string) (host, path string) {
+	if i := strings.Index(addr, "/"); i >= 0 {
+		return addr[:i], addr[i:]
+	}
+	return addr, ""
 }
@@ -0,0 +1,293 @@
+package dsql
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHedgeBudget is the fraction of queries hedged when Config.HedgeBudget is 0
+	defaultHedgeBudget = 0.1
+
+	// hedgeBurst is how many hedges can be saved up by a quiet connector
+	hedgeBurst = 10
+
+	// latencyWindow is how many recent latencies HedgePercentile is computed over
+	latencyWindow = 512
+
+	// minLatencySamples is how many latencies are needed before HedgePercentile is used
+	minLatencySamples = 20
+
+	// cancelTimeout bounds the request cancelling a losing query on its broker
+	cancelTimeout = 5 * time.Second
+)
+
+// hedger decides when a query gets a second copy sent to another broker
+type hedger struct {
+	delay      time.Duration
+	percentile float64
+	budget     float64
+	brokers    []string
+
+	mtx       sync.Mutex
+	tokens    float64
+	latencies []time.Duration
+	nextLat   int
+	nextHedge int
+}
+
+// newHedger returns a hedger for cfg, or nil when hedging isn't configured
+func newHedger(cfg *Config) *hedger {
+	if len(cfg.Brokers) == 0 || (cfg.HedgeDelay <= 0 && cfg.HedgePercentile <= 0) {
+		return nil
+	}
+
+	budget := cfg.HedgeBudget
+	if budget <= 0 {
+		budget = defaultHedgeBudget
+	}
+
+	return &hedger{
+		delay:      cfg.HedgeDelay,
+		percentile: cfg.HedgePercentile,
+		budget:     budget,
+		brokers:    cfg.Brokers,
+	}
+}
+
+// hedgeDelay returns how long to wait before hedging, false when the query
+// shouldn't be hedged at all
+func (h *hedger) hedgeDelay() (time.Duration, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.percentile > 0 && len(h.latencies) >= minLatencySamples {
+		sorted := make([]time.Duration, len(h.latencies))
+		copy(sorted, h.latencies)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		return sorted[int(h.percentile*float64(len(sorted)-1))], true
+	}
+
+	return h.delay, h.delay > 0
+}
+
+// observe records how long a broker took to return headers
+func (h *hedger) observe(d time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if len(h.latencies) < latencyWindow {
+		h.latencies = append(h.latencies, d)
+		return
+	}
+	h.latencies[h.nextLat] = d
+	h.nextLat = (h.nextLat + 1) % latencyWindow
+}
+
+// credit earns a fraction of a hedge for every query sent
+func (h *hedger) credit() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.tokens += h.budget
+	if h.tokens > hedgeBurst {
+		h.tokens = hedgeBurst
+	}
+}
+
+// take spends a hedge from the budget and returns the broker to send it to
+func (h *hedger) take() (string, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.tokens < 1 {
+		return "", false
+	}
+	h.tokens--
+
+	broker := h.brokers[h.nextHedge%len(h.brokers)]
+	h.nextHedge++
+	return broker, true
+}
+
+// attempt is the outcome of one copy of a hedged query
+type attempt struct {
+	broker  string
+	queryID string
+	res     *http.Response
+	err     error
+	cancel  context.CancelFunc
+}
+
+// ok reports whether the attempt can be used as the query's response
+func (a *attempt) ok() bool {
+	return a.err == nil && a.res.StatusCode < http.StatusInternalServerError
+}
+
+// cancelOnClose releases a request's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// hedgedRoundTrip sends request to BrokerAddr and, when no headers have come
+// back within the hedge delay, a copy to another broker. The first usable
+// response wins and the other copy is cancelled on its broker
+func (c *connection) hedgedRoundTrip(ctx context.Context, h *hedger, request *queryRequest) (*http.Response, error) {
+	h.credit()
+
+	delay, ok := h.hedgeDelay()
+	if !ok {
+		start := time.Now()
+		res, err := c.roundTrip(ctx, c.Cfg.BrokerAddr, request)
+		if err == nil {
+			h.observe(time.Since(start))
+		}
+		return res, err
+	}
+
+	results := make(chan *attempt, 2)
+	var launched []*attempt
+	launch := func(broker string, queryID string) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		a := &attempt{broker: broker, queryID: queryID, cancel: cancel}
+		launched = append(launched, a)
+		start := time.Now()
+		go func() {
+			a.res, a.err = c.roundTrip(attemptCtx, broker, withQueryID(request, queryID))
+			if a.err == nil {
+				h.observe(time.Since(start))
+			}
+			results <- a
+		}()
+	}
+
+	primaryID, _ := request.Context["sqlQueryId"].(string)
+	if primaryID == "" {
+		primaryID = newQueryID()
+	}
+	launch(c.Cfg.BrokerAddr, primaryID)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var last *attempt
+	for received := 0; ; {
+		select {
+		case <-timer.C:
+			if received > 0 {
+				continue
+			}
+			if broker, ok := h.take(); ok {
+				c.Cfg.logger().Log(LevelInfo, "druid: hedging query", "broker", c.Cfg.redact(broker), "after", delay)
+				launch(broker, primaryID+"-hedge")
+			}
+		case a := <-results:
+			received++
+			if a.ok() {
+				if last != nil {
+					last.discard()
+				}
+				c.abandon(launched, a, last, results, len(launched)-received)
+				a.res.Body = &cancelOnClose{ReadCloser: a.res.Body, cancel: a.cancel}
+				return a.res, nil
+			}
+
+			if last != nil {
+				last.discard()
+			}
+			last = a
+			if received == len(launched) {
+				return last.response()
+			}
+		case <-ctx.Done():
+			for _, a := range launched {
+				a.cancel()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// response returns the attempt's result so a failed status can still be reported
+func (a *attempt) response() (*http.Response, error) {
+	if a.err != nil {
+		a.cancel()
+		return nil, a.err
+	}
+	a.res.Body = &cancelOnClose{ReadCloser: a.res.Body, cancel: a.cancel}
+	return a.res, nil
+}
+
+// discard releases an attempt that won't be used
+func (a *attempt) discard() {
+	if a.res != nil {
+		a.res.Body.Close()
+	}
+	a.cancel()
+}
+
+// abandon cancels the copies still running once winner has been picked,
+// both locally and on their broker so it stops working on the query
+func (c *connection) abandon(launched []*attempt, winner *attempt, failed *attempt, results chan *attempt, pending int) {
+	for _, a := range launched {
+		if a == winner || a == failed {
+			continue
+		}
+		a.cancel()
+		go c.cancelQuery(a.broker, a.queryID)
+	}
+
+	go func() {
+		for i := 0; i < pending; i++ {
+			(<-results).discard()
+		}
+	}()
+}
+
+// withQueryID returns a copy of request whose query context carries queryID
+func withQueryID(request *queryRequest, queryID string) *queryRequest {
+	copied := *request
+	copied.Context = make(map[string]interface{}, len(request.Context)+1)
+	for k, v := range request.Context {
+		copied.Context[k] = v
+	}
+	copied.Context["sqlQueryId"] = queryID
+	return &copied
+}
+
+// cancelQuery asks broker to stop running the query with the given sqlQueryId
+// https://druid.apache.org/docs/latest/api-reference/sql-api.html#cancel-a-query
+func (c *connection) cancelQuery(broker string, queryID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	cancelURL := fmt.Sprintf("%s%s/%s", broker, c.Cfg.QueryEndpoint, url.PathEscape(queryID))
+	req, err := http.NewRequest(http.MethodDelete, cancelURL, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	if err := c.connector.authenticate(req); err != nil {
+		return
+	}
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		c.Cfg.logger().Log(LevelWarn, "druid: failed to cancel query", "broker", c.Cfg.redact(broker), "sqlQueryId", queryID, "error", c.Cfg.redact(err.Error()))
+		return
+	}
+	res.Body.Close()
+}
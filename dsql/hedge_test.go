@@ -0,0 +1,87 @@
+package dsql
+
+import (
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgerBudget(t *testing.T) {
+	h := newHedger(&Config{Brokers: []string{"http://b"}, HedgeDelay: time.Millisecond, HedgeBudget: 0.5})
+
+	h.credit()
+	_, ok := h.take()
+	require.False(t, ok)
+
+	h.credit()
+	broker, ok := h.take()
+	require.True(t, ok)
+	require.Equal(t, "http://b", broker)
+}
+
+func TestHedgerPercentileDelay(t *testing.T) {
+	h := newHedger(&Config{Brokers: []string{"http://b"}, HedgeDelay: time.Second, HedgePercentile: 0.9})
+
+	delay, ok := h.hedgeDelay()
+	require.True(t, ok)
+	require.Equal(t, time.Second, delay)
+
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	delay, _ = h.hedgeDelay()
+	require.Equal(t, 90*time.Millisecond, delay)
+}
+
+func TestSlowBrokerIsHedged(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"channel"}, [][]interface{}{{"STRING"}, {"VARCHAR"}, {"#en.wikipedia"}})
+
+	cancelled := make(chan string, 1)
+	slow, slowURL := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			cancelled <- r.URL.Path
+			return
+		}
+		// The request has to be read before the server notices it's cancelled
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer slow.Close()
+
+	fast, fastURL := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer fast.Close()
+
+	connector, err := NewConnector(&Config{
+		BrokerAddr:  slowURL,
+		Brokers:     []string{fastURL},
+		HedgeDelay:  20 * time.Millisecond,
+		HedgeBudget: 1,
+	})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	start := time.Now()
+	var channel string
+	require.NoError(t, db.QueryRow("SELECT channel FROM wiki").Scan(&channel))
+	require.Equal(t, "#en.wikipedia", channel)
+	require.True(t, time.Since(start) < time.Second)
+
+	select {
+	case path := <-cancelled:
+		require.True(t, strings.HasPrefix(path, "/druid/v2/sql/"), path)
+	case <-time.After(time.Second):
+		t.Fatal("losing query was not cancelled on its broker")
+	}
+}
@@ -0,0 +1,27 @@
+package dsql
+
+import (
+	"context"
+	"time"
+)
+
+// Hooks are callbacks for events of a Connector, any of them can be nil.
+// They're called synchronously so they should return quickly
+type Hooks struct {
+	// QueryStart is called before a query is sent or looked up in the cache
+	QueryStart func(ctx context.Context, query string)
+
+	// QueryDone is called once a query's response has been received and parsed
+	QueryDone func(ctx context.Context, query string, duration time.Duration, err error)
+
+	// TaskSubmitted is called with the id of the task ExecContext submitted
+	// a statement as, or BulkLoad submitted a batch as. query is empty for
+	// native tasks
+	TaskSubmitted func(ctx context.Context, query string, taskID string)
+
+	// BreakerStateChange is called when a broker's circuit breaker changes state
+	BreakerStateChange func(host string, from, to BreakerState)
+
+	// HealthCheck is called with the result of each background health check
+	HealthCheck func(broker string, err error)
+}
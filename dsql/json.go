@@ -0,0 +1,164 @@
+package dsql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// druidJSONType is the native type of nested JSON columns
+const druidJSONType = "COMPLEX<json>"
+
+// JSON holds the raw text of a COMPLEX<json> column, nil when it's null.
+// Passed as a query parameter it's sent as a string for PARSE_JSON(?)
+type JSON json.RawMessage
+
+// Scan implements sql.Scanner
+func (j *JSON) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append(JSON(nil), v...)
+	case string:
+		*j = JSON(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("druid: can't scan %T into JSON: %v", src, err)
+		}
+		*j = b
+	}
+	return nil
+}
+
+// Value implements driver.Valuer
+func (j JSON) Value() (driver.Value, error) {
+	if j == nil {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+// Unmarshal decodes the JSON into v, as json.Unmarshal does
+func (j JSON) Unmarshal(v interface{}) error {
+	if j == nil {
+		return json.Unmarshal([]byte("null"), v)
+	}
+	return json.Unmarshal(j, v)
+}
+
+// MarshalJSON implements json.Marshaler
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if j == nil {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (j *JSON) UnmarshalJSON(b []byte) error {
+	*j = append((*j)[:0], b...)
+	return nil
+}
+
+// JSONInto returns a scanner decoding a column's JSON into v, which can be
+// a pointer to a struct, a map, a slice or anything else json.Unmarshal
+// accepts, e.g. rows.Scan(dsql.JSONInto(&event))
+func JSONInto(v interface{}) sql.Scanner {
+	return &jsonScanner{v: v}
+}
+
+type jsonScanner struct {
+	v interface{}
+}
+
+func (s *jsonScanner) Scan(src interface{}) error {
+	var j JSON
+	if err := j.Scan(src); err != nil {
+		return err
+	}
+	if err := j.Unmarshal(s.v); err != nil {
+		return fmt.Errorf("druid: decoding JSON column: %v", err)
+	}
+	return nil
+}
+
+// decodeJSON is json.Unmarshal keeping numbers exact: numbers in the
+// interface{} values of v decode as int64 when they're integers that fit,
+// so longs above 2^53 aren't rounded, and as float64 otherwise
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid JSON after top-level value")
+	}
+	exactNumbers(reflect.ValueOf(v))
+	return nil
+}
+
+// exactNumbers replaces the json.Numbers held by interfaces in v with
+// their int64 or float64 value
+func exactNumbers(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if n, ok := v.Elem().Interface().(json.Number); ok && v.Kind() == reflect.Interface && v.CanSet() {
+			v.Set(reflect.ValueOf(numberValue(n)))
+			return
+		}
+		exactNumbers(v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			exactNumbers(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := v.MapIndex(key)
+			if n, ok := value.Interface().(json.Number); ok {
+				v.SetMapIndex(key, reflect.ValueOf(numberValue(n)))
+				continue
+			}
+			exactNumbers(value)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				exactNumbers(v.Field(i))
+			}
+		}
+	}
+}
+
+// numberValue returns n as an int64 when it's an integer that fits one,
+// and as a float64 otherwise
+func numberValue(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
+
+// jsonValue returns the driver value of a nested JSON column, its JSON
+// text so it scans into json.RawMessage, []byte, string, JSON or JSONInto
+func jsonValue(value interface{}) (driver.Value, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("druid: encoding JSON column: %v", err)
+	}
+	return b, nil
+}
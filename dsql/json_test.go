@@ -0,0 +1,120 @@
+package dsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type event struct {
+	User struct {
+		Name string `json:"name"`
+	} `json:"user"`
+	Tags []string `json:"tags"`
+}
+
+func TestJSONColumnsScan(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"payload", "score"}, [][]interface{}{
+		{"COMPLEX<json>", "COMPLEX<json>"},
+		{"OTHER", "OTHER"},
+		{map[string]interface{}{"user": map[string]interface{}{"name": "ada"}, "tags": []interface{}{"a", "b"}}, 1.5},
+	})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	const q = "SELECT payload, JSON_VALUE(payload, '$.score') FROM t"
+
+	var raw json.RawMessage
+	var score JSON
+	require.NoError(t, db.QueryRow(q).Scan(&raw, &score))
+	require.JSONEq(t, `{"user":{"name":"ada"},"tags":["a","b"]}`, string(raw))
+	require.Equal(t, JSON("1.5"), score)
+
+	var e event
+	var f float64
+	require.NoError(t, db.QueryRow(q).Scan(JSONInto(&e), JSONInto(&f)))
+	require.Equal(t, "ada", e.User.Name)
+	require.Equal(t, []string{"a", "b"}, e.Tags)
+	require.Equal(t, 1.5, f)
+
+	var m map[string]interface{}
+	var s string
+	require.NoError(t, db.QueryRow(q).Scan(JSONInto(&m), &s))
+	require.Equal(t, "ada", m["user"].(map[string]interface{})["name"])
+	require.Equal(t, "1.5", s)
+}
+
+func TestJSONScanner(t *testing.T) {
+	var j JSON
+	require.NoError(t, j.Scan(nil))
+	require.Nil(t, j)
+	v, err := j.Value()
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	require.NoError(t, j.Scan(map[string]interface{}{"a": 1.0}))
+	require.Equal(t, JSON(`{"a":1}`), j)
+	v, err = j.Value()
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1}`, v)
+
+	out, err := json.Marshal(struct {
+		Payload JSON `json:"payload"`
+	}{j})
+	require.NoError(t, err)
+	require.Equal(t, `{"payload":{"a":1}}`, string(out))
+
+	m := map[string]interface{}{"stale": true}
+	require.NoError(t, JSONInto(&m).Scan(nil))
+	require.Nil(t, m)
+	require.Error(t, JSONInto(&m).Scan("not json"))
+}
+
+func TestSmileJSONColumnsScan(t *testing.T) {
+	// [["payload","n"],["COMPLEX<json>","LONG"],["OTHER","BIGINT"],[{"a":1},2]]
+	// encoded by hand:
+	// 0xf8/0xf9 open and close arrays, 0xfa/0xfb objects, 0x40+len-1 short
+	// ascii values, 0x80+len-1 short ascii keys and 0xc0+zigzag small ints
+	body := []byte(":)\n\x00")
+	body = append(body, 0xf8)
+	body = append(body, 0xf8, 0x46)
+	body = append(body, "payload"...)
+	body = append(body, 0x40, 'n', 0xf9)
+	body = append(body, 0xf8, 0x4c)
+	body = append(body, "COMPLEX<json>"...)
+	body = append(body, 0x43)
+	body = append(body, "LONG"...)
+	body = append(body, 0xf9)
+	body = append(body, 0xf8, 0x44)
+	body = append(body, "OTHER"...)
+	body = append(body, 0x45)
+	body = append(body, "BIGINT"...)
+	body = append(body, 0xf9)
+	body = append(body, 0xf8, 0xfa, 0x80, 'a', 0xc2, 0xfb, 0xc4, 0xf9)
+	body = append(body, 0xf9)
+
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/x-jackson-smile", r.Header.Get("Accept"))
+		_, _ = w.Write(body)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url+"?smile=true")
+	require.NoError(t, err)
+	defer db.Close()
+
+	var m map[string]int
+	var n int64
+	require.NoError(t, db.QueryRow("SELECT payload, n FROM t").Scan(JSONInto(&m), &n))
+	require.Equal(t, map[string]int{"a": 1}, m)
+	require.Equal(t, int64(2), n)
+}
@@ -0,0 +1,229 @@
+package dsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned when a query would have to wait for a slot but
+// LimiterOptions.MaxQueued callers are already waiting
+var ErrQueueFull = errors.New("druid: too many queries waiting for a slot")
+
+// LimitScope selects what a Limiter counts queries per
+type LimitScope int
+
+const (
+	// LimitAll applies a single limit to every query
+	LimitAll LimitScope = iota
+	// LimitLane applies a separate limit per druid query lane, taken from the
+	// "lane" key of the query context
+	LimitLane
+	// LimitTag applies a separate limit per caller tag, see WithCallerTag
+	LimitTag
+)
+
+// LimiterOptions configures a Limiter. A zero value for a limit disables it
+type LimiterOptions struct {
+	// MaxInFlight is how many queries can be running at once
+	MaxInFlight int
+
+	// Rate is how many queries can be started per second
+	Rate float64
+
+	// Burst is how many queries can be started at once when Rate allows it,
+	// defaults to 1
+	Burst int
+
+	// MaxQueued is how many callers can wait for a slot before further
+	// queries fail with ErrQueueFull, 0 doesn't bound the queue
+	MaxQueued int
+
+	// Scope selects whether the limits apply to all queries, or to each
+	// lane or caller tag separately
+	Scope LimitScope
+}
+
+// LimiterStats is a snapshot of a limiter's counters
+type LimiterStats struct {
+	// Admitted is how many queries have been let through
+	Admitted int64
+	// Rejected is how many queries gave up waiting or found the queue full
+	Rejected int64
+	// InFlight is how many queries are currently running
+	InFlight int
+	// Waiting is how many queries are currently queued
+	Waiting int
+	// WaitTime is the total time admitted queries spent queued
+	WaitTime time.Duration
+	// MaxWait is the longest an admitted query spent queued
+	MaxWait time.Duration
+}
+
+// Limiter bounds how many queries run at once and how quickly they start,
+// so a burst from one workload can't take all of a cluster's query capacity.
+// A single Limiter can be shared by several configs
+type Limiter struct {
+	opts LimiterOptions
+
+	mtx    sync.Mutex
+	scopes map[string]*limitScope
+	stats  LimiterStats
+	now    func() time.Time
+}
+
+// limitScope is the state of the limits for one scope key
+type limitScope struct {
+	slots  chan struct{}
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter enforcing opts
+func NewLimiter(opts LimiterOptions) *Limiter {
+	if opts.Burst <= 0 {
+		opts.Burst = 1
+	}
+	return &Limiter{
+		opts:   opts,
+		scopes: make(map[string]*limitScope),
+		now:    time.Now,
+	}
+}
+
+// Stats returns the limiter's counters
+func (l *Limiter) Stats() LimiterStats {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.stats
+}
+
+// scopeKey returns the key request is limited under
+func (l *Limiter) scopeKey(ctx context.Context, request *queryRequest) string {
+	switch l.opts.Scope {
+	case LimitLane:
+		if lane, ok := request.Context["lane"]; ok {
+			return fmt.Sprint(lane)
+		}
+	case LimitTag:
+		return callerTag(ctx)
+	}
+	return ""
+}
+
+func (l *Limiter) scope(key string) *limitScope {
+	s, ok := l.scopes[key]
+	if !ok {
+		s = &limitScope{tokens: float64(l.opts.Burst), last: l.now()}
+		if l.opts.MaxInFlight > 0 {
+			s.slots = make(chan struct{}, l.opts.MaxInFlight)
+		}
+		l.scopes[key] = s
+	}
+	return s
+}
+
+// acquire waits until request may be sent and returns a func to call once
+// it has finished
+func (l *Limiter) acquire(ctx context.Context, request *queryRequest) (release func(), err error) {
+	key := l.scopeKey(ctx, request)
+	start := l.now()
+
+	l.mtx.Lock()
+	s := l.scope(key)
+	delay := l.reserve(s)
+	mustQueue := delay > 0 || (s.slots != nil && len(s.slots) == cap(s.slots))
+	if mustQueue && l.opts.MaxQueued > 0 && l.stats.Waiting >= l.opts.MaxQueued {
+		l.unreserve(s)
+		l.stats.Rejected++
+		l.mtx.Unlock()
+		return nil, ErrQueueFull
+	}
+	l.stats.Waiting++
+	l.mtx.Unlock()
+
+	err = l.wait(ctx, s, delay)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.stats.Waiting--
+	if err != nil {
+		l.unreserve(s)
+		l.stats.Rejected++
+		return nil, err
+	}
+
+	waited := l.now().Sub(start)
+	l.stats.Admitted++
+	l.stats.InFlight++
+	l.stats.WaitTime += waited
+	if waited > l.stats.MaxWait {
+		l.stats.MaxWait = waited
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if s.slots != nil {
+				<-s.slots
+			}
+			l.mtx.Lock()
+			l.stats.InFlight--
+			l.mtx.Unlock()
+		})
+	}, nil
+}
+
+// wait sleeps out a rate limit delay, then takes a concurrency slot
+func (l *Limiter) wait(ctx context.Context, s *limitScope, delay time.Duration) error {
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if s.slots == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token from the scope's bucket, returning how long the
+// caller has to wait for it to become available
+func (l *Limiter) reserve(s *limitScope) time.Duration {
+	if l.opts.Rate <= 0 {
+		return 0
+	}
+
+	now := l.now()
+	s.tokens += now.Sub(s.last).Seconds() * l.opts.Rate
+	if s.tokens > float64(l.opts.Burst) {
+		s.tokens = float64(l.opts.Burst)
+	}
+	s.last = now
+
+	s.tokens--
+	if s.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-s.tokens / l.opts.Rate * float64(time.Second))
+}
+
+// unreserve returns a token taken by reserve for a query that didn't run
+func (l *Limiter) unreserve(s *limitScope) {
+	if l.opts.Rate > 0 {
+		s.tokens++
+	}
+}
@@ -0,0 +1,126 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterBoundsInFlight(t *testing.T) {
+	l := NewLimiter(LimiterOptions{MaxInFlight: 1, MaxQueued: 1})
+	req := &queryRequest{}
+
+	release, err := l.acquire(context.Background(), req)
+	require.NoError(t, err)
+
+	waiting := make(chan error, 1)
+	go func() {
+		release, err := l.acquire(context.Background(), req)
+		if err == nil {
+			release()
+		}
+		waiting <- err
+	}()
+
+	require.Eventually(t, func() bool { return l.Stats().Waiting == 1 }, time.Second, time.Millisecond)
+
+	_, err = l.acquire(context.Background(), req)
+	require.Equal(t, ErrQueueFull, err)
+
+	release()
+	require.NoError(t, <-waiting)
+
+	stats := l.Stats()
+	require.Equal(t, int64(2), stats.Admitted)
+	require.Equal(t, int64(1), stats.Rejected)
+	require.Equal(t, 0, stats.InFlight)
+	require.True(t, stats.MaxWait > 0)
+}
+
+func TestLimiterRespectsContext(t *testing.T) {
+	l := NewLimiter(LimiterOptions{MaxInFlight: 1})
+	req := &queryRequest{}
+
+	release, err := l.acquire(context.Background(), req)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, req)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, int64(1), l.Stats().Rejected)
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(LimiterOptions{Rate: 100})
+	req := &queryRequest{}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		release, err := l.acquire(context.Background(), req)
+		require.NoError(t, err)
+		release()
+	}
+	require.True(t, time.Since(start) >= 35*time.Millisecond)
+}
+
+func TestLimiterScopesByTag(t *testing.T) {
+	l := NewLimiter(LimiterOptions{MaxInFlight: 1, Scope: LimitTag})
+	req := &queryRequest{}
+
+	release, err := l.acquire(WithCallerTag(context.Background(), "batch"), req)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(WithCallerTag(context.Background(), "dashboard"), time.Second)
+	defer cancel()
+	other, err := l.acquire(ctx, req)
+	require.NoError(t, err)
+	other()
+}
+
+func TestQueriesAreLimited(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"n"}, [][]interface{}{{"LONG"}, {"BIGINT"}, {1}})
+
+	var current, peak int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	limiter := NewLimiter(LimiterOptions{MaxInFlight: 2})
+	connector, err := NewConnector(&Config{BrokerAddr: url, Limiter: limiter})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int
+			assertNoError(t, db.QueryRow("SELECT 1").Scan(&n))
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&peak))
+	require.Equal(t, int64(6), limiter.Stats().Admitted)
+}
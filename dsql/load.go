@@ -0,0 +1,639 @@
+package dsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBulkLoad is returned when rows can't be encoded for BulkLoad
+var ErrBulkLoad = errors.New("druid: can't bulk load rows")
+
+// defaultLoadBatchBytes is the size of the inline data of each task
+// BulkLoad submits, well below druid's default maximum task payload
+const defaultLoadBatchBytes = 1 << 20
+
+// segmentGranularities maps the segment granularities BulkLoad accepts to
+// their MSQ PARTITIONED BY clause
+var segmentGranularities = map[string]string{
+	"SECOND":         "'PT1S'",
+	"MINUTE":         "'PT1M'",
+	"FIVE_MINUTE":    "'PT5M'",
+	"TEN_MINUTE":     "'PT10M'",
+	"FIFTEEN_MINUTE": "'PT15M'",
+	"THIRTY_MINUTE":  "'PT30M'",
+	"HOUR":           "HOUR",
+	"SIX_HOUR":       "'PT6H'",
+	"EIGHT_HOUR":     "'PT8H'",
+	"DAY":            "DAY",
+	"WEEK":           "'P1W'",
+	"MONTH":          "MONTH",
+	"QUARTER":        "'P3M'",
+	"YEAR":           "YEAR",
+	"ALL":            "ALL TIME",
+}
+
+// segmentDurations are the lengths of the segment granularities that are
+// a fixed duration
+var segmentDurations = map[string]time.Duration{
+	"SECOND":         time.Second,
+	"MINUTE":         time.Minute,
+	"FIVE_MINUTE":    5 * time.Minute,
+	"TEN_MINUTE":     10 * time.Minute,
+	"FIFTEEN_MINUTE": 15 * time.Minute,
+	"THIRTY_MINUTE":  30 * time.Minute,
+	"HOUR":           time.Hour,
+	"SIX_HOUR":       6 * time.Hour,
+	"EIGHT_HOUR":     8 * time.Hour,
+	"DAY":            24 * time.Hour,
+}
+
+// segmentStart returns the start of the segment of granularity, other than
+// ALL, that t falls in. Segments are in UTC and weeks start on Monday, as
+// they do in druid
+func segmentStart(t time.Time, granularity string) time.Time {
+	t = t.UTC()
+	switch granularity {
+	case "WEEK":
+		day := t.Truncate(24 * time.Hour)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "MONTH":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "QUARTER":
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	case "YEAR":
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(segmentDurations[granularity])
+}
+
+// LoadMethod is how BulkLoad ingests rows
+type LoadMethod int
+
+const (
+	// LoadNative ingests rows with native index_parallel tasks submitted to
+	// the overlord
+	LoadNative LoadMethod = iota
+
+	// LoadMSQ ingests rows with SQL INSERT and REPLACE statements submitted
+	// to the SQL task endpoint
+	LoadMSQ
+)
+
+// RowSource is a source of rows for BulkLoad. Next returns the next row,
+// a struct, a pointer to one or a map, and io.EOF after the last
+type RowSource interface {
+	Next() (interface{}, error)
+}
+
+// RowSourceFunc makes a function a RowSource
+type RowSourceFunc func() (interface{}, error)
+
+// Next implements RowSource
+func (f RowSourceFunc) Next() (interface{}, error) {
+	return f()
+}
+
+// LoadResult describes what BulkLoad ingested
+type LoadResult struct {
+	// TaskIDs are the ids of the tasks submitted, one per batch
+	TaskIDs []string
+
+	// Rows is the number of rows sent
+	Rows int64
+}
+
+// LoadOption configures BulkLoad
+type LoadOption func(*loadConfig)
+
+type loadConfig struct {
+	method          LoadMethod
+	timestampColumn string
+	dimensions      []string
+	granularity     string
+	batchBytes      int
+	replaceStart    time.Time
+	replaceEnd      time.Time
+	replace         bool
+	pollInterval    time.Duration
+	waitQueryable   bool
+}
+
+// LoadUsing sets how rows are ingested, LoadNative by default
+func LoadUsing(method LoadMethod) LoadOption {
+	return func(c *loadConfig) {
+		c.method = method
+	}
+}
+
+// LoadTimestamp sets the column rows hold their time in, "__time" by
+// default. It must be a time.Time, an ISO 8601 string or milliseconds since
+// the epoch
+func LoadTimestamp(column string) LoadOption {
+	return func(c *loadConfig) {
+		c.timestampColumn = column
+	}
+}
+
+// LoadDimensions sets the dimensions of native tasks, which otherwise
+// discover them and their types from the rows
+func LoadDimensions(dimensions ...string) LoadOption {
+	return func(c *loadConfig) {
+		c.dimensions = dimensions
+	}
+}
+
+// LoadSegmentGranularity sets how segments are partitioned by time, one of
+// druid's granularities from SECOND to YEAR such as FIFTEEN_MINUTE or
+// MONTH, or ALL. DAY by default
+func LoadSegmentGranularity(granularity string) LoadOption {
+	return func(c *loadConfig) {
+		c.granularity = granularity
+	}
+}
+
+// LoadBatchBytes sets the size of the rows sent inline with each task, 1MiB
+// by default. Larger loads are split in several tasks, n must be positive
+func LoadBatchBytes(n int) LoadOption {
+	return func(c *loadConfig) {
+		c.batchBytes = n
+	}
+}
+
+// LoadReplacing replaces the data of the datasource between start,
+// inclusive, and end, exclusive, instead of appending to it. Rows outside
+// the interval are dropped by native tasks and fail MSQ ones. Both ends
+// must fall on segment boundaries, so ALL segments can't be replaced
+func LoadReplacing(start, end time.Time) LoadOption {
+	return func(c *loadConfig) {
+		c.replaceStart, c.replaceEnd, c.replace = start, end, true
+	}
+}
+
+// LoadPollInterval sets how often tasks and segment loading are polled, 1s
+// by default
+func LoadPollInterval(interval time.Duration) LoadOption {
+	return func(c *loadConfig) {
+		c.pollInterval = interval
+	}
+}
+
+// LoadWaitQueryable makes BulkLoad wait, once its tasks have succeeded,
+// until the segments they wrote are loaded by historicals and so queryable.
+// Loading is polled from the coordinator at Config.CoordinatorAddr
+func LoadWaitQueryable() LoadOption {
+	return func(c *loadConfig) {
+		c.waitQueryable = true
+	}
+}
+
+// BulkLoad ingests rows into a datasource, encoded as inline JSON data of
+// native or MSQ tasks. rows is a slice of structs, pointers to structs or
+// maps, or a RowSource; structs are encoded as encoding/json encodes them.
+// Rows are split in batches of LoadBatchBytes, each ingested by a task, and
+// BulkLoad returns once every task has succeeded. When replacing, the
+// first batch replaces the interval and the others are appended once it
+// has. Nothing is ingested when there are no rows. Tasks are reported to
+// Hooks.TaskSubmitted and their progress to the callback of
+// WithTaskProgress
+func BulkLoad(ctx context.Context, db *sql.DB, datasource string, rows interface{}, opts ...LoadOption) (*LoadResult, error) {
+	cfg := loadConfig{
+		timestampColumn: "__time",
+		granularity:     "DAY",
+		batchBytes:      defaultLoadBatchBytes,
+		pollInterval:    defaultTaskPollInterval,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if datasource == "" {
+		return nil, wrapErr(ErrBulkLoad, errors.New("no datasource"))
+	}
+	if cfg.batchBytes <= 0 {
+		return nil, wrapErr(ErrBulkLoad, fmt.Errorf("batch size %d isn't positive", cfg.batchBytes))
+	}
+	granularity := strings.ToUpper(cfg.granularity)
+	if _, ok := segmentGranularities[granularity]; !ok {
+		return nil, wrapErr(ErrBulkLoad, fmt.Errorf("unknown segment granularity %q", cfg.granularity))
+	}
+	cfg.granularity = granularity
+	if cfg.replace && !cfg.replaceEnd.After(cfg.replaceStart) {
+		return nil, wrapErr(ErrBulkLoad, fmt.Errorf("replaced interval %s is empty", loadInterval(cfg.replaceStart, cfg.replaceEnd)))
+	}
+	if err := cfg.checkReplaced(); err != nil {
+		return nil, wrapErr(ErrBulkLoad, err)
+	}
+	source, err := rowSource(rows)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connectionOf(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &loader{conn: conn, cfg: cfg, datasource: datasource}
+	return l.load(ctx, source)
+}
+
+// checkReplaced returns an error when the replaced interval doesn't start
+// and end on segment boundaries. druid widens the interval of native tasks
+// to whole segments, replacing data outside of it, and fails MSQ ones
+func (c *loadConfig) checkReplaced() error {
+	if !c.replace {
+		return nil
+	}
+	if c.granularity == "ALL" {
+		return fmt.Errorf("can't replace interval %s of ALL segments, they span all time", loadInterval(c.replaceStart, c.replaceEnd))
+	}
+	for _, t := range []time.Time{c.replaceStart, c.replaceEnd} {
+		if !segmentStart(t, c.granularity).Equal(t) {
+			return fmt.Errorf("replaced interval %s isn't aligned to %s segments", loadInterval(c.replaceStart, c.replaceEnd), c.granularity)
+		}
+	}
+	return nil
+}
+
+// loader splits rows in batches and ingests them
+type loader struct {
+	conn       *connection
+	cfg        loadConfig
+	datasource string
+
+	result  LoadResult
+	pending []string
+
+	// minTime and maxTime bound the timestamps sent, to wait for the
+	// segments of their interval
+	minTime, maxTime time.Time
+}
+
+func (l *loader) load(ctx context.Context, source RowSource) (*LoadResult, error) {
+	batch := newLoadBatch()
+	for {
+		row, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, wrapErr(ErrBulkLoad, err)
+		}
+
+		line, values, err := l.encode(row)
+		if err != nil {
+			return nil, wrapErr(ErrBulkLoad, fmt.Errorf("row %d: %v", l.result.Rows+1, err))
+		}
+		if batch.data.Len() > 0 && batch.data.Len()+len(line) > l.cfg.batchBytes {
+			if err := l.flush(ctx, batch); err != nil {
+				return nil, err
+			}
+			batch = newLoadBatch()
+		}
+		batch.add(line, values)
+		l.result.Rows++
+	}
+	if batch.data.Len() > 0 {
+		if err := l.flush(ctx, batch); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, taskID := range l.pending {
+		if _, err := l.conn.waitForTask(ctx, taskID, l.cfg.pollInterval); err != nil {
+			return nil, err
+		}
+	}
+	if l.cfg.waitQueryable && len(l.result.TaskIDs) > 0 {
+		if err := l.waitQueryable(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &l.result, nil
+}
+
+// encode returns the JSON line of a row and its values, with time.Time
+// values encoded as ISO 8601 strings
+func (l *loader) encode(row interface{}) ([]byte, map[string]interface{}, error) {
+	line, err := json.Marshal(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, nil, fmt.Errorf("%T isn't encoded as a JSON object", row)
+	}
+
+	ts, ok := values[l.cfg.timestampColumn]
+	if !ok || ts == nil {
+		return nil, nil, fmt.Errorf("no timestamp in column %s", l.cfg.timestampColumn)
+	}
+	if t, ok := parseLoadTime(ts); ok {
+		if l.minTime.IsZero() || t.Before(l.minTime) {
+			l.minTime = t
+		}
+		if t.After(l.maxTime) {
+			l.maxTime = t
+		}
+	}
+	return line, values, nil
+}
+
+// flush submits a task ingesting batch. When replacing, the first task is
+// waited for before any other is submitted
+func (l *loader) flush(ctx context.Context, batch *loadBatch) error {
+	replace := l.cfg.replace && len(l.result.TaskIDs) == 0
+
+	var taskID, query string
+	var err error
+	if l.cfg.method == LoadMSQ {
+		query = l.msqStatement(batch, replace)
+		taskID, err = l.submitMSQ(ctx, query)
+	} else {
+		taskID, err = l.submitNative(ctx, batch, replace)
+	}
+	if err != nil {
+		return err
+	}
+	if hooks := l.conn.hooks(); hooks.TaskSubmitted != nil {
+		hooks.TaskSubmitted(ctx, query, taskID)
+	}
+	l.result.TaskIDs = append(l.result.TaskIDs, taskID)
+
+	if replace {
+		_, err := l.conn.waitForTask(ctx, taskID, l.cfg.pollInterval)
+		return err
+	}
+	l.pending = append(l.pending, taskID)
+	return nil
+}
+
+// submitMSQ submits an INSERT or REPLACE statement to the SQL task endpoint
+func (l *loader) submitMSQ(ctx context.Context, query string) (string, error) {
+	request, err := l.conn.newQueryRequest(ctx, query, nil)
+	if err != nil {
+		return "", wrapErr(ErrCreatingRequest, err)
+	}
+	return l.conn.submitTask(ctx, request)
+}
+
+// msqStatement returns the statement ingesting batch from inline data
+func (l *loader) msqStatement(batch *loadBatch, replace bool) string {
+	inputSource, _ := json.Marshal(map[string]string{"type": "inline", "data": batch.data.String()})
+
+	ts := l.cfg.timestampColumn
+	type column struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	signature := []column{{Name: ts, Type: batch.types[ts]}}
+	selected := []string{}
+	if batch.types[ts] == "long" {
+		selected = append(selected, fmt.Sprintf("MILLIS_TO_TIMESTAMP(%s) AS \"__time\"", quoteIdentifier(ts)))
+	} else {
+		selected = append(selected, fmt.Sprintf("TIME_PARSE(%s) AS \"__time\"", quoteIdentifier(ts)))
+	}
+	for _, name := range batch.columns() {
+		if name == ts {
+			continue
+		}
+		signature = append(signature, column{Name: name, Type: batch.types[name]})
+		selected = append(selected, quoteIdentifier(name))
+	}
+	signatureJSON, _ := json.Marshal(signature)
+
+	var b strings.Builder
+	if replace {
+		fmt.Fprintf(&b, "REPLACE INTO %s OVERWRITE WHERE \"__time\" >= TIMESTAMP '%s' AND \"__time\" < TIMESTAMP '%s'\n",
+			quoteIdentifier(l.datasource), l.cfg.replaceStart.UTC().Format(druidTimestampLayout), l.cfg.replaceEnd.UTC().Format(druidTimestampLayout))
+	} else {
+		fmt.Fprintf(&b, "INSERT INTO %s\n", quoteIdentifier(l.datasource))
+	}
+	fmt.Fprintf(&b, "SELECT %s\n", strings.Join(selected, ", "))
+	fmt.Fprintf(&b, "FROM TABLE(EXTERN(%s, '{\"type\":\"json\"}', %s))\n", quoteString(string(inputSource)), quoteString(string(signatureJSON)))
+	fmt.Fprintf(&b, "PARTITIONED BY %s", segmentGranularities[l.cfg.granularity])
+	return b.String()
+}
+
+// submitNative submits an index_parallel task to the overlord
+func (l *loader) submitNative(ctx context.Context, batch *loadBatch, replace bool) (string, error) {
+	dimensionsSpec := map[string]interface{}{"useSchemaDiscovery": true}
+	if len(l.cfg.dimensions) > 0 {
+		dimensionsSpec = map[string]interface{}{"dimensions": l.cfg.dimensions}
+	}
+	granularitySpec := map[string]interface{}{
+		"segmentGranularity": l.cfg.granularity,
+		"queryGranularity":   "NONE",
+		"rollup":             false,
+	}
+	ioConfig := map[string]interface{}{
+		"type":             "index_parallel",
+		"inputSource":      map[string]interface{}{"type": "inline", "data": batch.data.String()},
+		"inputFormat":      map[string]interface{}{"type": "json"},
+		"appendToExisting": !replace,
+	}
+	if replace {
+		granularitySpec["intervals"] = []string{loadInterval(l.cfg.replaceStart, l.cfg.replaceEnd)}
+		ioConfig["dropExisting"] = true
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": "index_parallel",
+		"spec": map[string]interface{}{
+			"dataSchema": map[string]interface{}{
+				"dataSource":      l.datasource,
+				"timestampSpec":   map[string]interface{}{"column": l.cfg.timestampColumn, "format": "auto"},
+				"dimensionsSpec":  dimensionsSpec,
+				"granularitySpec": granularitySpec,
+			},
+			"ioConfig":     ioConfig,
+			"tuningConfig": map[string]interface{}{"type": "index_parallel", "partitionsSpec": map[string]interface{}{"type": "dynamic"}},
+		},
+	})
+	if err != nil {
+		return "", wrapErr(ErrRequestForm, err)
+	}
+
+	l.conn.Cfg.logger().Log(LevelDebug, "druid: submitting ingestion task", "datasource", l.datasource, "bytes", batch.data.Len())
+	body, err := l.conn.apiRequest(ctx, http.MethodPost, l.conn.Cfg.OverlordAddr+"/druid/indexer/v1/task", payload)
+	if err != nil {
+		return "", wrapErr(ErrMakingRequest, err)
+	}
+	var response struct {
+		Task string `json:"task"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", wrapErr(ErrMakingRequest, fmt.Errorf("decoding task response: %v", err))
+	}
+	if response.Task == "" {
+		return "", wrapErr(ErrMakingRequest, errors.New("no task id in response"))
+	}
+	return response.Task, nil
+}
+
+// waitQueryable polls the coordinator until the segments of the interval
+// loaded are all available
+func (l *loader) waitQueryable(ctx context.Context) error {
+	start, end := l.minTime, l.maxTime.Add(time.Millisecond)
+	if l.cfg.replace {
+		start, end = l.cfg.replaceStart, l.cfg.replaceEnd
+	}
+	params := url.Values{"forceMetadataRefresh": {"true"}}
+	if !start.IsZero() {
+		params.Set("interval", loadInterval(start, end))
+	}
+	target := fmt.Sprintf("%s/druid/coordinator/v1/datasources/%s/loadstatus?%s", l.conn.Cfg.CoordinatorAddr, url.PathEscape(l.datasource), params.Encode())
+
+	ticker := time.NewTicker(l.cfg.pollInterval)
+	defer ticker.Stop()
+	for {
+		body, err := l.conn.apiRequest(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return wrapErr(ErrTaskStatus, err)
+		}
+
+		// There's no content until the coordinator knows of the segments
+		if len(body) > 0 {
+			var status map[string]float64
+			if err := json.Unmarshal(body, &status); err != nil {
+				return wrapErr(ErrTaskStatus, fmt.Errorf("decoding load status of %s: %v", l.datasource, err))
+			}
+			if status[l.datasource] >= 100 {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadBatch is the inline data of a task, with the types of its columns
+type loadBatch struct {
+	data  bytes.Buffer
+	types map[string]string
+}
+
+func newLoadBatch() *loadBatch {
+	return &loadBatch{types: make(map[string]string)}
+}
+
+func (b *loadBatch) add(line []byte, values map[string]interface{}) {
+	b.data.Write(line)
+	b.data.WriteByte('\n')
+	for name, v := range values {
+		b.types[name] = widenType(b.types[name], externType(v))
+	}
+}
+
+// columns returns the names of the batch's columns in order
+func (b *loadBatch) columns() []string {
+	names := make([]string, 0, len(b.types))
+	for name := range b.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// externType returns the EXTERN signature type of a decoded JSON value, ""
+// for null
+func externType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "long"
+		}
+		return "double"
+	case map[string]interface{}:
+		return "COMPLEX<json>"
+	default:
+		// Arrays are ingested as multi-value strings
+		return "string"
+	}
+}
+
+// widenType returns a type both a and b values fit in
+func widenType(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		if b == "" {
+			return "string"
+		}
+		return b
+	case b == "":
+		return a
+	case (a == "long" && b == "double") || (a == "double" && b == "long"):
+		return "double"
+	case a == "COMPLEX<json>" || b == "COMPLEX<json>":
+		return "COMPLEX<json>"
+	}
+	return "string"
+}
+
+// rowSource returns a RowSource over rows, a slice or a RowSource
+func rowSource(rows interface{}) (RowSource, error) {
+	if source, ok := rows.(RowSource); ok {
+		return source, nil
+	}
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, wrapErr(ErrBulkLoad, fmt.Errorf("rows must be a slice or a RowSource, not %T", rows))
+	}
+	i := 0
+	return RowSourceFunc(func() (interface{}, error) {
+		if i == v.Len() {
+			return nil, io.EOF
+		}
+		i++
+		return v.Index(i - 1).Interface(), nil
+	}), nil
+}
+
+// parseLoadTime returns the time of a decoded timestamp, false when it's
+// not one BulkLoad understands
+func parseLoadTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case json.Number:
+		ms, err := v.Int64()
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), err == nil
+	}
+	return time.Time{}, false
+}
+
+// loadInterval formats an interval as druid's ISO 8601 intervals
+func loadInterval(start, end time.Time) string {
+	return start.UTC().Format(time.RFC3339Nano) + "/" + end.UTC().Format(time.RFC3339Nano)
+}
+
+// quoteIdentifier quotes a SQL identifier
+func quoteIdentifier(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// quoteString quotes a SQL string literal
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
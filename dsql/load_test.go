@@ -0,0 +1,262 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type visit struct {
+	Time    time.Time `json:"__time"`
+	Page    string    `json:"page"`
+	Added   int64     `json:"added"`
+	Ratio   float64   `json:"ratio"`
+	Ignored string    `json:"-"`
+}
+
+// mockLoadServer serves the native and SQL task endpoints, the status of
+// the tasks they create, which succeed once polled, and the load status of
+// the visits datasource, loaded once asked twice
+type mockLoadServer struct {
+	t *testing.T
+
+	mtx        sync.Mutex
+	submitted  []map[string]interface{}
+	statements []string
+	succeeded  map[string]bool
+	loadStatus int
+}
+
+func (s *mockLoadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch {
+	case r.URL.Path == "/druid/indexer/v1/task":
+		var task map[string]interface{}
+		require.NoError(s.t, json.NewDecoder(r.Body).Decode(&task))
+		s.submitted = append(s.submitted, task)
+		_, _ = fmt.Fprintf(w, `{"task":"index-%d"}`, len(s.submitted))
+	case r.URL.Path == "/druid/v2/sql/task":
+		var request taskRequest
+		require.NoError(s.t, json.NewDecoder(r.Body).Decode(&request))
+		s.statements = append(s.statements, request.Query)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = fmt.Fprintf(w, `{"taskId":"query-%d","state":"RUNNING"}`, len(s.statements))
+	case strings.HasPrefix(r.URL.Path, "/druid/indexer/v1/task/") && strings.HasSuffix(r.URL.Path, "/status"):
+		id := strings.Split(r.URL.Path, "/")[5]
+		status := taskRunning
+		if s.succeeded[id] {
+			status = taskSuccess
+		}
+		s.succeeded[id] = true
+		_, _ = fmt.Fprintf(w, `{"task":"%s","status":{"id":"%s","statusCode":"%s"}}`, id, id, status)
+	case strings.HasSuffix(r.URL.Path, "/reports"):
+		w.WriteHeader(http.StatusNotFound)
+	case r.URL.Path == "/druid/coordinator/v1/datasources/visits/loadstatus":
+		require.Equal(s.t, "true", r.URL.Query().Get("forceMetadataRefresh"))
+		require.Equal(s.t, "2023-07-26T10:00:00Z/2023-07-26T12:00:00.001Z", r.URL.Query().Get("interval"))
+		s.loadStatus++
+		if s.loadStatus == 1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"visits":%d}`, 50*(s.loadStatus-1))
+	default:
+		s.t.Errorf("unexpected request to %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newMockLoad(t *testing.T, opts ...Option) (*mockLoadServer, *sql.DB, func()) {
+	server := &mockLoadServer{t: t, succeeded: make(map[string]bool)}
+	ts, url := startMockServer(server.ServeHTTP)
+	connector, err := NewConnector(&Config{BrokerAddr: url}, opts...)
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	return server, db, func() {
+		db.Close()
+		ts.Close()
+	}
+}
+
+func visits() []visit {
+	start := time.Date(2023, 7, 26, 10, 0, 0, 0, time.UTC)
+	return []visit{
+		{Time: start, Page: "Main", Added: 10, Ratio: 0.5},
+		{Time: start.Add(time.Hour), Page: "Druid", Added: 20, Ratio: 1.5},
+		{Time: start.Add(2 * time.Hour), Page: "Go", Added: 30, Ratio: 2},
+	}
+}
+
+func TestBulkLoadNative(t *testing.T) {
+	var tasks []string
+	hooks := Hooks{TaskSubmitted: func(ctx context.Context, query, taskID string) { tasks = append(tasks, taskID) }}
+	server, db, done := newMockLoad(t, WithHooks(hooks))
+	defer done()
+
+	result, err := BulkLoad(context.Background(), db, "visits", visits(),
+		LoadBatchBytes(150), LoadPollInterval(time.Millisecond), LoadWaitQueryable())
+	require.NoError(t, err)
+	require.Equal(t, int64(3), result.Rows)
+	require.Equal(t, []string{"index-1", "index-2"}, result.TaskIDs)
+	require.Equal(t, result.TaskIDs, tasks)
+	require.Equal(t, 3, server.loadStatus)
+
+	spec := server.submitted[0]["spec"].(map[string]interface{})
+	ioConfig := spec["ioConfig"].(map[string]interface{})
+	require.Equal(t, true, ioConfig["appendToExisting"])
+	data := ioConfig["inputSource"].(map[string]interface{})["data"].(string)
+	require.Equal(t, `{"__time":"2023-07-26T10:00:00Z","page":"Main","added":10,"ratio":0.5}`+"\n"+
+		`{"__time":"2023-07-26T11:00:00Z","page":"Druid","added":20,"ratio":1.5}`+"\n", data)
+
+	dataSchema := spec["dataSchema"].(map[string]interface{})
+	require.Equal(t, "visits", dataSchema["dataSource"])
+	require.Equal(t, map[string]interface{}{"column": "__time", "format": "auto"}, dataSchema["timestampSpec"])
+	require.Equal(t, map[string]interface{}{"useSchemaDiscovery": true}, dataSchema["dimensionsSpec"])
+	require.Equal(t, "DAY", dataSchema["granularitySpec"].(map[string]interface{})["segmentGranularity"])
+}
+
+func TestBulkLoadMSQReplace(t *testing.T) {
+	server, db, done := newMockLoad(t)
+	defer done()
+
+	start := time.Date(2023, 7, 26, 0, 0, 0, 0, time.UTC)
+	rows := visits()
+	i := 0
+	source := RowSourceFunc(func() (interface{}, error) {
+		if i == len(rows) {
+			return nil, io.EOF
+		}
+		i++
+		return map[string]interface{}{"ts": rows[i-1].Time.UnixNano() / int64(time.Millisecond), "page": rows[i-1].Page, "added": rows[i-1].Added}, nil
+	})
+
+	result, err := BulkLoad(context.Background(), db, "visits", source,
+		LoadUsing(LoadMSQ), LoadTimestamp("ts"), LoadSegmentGranularity("HOUR"),
+		LoadReplacing(start, start.AddDate(0, 0, 1)), LoadBatchBytes(60), LoadPollInterval(time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, []string{"query-1", "query-2", "query-3"}, result.TaskIDs)
+
+	// The interval is replaced once, the other batches appended after it
+	require.Equal(t, `REPLACE INTO "visits" OVERWRITE WHERE "__time" >= TIMESTAMP '2023-07-26 00:00:00.000' AND "__time" < TIMESTAMP '2023-07-27 00:00:00.000'
+SELECT MILLIS_TO_TIMESTAMP("ts") AS "__time", "added", "page"
+FROM TABLE(EXTERN('{"data":"{\"added\":10,\"page\":\"Main\",\"ts\":1690365600000}\n","type":"inline"}', '{"type":"json"}', '[{"name":"ts","type":"long"},{"name":"added","type":"long"},{"name":"page","type":"string"}]'))
+PARTITIONED BY HOUR`, server.statements[0])
+	require.True(t, strings.HasPrefix(server.statements[1], `INSERT INTO "visits"`))
+	require.True(t, server.succeeded["query-1"])
+}
+
+func TestBulkLoadReplacedIntervalIsAligned(t *testing.T) {
+	server, db, done := newMockLoad(t)
+	defer done()
+
+	day := time.Date(2023, 7, 26, 0, 0, 0, 0, time.UTC)
+	for _, misaligned := range []struct {
+		granularity string
+		start, end  time.Time
+	}{
+		{"DAY", day.Add(time.Hour), day.AddDate(0, 0, 1)},
+		{"HOUR", day, day.Add(90 * time.Minute)},
+		{"WEEK", day, day.AddDate(0, 0, 7)},
+		{"MONTH", day, day.AddDate(0, 1, 0)},
+		{"ALL", day, day.AddDate(0, 0, 1)},
+	} {
+		_, err := BulkLoad(context.Background(), db, "visits", visits(), LoadUsing(LoadMSQ),
+			LoadSegmentGranularity(misaligned.granularity), LoadReplacing(misaligned.start, misaligned.end))
+		require.True(t, errors.Is(err, ErrBulkLoad), "%s %v", misaligned.granularity, err)
+	}
+	require.Empty(t, server.statements)
+
+	_, err := BulkLoad(context.Background(), db, "visits", visits(), LoadUsing(LoadMSQ),
+		LoadSegmentGranularity("DAY"), LoadReplacing(day.Add(time.Hour), day.AddDate(0, 0, 1)))
+	require.EqualError(t, err, "druid: can't bulk load rows: replaced interval 2023-07-26T01:00:00Z/2023-07-27T00:00:00Z isn't aligned to DAY segments")
+
+	// 2023-07-24 is a Monday, weeks and quarters are aligned in UTC whatever
+	// the zone of the interval
+	monday := time.Date(2023, 7, 24, 0, 0, 0, 0, time.UTC)
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	for granularity, interval := range map[string][2]time.Time{
+		"WEEK":    {monday, monday.AddDate(0, 0, 14)},
+		"QUARTER": {time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"HOUR":    {day.In(newYork), day.Add(time.Hour).In(newYork)},
+	} {
+		_, err := BulkLoad(context.Background(), db, "visits", []visit{}, LoadUsing(LoadMSQ),
+			LoadSegmentGranularity(granularity), LoadReplacing(interval[0], interval[1]))
+		require.NoError(t, err, granularity)
+	}
+}
+
+func TestBulkLoadGranularities(t *testing.T) {
+	server, db, done := newMockLoad(t)
+	defer done()
+
+	for granularity, clause := range map[string]string{"month": "MONTH", "FIFTEEN_MINUTE": "'PT15M'", "all": "ALL TIME"} {
+		server.statements = nil
+		_, err := BulkLoad(context.Background(), db, "visits", visits(),
+			LoadUsing(LoadMSQ), LoadSegmentGranularity(granularity), LoadPollInterval(time.Millisecond))
+		require.NoError(t, err)
+		require.True(t, strings.HasSuffix(server.statements[0], "\nPARTITIONED BY "+clause), server.statements[0])
+	}
+}
+
+func TestBulkLoadPollsCoordinator(t *testing.T) {
+	overlord := &mockLoadServer{t: t, succeeded: make(map[string]bool)}
+	ts, overlordURL := startMockServer(overlord.ServeHTTP)
+	defer ts.Close()
+	coordinator := &mockLoadServer{t: t, succeeded: make(map[string]bool)}
+	cs, coordinatorURL := startMockServer(coordinator.ServeHTTP)
+	defer cs.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: overlordURL, CoordinatorAddr: coordinatorURL})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err = BulkLoad(context.Background(), db, "visits", visits(), LoadPollInterval(time.Millisecond), LoadWaitQueryable())
+	require.NoError(t, err)
+	require.Len(t, overlord.submitted, 1)
+	require.Zero(t, overlord.loadStatus)
+	require.Equal(t, 3, coordinator.loadStatus)
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	_, db, done := newMockLoad(t)
+	defer done()
+
+	_, err := BulkLoad(context.Background(), db, "visits", []map[string]interface{}{{"page": "Main"}})
+	require.True(t, errors.Is(err, ErrBulkLoad))
+	require.Contains(t, err.Error(), "row 1: no timestamp in column __time")
+
+	_, err = BulkLoad(context.Background(), db, "visits", visit{})
+	require.True(t, errors.Is(err, ErrBulkLoad))
+
+	_, err = BulkLoad(context.Background(), db, "visits", []string{"Main"})
+	require.True(t, errors.Is(err, ErrBulkLoad))
+
+	for _, opt := range []LoadOption{
+		LoadBatchBytes(0),
+		LoadBatchBytes(-1),
+		LoadSegmentGranularity("DAY; DROP TABLE visits"),
+		LoadSegmentGranularity("NONE"),
+	} {
+		_, err = BulkLoad(context.Background(), db, "visits", visits(), opt)
+		require.True(t, errors.Is(err, ErrBulkLoad))
+	}
+
+	// Nothing is loaded without rows
+	result, err := BulkLoad(context.Background(), db, "visits", []visit{})
+	require.NoError(t, err)
+	require.Empty(t, result.TaskIDs)
+}
@@ -0,0 +1,161 @@
+package dsql
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel int
+
+const (
+	// LevelDebug is used for query text, response bodies and per row details
+	LevelDebug LogLevel = iota
+	// LevelInfo is used for noteworthy but expected events
+	LevelInfo
+	// LevelWarn is used for recoverable problems
+	LevelWarn
+	// LevelError is used for failed requests
+	LevelError
+)
+
+// defaultLogMaxBytes is how much of a query or response body is logged
+// when Config.LogMaxBytes is left at zero
+const defaultLogMaxBytes = 1024
+
+// String returns the lower case name of the level
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// Logger is implemented by anything the driver can log through. keyvals
+// holds alternating keys and values, i.e. "status", 500, "query", "SELECT 1"
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface
+type LoggerFunc func(level LogLevel, msg string, keyvals ...interface{})
+
+// Log calls f
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+type nopLogger struct{}
+
+// Log discards the entry
+func (nopLogger) Log(LogLevel, string, ...interface{}) {}
+
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+// NewStdLogger returns a Logger writing to l as "level msg key=value ...",
+// entries below min are dropped. A nil l writes to the standard logger
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	if l == nil {
+		l = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	return &stdLogger{l: l, min: min}
+}
+
+// Log writes the entry if it is at or above the configured level
+func (s *stdLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < s.min {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var val interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%q", keyvals[i], fmt.Sprint(val))
+	}
+	s.l.Println(b.String())
+}
+
+// userinfoPattern matches the password part of a scheme://user:pass@ url
+var userinfoPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]*:)[^@/\s]*@`)
+
+// authorizationPattern matches the credentials of an Authorization header,
+// written as "Authorization: Basic ..." or as a printed http.Header
+var authorizationPattern = regexp.MustCompile(`(?i)(\bauthorization\s*[:=]\s*\[?(?:[a-z]+\s+)?)[^\s"',;&\]]+`)
+
+// passwordKeyPattern matches the value of a password=... DSN or config key
+var passwordKeyPattern = regexp.MustCompile(`(?i)(\bpassword\s*[:=]\s*)[^\s"',;&]+`)
+
+const redacted = "xxxxx"
+
+// logger returns the configured logger, or one that discards everything
+func (c *Config) logger() Logger {
+	if c == nil || c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
+}
+
+// redact removes credentials from s so it's safe to write to a log. Only
+// the places credentials are written to are redacted, a short password
+// would otherwise match unrelated text
+func (c *Config) redact(s string) string {
+	s = userinfoPattern.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = authorizationPattern.ReplaceAllString(s, "${1}"+redacted)
+	return passwordKeyPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactErr returns err with credentials removed from its message. The
+// original error is still reachable with errors.Is and errors.As
+func (c *Config) redactErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if clean := c.redact(msg); clean != msg {
+		return &redactedError{msg: clean, err: err}
+	}
+	return err
+}
+
+// redactedError hides credentials in the message of the error it wraps
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// logBody redacts and truncates a query or response body for debug logging
+func (c *Config) logBody(s string) string {
+	s = c.redact(s)
+
+	max := defaultLogMaxBytes
+	if c != nil && c.LogMaxBytes != 0 {
+		max = c.LogMaxBytes
+	}
+	if max > 0 && len(s) > max {
+		return fmt.Sprintf("%s... (%d bytes truncated)", s[:max], len(s)-max)
+	}
+	return s
+}
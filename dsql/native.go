@@ -0,0 +1,364 @@
+package dsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// nativePrefix marks a query as native when it doesn't start with {
+const nativePrefix = "NATIVE:"
+
+// NativeQuery sends a native JSON query to Config.NativeEndpoint and
+// returns the response body. It's sent as SQL queries are: authenticated,
+// through the limiter, circuit breakers, cache and coalescing, and bounded
+// by Config.Timeout. Config.QueryContext and the query context of ctx are
+// merged into the query's own context, which takes precedence. Hooks are
+// called with the JSON query
+func (c *Connector) NativeQuery(ctx context.Context, query []byte) ([]byte, error) {
+	conn := &connection{Client: c.client, Cfg: c.cfg, connector: c}
+	request, err := conn.newNativeRequest(ctx, query)
+	if err != nil {
+		return nil, wrapErr(ErrCreatingRequest, err)
+	}
+
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+
+	hooks := c.hooks
+	if hooks.QueryStart != nil {
+		hooks.QueryStart(ctx, request.Query)
+	}
+	start := time.Now()
+
+	body, err := conn.execute(ctx, request)
+
+	if hooks.QueryDone != nil {
+		hooks.QueryDone(ctx, request.Query, time.Since(start), err)
+	}
+	return body, err
+}
+
+// newNativeRequest returns a request for a native JSON query, with the
+// query context of the config and ctx merged into its own
+func (c *connection) newNativeRequest(ctx context.Context, query []byte) (*queryRequest, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(query, &fields); err != nil {
+		return nil, fmt.Errorf("native query isn't a JSON object: %v", err)
+	}
+	if _, ok := fields["queryType"]; !ok {
+		return nil, errors.New("native query has no queryType")
+	}
+
+	queryContext := make(map[string]interface{})
+	for k, v := range c.Cfg.QueryContext {
+		queryContext[k] = v
+	}
+	for k, v := range queryContextFrom(ctx) {
+		queryContext[k] = v
+	}
+	if raw, ok := fields["context"]; ok && string(raw) != "null" {
+		var own map[string]interface{}
+		if err := json.Unmarshal(raw, &own); err != nil {
+			return nil, fmt.Errorf("native query context: %v", err)
+		}
+		for k, v := range own {
+			queryContext[k] = v
+		}
+	}
+
+	request := &queryRequest{Query: string(query), native: true}
+	if len(queryContext) > 0 {
+		raw, err := json.Marshal(queryContext)
+		if err != nil {
+			return nil, fmt.Errorf("native query context: %v", err)
+		}
+		fields["context"] = raw
+		merged, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		request.Query, request.Context = string(merged), queryContext
+	}
+	return request, nil
+}
+
+// nativeQuery returns the JSON of q when it's a native query: it starts
+// with { or NATIVE:, or ctx is from WithNative
+func nativeQuery(ctx context.Context, q string) ([]byte, bool) {
+	trimmed := strings.TrimSpace(q)
+	switch {
+	case strings.HasPrefix(trimmed, nativePrefix):
+		return []byte(strings.TrimSpace(trimmed[len(nativePrefix):])), true
+	case strings.HasPrefix(trimmed, "{"), nativeFlag(ctx):
+		return []byte(trimmed), true
+	}
+	return nil, false
+}
+
+// queryNative sends a native query through db.QueryContext, returning its
+// results flattened into rows. Native queries take no parameters and
+// aren't run asynchronously
+func (c *connection) queryNative(ctx context.Context, q string, query []byte, args []driver.Value) (*rows, error) {
+	if len(args) > 0 {
+		return &rows{}, wrapErr(ErrCreatingRequest, errors.New("native queries take no parameters"))
+	}
+	request, err := c.newNativeRequest(ctx, query)
+	if err != nil {
+		return &rows{}, wrapErr(ErrCreatingRequest, err)
+	}
+	var header struct {
+		QueryType string `json:"queryType"`
+	}
+	if err := json.Unmarshal(query, &header); err != nil || !flattenable(header.QueryType) {
+		return &rows{}, wrapErr(ErrCreatingRequest, fmt.Errorf("native %s query results can't be returned as rows", header.QueryType))
+	}
+	location := timeZoneFrom(ctx)
+	if location == nil {
+		location = c.Cfg.Location
+	}
+
+	if c.Cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Cfg.Timeout)
+		defer cancel()
+	}
+
+	hooks := c.hooks()
+	if hooks.QueryStart != nil {
+		hooks.QueryStart(ctx, q)
+	}
+	start := time.Now()
+
+	var r *rows
+	body, err := c.execute(ctx, request)
+	if err == nil {
+		r, err = c.nativeRows(header.QueryType, body, location)
+	}
+
+	if hooks.QueryDone != nil {
+		hooks.QueryDone(ctx, q, time.Since(start), err)
+	}
+	if err != nil {
+		return &rows{}, err
+	}
+	return r, nil
+}
+
+// flattenable reports whether the results of a native query type can be
+// returned as rows
+func flattenable(queryType string) bool {
+	switch queryType {
+	case "timeseries", "topN", "groupBy", "scan":
+		return true
+	}
+	return false
+}
+
+// nativeTimeColumn is the column of the timestamps of timeseries, topN and
+// groupBy results, named as druid names them
+const nativeTimeColumn = "timestamp"
+
+// nativeRows flattens the results of a native query into rows. Timeseries,
+// topN and groupBy results have a timestamp column followed by their
+// aggregates, dimensions and post-aggregates in the order druid sent them,
+// a row per bucket, topN entry or group. Scan results have the query's
+// columns. timestamp and __time are returned as time.Time
+func (c *connection) nativeRows(queryType string, body []byte, location *time.Location) (*rows, error) {
+	var table nativeTable
+	var err error
+	switch queryType {
+	case "timeseries":
+		err = table.addBuckets(body, "result")
+	case "groupBy":
+		err = table.addBuckets(body, "event")
+	case "topN":
+		err = table.addTopN(body)
+	case "scan":
+		err = table.addScan(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("druid: can't decode native %s results: %v", queryType, err)
+	}
+
+	columnTypes := make([]string, len(table.columns))
+	for i, column := range table.columns {
+		if column == nativeTimeColumn && queryType != "scan" || column == "__time" && queryType == "scan" {
+			columnTypes[i] = "TIMESTAMP"
+		}
+	}
+	return c.newRows(table.columns, nil, columnTypes, table.values(), location), nil
+}
+
+// nativeTable collects the rows of native results, adding a column for
+// each name the first time it's seen
+type nativeTable struct {
+	columns []string
+	index   map[string]int
+	rows    []map[string]interface{}
+}
+
+func (t *nativeTable) addColumn(name string) {
+	if t.index == nil {
+		t.index = make(map[string]int)
+	}
+	if _, ok := t.index[name]; !ok {
+		t.index[name] = len(t.columns)
+		t.columns = append(t.columns, name)
+	}
+}
+
+// addRow adds a row of a timestamp and the fields of a JSON object
+func (t *nativeTable) addRow(timestamp interface{}, object json.RawMessage) error {
+	keys, values, err := decodeObject(object)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	t.addColumn(nativeTimeColumn)
+	for _, key := range keys {
+		t.addColumn(key)
+	}
+	values[nativeTimeColumn] = timestamp
+	t.rows = append(t.rows, values)
+	return nil
+}
+
+// addBuckets adds a row per result of timeseries or groupBy queries, the
+// timestamp and the fields of the object under key
+func (t *nativeTable) addBuckets(body []byte, key string) error {
+	var results []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &results); err != nil {
+		return err
+	}
+	t.addColumn(nativeTimeColumn)
+	for _, result := range results {
+		var timestamp interface{}
+		if err := json.Unmarshal(result["timestamp"], &timestamp); err != nil {
+			return err
+		}
+		if err := t.addRow(timestamp, result[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTopN adds a row per entry of each bucket of topN results
+func (t *nativeTable) addTopN(body []byte) error {
+	var results []struct {
+		Timestamp interface{}       `json:"timestamp"`
+		Result    []json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &results); err != nil {
+		return err
+	}
+	t.addColumn(nativeTimeColumn)
+	for _, result := range results {
+		for _, entry := range result.Result {
+			if err := t.addRow(result.Timestamp, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addScan adds the events of scan results, as objects or arrays in the
+// order of their batch's columns
+func (t *nativeTable) addScan(body []byte) error {
+	var batches []struct {
+		Columns []string      `json:"columns"`
+		Events  []interface{} `json:"events"`
+	}
+	if err := decodeJSON(body, &batches); err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		for _, column := range batch.Columns {
+			t.addColumn(column)
+		}
+		for _, event := range batch.Events {
+			switch event := event.(type) {
+			case map[string]interface{}:
+				t.rows = append(t.rows, event)
+			case []interface{}:
+				if len(event) != len(batch.Columns) {
+					return fmt.Errorf("event of %d values for %d columns", len(event), len(batch.Columns))
+				}
+				row := make(map[string]interface{}, len(event))
+				for i, value := range event {
+					row[batch.Columns[i]] = value
+				}
+				t.rows = append(t.rows, row)
+			default:
+				return fmt.Errorf("unexpected event of type %T", event)
+			}
+		}
+	}
+	return nil
+}
+
+// values returns the rows' values in the order of the columns, nil for
+// columns a row doesn't have
+func (t *nativeTable) values() [][]interface{} {
+	values := make([][]interface{}, len(t.rows))
+	for i, row := range t.rows {
+		values[i] = make([]interface{}, len(t.columns))
+		for j, column := range t.columns {
+			values[i][j] = row[column]
+		}
+	}
+	return values
+}
+
+// decodeObject decodes a JSON object, returning its keys in order along
+// with its values. null decodes to no keys or values
+func decodeObject(raw json.RawMessage) ([]string, map[string]interface{}, error) {
+	var values map[string]interface{}
+	if len(raw) == 0 {
+		return nil, nil, nil
+	}
+	if err := decodeJSON(raw, &values); err != nil || values == nil {
+		return nil, nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(values))
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, token.(string))
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, values, nil
+}
+
+// StatusCode returns the HTTP status code druid answered a failed query
+// with, as db.QueryContext and NativeQuery return them, 0 when err isn't
+// such a failure
+func StatusCode(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNativeQuery(t *testing.T) {
+	var sent string
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/druid/v2", r.URL.Path)
+		require.Empty(t, r.Header.Get("Accept"))
+		body, _ := ioutil.ReadAll(r.Body)
+		sent = string(body)
+		_, _ = w.Write([]byte(`[{"result":{"maxTime":"2023-07-07T00:00:00.000Z"}}]`))
+	})
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url, Smile: true})
+	require.NoError(t, err)
+	defer connector.Close()
+
+	ctx := WithQueryContext(context.Background(), map[string]interface{}{"priority": 5, "lane": "reports"})
+	body, err := connector.NativeQuery(ctx, []byte(`{"queryType":"timeBoundary","dataSource":"wikipedia","context":{"priority":1}}`))
+	require.NoError(t, err)
+	require.Contains(t, string(body), "maxTime")
+	require.JSONEq(t, `{"queryType":"timeBoundary","dataSource":"wikipedia","context":{"priority":1,"lane":"reports"}}`, sent)
+
+	_, err = connector.NativeQuery(ctx, []byte(`SELECT 1`))
+	require.True(t, errors.Is(err, ErrCreatingRequest))
+	_, err = connector.NativeQuery(ctx, []byte(`{"dataSource":"wikipedia"}`))
+	require.True(t, errors.Is(err, ErrCreatingRequest))
+}
+
+func TestNativeRows(t *testing.T) {
+	responses := map[string]string{
+		"timeseries": `[
+			{"timestamp":"2023-07-01T00:00:00.000Z","result":{"edits":100,"added":12.5}},
+			{"timestamp":"2023-07-02T00:00:00.000Z","result":{"edits":50,"added":null}}]`,
+		"topN": `[{"timestamp":"2023-07-01T00:00:00.000Z","result":[{"page":"Main","edits":10},{"page":"Go","edits":5}]}]`,
+		"groupBy": `[
+			{"version":"v1","timestamp":"2023-07-01T00:00:00.000Z","event":{"page":"Main","edits":10}},
+			{"version":"v1","timestamp":"2023-07-01T00:00:00.000Z","event":{"page":"Go","edits":5,"users":2}}]`,
+		"scan": `[
+			{"segmentId":"wikipedia_2023","columns":["__time","page"],"events":[{"__time":1688169600000,"page":"Main"}]},
+			{"segmentId":"wikipedia_2023","columns":["__time","page"],"events":[[1688169600001,"Go"]]}]`,
+	}
+	var sent map[string]interface{}
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/druid/v2", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &sent))
+		_, _ = w.Write([]byte(responses[sent["queryType"].(string)]))
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url)
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+	july := func(day, ms int) time.Time {
+		return time.Date(2023, 7, day, 0, 0, 0, ms*int(time.Millisecond), time.UTC)
+	}
+
+	for _, tc := range []struct {
+		query   string
+		ctx     context.Context
+		columns []string
+		rows    [][]interface{}
+	}{
+		{
+			query:   `{"queryType":"timeseries","dataSource":"wikipedia","granularity":"day"}`,
+			columns: []string{"timestamp", "edits", "added"},
+			rows:    [][]interface{}{{july(1, 0), int64(100), 12.5}, {july(2, 0), int64(50), nil}},
+		},
+		{
+			query:   ` NATIVE: {"queryType":"topN","dataSource":"wikipedia"}`,
+			columns: []string{"timestamp", "page", "edits"},
+			rows:    [][]interface{}{{july(1, 0), "Main", int64(10)}, {july(1, 0), "Go", int64(5)}},
+		},
+		{
+			query:   `{"queryType":"groupBy","dataSource":"wikipedia"}`,
+			columns: []string{"timestamp", "page", "edits", "users"},
+			rows:    [][]interface{}{{july(1, 0), "Main", int64(10), nil}, {july(1, 0), "Go", int64(5), int64(2)}},
+		},
+		{
+			query:   "\n" + `{"queryType":"scan","dataSource":"wikipedia"}`,
+			ctx:     WithNative(ctx),
+			columns: []string{"__time", "page"},
+			rows:    [][]interface{}{{july(1, 0), "Main"}, {july(1, 1), "Go"}},
+		},
+	} {
+		queryCtx := tc.ctx
+		if queryCtx == nil {
+			queryCtx = ctx
+		}
+		rows, err := db.QueryContext(queryCtx, tc.query)
+		require.NoError(t, err, tc.query)
+		columns, err := rows.Columns()
+		require.NoError(t, err)
+		require.Equal(t, tc.columns, columns)
+
+		var got [][]interface{}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			require.NoError(t, rows.Scan(dest...))
+			for i, v := range values {
+				if ts, ok := v.(time.Time); ok {
+					values[i] = ts.UTC()
+				}
+			}
+			got = append(got, values)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t, tc.rows, got, tc.query)
+		require.NoError(t, rows.Close())
+	}
+
+	// The timestamp scans into a time.Time as SQL timestamps do
+	var day time.Time
+	var edits int64
+	require.NoError(t, db.QueryRowContext(ctx, `{"queryType":"timeseries","dataSource":"wikipedia"}`).Scan(&day, &edits, new(sql.NullFloat64)))
+	require.Equal(t, july(1, 0), day.UTC())
+	require.Equal(t, int64(100), edits)
+
+	for _, query := range []string{
+		`{"queryType":"timeBoundary","dataSource":"wikipedia"}`,
+		`NATIVE: SELECT 1`,
+	} {
+		_, err = db.QueryContext(ctx, query)
+		require.True(t, errors.Is(err, ErrCreatingRequest), query)
+	}
+	_, err = db.QueryContext(ctx, `{"queryType":"scan","dataSource":"wikipedia"}`, 1)
+	require.True(t, errors.Is(err, ErrCreatingRequest))
+}
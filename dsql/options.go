@@ -0,0 +1,57 @@
+package dsql
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a Connector created with NewConnector
+type Option func(*Connector)
+
+// WithHTTPClient makes the connector send every request with client. The
+// connector won't close a client it was given
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Connector) {
+		c.client = client
+		c.ownsTransport = false
+	}
+}
+
+// WithTransport makes the connector send every request through rt, e.g. to
+// stub druid out in tests or add tracing
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Connector) {
+		c.client = &http.Client{Transport: rt}
+		c.ownsTransport = false
+	}
+}
+
+// WithAuthenticator makes the connector authenticate requests with auth
+// instead of basic auth from Config.User and Config.Passwd
+func WithAuthenticator(auth Authenticator) Option {
+	return func(c *Connector) {
+		c.auth = auth
+	}
+}
+
+// WithHooks registers callbacks for events of the connector
+func WithHooks(hooks Hooks) Option {
+	return func(c *Connector) {
+		c.hooks = hooks
+	}
+}
+
+// WithLogger makes the connector log through logger, it replaces Config.Logger
+func WithLogger(logger Logger) Option {
+	return func(c *Connector) {
+		c.cfg.Logger = logger
+	}
+}
+
+// WithHealthCheck pings every broker each interval in the background until
+// the connector is closed, results are passed to Hooks.HealthCheck
+func WithHealthCheck(interval time.Duration) Option {
+	return func(c *Connector) {
+		c.healthInterval = interval
+	}
+}
@@ -0,0 +1,66 @@
+package dsql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// queryParameter is a dynamic parameter bound to a ? placeholder
+// https://druid.apache.org/docs/latest/querying/sql.html#dynamic-parameters
+type queryParameter struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// druidTimestampLayout is the literal format druid accepts for TIMESTAMP parameters
+const druidTimestampLayout = "2006-01-02 15:04:05.000"
+
+// toQueryParameters converts args to druid parameters, formatting times as
+// literals in zone, which should be the query's sqlTimeZone. nil means UTC
+func toQueryParameters(args []driver.Value, zone *time.Location) ([]queryParameter, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	params := make([]queryParameter, 0, len(args))
+	for i, arg := range args {
+		param, err := toQueryParameter(arg, zone)
+		if err != nil {
+			return nil, fmt.Errorf("druid: parameter %d: %v", i+1, err)
+		}
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+func toQueryParameter(arg driver.Value, zone *time.Location) (queryParameter, error) {
+	if zone == nil {
+		zone = time.UTC
+	}
+
+	switch v := arg.(type) {
+	case nil:
+		return queryParameter{Type: "VARCHAR", Value: nil}, nil
+	case string:
+		return queryParameter{Type: "VARCHAR", Value: v}, nil
+	case []byte:
+		return queryParameter{Type: "VARCHAR", Value: string(v)}, nil
+	case bool:
+		return queryParameter{Type: "BOOLEAN", Value: v}, nil
+	case int64:
+		return queryParameter{Type: "BIGINT", Value: v}, nil
+	case float64:
+		return queryParameter{Type: "DOUBLE", Value: v}, nil
+	case []string, StringArray, []int64, []int, []float64, []interface{}, Array:
+		values, err := arrayParameter(v)
+		if err != nil {
+			return queryParameter{}, err
+		}
+		return queryParameter{Type: "ARRAY", Value: values}, nil
+	case time.Time:
+		return queryParameter{Type: "TIMESTAMP", Value: v.In(zone).Format(druidTimestampLayout)}, nil
+	default:
+		return queryParameter{}, fmt.Errorf("unsupported type %T", arg)
+	}
+}
@@ -0,0 +1,420 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases of MSQ stages
+const (
+	StageNew          = "NEW"
+	StageReadingInput = "READING_INPUT"
+	StagePostReading  = "POST_READING"
+	StageResultsReady = "RESULTS_READY"
+	StageFinished     = "FINISHED"
+	StageFailed       = "FAILED"
+)
+
+// TaskReport is the report of a multi-stage query (MSQ) task, run for SQL
+// ingestion, ExecContext statements and asynchronous queries. Reports of
+// running tasks describe their progress so far
+// https://druid.apache.org/docs/latest/api-reference/sql-ingestion-api.html#get-the-report-for-a-query-task
+type TaskReport struct {
+	TaskID string           `json:"taskId"`
+	Status TaskReportStatus `json:"status"`
+	Stages []StageReport    `json:"stages"`
+
+	// Counters are the counters of each worker of each stage, by stage
+	// number then worker number
+	Counters map[int]map[int]WorkerCounters `json:"counters"`
+}
+
+// TaskReportStatus is the state of an MSQ task
+type TaskReportStatus struct {
+	// Status is RUNNING, SUCCESS or FAILED
+	Status       string     `json:"status"`
+	ErrorReport  *MSQError  `json:"errorReport"`
+	Warnings     []MSQError `json:"warnings"`
+	StartTime    time.Time  `json:"startTime"`
+	DurationMs   int64      `json:"durationMs"`
+	PendingTasks int        `json:"pendingTasks"`
+	RunningTasks int        `json:"runningTasks"`
+}
+
+// MSQError is an error or warning of an MSQ task, with the stage and the
+// worker task it was raised by, if known
+type MSQError struct {
+	TaskID              string   `json:"taskId"`
+	Host                string   `json:"host"`
+	StageNumber         *int     `json:"stageNumber"`
+	Fault               MSQFault `json:"error"`
+	ExceptionStackTrace string   `json:"exceptionStackTrace"`
+}
+
+// MSQFault describes an MSQ error, such as TooManyWarnings or
+// InsertTimeNull
+type MSQFault struct {
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (e *MSQError) Error() string {
+	msg := e.Fault.ErrorCode
+	if e.Fault.ErrorMessage != "" {
+		msg = e.Fault.ErrorCode + ": " + e.Fault.ErrorMessage
+	}
+	if e.StageNumber != nil {
+		return fmt.Sprintf("stage %d: %s", *e.StageNumber, msg)
+	}
+	return msg
+}
+
+// StageReport describes a stage of an MSQ task
+type StageReport struct {
+	StageNumber    int             `json:"stageNumber"`
+	Definition     StageDefinition `json:"definition"`
+	Phase          string          `json:"phase"`
+	WorkerCount    int             `json:"workerCount"`
+	PartitionCount int             `json:"partitionCount"`
+	StartTime      time.Time       `json:"startTime"`
+
+	// Duration is how long the stage ran in milliseconds
+	Duration int64 `json:"duration"`
+}
+
+// StageDefinition is what a stage of an MSQ task runs
+type StageDefinition struct {
+	ID        string `json:"id"`
+	Processor struct {
+		Type string `json:"type"`
+	} `json:"processor"`
+	MaxWorkerCount int `json:"maxWorkerCount"`
+}
+
+// WorkerCounters are the counters of a worker in a stage
+type WorkerCounters struct {
+	// Inputs are the counters of each of the stage's inputs, by number
+	Inputs map[int]ChannelCounters
+
+	Output            *ChannelCounters
+	Shuffle           *ChannelCounters
+	SortProgress      *SortProgress
+	SegmentGeneration *SegmentGenerationProgress
+
+	// Warnings are the numbers of warnings raised, by error code
+	Warnings map[string]int64
+}
+
+// ChannelCounters count what went through an input or output channel, by
+// partition
+type ChannelCounters struct {
+	Rows       []int64 `json:"rows"`
+	Bytes      []int64 `json:"bytes"`
+	Frames     []int64 `json:"frames"`
+	Files      []int64 `json:"files"`
+	TotalFiles []int64 `json:"totalFiles"`
+}
+
+// TotalRows returns the rows of every partition
+func (c *ChannelCounters) TotalRows() int64 {
+	return sum(c.Rows)
+}
+
+// TotalBytes returns the bytes of every partition
+func (c *ChannelCounters) TotalBytes() int64 {
+	return sum(c.Bytes)
+}
+
+// SortProgress is the progress of a worker sorting its output
+type SortProgress struct {
+	TotalMergingLevels int     `json:"totalMergingLevels"`
+	ProgressDigest     float64 `json:"progressDigest"`
+}
+
+// SegmentGenerationProgress is the progress of a worker writing segments
+type SegmentGenerationProgress struct {
+	RowsProcessed int64 `json:"rowsProcessed"`
+	RowsPersisted int64 `json:"rowsPersisted"`
+	RowsMerged    int64 `json:"rowsMerged"`
+	RowsPushed    int64 `json:"rowsPushed"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, reading the report from the
+// overlord's reports response or the report alone
+func (r *TaskReport) UnmarshalJSON(b []byte) error {
+	var response struct {
+		MultiStageQuery *struct {
+			TaskID  string          `json:"taskId"`
+			Payload json.RawMessage `json:"payload"`
+		} `json:"multiStageQuery"`
+	}
+	if err := json.Unmarshal(b, &response); err != nil {
+		return err
+	}
+	taskID := ""
+	if msq := response.MultiStageQuery; msq != nil {
+		taskID, b = msq.TaskID, msq.Payload
+	}
+
+	var payload struct {
+		TaskID   string                                           `json:"taskId"`
+		Status   TaskReportStatus                                 `json:"status"`
+		Stages   []StageReport                                    `json:"stages"`
+		Counters map[string]map[string]map[string]json.RawMessage `json:"counters"`
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return err
+	}
+	if taskID == "" {
+		taskID = payload.TaskID
+	}
+	*r = TaskReport{TaskID: taskID, Status: payload.Status, Stages: payload.Stages}
+
+	if len(payload.Counters) > 0 {
+		r.Counters = make(map[int]map[int]WorkerCounters, len(payload.Counters))
+	}
+	for stageKey, workers := range payload.Counters {
+		stage, err := strconv.Atoi(stageKey)
+		if err != nil {
+			return fmt.Errorf("stage %q: %v", stageKey, err)
+		}
+		r.Counters[stage] = make(map[int]WorkerCounters, len(workers))
+		for workerKey, counters := range workers {
+			worker, err := strconv.Atoi(workerKey)
+			if err != nil {
+				return fmt.Errorf("worker %q: %v", workerKey, err)
+			}
+			wc, err := decodeWorkerCounters(counters)
+			if err != nil {
+				return fmt.Errorf("stage %d worker %d: %v", stage, worker, err)
+			}
+			r.Counters[stage][worker] = wc
+		}
+	}
+	return nil
+}
+
+// decodeWorkerCounters decodes a worker's counters by their names,
+// skipping those it doesn't know
+func decodeWorkerCounters(counters map[string]json.RawMessage) (WorkerCounters, error) {
+	var wc WorkerCounters
+	for name, raw := range counters {
+		var err error
+		switch {
+		case strings.HasPrefix(name, "input"):
+			n, convErr := strconv.Atoi(strings.TrimPrefix(name, "input"))
+			if convErr != nil {
+				continue
+			}
+			var c ChannelCounters
+			if err = json.Unmarshal(raw, &c); err == nil {
+				if wc.Inputs == nil {
+					wc.Inputs = make(map[int]ChannelCounters)
+				}
+				wc.Inputs[n] = c
+			}
+		case name == "output":
+			err = json.Unmarshal(raw, &wc.Output)
+		case name == "shuffle":
+			err = json.Unmarshal(raw, &wc.Shuffle)
+		case name == "sortProgress":
+			err = json.Unmarshal(raw, &wc.SortProgress)
+		case name == "segmentGenerationProgress":
+			err = json.Unmarshal(raw, &wc.SegmentGeneration)
+		case name == "warnings":
+			var warnings map[string]interface{}
+			if err = json.Unmarshal(raw, &warnings); err == nil {
+				for code, v := range warnings {
+					if n, ok := v.(float64); ok {
+						if wc.Warnings == nil {
+							wc.Warnings = make(map[string]int64)
+						}
+						wc.Warnings[code] = int64(n)
+					}
+				}
+			}
+		}
+		if err != nil {
+			return wc, fmt.Errorf("counter %s: %v", name, err)
+		}
+	}
+	return wc, nil
+}
+
+// Stage returns the report of a stage, false when there's none
+func (r *TaskReport) Stage(stage int) (StageReport, bool) {
+	for _, s := range r.Stages {
+		if s.StageNumber == stage {
+			return s, true
+		}
+	}
+	return StageReport{}, false
+}
+
+// FailedStage returns the stage the task failed in, false when it didn't
+// fail or the failure wasn't raised by a stage
+func (r *TaskReport) FailedStage() (StageReport, bool) {
+	if e := r.Status.ErrorReport; e != nil && e.StageNumber != nil {
+		if s, ok := r.Stage(*e.StageNumber); ok {
+			return s, true
+		}
+	}
+	for _, s := range r.Stages {
+		if s.Phase == StageFailed {
+			return s, true
+		}
+	}
+	return StageReport{}, false
+}
+
+// StageInput returns the rows and bytes a stage has read, from all its
+// inputs and workers
+func (r *TaskReport) StageInput(stage int) (rows, bytes int64) {
+	for _, wc := range r.Counters[stage] {
+		for _, c := range wc.Inputs {
+			rows += c.TotalRows()
+			bytes += c.TotalBytes()
+		}
+	}
+	return rows, bytes
+}
+
+// StageOutput returns the rows and bytes a stage has written, from all its
+// workers
+func (r *TaskReport) StageOutput(stage int) (rows, bytes int64) {
+	for _, wc := range r.Counters[stage] {
+		if wc.Output != nil {
+			rows += wc.Output.TotalRows()
+			bytes += wc.Output.TotalBytes()
+		}
+	}
+	return rows, bytes
+}
+
+// RowsPushed returns the rows the task pushed to segments, false when it
+// doesn't write segments, as for a SELECT
+func (r *TaskReport) RowsPushed() (int64, bool) {
+	var rows int64
+	found := false
+	for _, workers := range r.Counters {
+		for _, wc := range workers {
+			if wc.SegmentGeneration != nil {
+				rows += wc.SegmentGeneration.RowsPushed
+				found = true
+			}
+		}
+	}
+	return rows, found
+}
+
+// Err returns the error the task failed with, nil when it didn't fail
+func (r *TaskReport) Err() error {
+	if r.Status.ErrorReport == nil {
+		return nil
+	}
+	return r.Status.ErrorReport
+}
+
+// String summarizes the task's progress, one stage at a time
+func (r *TaskReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", r.TaskID, r.Status.Status)
+	stages := append([]StageReport(nil), r.Stages...)
+	sort.Slice(stages, func(i, j int) bool { return stages[i].StageNumber < stages[j].StageNumber })
+	for _, s := range stages {
+		in, _ := r.StageInput(s.StageNumber)
+		out, _ := r.StageOutput(s.StageNumber)
+		fmt.Fprintf(&b, ", stage %d %s %s: %d rows in, %d rows out", s.StageNumber, s.Definition.Processor.Type, s.Phase, in, out)
+	}
+	return b.String()
+}
+
+// FetchTaskReport returns the report of an MSQ task, such as one
+// ExecContext submitted or an asynchronous query, from the overlord
+func FetchTaskReport(ctx context.Context, db *sql.DB, taskID string) (*TaskReport, error) {
+	conn, err := connectionOf(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return conn.taskReport(ctx, taskID)
+}
+
+// taskReport fetches the report of a task from the overlord
+func (c *connection) taskReport(ctx context.Context, taskID string) (*TaskReport, error) {
+	body, err := c.apiRequest(ctx, http.MethodGet, c.taskURL(taskID, "reports"), nil)
+	if err != nil {
+		return nil, wrapErr(ErrTaskStatus, err)
+	}
+	var report TaskReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, wrapErr(ErrTaskStatus, fmt.Errorf("decoding report of task %s: %v", taskID, err))
+	}
+	if report.TaskID == "" {
+		report.TaskID = taskID
+	}
+	return &report, nil
+}
+
+// reportProgress passes the current report of a task to the progress
+// callback of ctx, if any. Reports may not be available yet, so failing
+// to fetch one is only logged
+func (c *connection) reportProgress(ctx context.Context, taskID string) *TaskReport {
+	progress := taskProgress(ctx)
+	if progress == nil {
+		return nil
+	}
+	report, err := c.taskReport(ctx, taskID)
+	if err != nil {
+		c.Cfg.logger().Log(LevelDebug, "druid: task report unavailable", "task", taskID, "error", c.Cfg.redact(err.Error()))
+		return nil
+	}
+	progress(report)
+	return report
+}
+
+// failure returns the error of a failed task, naming the stage it failed
+// in when its report says
+func (c *connection) failure(ctx context.Context, sentinel error, taskID, msg string, report *TaskReport) error {
+	if report == nil {
+		report, _ = c.taskReport(ctx, taskID)
+	}
+	if report != nil && report.Status.ErrorReport != nil {
+		e := report.Status.ErrorReport
+		if stage, ok := report.FailedStage(); ok {
+			return wrapErr(sentinel, fmt.Errorf("%s: stage %d (%s): %s", taskID, stage.StageNumber, stage.Definition.Processor.Type, faultMessage(e.Fault, msg)))
+		}
+		return wrapErr(sentinel, fmt.Errorf("%s: %s", taskID, faultMessage(e.Fault, msg)))
+	}
+	if msg == "" {
+		msg = "no error message"
+	}
+	return wrapErr(sentinel, fmt.Errorf("%s: %s", taskID, msg))
+}
+
+// faultMessage describes a fault, falling back to msg
+func faultMessage(f MSQFault, msg string) string {
+	switch {
+	case f.ErrorCode != "" && f.ErrorMessage != "":
+		return f.ErrorCode + ": " + f.ErrorMessage
+	case f.ErrorCode != "":
+		return f.ErrorCode
+	case msg != "":
+		return msg
+	}
+	return "no error message"
+}
+
+func sum(values []int64) int64 {
+	var total int64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
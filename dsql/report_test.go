@@ -0,0 +1,145 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const mockRunningReport = `{"multiStageQuery":{"type":"multiStageQuery","taskId":"query-1","payload":{
+	"status":{"status":"RUNNING","startTime":"2023-07-26T10:00:00.000Z","durationMs":5200,"pendingTasks":0,"runningTasks":3,
+		"warnings":[{"taskId":"query-1-worker0_0","host":"localhost:8101","stageNumber":0,"error":{"errorCode":"CannotParseExternalData","errorMessage":"Unable to parse row [x]"}}]},
+	"stages":[
+		{"stageNumber":0,"definition":{"id":"a_0","processor":{"type":"scan"},"maxWorkerCount":2},"phase":"RESULTS_READY","workerCount":2,"partitionCount":1,"startTime":"2023-07-26T10:00:01.000Z","duration":3000},
+		{"stageNumber":1,"definition":{"id":"a_1","processor":{"type":"segmentGenerator"},"maxWorkerCount":1},"phase":"READING_INPUT","workerCount":1,"startTime":"2023-07-26T10:00:04.000Z","duration":1200}
+	],
+	"counters":{
+		"0":{"0":{"input0":{"type":"channel","rows":[600],"bytes":[6000],"files":[1],"totalFiles":[1]},"output":{"type":"channel","rows":[600],"bytes":[3000],"frames":[1]},"sortProgress":{"type":"sortProgress","totalMergingLevels":3,"progressDigest":1.0},"warnings":{"type":"warnings","CannotParseExternalData":1}},
+		     "1":{"input0":{"type":"channel","rows":[400],"bytes":[4000]},"output":{"type":"channel","rows":[399],"bytes":[2000]}}},
+		"1":{"0":{"input0":{"type":"channel","rows":[500,200]},"segmentGenerationProgress":{"type":"segmentGenerationProgress","rowsProcessed":700,"rowsPersisted":700,"rowsMerged":0,"rowsPushed":0}}}
+	}
+}}}`
+
+const mockFailedReport = `{"multiStageQuery":{"type":"multiStageQuery","taskId":"query-1","payload":{
+	"status":{"status":"FAILED","errorReport":{"taskId":"query-1-worker0_0","host":"localhost:8101","stageNumber":1,
+		"error":{"errorCode":"InsertTimeNull","errorMessage":"Encountered a null timestamp in the __time field during INSERT or REPLACE."}}},
+	"stages":[
+		{"stageNumber":0,"definition":{"id":"a_0","processor":{"type":"scan"}},"phase":"FINISHED","workerCount":1},
+		{"stageNumber":1,"definition":{"id":"a_1","processor":{"type":"segmentGenerator"}},"phase":"FAILED","workerCount":1}
+	]
+}}}`
+
+func TestDecodeTaskReport(t *testing.T) {
+	var report TaskReport
+	require.NoError(t, json.Unmarshal([]byte(mockRunningReport), &report))
+
+	require.Equal(t, "query-1", report.TaskID)
+	require.Equal(t, "RUNNING", report.Status.Status)
+	require.Equal(t, 3, report.Status.RunningTasks)
+	require.Equal(t, int64(5200), report.Status.DurationMs)
+	require.Len(t, report.Status.Warnings, 1)
+	require.Equal(t, "stage 0: CannotParseExternalData: Unable to parse row [x]", report.Status.Warnings[0].Error())
+	require.NoError(t, report.Err())
+
+	require.Len(t, report.Stages, 2)
+	stage, ok := report.Stage(1)
+	require.True(t, ok)
+	require.Equal(t, "segmentGenerator", stage.Definition.Processor.Type)
+	require.Equal(t, StageReadingInput, stage.Phase)
+	_, ok = report.FailedStage()
+	require.False(t, ok)
+
+	rows, bytes := report.StageInput(0)
+	require.Equal(t, int64(1000), rows)
+	require.Equal(t, int64(10000), bytes)
+	rows, bytes = report.StageOutput(0)
+	require.Equal(t, int64(999), rows)
+	require.Equal(t, int64(5000), bytes)
+	rows, _ = report.StageInput(1)
+	require.Equal(t, int64(700), rows)
+
+	worker := report.Counters[0][0]
+	require.Equal(t, 3, worker.SortProgress.TotalMergingLevels)
+	require.Equal(t, map[string]int64{"CannotParseExternalData": 1}, worker.Warnings)
+	require.Equal(t, int64(700), report.Counters[1][0].SegmentGeneration.RowsProcessed)
+
+	pushed, ok := report.RowsPushed()
+	require.True(t, ok)
+	require.Equal(t, int64(0), pushed)
+
+	require.Equal(t, "query-1 RUNNING, stage 0 scan RESULTS_READY: 1000 rows in, 999 rows out, stage 1 segmentGenerator READING_INPUT: 700 rows in, 0 rows out", report.String())
+}
+
+func TestFailedTaskReport(t *testing.T) {
+	var report TaskReport
+	require.NoError(t, json.Unmarshal([]byte(mockFailedReport), &report))
+
+	stage, ok := report.FailedStage()
+	require.True(t, ok)
+	require.Equal(t, 1, stage.StageNumber)
+	require.EqualError(t, report.Err(), "stage 1: InsertTimeNull: Encountered a null timestamp in the __time field during INSERT or REPLACE.")
+
+	_, ok = report.RowsPushed()
+	require.False(t, ok)
+}
+
+func TestExecReportsTaskProgress(t *testing.T) {
+	var statuses, reports int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/druid/v2/sql/task":
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"taskId":"query-1","state":"RUNNING"}`))
+		case "/druid/indexer/v1/task/query-1/status":
+			status := taskRunning
+			if atomic.AddInt32(&statuses, 1) > 2 {
+				status = taskFailed
+			}
+			_, _ = w.Write([]byte(`{"task":"query-1","status":{"id":"query-1","statusCode":"` + status + `","errorMsg":"see report"}}`))
+		case "/druid/indexer/v1/task/query-1/reports":
+			// The report isn't there until the controller has started
+			switch atomic.AddInt32(&reports, 1) {
+			case 1:
+				w.WriteHeader(http.StatusNotFound)
+			case 2:
+				_, _ = w.Write([]byte(mockRunningReport))
+			default:
+				_, _ = w.Write([]byte(mockFailedReport))
+			}
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	progress := make(chan *TaskReport, 10)
+	ctx := WithTaskProgress(WithTaskWait(context.Background(), time.Millisecond), func(r *TaskReport) { progress <- r })
+	_, err = db.ExecContext(ctx, "INSERT INTO t SELECT * FROM s PARTITIONED BY DAY")
+	require.True(t, errors.Is(err, ErrTaskFailed))
+	require.Contains(t, err.Error(), "query-1: stage 1 (segmentGenerator): InsertTimeNull: Encountered a null timestamp")
+	close(progress)
+
+	var phases []string
+	for r := range progress {
+		phases = append(phases, r.Status.Status)
+	}
+	require.Equal(t, []string{"RUNNING", "FAILED"}, phases)
+
+	report, err := FetchTaskReport(context.Background(), db, "query-1")
+	require.NoError(t, err)
+	require.Equal(t, "query-1", report.TaskID)
+	require.Error(t, report.Err())
+}
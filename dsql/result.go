@@ -2,14 +2,21 @@ package dsql
 
 import "database/sql/driver"
 
-type result struct{}
+type result struct {
+	rowsAffected    int64
+	hasRowsAffected bool
+}
 
 // LastInsertId is a noop
 func (r *result) LastInsertId() (id int64, err error) {
 	return id, driver.ErrSkip
 }
 
-// RowsAffected is a noop as this driver does not support inserts
+// RowsAffected returns the rows written by a statement ExecContext waited
+// for, it's unknown otherwise
 func (r *result) RowsAffected() (rows int64, err error) {
-	return rows, driver.ErrSkip
+	if !r.hasRowsAffected {
+		return rows, driver.ErrSkip
+	}
+	return r.rowsAffected, nil
 }
@@ -3,8 +3,8 @@ package dsql
 import (
 	"database/sql/driver"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"time"
 )
 
@@ -15,11 +15,46 @@ type resultSet struct {
 	cancelled   bool
 	dateField   string
 	dateFormat  string
+
+	// columnTypes are the SQL types of the columns, when druid sent them
+	columnTypes []string
+
+	// druidTypes are the native druid types of the columns, i.e LONG or
+	// ARRAY<STRING>, when druid sent them
+	druidTypes []string
+
+	// location is the time.Location timestamps are returned in
+	location *time.Location
+}
+
+// druidType returns the native type of column i, or "" when it's unknown
+func (rs *resultSet) druidType(i int) string {
+	if i < len(rs.druidTypes) {
+		return rs.druidTypes[i]
+	}
+	return ""
+}
+
+// timeFormat returns how column i is decoded to a time.Time, and whether
+// it's a timestamp column at all
+func (rs *resultSet) timeFormat(i int) (string, bool) {
+	if isDateField(rs.dateField, rs.columnNames[i]) {
+		return rs.dateFormat, true
+	}
+	if i < len(rs.columnTypes) && isTimestampType(rs.columnTypes[i]) {
+		return "", true
+	}
+	return "", false
 }
 
 type rows struct {
 	conn      *connection
 	resultSet resultSet
+
+	// nextPage returns the values of the next page of results once those
+	// of resultSet are exhausted, nil values when there are no more. Only
+	// asynchronous queries are paged
+	nextPage func() ([][]interface{}, error)
 }
 
 func (r *rows) Columns() (cols []string) {
@@ -36,7 +71,9 @@ func (r *rows) Close() (err error) {
 // Next value
 func (r *rows) Next(dest []driver.Value) error {
 	if !r.HasNextResultSet() {
-		return io.EOF
+		if err := r.fetchPage(); err != nil {
+			return err
+		}
 	}
 
 	data := r.resultSet.rows[r.resultSet.currentRow]
@@ -45,27 +82,44 @@ func (r *rows) Next(dest []driver.Value) error {
 	}
 
 	for i := range dest {
-		// Parse pre-defined timestamp field
-		if r.resultSet.columnNames[i] == r.resultSet.dateField {
-
-			log.Println("col: ", r.resultSet.columnNames[i])
-			log.Println("date field: ", r.resultSet.dateField)
-
-			// This refers to ISO8601
-			if r.resultSet.dateFormat == "iso" {
-				t, err := time.Parse(time.RFC3339Nano, data[i].Value.Interface().(string))
-				if err != nil {
-					log.Fatal("druid: failed to parse given datetime field: ", err.Error())
-				}
-				dest[i] = t
-				continue
+		if data[i].Type == nil {
+			dest[i] = nil
+			continue
+		}
+
+		if format, ok := r.resultSet.timeFormat(i); ok {
+			t, err := parseTimestamp(data[i].Value.Interface(), format, r.resultSet.location)
+			if err != nil {
+				return fmt.Errorf("%w (column %s)", err, r.resultSet.columnNames[i])
+			}
+			dest[i] = t
+			continue
+		}
+
+		if isComplexType(r.resultSet.druidType(i)) {
+			value, err := complexValue(data[i].Value.Interface())
+			if err != nil {
+				return fmt.Errorf("%w (column %s)", err, r.resultSet.columnNames[i])
+			}
+			dest[i] = value
+			continue
+		}
+
+		if _, isObject := data[i].Value.Interface().(map[string]interface{}); isObject || r.resultSet.druidType(i) == druidJSONType {
+			value, err := jsonValue(data[i].Value.Interface())
+			if err != nil {
+				return err
 			}
+			dest[i] = value
+			continue
+		}
 
-			// @todo(e.v) - add more time formats here...
+		if values, ok := data[i].Value.Interface().([]interface{}); ok {
+			dest[i] = arrayValue(values, r.resultSet.druidType(i))
+			continue
 		}
 
 		switch data[i].Type.Name() {
-		// TODO: []byte
 		case "bool":
 			dest[i] = data[i].Value.Interface().(bool)
 		case "string":
@@ -74,10 +128,12 @@ func (r *rows) Next(dest []driver.Value) error {
 			dest[i] = data[i].Value.Interface().(int)
 		case "int64":
 			dest[i] = data[i].Value.Interface().(int64)
+		case "float32":
+			dest[i] = float64(data[i].Value.Interface().(float32))
 		case "float64":
 			dest[i] = data[i].Value.Interface().(float64)
 		default:
-			log.Fatal("druid: can't scan type ", data[i].Type.Name())
+			return fmt.Errorf("druid: can't scan type %s (column %s)", data[i].Type, r.resultSet.columnNames[i])
 		}
 	}
 
@@ -86,6 +142,26 @@ func (r *rows) Next(dest []driver.Value) error {
 	return nil
 }
 
+// fetchPage replaces the exhausted result set's rows with those of the next
+// page that has any, io.EOF when there's none
+func (r *rows) fetchPage() error {
+	for r.nextPage != nil {
+		values, err := r.nextPage()
+		if err != nil {
+			return err
+		}
+		if values == nil {
+			r.nextPage = nil
+			break
+		}
+		if len(values) > 0 {
+			r.resultSet.rows, r.resultSet.currentRow = toFields(values), 0
+			return nil
+		}
+	}
+	return io.EOF
+}
+
 // HasNextResultSet implements driver.RowsNextResultSet
 func (r *rows) HasNextResultSet() bool {
 	return r.resultSet.currentRow != len(r.resultSet.rows)
@@ -0,0 +1,73 @@
+package dsql
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup shares the result of identical queries running at the same time
+type flightGroup struct {
+	mtx   sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a request in progress and the callers waiting on it
+type flight struct {
+	done    chan struct{}
+	body    []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flight)}
+}
+
+// do runs fn once for all concurrent callers with the same key and returns
+// its result to each of them. fn's context carries no values of any caller,
+// as it's shared by all of them, and is only cancelled once every caller
+// waiting on it has given up
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	g.mtx.Lock()
+	f, ok := g.calls[key]
+	if !ok {
+		flightCtx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = f
+
+		go func() {
+			f.body, f.err = fn(flightCtx)
+			g.forget(key, f)
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mtx.Unlock()
+
+	select {
+	case <-f.done:
+		return f.body, f.err
+	case <-ctx.Done():
+		g.mtx.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if g.calls[key] == f {
+				delete(g.calls, key)
+			}
+		}
+		g.mtx.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes f so later callers start a new request
+func (g *flightGroup) forget(key string, f *flight) {
+	g.mtx.Lock()
+	if g.calls[key] == f {
+		delete(g.calls, key)
+	}
+	g.mtx.Unlock()
+}
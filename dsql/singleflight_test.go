@@ -0,0 +1,194 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlightGroupSharesResult(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+
+	var calls int32
+	fn := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("body"), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan []byte, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := g.do(context.Background(), "k", fn)
+			if err == nil {
+				results <- body
+			}
+		}()
+	}
+
+	// Give every caller a chance to join the flight before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	count := 0
+	for body := range results {
+		require.Equal(t, []byte("body"), body)
+		count++
+	}
+	require.Equal(t, 10, count)
+}
+
+func TestFlightGroupCancelsOnlyWhenEveryCallerCancels(t *testing.T) {
+	g := newFlightGroup()
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fn := func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := g.do(ctx1, "k", fn)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := g.do(ctx2, "k", fn)
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel1()
+	require.True(t, errors.Is(<-errs, context.Canceled))
+	select {
+	case <-cancelled:
+		t.Fatal("shared request cancelled while a caller is still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel2()
+	require.True(t, errors.Is(<-errs, context.Canceled))
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("shared request not cancelled after every caller gave up")
+	}
+}
+
+func TestConcurrentQueriesAreCoalesced(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"channel"}, [][]interface{}{{"STRING"}, {"VARCHAR"}, {"#en.wikipedia"}, {"#ca.wikipedia"}})
+
+	var requests int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url, CoalesceQueries: true})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query("SELECT channel FROM wiki")
+			if !assertNoError(t, err) {
+				return
+			}
+			defer rows.Close()
+
+			var channels []string
+			for rows.Next() {
+				var channel string
+				assertNoError(t, rows.Scan(&channel))
+				channels = append(channels, channel)
+			}
+			if len(channels) != 2 {
+				t.Errorf("expected every caller to see both rows, got %v", channels)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestCoalescedQueriesDontShareCallerValues(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"n"}, [][]interface{}{{"LONG"}, {"BIGINT"}, {1}})
+	release := make(chan struct{})
+	var requests int32
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	type tenantKey struct{}
+	var mtx sync.Mutex
+	var tenants []interface{}
+	provider := func(ctx context.Context) (string, error) {
+		mtx.Lock()
+		tenants = append(tenants, ctx.Value(tenantKey{}))
+		mtx.Unlock()
+		return "pw", nil
+	}
+
+	connector, err := NewConnector(&Config{BrokerAddr: url, User: "bob", PasswordProvider: provider, CoalesceQueries: true})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for _, tag := range []string{"a", "a", "b"} {
+		ctx := WithCallerTag(context.WithValue(context.Background(), tenantKey{}, tag), tag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int64
+			assertNoError(t, db.QueryRowContext(ctx, "SELECT 1").Scan(&n))
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Callers with different tags aren't coalesced, and no caller's values
+	// reach the shared request
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	require.Equal(t, []interface{}{nil, nil}, tenants)
+}
+
+func assertNoError(t *testing.T, err error) bool {
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package dsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// ErrTaskFailed is returned when a task ExecContext waited for failed
+	ErrTaskFailed = errors.New("druid: task failed")
+
+	// ErrTaskStatus is returned when a task's status or report can't be fetched
+	ErrTaskStatus = errors.New("druid: error fetching task status")
+)
+
+// defaultTaskPollInterval is how often tasks are polled when WithTaskWait
+// isn't given an interval
+const defaultTaskPollInterval = time.Second
+
+// Task states druid reports
+const (
+	taskRunning = "RUNNING"
+	taskSuccess = "SUCCESS"
+	taskFailed  = "FAILED"
+)
+
+// taskRequest is a statement submitted to the SQL task or statements endpoint
+// https://druid.apache.org/docs/latest/api-reference/sql-ingestion-api.html
+type taskRequest struct {
+	Query      string                 `json:"query"`
+	Parameters []queryParameter       `json:"parameters,omitempty"`
+	Context    map[string]interface{} `json:"context,omitempty"`
+}
+
+// taskResponse is the SQL task endpoint's response to a submitted statement
+type taskResponse struct {
+	TaskID string `json:"taskId"`
+	State  string `json:"state"`
+}
+
+// taskStatusResponse is the overlord's response to a task status request
+type taskStatusResponse struct {
+	Task   string `json:"task"`
+	Status struct {
+		StatusCode string `json:"statusCode"`
+		ErrorMsg   string `json:"errorMsg"`
+	} `json:"status"`
+}
+
+// ExecContext implements driver.ExecerContext. Statements, such as SQL
+// ingestion with INSERT or REPLACE, are submitted to druid as tasks. The
+// result's RowsAffected is only known when the task was waited for with
+// WithTaskWait, LastInsertId never is
+func (c *connection) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	vals, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	request, err := c.newQueryRequest(ctx, q, vals)
+	if err != nil {
+		return nil, wrapErr(ErrCreatingRequest, err)
+	}
+
+	taskID, err := c.submitTask(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if hooks := c.hooks(); hooks.TaskSubmitted != nil {
+		hooks.TaskSubmitted(ctx, q, taskID)
+	}
+
+	interval, wait := taskWait(ctx)
+	if !wait {
+		return &result{}, nil
+	}
+	report, err := c.waitForTask(ctx, taskID, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	if report == nil {
+		if report, err = c.taskReport(ctx, taskID); err != nil {
+			return nil, err
+		}
+	}
+	rows, ok := report.RowsPushed()
+	return &result{rowsAffected: rows, hasRowsAffected: ok}, nil
+}
+
+// submitTask submits request to the SQL task endpoint and returns the id
+// of the task druid created
+func (c *connection) submitTask(ctx context.Context, request *queryRequest) (string, error) {
+	payload, err := json.Marshal(taskRequest{
+		Query:      request.Query,
+		Parameters: request.Parameters,
+		Context:    request.Context,
+	})
+	if err != nil {
+		return "", wrapErr(ErrRequestForm, err)
+	}
+
+	c.Cfg.logger().Log(LevelDebug, "druid: submitting task", "query", c.Cfg.logBody(request.Query))
+	body, err := c.apiRequest(ctx, http.MethodPost, c.Cfg.BrokerAddr+c.Cfg.TaskEndpoint, payload)
+	if err != nil {
+		return "", wrapErr(ErrMakingRequest, err)
+	}
+
+	var response taskResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", wrapErr(ErrMakingRequest, fmt.Errorf("decoding task response: %v", err))
+	}
+	if response.TaskID == "" {
+		return "", wrapErr(ErrMakingRequest, errors.New("no task id in response"))
+	}
+	return response.TaskID, nil
+}
+
+// waitForTask polls the status of a task every interval until it succeeds,
+// fails or ctx is done, passing its report to the progress callback of ctx
+// after each poll. It returns the last report it fetched, if any
+func (c *connection) waitForTask(ctx context.Context, taskID string, interval time.Duration) (*TaskReport, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		body, err := c.apiRequest(ctx, http.MethodGet, c.taskURL(taskID, "status"), nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, wrapErr(ErrTaskStatus, err)
+		}
+		var status taskStatusResponse
+		if err := json.Unmarshal(body, &status); err != nil {
+			return nil, wrapErr(ErrTaskStatus, fmt.Errorf("decoding status of task %s: %v", taskID, err))
+		}
+
+		report := c.reportProgress(ctx, taskID)
+		switch status.Status.StatusCode {
+		case taskSuccess:
+			return report, nil
+		case taskFailed:
+			return report, c.failure(ctx, ErrTaskFailed, taskID, status.Status.ErrorMsg, report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// taskURL returns the overlord URL of a task's status or reports
+func (c *connection) taskURL(taskID, resource string) string {
+	return fmt.Sprintf("%s/druid/indexer/v1/task/%s/%s", c.Cfg.OverlordAddr, url.PathEscape(taskID), resource)
+}
+
+// apiRequest sends a request to one of druid's APIs other than the SQL
+// query endpoint and returns the response body. Each request is bounded
+// by Config.Timeout, waiting for a task or query isn't
+func (c *connection) apiRequest(ctx context.Context, method, target string, payload []byte) ([]byte, error) {
+	if c.Cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Cfg.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, c.Cfg.redactErr(err)
+	}
+	req = req.WithContext(ctx)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := c.connector.authenticate(req); err != nil {
+		return nil, err
+	}
+
+	res, err := c.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, c.Cfg.redactErr(err)
+	}
+	defer res.Body.Close()
+
+	respBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNoContent {
+		logger := c.Cfg.logger()
+		logger.Log(LevelError, "druid: request returned an error status", "status", res.StatusCode)
+		logger.Log(LevelDebug, "druid: error response", "status", res.StatusCode, "body", c.Cfg.logBody(string(respBody)))
+		return nil, &statusError{code: res.StatusCode, message: errorMessage(respBody)}
+	}
+	return respBody, nil
+}
+
+// errorMessage returns the message of a druid error response, empty when
+// body isn't one
+func errorMessage(body []byte) string {
+	var response struct {
+		Error        string `json:"error"`
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return ""
+	}
+	if response.ErrorMessage != "" {
+		return response.ErrorMessage
+	}
+	return response.Error
+}
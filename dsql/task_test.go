@@ -0,0 +1,163 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const mockTaskReport = `{"multiStageQuery":{"taskId":"query-1","payload":{
+	"status":{"status":"SUCCESS"},
+	"counters":{
+		"0":{"0":{"input0":{"type":"channel","rows":[1000]}}},
+		"1":{"0":{"segmentGenerationProgress":{"type":"segmentGenerationProgress","rowsProcessed":600,"rowsPushed":600}},
+		     "1":{"segmentGenerationProgress":{"type":"segmentGenerationProgress","rowsProcessed":400,"rowsPushed":400}}}
+	}
+}}}`
+
+// mockTaskServer serves the SQL task endpoint and the status and reports
+// of task query-1, which runs for polls status requests before ending in
+// finalStatus
+func mockTaskServer(t *testing.T, polls int32, finalStatus string, submitted *taskRequest) http.HandlerFunc {
+	var seen int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/druid/v2/sql/task":
+			require.Equal(t, http.MethodPost, r.Method)
+			require.NoError(t, json.NewDecoder(r.Body).Decode(submitted))
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"taskId":"query-1","state":"RUNNING"}`))
+		case "/druid/indexer/v1/task/query-1/status":
+			status := taskRunning
+			if atomic.AddInt32(&seen, 1) > polls {
+				status = finalStatus
+			}
+			_, _ = w.Write([]byte(`{"task":"query-1","status":{"id":"query-1","statusCode":"` + status + `","errorMsg":"InsertTimeNull"}}`))
+		case "/druid/indexer/v1/task/query-1/reports":
+			_, _ = w.Write([]byte(mockTaskReport))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func TestExecSubmitsTask(t *testing.T) {
+	var submitted taskRequest
+	ts, url := startMockServer(mockTaskServer(t, 0, taskSuccess, &submitted))
+	defer ts.Close()
+
+	var tasks []string
+	connector, err := NewConnector(&Config{BrokerAddr: url}, WithHooks(Hooks{
+		TaskSubmitted: func(ctx context.Context, query, taskID string) { tasks = append(tasks, taskID) },
+	}))
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx := WithQueryContext(context.Background(), map[string]interface{}{"maxNumTasks": 3})
+	res, err := db.ExecContext(ctx, "INSERT INTO t SELECT * FROM s WHERE a = ? PARTITIONED BY DAY", "x")
+	require.NoError(t, err)
+	require.Equal(t, []string{"query-1"}, tasks)
+	require.Equal(t, "INSERT INTO t SELECT * FROM s WHERE a = ? PARTITIONED BY DAY", submitted.Query)
+	require.Equal(t, []queryParameter{{Type: "VARCHAR", Value: "x"}}, submitted.Parameters)
+	require.Equal(t, map[string]interface{}{"maxNumTasks": float64(3)}, submitted.Context)
+
+	// Without waiting the rows written aren't known yet
+	_, err = res.RowsAffected()
+	require.Error(t, err)
+	_, err = res.LastInsertId()
+	require.Error(t, err)
+}
+
+func TestExecWaitsForTask(t *testing.T) {
+	var submitted taskRequest
+	ts, url := startMockServer(mockTaskServer(t, 2, taskSuccess, &submitted))
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx := WithTaskWait(context.Background(), time.Millisecond)
+	res, err := db.ExecContext(ctx, "REPLACE INTO t OVERWRITE ALL SELECT * FROM s PARTITIONED BY DAY")
+	require.NoError(t, err)
+	rows, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), rows)
+}
+
+func TestExecTaskFailure(t *testing.T) {
+	var submitted taskRequest
+	ts, url := startMockServer(mockTaskServer(t, 1, taskFailed, &submitted))
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err = db.ExecContext(WithTaskWait(context.Background(), time.Millisecond), "INSERT INTO t SELECT * FROM s PARTITIONED BY DAY")
+	require.True(t, errors.Is(err, ErrTaskFailed))
+	require.Contains(t, err.Error(), "query-1: InsertTimeNull")
+
+	// Waiting stops with the context
+	ts2, url2 := startMockServer(mockTaskServer(t, 1<<30, taskSuccess, &submitted))
+	defer ts2.Close()
+	connector, err = NewConnector(&Config{BrokerAddr: url2})
+	require.NoError(t, err)
+	db2 := sql.OpenDB(connector)
+	defer db2.Close()
+
+	ctx, cancel := context.WithTimeout(WithTaskWait(context.Background(), time.Millisecond), 20*time.Millisecond)
+	defer cancel()
+	_, err = db2.ExecContext(ctx, "INSERT INTO t SELECT * FROM s PARTITIONED BY DAY")
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestExecRejectedStatement(t *testing.T) {
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"Plan validation failed","errorMessage":"INSERT must have a PARTITIONED BY clause"}`))
+	})
+	defer ts.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: url})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	_, err = db.ExecContext(context.Background(), "INSERT INTO t SELECT * FROM s")
+	require.True(t, errors.Is(err, ErrMakingRequest))
+	require.Contains(t, err.Error(), "status code: 400: INSERT must have a PARTITIONED BY clause")
+}
+
+func TestTaskStatusFromOverlord(t *testing.T) {
+	var submitted taskRequest
+	overlord, overlordURL := startMockServer(mockTaskServer(t, 0, taskSuccess, &submitted))
+	defer overlord.Close()
+	broker, brokerURL := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/druid/v2/sql/task", r.URL.Path)
+		_, _ = w.Write([]byte(`{"taskId":"query-1","state":"RUNNING"}`))
+	})
+	defer broker.Close()
+
+	connector, err := NewConnector(&Config{BrokerAddr: brokerURL, OverlordAddr: overlordURL})
+	require.NoError(t, err)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	res, err := db.ExecContext(WithTaskWait(context.Background(), 0), "INSERT INTO t SELECT * FROM s PARTITIONED BY DAY")
+	require.NoError(t, err)
+	rows, err := res.RowsAffected()
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), rows)
+}
@@ -0,0 +1,261 @@
+package dsql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrParsingTime is returned when a timestamp column can't be decoded
+var ErrParsingTime = errors.New("druid: failed to parse timestamp")
+
+// Date formats understood by Config.DateFormat, anything else is used as a
+// Go time layout
+const (
+	dateFormatISO     = "iso"
+	dateFormatMillis  = "millis"
+	dateFormatSeconds = "seconds"
+)
+
+// sqlTimeZoneKey is the query context entry setting the time zone druid
+// buckets, parses and formats times in
+const sqlTimeZoneKey = "sqlTimeZone"
+
+// offsetPattern matches fixed offset time zones such as +05:30
+var offsetPattern = regexp.MustCompile(`^([+-])(\d{2}):?(\d{2})$`)
+
+// loadTimeZone returns the location named by an IANA name like
+// America/New_York or a fixed offset like -08:00, the forms druid accepts
+// for sqlTimeZone
+func loadTimeZone(name string) (*time.Location, error) {
+	if m := offsetPattern.FindStringSubmatch(name); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+
+	zone, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %v", name, err)
+	}
+	return zone, nil
+}
+
+// sqlTimeZoneName returns the name druid knows zone by: its IANA name, or
+// an offset like +05:30 for a fixed zone whatever it's called. time.Local
+// is looked up through $TZ or /etc/localtime. Zones with neither are an error
+func sqlTimeZoneName(zone *time.Location) (string, error) {
+	name := zone.String()
+	switch {
+	case zone == time.Local:
+		if local, ok := localZoneName(); ok {
+			return local, nil
+		}
+	case offsetPattern.MatchString(name):
+		return name, nil
+	case name != "" && name != "Local":
+		if loaded, err := time.LoadLocation(name); err == nil && sameOffsets(zone, loaded) {
+			return name, nil
+		}
+	}
+
+	if offset, ok := fixedOffset(zone); ok {
+		sign := '+'
+		if offset < 0 {
+			sign, offset = '-', -offset
+		}
+		return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset/60%60), nil
+	}
+	return "", fmt.Errorf("time zone %q has no IANA name or fixed offset to send as sqlTimeZone", name)
+}
+
+// localZoneName returns the IANA name of time.Local, as go finds it
+func localZoneName() (string, bool) {
+	name, ok := os.LookupEnv("TZ")
+	name = strings.TrimPrefix(name, ":")
+	switch {
+	case ok && name == "":
+		return "UTC", true
+	case !ok || filepath.IsAbs(name):
+		file := "/etc/localtime"
+		if ok {
+			file = name
+		}
+		target, err := filepath.EvalSymlinks(file)
+		i := strings.LastIndex(target, "zoneinfo/")
+		if err != nil || i < 0 {
+			return "", false
+		}
+		name = target[i+len("zoneinfo/"):]
+	}
+
+	zone, err := time.LoadLocation(name)
+	if err != nil || !sameOffsets(zone, time.Local) {
+		return "", false
+	}
+	return name, true
+}
+
+// zoneProbes are instants zones are compared at, either side of daylight
+// saving in both hemispheres over a few years
+var zoneProbes = func() []time.Time {
+	var probes []time.Time
+	for year := 2000; year <= 2030; year += 5 {
+		probes = append(probes,
+			time.Date(year, time.January, 15, 12, 0, 0, 0, time.UTC),
+			time.Date(year, time.July, 15, 12, 0, 0, 0, time.UTC))
+	}
+	return probes
+}()
+
+// sameOffsets reports whether a and b are the same distance from UTC at
+// every probe
+func sameOffsets(a, b *time.Location) bool {
+	for _, t := range zoneProbes {
+		_, x := t.In(a).Zone()
+		_, y := t.In(b).Zone()
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// fixedOffset returns zone's offset from UTC if it never changes
+func fixedOffset(zone *time.Location) (int, bool) {
+	_, offset := zoneProbes[0].In(zone).Zone()
+	return offset, sameOffsets(zone, time.FixedZone("", offset))
+}
+
+// sqlTypeNames are the type names druid sends in the sqlTypesHeader row
+var sqlTypeNames = map[string]bool{
+	"ANY": true, "ARRAY": true, "BIGINT": true, "BINARY": true, "BOOLEAN": true,
+	"CHAR": true, "DATE": true, "DECIMAL": true, "DOUBLE": true, "FLOAT": true,
+	"INTEGER": true, "MAP": true, "NULL": true, "OTHER": true, "REAL": true,
+	"ROW": true, "SMALLINT": true, "TIME": true, "TIMESTAMP": true,
+	"TIMESTAMP_WITH_LOCAL_TIME_ZONE": true, "TINYINT": true, "VARBINARY": true,
+	"VARCHAR": true,
+}
+
+// isSQLTypeName reports whether name is a type druid sends in the
+// sqlTypesHeader row
+func isSQLTypeName(name string) bool {
+	return sqlTypeNames[name]
+}
+
+// isTimestampType reports whether values of the SQL type are sent as times
+func isTimestampType(sqlType string) bool {
+	switch sqlType {
+	case "TIMESTAMP", "DATE", "TIMESTAMP_WITH_LOCAL_TIME_ZONE":
+		return true
+	}
+	return false
+}
+
+// isDateField reports whether column is one of the comma separated fields
+func isDateField(fields string, column string) bool {
+	if fields == "" {
+		return false
+	}
+	for _, f := range strings.Split(fields, ",") {
+		if strings.TrimSpace(f) == column {
+			return true
+		}
+	}
+	return false
+}
+
+// validDateFormat reports whether format is one parseTimestamp understands,
+// a custom layout has to contain at least one layout element
+func validDateFormat(format string) bool {
+	switch format {
+	case "", dateFormatISO, dateFormatMillis, dateFormatSeconds:
+		return true
+	}
+	return time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(format) != format
+}
+
+// parseTimestamp decodes a value druid returned for a timestamp column.
+// An empty or iso format accepts ISO 8601 strings and epoch milliseconds,
+// which is how druid sends TIMESTAMP columns. loc is the location times
+// without an offset are read in and every time is returned in, UTC when nil
+func parseTimestamp(value interface{}, format string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var t time.Time
+	var err error
+	switch format {
+	case "", dateFormatISO:
+		if s, ok := value.(string); ok {
+			t, err = parseISOTime(s, loc)
+		} else {
+			t, err = epochTime(value, time.Millisecond)
+		}
+	case dateFormatMillis:
+		t, err = epochTime(value, time.Millisecond)
+	case dateFormatSeconds:
+		t, err = epochTime(value, time.Second)
+	default:
+		s, ok := value.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("%w: expected a string for layout %q, got %T", ErrParsingTime, format, value)
+		}
+		t, err = time.ParseInLocation(format, s, loc)
+	}
+	if err != nil {
+		return time.Time{}, wrapErr(ErrParsingTime, err)
+	}
+	return t.In(loc), nil
+}
+
+// isoLayouts are tried in order by parseISOTime
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// parseISOTime parses the ISO 8601 forms druid formats timestamps and dates as
+func parseISOTime(s string, loc *time.Location) (t time.Time, err error) {
+	for _, layout := range isoLayouts {
+		if t, err = time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// epochTime converts a number of units since the unix epoch to a time
+func epochTime(value interface{}, unit time.Duration) (time.Time, error) {
+	var n float64
+	switch v := value.(type) {
+	case float64:
+		n = v
+	case float32:
+		n = float64(v)
+	case int:
+		return time.Unix(0, 0).Add(time.Duration(v) * unit), nil
+	case int32:
+		return time.Unix(0, 0).Add(time.Duration(v) * unit), nil
+	case int64:
+		return time.Unix(0, 0).Add(time.Duration(v) * unit), nil
+	default:
+		return time.Time{}, fmt.Errorf("expected an epoch number, got %T", value)
+	}
+
+	whole, frac := math.Modf(n)
+	return time.Unix(0, 0).Add(time.Duration(whole)*unit + time.Duration(frac*float64(unit))), nil
+}
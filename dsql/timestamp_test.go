@@ -0,0 +1,194 @@
+package dsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+	want := time.Date(2013, 1, 1, 10, 30, 0, 250e6, time.UTC)
+
+	cases := []struct {
+		value  interface{}
+		format string
+		loc    *time.Location
+		want   time.Time
+	}{
+		{"2013-01-01T10:30:00.250Z", "", nil, want},
+		{"2013-01-01T10:30:00.250Z", "iso", nil, want},
+		{"2013-01-01T05:30:00.250-05:00", "iso", nil, want},
+		{float64(1357036200250), "", nil, want},
+		{float64(1357036200250), "millis", nil, want},
+		{int64(1357036200250), "millis", nil, want},
+		{1357036200.25, "seconds", nil, want},
+		{int64(1357036200), "seconds", nil, want.Truncate(time.Second)},
+		{"01/01/2013 10:30", "01/02/2006 15:04", nil, want.Truncate(time.Second)},
+		{"2013-01-01", "", nil, time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2013-01-01T10:30:00.250Z", "", london, want.In(london)},
+		{"2013-07-01 10:30:00", "", london, time.Date(2013, 7, 1, 9, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range cases {
+		got, err := parseTimestamp(tc.value, tc.format, tc.loc)
+		require.NoError(t, err, "%v %q", tc.value, tc.format)
+		require.True(t, tc.want.Equal(got), "%v %q: got %v", tc.value, tc.format, got)
+		if tc.loc != nil {
+			require.Equal(t, tc.loc, got.Location())
+		} else {
+			require.Equal(t, time.UTC, got.Location())
+		}
+	}
+
+	for _, bad := range []struct {
+		value  interface{}
+		format string
+	}{
+		{"yesterday", ""},
+		{"2013-01-01", "millis"},
+		{float64(1), "2006-01-02"},
+		{true, "seconds"},
+	} {
+		_, err := parseTimestamp(bad.value, bad.format, nil)
+		require.True(t, errors.Is(err, ErrParsingTime), "%v %q", bad.value, bad.format)
+	}
+}
+
+func TestTimestampColumnsScanIntoTime(t *testing.T) {
+	output, _ := constructMockResults([]interface{}{"__time", "floored", "channel", "created"}, [][]interface{}{
+		{"LONG", "LONG", "STRING", "LONG"},
+		{"TIMESTAMP", "TIMESTAMP", "VARCHAR", "BIGINT"},
+		{"2013-01-01T10:30:00.250Z", "2013-01-01T00:00:00.000Z", "#en.wikipedia", 1357036200},
+		{"2013-01-02T10:30:00.000Z", nil, "#fr.wikipedia", 1357122600},
+	})
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url+"?dateField=created&dateFormat=seconds&loc=America/New_York")
+	require.NoError(t, err)
+	defer db.Close()
+
+	rows, err := db.Query("SELECT __time, TIME_FLOOR(__time, 'P1D') AS floored, channel, created FROM wiki")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	var times []time.Time
+	for rows.Next() {
+		var ts, created time.Time
+		var floored sql.NullTime
+		var channel string
+		require.NoError(t, rows.Scan(&ts, &floored, &channel, &created))
+		require.Equal(t, newYork, ts.Location())
+		require.True(t, ts.Truncate(time.Second).Equal(created))
+		times = append(times, ts)
+		if floored.Valid {
+			require.True(t, floored.Time.Equal(time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)))
+		}
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, times, 2)
+	require.True(t, times[0].Equal(time.Date(2013, 1, 1, 10, 30, 0, 250e6, time.UTC)))
+}
+
+func TestTimeZoneAppliesToContextParametersAndResults(t *testing.T) {
+	var got queryRequest
+	ts, url := startMockServer(func(w http.ResponseWriter, r *http.Request) {
+		got = queryRequest{}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		output, _ := constructMockResults([]interface{}{"day"}, [][]interface{}{
+			{"LONG"},
+			{"TIMESTAMP"},
+			{"2020-01-02T00:00:00.000-05:00"},
+		})
+		_, _ = w.Write(output)
+	})
+	defer ts.Close()
+
+	db, err := sql.Open("druid", url+"?timeZone=America/New_York")
+	require.NoError(t, err)
+	defer db.Close()
+
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	since := time.Date(2020, 1, 2, 5, 0, 0, 0, time.UTC)
+
+	var day time.Time
+	require.NoError(t, db.QueryRow("SELECT TIME_FLOOR(__time, 'P1D') AS day FROM t WHERE __time >= ?", since).Scan(&day))
+	require.Equal(t, map[string]interface{}{"sqlTimeZone": "America/New_York"}, got.Context)
+	require.Equal(t, "2020-01-02 00:00:00.000", got.Parameters[0].Value)
+	require.Equal(t, newYork, day.Location())
+	require.True(t, day.Equal(since))
+
+	// A single query can run in another zone
+	india := time.FixedZone("+05:30", 5*3600+30*60)
+	ctx := WithTimeZone(context.Background(), india)
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT TIME_FLOOR(__time, 'P1D') AS day FROM t WHERE __time >= ?", since).Scan(&day))
+	require.Equal(t, map[string]interface{}{"sqlTimeZone": "+05:30"}, got.Context)
+	require.Equal(t, "2020-01-02 10:30:00.000", got.Parameters[0].Value)
+	require.Equal(t, india, day.Location())
+
+	// So can one setting sqlTimeZone in its query context
+	ctx = WithQueryContext(context.Background(), map[string]interface{}{"sqlTimeZone": "-08:00"})
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT TIME_FLOOR(__time, 'P1D') AS day FROM t WHERE __time >= ?", since).Scan(&day))
+	require.Equal(t, "2020-01-01 21:00:00.000", got.Parameters[0].Value)
+	_, offset := day.Zone()
+	require.Equal(t, -8*3600, offset)
+
+	ctx = WithQueryContext(context.Background(), map[string]interface{}{"sqlTimeZone": "Mars/Olympus_Mons"})
+	require.Error(t, db.QueryRowContext(ctx, "SELECT 1").Scan(&day))
+
+	// Zones are sent by a name druid understands, whatever go calls them
+	ctx = WithTimeZone(context.Background(), time.FixedZone("IST", 5*3600+30*60))
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT TIME_FLOOR(__time, 'P1D') AS day FROM t").Scan(&day))
+	require.Equal(t, map[string]interface{}{"sqlTimeZone": "+05:30"}, got.Context)
+}
+
+func TestSQLTimeZoneName(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	for expected, zone := range map[string]*time.Location{
+		"UTC":              time.UTC,
+		"America/New_York": newYork,
+		"+05:30":           time.FixedZone("IST", 5*3600+30*60),
+		"-03:30":           time.FixedZone("-03:30", -(3*3600 + 30*60)),
+		"+00:00":           time.FixedZone("", 0),
+		"-01:00":           time.FixedZone("America/New_York", -3600),
+	} {
+		name, err := sqlTimeZoneName(zone)
+		require.NoError(t, err, expected)
+		require.Equal(t, expected, name)
+	}
+
+	// time.Local is sent as the zone it stands for
+	name, err := sqlTimeZoneName(time.Local)
+	require.NoError(t, err)
+	require.NotEqual(t, "Local", name)
+	local, err := loadTimeZone(name)
+	require.NoError(t, err)
+	require.True(t, sameOffsets(local, time.Local), name)
+
+	// A zone with daylight saving and a name druid doesn't know can't be sent
+	data, err := ioutil.ReadFile("/usr/share/zoneinfo/America/New_York")
+	if err != nil {
+		t.Skip("no zoneinfo: ", err)
+	}
+	custom, err := time.LoadLocationFromTZData("Eastern", data)
+	require.NoError(t, err)
+	_, err = sqlTimeZoneName(custom)
+	require.Error(t, err)
+}
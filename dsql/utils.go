@@ -1,8 +1,10 @@
 package dsql
 
 import (
+	"crypto/rand"
 	"database/sql/driver"
 	"errors"
+	"fmt"
 )
 
 func namedValuesToValues(namedValues []driver.NamedValue) (values []driver.Value, err error) {
@@ -10,7 +12,14 @@ func namedValuesToValues(namedValues []driver.NamedValue) (values []driver.Value
 		if len(val.Name) > 0 {
 			return values, errors.New("druid: named values not supported")
 		}
-		values = append(values, val)
+		values = append(values, val.Value)
 	}
 	return
 }
+
+// newQueryID returns a random identifier in the form druid uses for sqlQueryId
+func newQueryID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
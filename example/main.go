@@ -23,7 +23,11 @@ func newConnection() (*sqlx.DB, error) {
 		DateField:    "created_at",
 		Smile:        true,
 	}
-	db, err := sqlx.Open("druid", cfg.FormatDSN())
+	dsn, err := cfg.FormatDSN()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Open("druid", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,6 @@
 module github.com/peak-ai/go-druid
 
-go 1.15
+go 1.17
 
 require (
 	github.com/jmoiron/sqlx v1.3.1
@@ -8,3 +8,9 @@ require (
 	github.com/stretchr/testify v1.7.0
 	github.com/zencoder/go-smile v0.0.0-20201125115512-b261ba0acaa3
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
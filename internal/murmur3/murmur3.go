@@ -0,0 +1,114 @@
+// Package murmur3 implements the MurmurHash3 variants used by druid's
+// extensions, so values hashed in Go land in the same place as in druid
+package murmur3
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	c1 = 0x87c37b91114253d5
+	c2 = 0x4cf5ad432745937f
+)
+
+// Sum128 returns MurmurHash3_x64_128 of data, as DataSketches hashes items
+// into Theta and HLL sketches
+func Sum128(data []byte, seed uint64) (h1, h2 uint64) {
+	h1, h2 = seed, seed
+
+	nblocks := len(data) / 16
+	for i := 0; i < nblocks; i++ {
+		k1 := binary.LittleEndian.Uint64(data[i*16:])
+		k2 := binary.LittleEndian.Uint64(data[i*16+8:])
+
+		h1 ^= mixK1(k1)
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		h2 ^= mixK2(k2)
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	tail := data[nblocks*16:]
+	var k1, k2 uint64
+	for i := len(tail) - 1; i >= 8; i-- {
+		k2 ^= uint64(tail[i]) << (uint(i-8) * 8)
+	}
+	if len(tail) > 8 {
+		h2 ^= mixK2(k2)
+	}
+	for i := min(len(tail), 8) - 1; i >= 0; i-- {
+		k1 ^= uint64(tail[i]) << (uint(i) * 8)
+	}
+	if len(tail) > 0 {
+		h1 ^= mixK1(k1)
+	}
+
+	h1 ^= uint64(len(data))
+	h2 ^= uint64(len(data))
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+// Hash64 returns the 64 bit variant of MurmurHash3 in Hive's Murmur3
+// class, as druid's BloomKFilter hashes values. It isn't either half of
+// Sum128
+func Hash64(data []byte, seed int32) uint64 {
+	h := uint64(int64(seed))
+
+	nblocks := len(data) / 8
+	for i := 0; i < nblocks; i++ {
+		k := binary.LittleEndian.Uint64(data[i*8:])
+		h ^= mixK1(k)
+		h = bits.RotateLeft64(h, 27)*5 + 0x52dce729
+	}
+
+	tail := data[nblocks*8:]
+	var k uint64
+	for i := len(tail) - 1; i >= 0; i-- {
+		k ^= uint64(tail[i]) << (uint(i) * 8)
+	}
+	if len(tail) > 0 {
+		h ^= mixK1(k)
+	}
+
+	h ^= uint64(len(data))
+	return fmix64(h)
+}
+
+func mixK1(k uint64) uint64 {
+	k *= c1
+	k = bits.RotateLeft64(k, 31)
+	return k * c2
+}
+
+func mixK2(k uint64) uint64 {
+	k *= c2
+	k = bits.RotateLeft64(k, 33)
+	return k * c1
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
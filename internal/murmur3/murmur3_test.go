@@ -0,0 +1,41 @@
+package murmur3
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSum128(t *testing.T) {
+	// Reference values of the canonical C++ implementation
+	h1, h2 := Sum128([]byte("The quick brown fox jumps over the lazy dog"), 0)
+	require.Equal(t, uint64(0xe34bbc7bbc071b6c), h1)
+	require.Equal(t, uint64(0x7a433ca9c49a9347), h2)
+
+	h1, h2 = Sum128(nil, 0)
+	require.Equal(t, uint64(0), h1)
+	require.Equal(t, uint64(0), h2)
+}
+
+func TestSum128DataSketchesSeedHash(t *testing.T) {
+	// DataSketches stores the low 16 bits of the hash of its seed in every
+	// sketch, 0x93cc for the default seed of 9001
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], 9001)
+	h1, _ := Sum128(seed[:], 0)
+	require.Equal(t, uint16(0x93cc), uint16(h1))
+}
+
+func TestHash64(t *testing.T) {
+	// Reference value of Hive's TestMurmur3.testHashCodeM3_64, hashed with
+	// Murmur3.DEFAULT_SEED as druid's BloomKFilter hashes values
+	text := []byte("It was the best of times, it was the worst of times, it was the age of wisdom, " +
+		"it was the age of foolishness, it was the epoch of belief, it was the epoch of incredulity, " +
+		"it was the season of Light, it was the season of Darkness, it was the spring of hope, " +
+		"it was the winter of despair, we had everything before us, we had nothing before us, " +
+		"we were all going direct to Heaven, we were all going direct the other way.")
+	require.Equal(t, int64(305830725663368540), int64(Hash64(text, 104729)))
+
+	require.NotEqual(t, Hash64([]byte("a"), 104729), Hash64([]byte("b"), 104729))
+}
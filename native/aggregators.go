@@ -0,0 +1,379 @@
+package native
+
+import "fmt"
+
+// Aggregator is a native aggregator, built by the functions of this package
+// https://druid.apache.org/docs/latest/querying/aggregations.html
+type Aggregator interface {
+	Validate() error
+	aggregator()
+}
+
+// CountAggregator counts rows
+type CountAggregator struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// Count returns an aggregator counting rows as name. Rows are counted after
+// rollup, sum a count metric ingested with them to count raw rows
+func Count(name string) *CountAggregator {
+	return &CountAggregator{Type: "count", Name: name}
+}
+
+// Validate checks the aggregator is complete
+func (a *CountAggregator) Validate() error {
+	return requireField("count aggregator", "name", a.Name)
+}
+
+func (*CountAggregator) aggregator() {}
+
+// FieldAggregator sums, or takes the minimum or maximum of, a numeric
+// column or expression
+type FieldAggregator struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	FieldName  string `json:"fieldName,omitempty"`
+	Expression string `json:"expression,omitempty"`
+}
+
+// LongSum returns an aggregator summing column fieldName as a long
+func LongSum(name, fieldName string) *FieldAggregator {
+	return &FieldAggregator{Type: "longSum", Name: name, FieldName: fieldName}
+}
+
+// LongMin returns an aggregator taking the minimum of column fieldName as a
+// long
+func LongMin(name, fieldName string) *FieldAggregator {
+	return &FieldAggregator{Type: "longMin", Name: name, FieldName: fieldName}
+}
+
+// LongMax returns an aggregator taking the maximum of column fieldName as a
+// long
+func LongMax(name, fieldName string) *FieldAggregator {
+	return &FieldAggregator{Type: "longMax", Name: name, FieldName: fieldName}
+}
+
+// DoubleSum returns an aggregator summing column fieldName as a double
+func DoubleSum(name, fieldName string) *FieldAggregator {
+	return &FieldAggregator{Type: "doubleSum", Name: name, FieldName: fieldName}
+}
+
+// DoubleMin returns an aggregator taking the minimum of column fieldName as
+// a double
+func DoubleMin(name, fieldName string) *FieldAggregator {
+	return &FieldAggregator{Type: "doubleMin", Name: name, FieldName: fieldName}
+}
+
+// DoubleMax returns an aggregator taking the maximum of column fieldName as
+// a double
+func DoubleMax(name, fieldName string) *FieldAggregator {
+	return &FieldAggregator{Type: "doubleMax", Name: name, FieldName: fieldName}
+}
+
+// OfExpression aggregates expression, in druid's expression language,
+// instead of a column
+func (a *FieldAggregator) OfExpression(expression string) *FieldAggregator {
+	a.FieldName, a.Expression = "", expression
+	return a
+}
+
+// Validate checks the aggregator is complete
+func (a *FieldAggregator) Validate() error {
+	part := a.Type + " aggregator"
+	if (a.FieldName == "") == (a.Expression == "") {
+		return invalidPart(part, "needs one of fieldName or expression")
+	}
+	return requireField(part, "name", a.Name)
+}
+
+func (*FieldAggregator) aggregator() {}
+
+// CardinalityAggregator estimates the number of distinct values, or
+// combinations of values, of dimensions
+type CardinalityAggregator struct {
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	Fields []string `json:"fields"`
+	ByRow  bool     `json:"byRow,omitempty"`
+	Round  bool     `json:"round,omitempty"`
+}
+
+// Cardinality returns an aggregator estimating the number of distinct values
+// of fields, or of their combinations when byRow is set
+func Cardinality(name string, byRow bool, fields ...string) *CardinalityAggregator {
+	return &CardinalityAggregator{Type: "cardinality", Name: name, Fields: fields, ByRow: byRow}
+}
+
+// Validate checks the aggregator is complete
+func (a *CardinalityAggregator) Validate() error {
+	if len(a.Fields) == 0 {
+		return invalidPart("cardinality aggregator", "no fields")
+	}
+	return requireField("cardinality aggregator", "name", a.Name)
+}
+
+func (*CardinalityAggregator) aggregator() {}
+
+// SketchAggregator builds, or merges, a datasketches sketch of a column
+// https://druid.apache.org/docs/latest/development/extensions-core/datasketches-extension.html
+type SketchAggregator struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	FieldName string `json:"fieldName"`
+
+	// Size is the nominal entries of theta sketches
+	Size int `json:"size,omitempty"`
+
+	// LgK is log2 of the buckets of HLL sketches
+	LgK int `json:"lgK,omitempty"`
+
+	// K is the accuracy of quantiles sketches
+	K int `json:"k,omitempty"`
+}
+
+// ThetaSketch returns an aggregator building a theta sketch of column
+// fieldName, or merging the sketches it holds, with size nominal entries, a
+// power of 2. Zero keeps druid's default
+func ThetaSketch(name, fieldName string, size int) *SketchAggregator {
+	return &SketchAggregator{Type: "thetaSketch", Name: name, FieldName: fieldName, Size: size}
+}
+
+// HLLSketchBuild returns an aggregator building an HLL sketch of column
+// fieldName with 2^lgK buckets, lgK from 4 to 21. Zero keeps druid's default
+func HLLSketchBuild(name, fieldName string, lgK int) *SketchAggregator {
+	return &SketchAggregator{Type: "HLLSketchBuild", Name: name, FieldName: fieldName, LgK: lgK}
+}
+
+// HLLSketchMerge returns an aggregator merging the HLL sketches of column
+// fieldName, as HLLSketchBuild
+func HLLSketchMerge(name, fieldName string, lgK int) *SketchAggregator {
+	return &SketchAggregator{Type: "HLLSketchMerge", Name: name, FieldName: fieldName, LgK: lgK}
+}
+
+// QuantilesSketch returns an aggregator building a quantiles sketch of
+// column fieldName, or merging the sketches it holds, with accuracy k, a
+// power of 2 from 2 to 32768. Zero keeps druid's default
+func QuantilesSketch(name, fieldName string, k int) *SketchAggregator {
+	return &SketchAggregator{Type: "quantilesDoublesSketch", Name: name, FieldName: fieldName, K: k}
+}
+
+// Validate checks the aggregator is complete and its parameters are in
+// the ranges druid accepts
+func (a *SketchAggregator) Validate() error {
+	part := a.Type + " aggregator"
+	switch {
+	case a.Size != 0 && (a.Size < 16 || !powerOf2(a.Size)):
+		return invalidPart(part, fmt.Sprintf("size %d isn't a power of 2 of at least 16", a.Size))
+	case a.LgK != 0 && (a.LgK < 4 || a.LgK > 21):
+		return invalidPart(part, fmt.Sprintf("lgK %d isn't from 4 to 21", a.LgK))
+	case a.K != 0 && (a.K < 2 || a.K > 32768 || !powerOf2(a.K)):
+		return invalidPart(part, fmt.Sprintf("k %d isn't a power of 2 from 2 to 32768", a.K))
+	}
+	if err := requireField(part, "fieldName", a.FieldName); err != nil {
+		return err
+	}
+	return requireField(part, "name", a.Name)
+}
+
+func (*SketchAggregator) aggregator() {}
+
+// FilteredAggregator aggregates the rows matching a filter
+type FilteredAggregator struct {
+	Type       string     `json:"type"`
+	Filter     Filter     `json:"filter"`
+	Aggregator Aggregator `json:"aggregator"`
+	Name       string     `json:"name,omitempty"`
+}
+
+// Filtered returns an aggregator applying aggregator to the rows matching
+// filter, named as aggregator
+func Filtered(filter Filter, aggregator Aggregator) *FilteredAggregator {
+	return &FilteredAggregator{Type: "filtered", Filter: filter, Aggregator: aggregator}
+}
+
+// Validate checks the aggregator, its filter and aggregator are complete
+func (a *FilteredAggregator) Validate() error {
+	switch {
+	case a.Filter == nil:
+		return invalidPart("filtered aggregator", "nil filter")
+	case a.Aggregator == nil:
+		return invalidPart("filtered aggregator", "nil aggregator")
+	}
+	if err := a.Filter.Validate(); err != nil {
+		return err
+	}
+	return a.Aggregator.Validate()
+}
+
+func (*FilteredAggregator) aggregator() {}
+
+// PostAggregator is a native post-aggregator, built by the functions of
+// this package
+// https://druid.apache.org/docs/latest/querying/post-aggregations.html
+type PostAggregator interface {
+	Validate() error
+	postAggregator()
+}
+
+// ArithmeticPostAggregator applies an arithmetic function to its fields
+type ArithmeticPostAggregator struct {
+	Type     string           `json:"type"`
+	Name     string           `json:"name"`
+	Fn       string           `json:"fn"`
+	Fields   []PostAggregator `json:"fields"`
+	Ordering string           `json:"ordering,omitempty"`
+}
+
+// Arithmetic returns a post-aggregator applying fn, one of + - * / quotient
+// or pow, to fields left to right. Division by zero is 0, use quotient to
+// divide as floats do
+func Arithmetic(name, fn string, fields ...PostAggregator) *ArithmeticPostAggregator {
+	return &ArithmeticPostAggregator{Type: "arithmetic", Name: name, Fn: fn, Fields: fields}
+}
+
+// Validate checks the post-aggregator and its fields are complete
+func (p *ArithmeticPostAggregator) Validate() error {
+	switch p.Fn {
+	case "+", "-", "*", "/", "quotient", "pow":
+	default:
+		return invalidPart("arithmetic post-aggregator", fmt.Sprintf("unknown fn %q", p.Fn))
+	}
+	if len(p.Fields) < 2 {
+		return invalidPart("arithmetic post-aggregator", "fewer than 2 fields")
+	}
+	if err := validatePostAggregators("arithmetic post-aggregator", p.Fields...); err != nil {
+		return err
+	}
+	return requireField("arithmetic post-aggregator", "name", p.Name)
+}
+
+func (*ArithmeticPostAggregator) postAggregator() {}
+
+// FieldAccessPostAggregator returns the value of an aggregator
+type FieldAccessPostAggregator struct {
+	Type      string `json:"type"`
+	Name      string `json:"name,omitempty"`
+	FieldName string `json:"fieldName"`
+}
+
+// FieldAccess returns a post-aggregator returning the raw value of
+// aggregator fieldName, e.g. a sketch rather than its estimate
+func FieldAccess(name, fieldName string) *FieldAccessPostAggregator {
+	return &FieldAccessPostAggregator{Type: "fieldAccess", Name: name, FieldName: fieldName}
+}
+
+// FinalizingFieldAccess returns a post-aggregator returning the final value
+// of aggregator fieldName, as the query results have it
+func FinalizingFieldAccess(name, fieldName string) *FieldAccessPostAggregator {
+	return &FieldAccessPostAggregator{Type: "finalizingFieldAccess", Name: name, FieldName: fieldName}
+}
+
+// Validate checks the post-aggregator is complete
+func (p *FieldAccessPostAggregator) Validate() error {
+	return requireField(p.Type+" post-aggregator", "fieldName", p.FieldName)
+}
+
+func (*FieldAccessPostAggregator) postAggregator() {}
+
+// ConstantPostAggregator returns a constant
+type ConstantPostAggregator struct {
+	Type  string  `json:"type"`
+	Name  string  `json:"name,omitempty"`
+	Value float64 `json:"value"`
+}
+
+// Constant returns a post-aggregator returning value
+func Constant(name string, value float64) *ConstantPostAggregator {
+	return &ConstantPostAggregator{Type: "constant", Name: name, Value: value}
+}
+
+// Validate checks the post-aggregator is complete
+func (p *ConstantPostAggregator) Validate() error {
+	return nil
+}
+
+func (*ConstantPostAggregator) postAggregator() {}
+
+// ExpressionPostAggregator evaluates an expression of aggregators and other
+// post-aggregators
+type ExpressionPostAggregator struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// ExpressionPost returns a post-aggregator evaluating expression, in druid's
+// expression language, which refers to aggregators by name
+func ExpressionPost(name, expression string) *ExpressionPostAggregator {
+	return &ExpressionPostAggregator{Type: "expression", Name: name, Expression: expression}
+}
+
+// Validate checks the post-aggregator is complete
+func (p *ExpressionPostAggregator) Validate() error {
+	if err := requireField("expression post-aggregator", "expression", p.Expression); err != nil {
+		return err
+	}
+	return requireField("expression post-aggregator", "name", p.Name)
+}
+
+func (*ExpressionPostAggregator) postAggregator() {}
+
+// SketchPostAggregator computes a value from a sketch
+type SketchPostAggregator struct {
+	Type     string         `json:"type"`
+	Name     string         `json:"name"`
+	Field    PostAggregator `json:"field"`
+	Round    bool           `json:"round,omitempty"`
+	Fraction *float64       `json:"fraction,omitempty"`
+}
+
+// ThetaSketchEstimate returns a post-aggregator estimating the distinct
+// values of the theta sketch field, usually a FieldAccess
+func ThetaSketchEstimate(name string, field PostAggregator) *SketchPostAggregator {
+	return &SketchPostAggregator{Type: "thetaSketchEstimate", Name: name, Field: field}
+}
+
+// HLLSketchEstimate returns a post-aggregator estimating the distinct
+// values of the HLL sketch field, usually a FieldAccess, rounded if round
+// is set
+func HLLSketchEstimate(name string, field PostAggregator, round bool) *SketchPostAggregator {
+	return &SketchPostAggregator{Type: "HLLSketchEstimate", Name: name, Field: field, Round: round}
+}
+
+// QuantilesSketchToQuantile returns a post-aggregator estimating the value
+// at fraction, from 0 to 1, of the quantiles sketch field, usually a
+// FieldAccess
+func QuantilesSketchToQuantile(name string, field PostAggregator, fraction float64) *SketchPostAggregator {
+	return &SketchPostAggregator{Type: "quantilesDoublesSketchToQuantile", Name: name, Field: field, Fraction: &fraction}
+}
+
+// Validate checks the post-aggregator and its field are complete
+func (p *SketchPostAggregator) Validate() error {
+	part := p.Type + " post-aggregator"
+	if p.Fraction != nil && (*p.Fraction < 0 || *p.Fraction > 1) {
+		return invalidPart(part, fmt.Sprintf("fraction %v isn't from 0 to 1", *p.Fraction))
+	}
+	if err := validatePostAggregators(part, p.Field); err != nil {
+		return err
+	}
+	return requireField(part, "name", p.Name)
+}
+
+func (*SketchPostAggregator) postAggregator() {}
+
+func validatePostAggregators(part string, fields ...PostAggregator) error {
+	for _, field := range fields {
+		if field == nil {
+			return invalidPart(part, "nil field")
+		}
+		if err := field.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func powerOf2(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
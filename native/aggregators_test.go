@@ -0,0 +1,108 @@
+package native
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatorJSON(t *testing.T) {
+	for expected, a := range map[string]Aggregator{
+		`{"type":"count","name":"rows"}`:                                              Count("rows"),
+		`{"type":"longSum","name":"added","fieldName":"added"}`:                       LongSum("added", "added"),
+		`{"type":"doubleMax","name":"delta","expression":"added - deleted"}`:          DoubleMax("delta", "").OfExpression("added - deleted"),
+		`{"type":"cardinality","name":"pages","fields":["page","user"],"byRow":true}`: Cardinality("pages", true, "page", "user"),
+		`{"type":"thetaSketch","name":"users","fieldName":"user","size":16384}`:       ThetaSketch("users", "user", 16384),
+		`{"type":"HLLSketchBuild","name":"users","fieldName":"user","lgK":12}`:        HLLSketchBuild("users", "user", 12),
+		`{"type":"HLLSketchMerge","name":"users","fieldName":"user_hll"}`:             HLLSketchMerge("users", "user_hll", 0),
+		`{"type":"quantilesDoublesSketch","name":"latency","fieldName":"ms","k":128}`: QuantilesSketch("latency", "ms", 128),
+		`{"type":"filtered","filter":{"type":"selector","dimension":"robot","value":"true"},
+			"aggregator":{"type":"count","name":"robots"}}`: Filtered(Selector("robot", "true"), Count("robots")),
+	} {
+		require.NoError(t, a.Validate(), expected)
+		requireJSON(t, expected, a)
+	}
+}
+
+func TestPostAggregatorJSON(t *testing.T) {
+	for expected, p := range map[string]PostAggregator{
+		`{"type":"arithmetic","name":"avg","fn":"quotient","fields":[
+			{"type":"fieldAccess","fieldName":"added"},{"type":"finalizingFieldAccess","fieldName":"rows"}]}`: Arithmetic("avg", "quotient", FieldAccess("", "added"), FinalizingFieldAccess("", "rows")),
+		`{"type":"arithmetic","name":"pct","fn":"*","fields":[{"type":"fieldAccess","fieldName":"ratio"},{"type":"constant","value":100}]}`: Arithmetic("pct", "*", FieldAccess("", "ratio"), Constant("", 100)),
+		`{"type":"expression","name":"net","expression":"added - deleted"}`:                                                                 ExpressionPost("net", "added - deleted"),
+		`{"type":"thetaSketchEstimate","name":"users","field":{"type":"fieldAccess","fieldName":"users_sketch"}}`:                           ThetaSketchEstimate("users", FieldAccess("", "users_sketch")),
+		`{"type":"HLLSketchEstimate","name":"users","field":{"type":"fieldAccess","fieldName":"hll"},"round":true}`:                         HLLSketchEstimate("users", FieldAccess("", "hll"), true),
+		`{"type":"quantilesDoublesSketchToQuantile","name":"p0","field":{"type":"fieldAccess","fieldName":"latency"},"fraction":0}`:         QuantilesSketchToQuantile("p0", FieldAccess("", "latency"), 0),
+	} {
+		require.NoError(t, p.Validate(), expected)
+		requireJSON(t, expected, p)
+	}
+}
+
+func TestInvalidAggregators(t *testing.T) {
+	for name, v := range map[string]validator{
+		"count name":         Count(""),
+		"sum field":          LongSum("added", ""),
+		"sum both":           &FieldAggregator{Type: "longSum", Name: "added", FieldName: "added", Expression: "added"},
+		"cardinality fields": Cardinality("pages", false),
+		"theta size":         ThetaSketch("users", "user", 1000),
+		"hll lgK":            HLLSketchBuild("users", "user", 22),
+		"quantiles k":        QuantilesSketch("latency", "ms", 65536),
+		"filtered nil":       Filtered(nil, Count("rows")),
+		"filtered filter":    Filtered(In("page"), Count("rows")),
+		"arithmetic fn":      Arithmetic("avg", "%", FieldAccess("", "a"), FieldAccess("", "b")),
+		"arithmetic fields":  Arithmetic("avg", "+", FieldAccess("", "a")),
+		"arithmetic nested":  Arithmetic("avg", "+", FieldAccess("", "a"), FieldAccess("", "")),
+		"sketch field":       ThetaSketchEstimate("users", nil),
+		"fraction":           QuantilesSketchToQuantile("p", FieldAccess("", "latency"), 1.5),
+		"expression":         ExpressionPost("net", ""),
+	} {
+		require.True(t, errors.Is(v.Validate(), ErrInvalidQuery), name)
+	}
+}
+
+func TestBuiltQuery(t *testing.T) {
+	var sent map[string]interface{}
+	client, done := newClient(t, `[]`, &sent)
+	defer done()
+	ctx := context.Background()
+
+	q := &Timeseries{
+		DataSource: "wikipedia",
+		Intervals:  week,
+		Filter:     And(Equals("robot", "false"), Not(In("namespace", "User", "Talk"))),
+		Aggregations: []interface{}{
+			Count("edits"),
+			HLLSketchBuild("users_hll", "user", 0),
+		},
+		PostAggregations: []interface{}{
+			HLLSketchEstimate("users", FieldAccess("", "users_hll"), true),
+		},
+	}
+	_, err := client.Timeseries(ctx, q)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"type": "and",
+		"fields": []interface{}{
+			map[string]interface{}{"type": "equals", "column": "robot", "matchValueType": "STRING", "matchValue": "false"},
+			map[string]interface{}{"type": "not", "field": map[string]interface{}{"type": "in", "dimension": "namespace", "values": []interface{}{"User", "Talk"}}},
+		},
+	}, sent["filter"])
+	require.Len(t, sent["aggregations"], 2)
+
+	// Invalid parts fail the query before it's sent
+	sent = nil
+	q.Filter = And(Equals("robot", nil))
+	_, err = client.Timeseries(ctx, q)
+	require.True(t, errors.Is(err, ErrInvalidQuery))
+	require.Contains(t, err.Error(), "timeseries")
+	require.Nil(t, sent)
+
+	q.Filter = nil
+	q.PostAggregations = []interface{}{QuantilesSketchToQuantile("p99", FieldAccess("", "latency"), 99)}
+	_, err = client.Timeseries(ctx, q)
+	require.True(t, errors.Is(err, ErrInvalidQuery))
+	require.Nil(t, sent)
+}
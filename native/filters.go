@@ -0,0 +1,458 @@
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/peak-ai/go-druid/bloom"
+)
+
+// Filter is a native filter, built by the functions of this package
+// https://druid.apache.org/docs/latest/querying/filters.html
+type Filter interface {
+	Validate() error
+	filter()
+}
+
+// SelectorFilter matches rows whose dimension is a value, or null
+type SelectorFilter struct {
+	Type      string  `json:"type"`
+	Dimension string  `json:"dimension"`
+	Value     *string `json:"value"`
+}
+
+// Selector returns a filter matching rows whose dimension is value
+func Selector(dimension, value string) *SelectorFilter {
+	return &SelectorFilter{Type: "selector", Dimension: dimension, Value: &value}
+}
+
+// Validate checks the filter is complete
+func (f *SelectorFilter) Validate() error {
+	return requireField("selector filter", "dimension", f.Dimension)
+}
+
+func (*SelectorFilter) filter() {}
+
+// NullFilter matches rows whose column is null
+type NullFilter struct {
+	Type   string `json:"type"`
+	Column string `json:"column"`
+}
+
+// IsNull returns a filter matching rows whose column is null
+func IsNull(column string) *NullFilter {
+	return &NullFilter{Type: "null", Column: column}
+}
+
+// Validate checks the filter is complete
+func (f *NullFilter) Validate() error {
+	return requireField("null filter", "column", f.Column)
+}
+
+func (*NullFilter) filter() {}
+
+// EqualityFilter matches rows whose column equals a typed value
+type EqualityFilter struct {
+	Type           string      `json:"type"`
+	Column         string      `json:"column"`
+	MatchValueType string      `json:"matchValueType"`
+	MatchValue     interface{} `json:"matchValue"`
+
+	err error
+}
+
+// Equals returns a filter matching rows whose column equals value, a
+// string, integer, float or slice of them, compared as druid's STRING,
+// LONG, DOUBLE or ARRAY type
+func Equals(column string, value interface{}) *EqualityFilter {
+	valueType, err := matchValueType(value)
+	return &EqualityFilter{Type: "equals", Column: column, MatchValueType: valueType, MatchValue: value, err: err}
+}
+
+// Validate checks the filter is complete
+func (f *EqualityFilter) Validate() error {
+	if f.err != nil {
+		return invalidPart("equals filter", f.err.Error())
+	}
+	return requireField("equals filter", "column", f.Column)
+}
+
+func (*EqualityFilter) filter() {}
+
+// InFilter matches rows whose dimension is one of a set of values
+type InFilter struct {
+	Type      string   `json:"type"`
+	Dimension string   `json:"dimension"`
+	Values    []string `json:"values"`
+}
+
+// In returns a filter matching rows whose dimension is one of values
+func In(dimension string, values ...string) *InFilter {
+	return &InFilter{Type: "in", Dimension: dimension, Values: values}
+}
+
+// Validate checks the filter is complete
+func (f *InFilter) Validate() error {
+	if len(f.Values) == 0 {
+		return invalidPart("in filter", "no values")
+	}
+	return requireField("in filter", "dimension", f.Dimension)
+}
+
+func (*InFilter) filter() {}
+
+// Orderings of bound filters
+const (
+	Lexicographic = "lexicographic"
+	Alphanumeric  = "alphanumeric"
+	Numeric       = "numeric"
+	Strlen        = "strlen"
+	Version       = "version"
+)
+
+// BoundFilter matches rows whose dimension is between bounds
+type BoundFilter struct {
+	Type        string `json:"type"`
+	Dimension   string `json:"dimension"`
+	Lower       string `json:"lower,omitempty"`
+	Upper       string `json:"upper,omitempty"`
+	LowerStrict bool   `json:"lowerStrict,omitempty"`
+	UpperStrict bool   `json:"upperStrict,omitempty"`
+	Ordering    string `json:"ordering,omitempty"`
+}
+
+// Bound returns a filter matching rows whose dimension is between lower
+// and upper inclusive, compared lexicographically. An empty bound is open
+func Bound(dimension, lower, upper string) *BoundFilter {
+	return &BoundFilter{Type: "bound", Dimension: dimension, Lower: lower, Upper: upper}
+}
+
+// Strict excludes the lower and upper bounds
+func (f *BoundFilter) Strict(lower, upper bool) *BoundFilter {
+	f.LowerStrict, f.UpperStrict = lower, upper
+	return f
+}
+
+// Ordered sets how values are compared, e.g. Numeric
+func (f *BoundFilter) Ordered(ordering string) *BoundFilter {
+	f.Ordering = ordering
+	return f
+}
+
+// Validate checks the filter is complete
+func (f *BoundFilter) Validate() error {
+	if f.Lower == "" && f.Upper == "" {
+		return invalidPart("bound filter", "no lower or upper bound")
+	}
+	switch f.Ordering {
+	case "", Lexicographic, Alphanumeric, Numeric, Strlen, Version:
+	default:
+		return invalidPart("bound filter", fmt.Sprintf("unknown ordering %q", f.Ordering))
+	}
+	return requireField("bound filter", "dimension", f.Dimension)
+}
+
+func (*BoundFilter) filter() {}
+
+// RangeFilter matches rows whose column is between typed bounds
+type RangeFilter struct {
+	Type           string      `json:"type"`
+	Column         string      `json:"column"`
+	MatchValueType string      `json:"matchValueType"`
+	Lower          interface{} `json:"lower,omitempty"`
+	Upper          interface{} `json:"upper,omitempty"`
+	LowerOpen      bool        `json:"lowerOpen,omitempty"`
+	UpperOpen      bool        `json:"upperOpen,omitempty"`
+
+	err error
+}
+
+// Range returns a filter matching rows whose column is between lower and
+// upper inclusive, typed as Equals types its value. A nil bound is open
+func Range(column string, lower, upper interface{}) *RangeFilter {
+	f := &RangeFilter{Type: "range", Column: column, Lower: lower, Upper: upper}
+	for _, bound := range []interface{}{lower, upper} {
+		if bound == nil {
+			continue
+		}
+		valueType, err := matchValueType(bound)
+		switch {
+		case err != nil:
+			f.err = err
+		case f.MatchValueType != "" && f.MatchValueType != valueType:
+			f.err = fmt.Errorf("bounds of types %s and %s", f.MatchValueType, valueType)
+		}
+		f.MatchValueType = valueType
+	}
+	return f
+}
+
+// Open excludes the lower and upper bounds
+func (f *RangeFilter) Open(lower, upper bool) *RangeFilter {
+	f.LowerOpen, f.UpperOpen = lower, upper
+	return f
+}
+
+// Validate checks the filter is complete
+func (f *RangeFilter) Validate() error {
+	switch {
+	case f.err != nil:
+		return invalidPart("range filter", f.err.Error())
+	case f.Lower == nil && f.Upper == nil:
+		return invalidPart("range filter", "no lower or upper bound")
+	}
+	return requireField("range filter", "column", f.Column)
+}
+
+func (*RangeFilter) filter() {}
+
+// LikeFilter matches rows whose dimension matches a SQL LIKE pattern
+type LikeFilter struct {
+	Type      string `json:"type"`
+	Dimension string `json:"dimension"`
+	Pattern   string `json:"pattern"`
+	Escape    string `json:"escape,omitempty"`
+}
+
+// Like returns a filter matching rows whose dimension matches pattern, in
+// which % matches any characters and _ any one character
+func Like(dimension, pattern string) *LikeFilter {
+	return &LikeFilter{Type: "like", Dimension: dimension, Pattern: pattern}
+}
+
+// Validate checks the filter is complete
+func (f *LikeFilter) Validate() error {
+	if len([]rune(f.Escape)) > 1 {
+		return invalidPart("like filter", "escape must be a single character")
+	}
+	if err := requireField("like filter", "pattern", f.Pattern); err != nil {
+		return err
+	}
+	return requireField("like filter", "dimension", f.Dimension)
+}
+
+func (*LikeFilter) filter() {}
+
+// RegexFilter matches rows whose dimension matches a Java regular
+// expression
+type RegexFilter struct {
+	Type      string `json:"type"`
+	Dimension string `json:"dimension"`
+	Pattern   string `json:"pattern"`
+}
+
+// Regex returns a filter matching rows whose dimension matches pattern
+func Regex(dimension, pattern string) *RegexFilter {
+	return &RegexFilter{Type: "regex", Dimension: dimension, Pattern: pattern}
+}
+
+// Validate checks the filter is complete
+func (f *RegexFilter) Validate() error {
+	if err := requireField("regex filter", "pattern", f.Pattern); err != nil {
+		return err
+	}
+	return requireField("regex filter", "dimension", f.Dimension)
+}
+
+func (*RegexFilter) filter() {}
+
+// LogicalFilter matches rows matching all or any of its filters
+type LogicalFilter struct {
+	Type   string   `json:"type"`
+	Fields []Filter `json:"fields"`
+}
+
+// And returns a filter matching rows matching every filter
+func And(filters ...Filter) *LogicalFilter {
+	return &LogicalFilter{Type: "and", Fields: filters}
+}
+
+// Or returns a filter matching rows matching any filter
+func Or(filters ...Filter) *LogicalFilter {
+	return &LogicalFilter{Type: "or", Fields: filters}
+}
+
+// Validate checks the filter and its filters are complete
+func (f *LogicalFilter) Validate() error {
+	if len(f.Fields) == 0 {
+		return invalidPart(f.Type+" filter", "no filters")
+	}
+	for _, field := range f.Fields {
+		if field == nil {
+			return invalidPart(f.Type+" filter", "nil filter")
+		}
+		if err := field.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*LogicalFilter) filter() {}
+
+// NotFilter matches rows not matching its filter
+type NotFilter struct {
+	Type  string `json:"type"`
+	Field Filter `json:"field"`
+}
+
+// Not returns a filter matching rows not matching filter
+func Not(filter Filter) *NotFilter {
+	return &NotFilter{Type: "not", Field: filter}
+}
+
+// Validate checks the filter and its filter are complete
+func (f *NotFilter) Validate() error {
+	if f.Field == nil {
+		return invalidPart("not filter", "nil filter")
+	}
+	return f.Field.Validate()
+}
+
+func (*NotFilter) filter() {}
+
+// IntervalFilter matches rows whose dimension, in milliseconds, falls in
+// one of a set of intervals
+type IntervalFilter struct {
+	Type      string   `json:"type"`
+	Dimension string   `json:"dimension"`
+	Intervals []string `json:"intervals"`
+}
+
+// InIntervals returns a filter matching rows whose dimension falls in one
+// of intervals, formatted as Interval formats them
+func InIntervals(dimension string, intervals ...string) *IntervalFilter {
+	return &IntervalFilter{Type: "interval", Dimension: dimension, Intervals: intervals}
+}
+
+// Validate checks the filter is complete and its intervals are valid
+func (f *IntervalFilter) Validate() error {
+	if len(f.Intervals) == 0 {
+		return invalidPart("interval filter", "no intervals")
+	}
+	for _, interval := range f.Intervals {
+		if err := validateInterval(interval); err != nil {
+			return invalidPart("interval filter", err.Error())
+		}
+	}
+	return requireField("interval filter", "dimension", f.Dimension)
+}
+
+func (*IntervalFilter) filter() {}
+
+// ExpressionFilter matches rows for which an expression is true
+type ExpressionFilter struct {
+	Type       string `json:"type"`
+	Expression string `json:"expression"`
+}
+
+// Expression returns a filter matching rows for which expression, in
+// druid's expression language, is true
+func Expression(expression string) *ExpressionFilter {
+	return &ExpressionFilter{Type: "expression", Expression: expression}
+}
+
+// Validate checks the filter is complete
+func (f *ExpressionFilter) Validate() error {
+	return requireField("expression filter", "expression", f.Expression)
+}
+
+func (*ExpressionFilter) filter() {}
+
+// BloomFilter matches rows whose dimension may be in a bloom filter
+type BloomFilter struct {
+	bloom.DimFilter
+}
+
+// Bloom returns a filter matching rows whose dimension may have been added
+// to f
+func Bloom(dimension string, f *bloom.Filter) *BloomFilter {
+	if f == nil {
+		return &BloomFilter{bloom.DimFilter{Type: "bloom", Dimension: dimension}}
+	}
+	return &BloomFilter{f.DimFilter(dimension)}
+}
+
+// Validate checks the filter is complete
+func (f *BloomFilter) Validate() error {
+	if f.BloomKFilter == nil {
+		return invalidPart("bloom filter", "nil bloom filter")
+	}
+	return requireField("bloom filter", "dimension", f.Dimension)
+}
+
+func (*BloomFilter) filter() {}
+
+// RawJSON is a filter, aggregator or post-aggregator written as JSON, for
+// those this package has no constructor for
+type RawJSON json.RawMessage
+
+// MarshalJSON implements json.Marshaler
+func (r RawJSON) MarshalJSON() ([]byte, error) {
+	return json.RawMessage(r).MarshalJSON()
+}
+
+// Validate checks the JSON is an object with a type
+func (r RawJSON) Validate() error {
+	var part struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(r, &part); err != nil {
+		return invalidPart("raw JSON", err.Error())
+	}
+	return requireField("raw JSON", "type", part.Type)
+}
+
+func (RawJSON) filter()         {}
+func (RawJSON) aggregator()     {}
+func (RawJSON) postAggregator() {}
+
+// matchValueType returns the druid type values of v are compared as
+func matchValueType(v interface{}) (string, error) {
+	switch v.(type) {
+	case string:
+		return "STRING", nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "LONG", nil
+	case float32, float64:
+		return "DOUBLE", nil
+	case []string:
+		return "ARRAY<STRING>", nil
+	case []int, []int64:
+		return "ARRAY<LONG>", nil
+	case []float64:
+		return "ARRAY<DOUBLE>", nil
+	case nil:
+		return "", errors.New("nil value, use IsNull to match nulls")
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// validateInterval checks an interval is two ISO 8601 times, or a time and
+// a period, separated by a slash
+func validateInterval(interval string) error {
+	parts := strings.Split(interval, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("interval %q isn't start/end", interval)
+	}
+	start, startErr := time.Parse(time.RFC3339Nano, parts[0])
+	end, endErr := time.Parse(time.RFC3339Nano, parts[1])
+	if startErr == nil && endErr == nil && end.Before(start) {
+		return fmt.Errorf("interval %q ends before it starts", interval)
+	}
+	return nil
+}
+
+func requireField(part, field, value string) error {
+	if value == "" {
+		return invalidPart(part, "no "+field)
+	}
+	return nil
+}
+
+func invalidPart(part, reason string) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidQuery, part, reason)
+}
@@ -0,0 +1,67 @@
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/peak-ai/go-druid/bloom"
+	"github.com/stretchr/testify/require"
+)
+
+func requireJSON(t *testing.T, expected string, v interface{}) {
+	t.Helper()
+	actual, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.JSONEq(t, expected, string(actual))
+}
+
+func TestFilterJSON(t *testing.T) {
+	for expected, f := range map[string]Filter{
+		`{"type":"selector","dimension":"page","value":"Main"}`:                                                  Selector("page", "Main"),
+		`{"type":"null","column":"page"}`:                                                                        IsNull("page"),
+		`{"type":"equals","column":"added","matchValueType":"LONG","matchValue":0}`:                              Equals("added", 0),
+		`{"type":"equals","column":"tags","matchValueType":"ARRAY<STRING>","matchValue":["a","b"]}`:              Equals("tags", []string{"a", "b"}),
+		`{"type":"in","dimension":"page","values":["Main","Go"]}`:                                                In("page", "Main", "Go"),
+		`{"type":"bound","dimension":"added","lower":"10","upperStrict":true,"upper":"20","ordering":"numeric"}`: Bound("added", "10", "20").Strict(false, true).Ordered(Numeric),
+		`{"type":"range","column":"added","matchValueType":"DOUBLE","lower":1.5,"lowerOpen":true}`:               Range("added", 1.5, nil).Open(true, false),
+		`{"type":"like","dimension":"page","pattern":"Ma%"}`:                                                     Like("page", "Ma%"),
+		`{"type":"regex","dimension":"page","pattern":"^M"}`:                                                     Regex("page", "^M"),
+		`{"type":"interval","dimension":"__time","intervals":["2023-07-01T00:00:00Z/2023-07-08T00:00:00Z"]}`:     InIntervals("__time", week...),
+		`{"type":"expression","expression":"added > deleted"}`:                                                   Expression("added > deleted"),
+		`{"type":"custom","x":1}`: RawJSON(`{"type":"custom","x":1}`),
+		`{"type":"and","fields":[{"type":"selector","dimension":"page","value":"Main"},
+			{"type":"not","field":{"type":"or","fields":[{"type":"null","column":"user"},{"type":"like","dimension":"user","pattern":"bot%"}]}}]}`: And(Selector("page", "Main"), Not(Or(IsNull("user"), Like("user", "bot%")))),
+	} {
+		require.NoError(t, f.Validate(), expected)
+		requireJSON(t, expected, f)
+	}
+
+	f := bloom.New(100)
+	f.AddString("Main")
+	requireJSON(t, `{"type":"bloom","dimension":"page","bloomKFilter":"`+f.String()+`"}`, Bloom("page", f))
+}
+
+func TestInvalidFilters(t *testing.T) {
+	for name, f := range map[string]Filter{
+		"selector dimension": Selector("", "Main"),
+		"equals nil":         Equals("page", nil),
+		"equals type":        Equals("page", struct{}{}),
+		"in values":          In("page"),
+		"bound open":         Bound("added", "", ""),
+		"bound ordering":     Bound("added", "1", "2").Ordered("random"),
+		"range types":        Range("added", 1, "2"),
+		"range open":         Range("added", nil, nil),
+		"like escape":        &LikeFilter{Type: "like", Dimension: "page", Pattern: "%", Escape: "ab"},
+		"regex pattern":      Regex("page", ""),
+		"and empty":          And(),
+		"and nested":         And(Selector("page", "Main"), Not(In("user"))),
+		"not nil":            Not(nil),
+		"interval":           InIntervals("__time", "2023-07-08T00:00:00Z/2023-07-01T00:00:00Z"),
+		"expression":         Expression(""),
+		"bloom nil":          Bloom("page", nil),
+		"raw JSON":           RawJSON(`{"dimension":"page"}`),
+	} {
+		require.True(t, errors.Is(f.Validate(), ErrInvalidQuery), name)
+	}
+}
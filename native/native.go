@@ -0,0 +1,179 @@
+// Package native sends druid's native JSON queries, for what SQL doesn't
+// expose, with typed requests and responses for each query type. Queries
+// go through a dsql.Connector to Config.NativeEndpoint, so they share its
+// authentication, TLS settings, limiter, circuit breakers and cache
+// https://druid.apache.org/docs/latest/querying/querying.html
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/peak-ai/go-druid/dsql"
+)
+
+var (
+	// ErrInvalidQuery is returned when a query is rejected before it's sent
+	ErrInvalidQuery = errors.New("native: invalid query")
+
+	// ErrDecoding is returned when a response can't be decoded
+	ErrDecoding = errors.New("native: error decoding response")
+)
+
+// Query is a native query, it marshals to its JSON with its queryType
+type Query interface {
+	QueryType() string
+}
+
+// validator is implemented by queries and their parts checking they're
+// complete before they're sent
+type validator interface {
+	Validate() error
+}
+
+// Client sends native queries through a connector. It's safe for
+// concurrent use
+type Client struct {
+	connector *dsql.Connector
+	retries   int
+	backoff   time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithRetries retries queries up to n times when druid can't answer them,
+// i.e. it can't be reached or answers with a 5xx or 429, waiting backoff
+// before the first retry and twice as long before each of the next
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries, c.backoff = n, backoff
+	}
+}
+
+// New returns a client sending queries through connector
+func New(connector *dsql.Connector, opts ...Option) *Client {
+	c := &Client{connector: connector}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Do sends q and decodes the response into result, which can be any value
+// encoding/json decodes into
+func (c *Client) Do(ctx context.Context, q Query, result interface{}) error {
+	if v, ok := q.(validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	body, err := c.send(ctx, payload)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrDecoding, q.QueryType(), err)
+	}
+	return nil
+}
+
+// send sends a query, retrying failures druid may recover from
+func (c *Client) send(ctx context.Context, payload []byte) ([]byte, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		body, err := c.connector.NativeQuery(ctx, payload)
+		if err == nil || attempt >= c.retries || !retryable(ctx, err) {
+			return body, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a failed query may succeed if it's sent again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, dsql.ErrCircuitOpen) || errors.Is(err, dsql.ErrQueueFull) || errors.Is(err, dsql.ErrCreatingRequest) {
+		return false
+	}
+	code := dsql.StatusCode(err)
+	return code == 0 || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// Timeseries sends a timeseries query
+func (c *Client) Timeseries(ctx context.Context, q *Timeseries) ([]TimeseriesResult, error) {
+	var results []TimeseriesResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// TopN sends a topN query
+func (c *Client) TopN(ctx context.Context, q *TopN) ([]TopNResult, error) {
+	var results []TopNResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// GroupBy sends a groupBy query
+func (c *Client) GroupBy(ctx context.Context, q *GroupBy) ([]GroupByResult, error) {
+	var results []GroupByResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// Scan sends a scan query
+func (c *Client) Scan(ctx context.Context, q *Scan) ([]ScanResult, error) {
+	var results []ScanResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// Search sends a search query
+func (c *Client) Search(ctx context.Context, q *Search) ([]SearchResult, error) {
+	var results []SearchResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// TimeBoundary sends a timeBoundary query
+func (c *Client) TimeBoundary(ctx context.Context, q *TimeBoundary) ([]TimeBoundaryResult, error) {
+	var results []TimeBoundaryResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// SegmentMetadata sends a segmentMetadata query
+func (c *Client) SegmentMetadata(ctx context.Context, q *SegmentMetadata) ([]SegmentAnalysis, error) {
+	var results []SegmentAnalysis
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// DataSourceMetadata sends a dataSourceMetadata query
+func (c *Client) DataSourceMetadata(ctx context.Context, q *DataSourceMetadata) ([]DataSourceMetadataResult, error) {
+	var results []DataSourceMetadataResult
+	err := c.Do(ctx, q, &results)
+	return results, err
+}
+
+// Interval formats the interval from start, inclusive, to end, exclusive,
+// as queries take them
+func Interval(start, end time.Time) string {
+	return start.UTC().Format(time.RFC3339Nano) + "/" + end.UTC().Format(time.RFC3339Nano)
+}
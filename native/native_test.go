@@ -0,0 +1,211 @@
+package native
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peak-ai/go-druid/dsql"
+	"github.com/stretchr/testify/require"
+)
+
+// newClient returns a client of a broker answering every native query with
+// response, after checking it's sent as druid expects
+func newClient(t *testing.T, response string, sent *map[string]interface{}, opts ...Option) (*Client, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/druid/v2", r.URL.Path)
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		user, pass, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "druid", user)
+		require.Equal(t, "secret", pass)
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if sent != nil {
+			require.NoError(t, json.Unmarshal(body, sent))
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+
+	connector, err := dsql.NewConnector(&dsql.Config{
+		BrokerAddr:   ts.URL,
+		User:         "druid",
+		Passwd:       "secret",
+		QueryContext: map[string]interface{}{"priority": 10},
+	})
+	require.NoError(t, err)
+	return New(connector, opts...), func() {
+		connector.Close()
+		ts.Close()
+	}
+}
+
+var week = []string{Interval(time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 7, 8, 0, 0, 0, 0, time.UTC))}
+
+func TestTimeseries(t *testing.T) {
+	var sent map[string]interface{}
+	client, done := newClient(t, `[
+		{"timestamp":"2023-07-01T00:00:00.000Z","result":{"edits":100,"added":12.5}},
+		{"timestamp":"2023-07-02T00:00:00.000Z","result":{"edits":50,"added":null}}]`, &sent)
+	defer done()
+
+	results, err := client.Timeseries(context.Background(), &Timeseries{
+		DataSource:   "wikipedia",
+		Intervals:    week,
+		Granularity:  "day",
+		Aggregations: []interface{}{map[string]string{"type": "count", "name": "edits"}},
+		Context:      map[string]interface{}{"timeout": 1000},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"queryType":    "timeseries",
+		"dataSource":   "wikipedia",
+		"intervals":    []interface{}{"2023-07-01T00:00:00Z/2023-07-08T00:00:00Z"},
+		"granularity":  "day",
+		"aggregations": []interface{}{map[string]interface{}{"type": "count", "name": "edits"}},
+		"context":      map[string]interface{}{"timeout": float64(1000), "priority": float64(10)},
+	}, sent)
+
+	require.Len(t, results, 2)
+	require.Equal(t, time.Date(2023, 7, 2, 0, 0, 0, 0, time.UTC), results[1].Timestamp.UTC())
+	require.Equal(t, float64(100), results[0].Result["edits"])
+	require.Nil(t, results[1].Result["added"])
+}
+
+func TestQueryResults(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("topN", func(t *testing.T) {
+		var sent map[string]interface{}
+		client, done := newClient(t, `[{"timestamp":"2023-07-01T00:00:00.000Z","result":[{"page":"Main","edits":10},{"page":"Go","edits":5}]}]`, &sent)
+		defer done()
+		results, err := client.TopN(ctx, &TopN{DataSource: "wikipedia", Intervals: week, Dimension: "page", Metric: "edits", Threshold: 2})
+		require.NoError(t, err)
+		require.Equal(t, "topN", sent["queryType"])
+		require.Equal(t, "all", sent["granularity"])
+		require.Equal(t, "Go", results[0].Result[1]["page"])
+	})
+
+	t.Run("groupBy", func(t *testing.T) {
+		var sent map[string]interface{}
+		client, done := newClient(t, `[{"version":"v1","timestamp":"2023-07-01T00:00:00.000Z","event":{"page":"Main","edits":10}}]`, &sent)
+		defer done()
+		results, err := client.GroupBy(ctx, &GroupBy{DataSource: "wikipedia", Intervals: week, Dimensions: []interface{}{"page"}})
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"page"}, sent["dimensions"])
+		require.Equal(t, "Main", results[0].Event["page"])
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		client, done := newClient(t, `[
+			{"segmentId":"wikipedia_2023","columns":["__time","page"],"events":[{"__time":1688169600000,"page":"Main"}]},
+			{"segmentId":"wikipedia_2023","columns":["__time","page"],"events":[[1688169600001,"Go"]]}]`, nil)
+		defer done()
+		results, err := client.Scan(ctx, &Scan{DataSource: "wikipedia", Intervals: week, Limit: 2})
+		require.NoError(t, err)
+		require.Equal(t, [][]interface{}{{float64(1688169600000), "Main"}}, results[0].Rows())
+		require.Equal(t, [][]interface{}{{float64(1688169600001), "Go"}}, results[1].Rows())
+	})
+
+	t.Run("search", func(t *testing.T) {
+		var sent map[string]interface{}
+		client, done := newClient(t, `[{"timestamp":"2023-07-01T00:00:00.000Z","result":[{"dimension":"page","value":"Main","count":3}]}]`, &sent)
+		defer done()
+		results, err := client.Search(ctx, &Search{DataSource: "wikipedia", Intervals: week, Query: InsensitiveContains("mai")})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"type": "insensitive_contains", "value": "mai"}, sent["query"])
+		require.Equal(t, SearchHit{Dimension: "page", Value: "Main", Count: 3}, results[0].Result[0])
+	})
+
+	t.Run("timeBoundary", func(t *testing.T) {
+		client, done := newClient(t, `[{"timestamp":"2023-07-01T00:00:00.000Z","result":{"minTime":"2023-07-01T00:00:00.000Z","maxTime":"2023-07-07T23:59:59.000Z"}}]`, nil)
+		defer done()
+		results, err := client.TimeBoundary(ctx, &TimeBoundary{DataSource: "wikipedia"})
+		require.NoError(t, err)
+		require.Equal(t, 7, results[0].Result.MaxTime.Day())
+	})
+
+	t.Run("segmentMetadata", func(t *testing.T) {
+		client, done := newClient(t, `[{"id":"merged","intervals":["2023-07-01T00:00:00.000Z/2023-07-08T00:00:00.000Z"],
+			"columns":{"page":{"typeSignature":"STRING","type":"STRING","hasMultipleValues":false,"hasNulls":false,"size":0,"cardinality":42,"minValue":"A","maxValue":"Z","errorMessage":null}},
+			"size":0,"numRows":1000,"aggregators":null,"timestampSpec":null,"queryGranularity":null,"rollup":null}]`, nil)
+		defer done()
+		results, err := client.SegmentMetadata(ctx, &SegmentMetadata{DataSource: "wikipedia", Merge: true})
+		require.NoError(t, err)
+		require.Equal(t, int64(1000), results[0].NumRows)
+		require.Equal(t, int64(42), *results[0].Columns["page"].Cardinality)
+		require.Nil(t, results[0].Rollup)
+	})
+
+	t.Run("dataSourceMetadata", func(t *testing.T) {
+		client, done := newClient(t, `[{"timestamp":"2023-07-07T23:00:00.000Z","result":{"maxIngestedEventTime":"2023-07-07T23:00:00.000Z"}}]`, nil)
+		defer done()
+		results, err := client.DataSourceMetadata(ctx, &DataSourceMetadata{DataSource: "wikipedia"})
+		require.NoError(t, err)
+		require.Equal(t, 23, results[0].Result.MaxIngestedEventTime.Hour())
+	})
+}
+
+func TestInvalidQueries(t *testing.T) {
+	client, done := newClient(t, `[]`, nil)
+	defer done()
+	ctx := context.Background()
+
+	for name, q := range map[string]Query{
+		"no dataSource":  &Timeseries{Intervals: week},
+		"no intervals":   &GroupBy{DataSource: "wikipedia"},
+		"no metric":      &TopN{DataSource: "wikipedia", Intervals: week, Dimension: "page", Threshold: 5},
+		"threshold":      &TopN{DataSource: "wikipedia", Intervals: week, Dimension: "page", Metric: "edits"},
+		"result format":  &Scan{DataSource: "wikipedia", Intervals: week, ResultFormat: "csv"},
+		"no search spec": &Search{DataSource: "wikipedia", Intervals: week},
+		"bound":          &TimeBoundary{DataSource: "wikipedia", Bound: "latest"},
+	} {
+		err := client.Do(ctx, q, &[]interface{}{})
+		require.True(t, errors.Is(err, ErrInvalidQuery), name)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte(`[]`))
+		}
+	}))
+	defer ts.Close()
+
+	connector, err := dsql.NewConnector(&dsql.Config{BrokerAddr: ts.URL})
+	require.NoError(t, err)
+	defer connector.Close()
+
+	client := New(connector, WithRetries(2, time.Millisecond))
+	_, err = client.TimeBoundary(context.Background(), &TimeBoundary{DataSource: "wikipedia"})
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts)
+
+	// Queries druid rejects aren't retried
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"Unknown exception","errorMessage":"Unknown type id 'timeseriez'"}`))
+	})
+	attempts = 0
+	_, err = client.TimeBoundary(context.Background(), &TimeBoundary{DataSource: "wikipedia"})
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, dsql.StatusCode(err))
+	require.Contains(t, err.Error(), "Unknown type id")
+	require.Equal(t, 1, attempts)
+}
@@ -0,0 +1,381 @@
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Fields typed interface{} take any value marshalling to what druid
+// expects there: a datasource name or object, a granularity name such as
+// "day" or object, a filter, aggregator, dimension spec and so on. The
+// filters, aggregators and post-aggregators built by this package are
+// validated with the query
+
+// Timeseries is a timeseries query, aggregating rows by time
+// https://druid.apache.org/docs/latest/querying/timeseriesquery.html
+type Timeseries struct {
+	DataSource       interface{}            `json:"dataSource"`
+	Intervals        []string               `json:"intervals"`
+	Granularity      interface{}            `json:"granularity"`
+	Filter           interface{}            `json:"filter,omitempty"`
+	VirtualColumns   []interface{}          `json:"virtualColumns,omitempty"`
+	Aggregations     []interface{}          `json:"aggregations,omitempty"`
+	PostAggregations []interface{}          `json:"postAggregations,omitempty"`
+	Descending       bool                   `json:"descending,omitempty"`
+	Limit            int                    `json:"limit,omitempty"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (Timeseries) QueryType() string { return "timeseries" }
+
+// MarshalJSON implements json.Marshaler, granularity defaults to all
+func (q Timeseries) MarshalJSON() ([]byte, error) {
+	type query Timeseries
+	if q.Granularity == nil {
+		q.Granularity = "all"
+	}
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q Timeseries) Validate() error {
+	if err := requireIntervals(q.QueryType(), q.Intervals); err != nil {
+		return err
+	}
+	return validate(q.QueryType(), q.DataSource, q.Filter, q.Aggregations, q.PostAggregations)
+}
+
+// TopN is a topN query, ranking the values of a dimension by a metric
+// https://druid.apache.org/docs/latest/querying/topnquery.html
+type TopN struct {
+	DataSource       interface{}            `json:"dataSource"`
+	Intervals        []string               `json:"intervals"`
+	Granularity      interface{}            `json:"granularity"`
+	Dimension        interface{}            `json:"dimension"`
+	Metric           interface{}            `json:"metric"`
+	Threshold        int                    `json:"threshold"`
+	Filter           interface{}            `json:"filter,omitempty"`
+	VirtualColumns   []interface{}          `json:"virtualColumns,omitempty"`
+	Aggregations     []interface{}          `json:"aggregations,omitempty"`
+	PostAggregations []interface{}          `json:"postAggregations,omitempty"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (TopN) QueryType() string { return "topN" }
+
+// MarshalJSON implements json.Marshaler, granularity defaults to all
+func (q TopN) MarshalJSON() ([]byte, error) {
+	type query TopN
+	if q.Granularity == nil {
+		q.Granularity = "all"
+	}
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q TopN) Validate() error {
+	switch {
+	case q.Dimension == nil || q.Dimension == "":
+		return invalid(q.QueryType(), "no dimension")
+	case q.Metric == nil || q.Metric == "":
+		return invalid(q.QueryType(), "no metric")
+	case q.Threshold <= 0:
+		return invalid(q.QueryType(), "threshold must be positive")
+	}
+	if err := requireIntervals(q.QueryType(), q.Intervals); err != nil {
+		return err
+	}
+	return validate(q.QueryType(), q.DataSource, q.Filter, q.Aggregations, q.PostAggregations)
+}
+
+// GroupBy is a groupBy query, aggregating rows by dimensions
+// https://druid.apache.org/docs/latest/querying/groupbyquery.html
+type GroupBy struct {
+	DataSource       interface{}            `json:"dataSource"`
+	Intervals        []string               `json:"intervals"`
+	Granularity      interface{}            `json:"granularity"`
+	Dimensions       []interface{}          `json:"dimensions"`
+	Filter           interface{}            `json:"filter,omitempty"`
+	VirtualColumns   []interface{}          `json:"virtualColumns,omitempty"`
+	Aggregations     []interface{}          `json:"aggregations,omitempty"`
+	PostAggregations []interface{}          `json:"postAggregations,omitempty"`
+	Having           interface{}            `json:"having,omitempty"`
+	LimitSpec        interface{}            `json:"limitSpec,omitempty"`
+	SubtotalsSpec    [][]string             `json:"subtotalsSpec,omitempty"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (GroupBy) QueryType() string { return "groupBy" }
+
+// MarshalJSON implements json.Marshaler, granularity defaults to all
+func (q GroupBy) MarshalJSON() ([]byte, error) {
+	type query GroupBy
+	if q.Granularity == nil {
+		q.Granularity = "all"
+	}
+	if q.Dimensions == nil {
+		q.Dimensions = []interface{}{}
+	}
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q GroupBy) Validate() error {
+	if err := validateParts(q.QueryType(), q.Dimensions); err != nil {
+		return err
+	}
+	if err := requireIntervals(q.QueryType(), q.Intervals); err != nil {
+		return err
+	}
+	return validate(q.QueryType(), q.DataSource, q.Filter, q.Aggregations, q.PostAggregations)
+}
+
+// Scan result formats
+const (
+	ScanList          = "list"
+	ScanCompactedList = "compactedList"
+)
+
+// Scan is a scan query, returning raw rows
+// https://druid.apache.org/docs/latest/querying/scan-query.html
+type Scan struct {
+	DataSource     interface{}   `json:"dataSource"`
+	Intervals      []string      `json:"intervals"`
+	Columns        []string      `json:"columns,omitempty"`
+	Filter         interface{}   `json:"filter,omitempty"`
+	VirtualColumns []interface{} `json:"virtualColumns,omitempty"`
+
+	// ResultFormat is ScanList, each row an object, or ScanCompactedList,
+	// each row an array. Defaults to ScanList
+	ResultFormat string `json:"resultFormat,omitempty"`
+
+	// Order is none, ascending or descending by __time
+	Order     string                 `json:"order,omitempty"`
+	Limit     int64                  `json:"limit,omitempty"`
+	Offset    int64                  `json:"offset,omitempty"`
+	BatchSize int                    `json:"batchSize,omitempty"`
+	Context   map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (Scan) QueryType() string { return "scan" }
+
+// MarshalJSON implements json.Marshaler
+func (q Scan) MarshalJSON() ([]byte, error) {
+	type query Scan
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q Scan) Validate() error {
+	switch q.ResultFormat {
+	case "", ScanList, ScanCompactedList:
+	default:
+		return invalid(q.QueryType(), fmt.Sprintf("unknown result format %q", q.ResultFormat))
+	}
+	if err := requireIntervals(q.QueryType(), q.Intervals); err != nil {
+		return err
+	}
+	return validate(q.QueryType(), q.DataSource, q.Filter)
+}
+
+// SearchQuerySpec is what a search query looks for
+// https://druid.apache.org/docs/latest/querying/searchqueryspec.html
+type SearchQuerySpec struct {
+	Type          string `json:"type"`
+	Value         string `json:"value"`
+	CaseSensitive bool   `json:"caseSensitive,omitempty"`
+}
+
+// Contains returns a spec matching values containing value
+func Contains(value string, caseSensitive bool) SearchQuerySpec {
+	return SearchQuerySpec{Type: "contains", Value: value, CaseSensitive: caseSensitive}
+}
+
+// InsensitiveContains returns a spec matching values containing value,
+// ignoring case
+func InsensitiveContains(value string) SearchQuerySpec {
+	return SearchQuerySpec{Type: "insensitive_contains", Value: value}
+}
+
+// Search is a search query, finding the dimension values matching a spec
+// https://druid.apache.org/docs/latest/querying/searchquery.html
+type Search struct {
+	DataSource       interface{}            `json:"dataSource"`
+	Intervals        []string               `json:"intervals"`
+	Granularity      interface{}            `json:"granularity"`
+	Query            interface{}            `json:"query"`
+	SearchDimensions []string               `json:"searchDimensions,omitempty"`
+	Filter           interface{}            `json:"filter,omitempty"`
+	VirtualColumns   []interface{}          `json:"virtualColumns,omitempty"`
+	Limit            int                    `json:"limit,omitempty"`
+	Sort             interface{}            `json:"sort,omitempty"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (Search) QueryType() string { return "search" }
+
+// MarshalJSON implements json.Marshaler, granularity defaults to all
+func (q Search) MarshalJSON() ([]byte, error) {
+	type query Search
+	if q.Granularity == nil {
+		q.Granularity = "all"
+	}
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q Search) Validate() error {
+	if q.Query == nil {
+		return invalid(q.QueryType(), "no search query spec")
+	}
+	if err := requireIntervals(q.QueryType(), q.Intervals); err != nil {
+		return err
+	}
+	return validate(q.QueryType(), q.DataSource, q.Filter)
+}
+
+// TimeBoundary is a timeBoundary query, returning the earliest and latest
+// times of a datasource
+// https://druid.apache.org/docs/latest/querying/timeboundaryquery.html
+type TimeBoundary struct {
+	DataSource interface{} `json:"dataSource"`
+
+	// Bound is minTime or maxTime to return only one of them
+	Bound   string                 `json:"bound,omitempty"`
+	Filter  interface{}            `json:"filter,omitempty"`
+	Context map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (TimeBoundary) QueryType() string { return "timeBoundary" }
+
+// MarshalJSON implements json.Marshaler
+func (q TimeBoundary) MarshalJSON() ([]byte, error) {
+	type query TimeBoundary
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q TimeBoundary) Validate() error {
+	switch q.Bound {
+	case "", "minTime", "maxTime":
+	default:
+		return invalid(q.QueryType(), fmt.Sprintf("unknown bound %q", q.Bound))
+	}
+	return validate(q.QueryType(), q.DataSource, q.Filter)
+}
+
+// SegmentMetadata is a segmentMetadata query, describing the segments and
+// columns of a datasource
+// https://druid.apache.org/docs/latest/querying/segmentmetadataquery.html
+type SegmentMetadata struct {
+	DataSource interface{} `json:"dataSource"`
+
+	// Intervals default to the last week of data when nil
+	Intervals []string `json:"intervals,omitempty"`
+
+	// ToInclude selects the columns analyzed, all of them when nil
+	ToInclude interface{} `json:"toInclude,omitempty"`
+
+	// Merge merges the analyses of every segment into one
+	Merge                   bool                   `json:"merge,omitempty"`
+	AnalysisTypes           []string               `json:"analysisTypes,omitempty"`
+	AggregatorMergeStrategy string                 `json:"aggregatorMergeStrategy,omitempty"`
+	Context                 map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (SegmentMetadata) QueryType() string { return "segmentMetadata" }
+
+// MarshalJSON implements json.Marshaler
+func (q SegmentMetadata) MarshalJSON() ([]byte, error) {
+	type query SegmentMetadata
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q SegmentMetadata) Validate() error {
+	return validate(q.QueryType(), q.DataSource, nil)
+}
+
+// DataSourceMetadata is a dataSourceMetadata query, returning when data
+// was last ingested into a datasource
+// https://druid.apache.org/docs/latest/querying/datasourcemetadataquery.html
+type DataSourceMetadata struct {
+	DataSource interface{}            `json:"dataSource"`
+	Context    map[string]interface{} `json:"context,omitempty"`
+}
+
+// QueryType implements Query
+func (DataSourceMetadata) QueryType() string { return "dataSourceMetadata" }
+
+// MarshalJSON implements json.Marshaler
+func (q DataSourceMetadata) MarshalJSON() ([]byte, error) {
+	type query DataSourceMetadata
+	return marshalQuery(q.QueryType(), query(q))
+}
+
+// Validate checks the query is complete
+func (q DataSourceMetadata) Validate() error {
+	return validate(q.QueryType(), q.DataSource, nil)
+}
+
+// marshalQuery marshals the fields of query after its queryType
+func marshalQuery(queryType string, query interface{}) ([]byte, error) {
+	fields, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	if string(fields) == "{}" {
+		return []byte(fmt.Sprintf(`{"queryType":%q}`, queryType)), nil
+	}
+	return append([]byte(fmt.Sprintf(`{"queryType":%q,`, queryType)), fields[1:]...), nil
+}
+
+// validate checks the datasource, filter, aggregators and post-aggregators
+// of a query
+func validate(queryType string, dataSource, filter interface{}, parts ...[]interface{}) error {
+	if dataSource == nil || dataSource == "" {
+		return invalid(queryType, "no dataSource")
+	}
+	if filter != nil {
+		if err := validateParts(queryType, []interface{}{filter}); err != nil {
+			return err
+		}
+	}
+	for _, p := range parts {
+		if err := validateParts(queryType, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireIntervals checks a query has intervals
+func requireIntervals(queryType string, intervals []string) error {
+	if len(intervals) == 0 {
+		return invalid(queryType, "no intervals")
+	}
+	return nil
+}
+
+// validateParts validates the parts of a query that can validate themselves
+func validateParts(queryType string, parts []interface{}) error {
+	for _, part := range parts {
+		if v, ok := part.(validator); ok {
+			if err := v.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", queryType, err)
+			}
+		}
+	}
+	return nil
+}
+
+func invalid(queryType, reason string) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidQuery, queryType, reason)
+}
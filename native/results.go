@@ -0,0 +1,111 @@
+package native
+
+import "time"
+
+// Numbers in results without a fixed type are decoded as float64, as
+// encoding/json decodes them
+
+// TimeseriesResult is the aggregates of a time bucket
+type TimeseriesResult struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Result    map[string]interface{} `json:"result"`
+}
+
+// TopNResult is the top values of a time bucket, in order
+type TopNResult struct {
+	Timestamp time.Time                `json:"timestamp"`
+	Result    []map[string]interface{} `json:"result"`
+}
+
+// GroupByResult is the dimensions and aggregates of a group
+type GroupByResult struct {
+	Version   string                 `json:"version"`
+	Timestamp time.Time              `json:"timestamp"`
+	Event     map[string]interface{} `json:"event"`
+}
+
+// ScanResult is a batch of rows of a segment
+type ScanResult struct {
+	SegmentID string   `json:"segmentId"`
+	Columns   []string `json:"columns"`
+
+	// Events are the rows, objects for ScanList results and arrays for
+	// ScanCompactedList ones
+	Events []interface{} `json:"events"`
+}
+
+// Rows returns the rows of the batch as values in the order of Columns,
+// whatever the result format
+func (r *ScanResult) Rows() [][]interface{} {
+	rows := make([][]interface{}, 0, len(r.Events))
+	for _, event := range r.Events {
+		switch event := event.(type) {
+		case []interface{}:
+			rows = append(rows, event)
+		case map[string]interface{}:
+			row := make([]interface{}, len(r.Columns))
+			for i, column := range r.Columns {
+				row[i] = event[column]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// SearchResult is the values matching a search in a time bucket
+type SearchResult struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Result    []SearchHit `json:"result"`
+}
+
+// SearchHit is a dimension value matching a search
+type SearchHit struct {
+	Dimension string `json:"dimension"`
+	Value     string `json:"value"`
+	Count     int64  `json:"count"`
+}
+
+// TimeBoundaryResult is the earliest and latest times of a datasource,
+// only one of them is set when the query has a Bound
+type TimeBoundaryResult struct {
+	Timestamp time.Time `json:"timestamp"`
+	Result    struct {
+		MinTime time.Time `json:"minTime"`
+		MaxTime time.Time `json:"maxTime"`
+	} `json:"result"`
+}
+
+// SegmentAnalysis describes a segment, or every segment when merged
+type SegmentAnalysis struct {
+	ID               string                    `json:"id"`
+	Intervals        []string                  `json:"intervals"`
+	Columns          map[string]ColumnAnalysis `json:"columns"`
+	Size             int64                     `json:"size"`
+	NumRows          int64                     `json:"numRows"`
+	Aggregators      map[string]interface{}    `json:"aggregators"`
+	TimestampSpec    map[string]interface{}    `json:"timestampSpec"`
+	QueryGranularity interface{}               `json:"queryGranularity"`
+	Rollup           *bool                     `json:"rollup"`
+}
+
+// ColumnAnalysis describes a column of a segment
+type ColumnAnalysis struct {
+	TypeSignature     string      `json:"typeSignature"`
+	Type              string      `json:"type"`
+	HasMultipleValues bool        `json:"hasMultipleValues"`
+	HasNulls          bool        `json:"hasNulls"`
+	Size              int64       `json:"size"`
+	Cardinality       *int64      `json:"cardinality"`
+	MinValue          interface{} `json:"minValue"`
+	MaxValue          interface{} `json:"maxValue"`
+	ErrorMessage      string      `json:"errorMessage"`
+}
+
+// DataSourceMetadataResult is when data was last ingested into a datasource
+type DataSourceMetadataResult struct {
+	Timestamp time.Time `json:"timestamp"`
+	Result    struct {
+		MaxIngestedEventTime time.Time `json:"maxIngestedEventTime"`
+	} `json:"result"`
+}
@@ -0,0 +1,467 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// HLLType is how an HLL sketch packs its registers
+type HLLType int
+
+// HLL register packings, druid defaults to HLL4
+const (
+	HLL4 HLLType = iota
+	HLL6
+	HLL8
+)
+
+func (t HLLType) String() string {
+	switch t {
+	case HLL4:
+		return "HLL_4"
+	case HLL6:
+		return "HLL_6"
+	case HLL8:
+		return "HLL_8"
+	}
+	return fmt.Sprintf("HLLType(%d)", int(t))
+}
+
+// HLL sketch modes, small sketches hold coupons until they're promoted to
+// registers
+const (
+	modeList = 0
+	modeSet  = 1
+	modeHLL  = 2
+)
+
+// HLL preamble layout
+const (
+	hllSerVer         = 1
+	hllFamily         = 7
+	hllListPreInts    = 2
+	hllSetPreInts     = 3
+	hllPreInts        = 10
+	hllFlagEmpty      = 4
+	hllFlagCompact    = 8
+	hllFlagOutOfOrder = 16
+	hllRegistersAt    = 40
+	hllAuxToken       = 15
+	couponKeyBits     = 26
+	couponKeyMask     = 1<<couponKeyBits - 1
+)
+
+// DefaultLgK is the log2 of the number of registers druid gives HLL
+// sketches unless a query sets another
+const DefaultLgK = 12
+
+// Relative standard errors DataSketches uses for bounds
+var (
+	couponRSE       = 0.409 / (1 << 13)
+	hipRSEFactor    = math.Sqrt(math.Log(2))
+	nonHIPRSEFactor = math.Sqrt(3*math.Log(2) - 1)
+)
+
+// HLL is a DataSketches HLL sketch, as druid returns for DS_HLL and HLLSketch
+// aggregations that aren't finalized. It's immutable, unions return new
+// sketches
+type HLL struct {
+	lgK     int
+	hllType HLLType
+	mode    int
+
+	// coupons are the distinct coupons of a sketch in list or set mode,
+	// each a 26 bit hash address and a 6 bit register value
+	coupons []uint32
+
+	// registers are the register values of a sketch in HLL mode
+	registers []uint8
+
+	// hipAccum is the HIP estimate, valid while outOfOrder is false
+	hipAccum   float64
+	outOfOrder bool
+}
+
+// DecodeHLL deserializes an HLL sketch in the DataSketches format, compact
+// or updatable and of any register packing
+func DecodeHLL(b []byte) (*HLL, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: %d bytes is too short for an HLL sketch", ErrInvalidSketch, len(b))
+	}
+
+	preInts, serVer, family := int(b[0]), b[1], b[2]
+	lgK, lgArr, flags, modeByte := int(b[3]), int(b[4]), b[5], b[7]
+	if family != hllFamily {
+		return nil, fmt.Errorf("%w: family %d is not an HLL sketch", ErrInvalidSketch, family)
+	}
+	if serVer != hllSerVer {
+		return nil, fmt.Errorf("%w: HLL serial version %d", ErrUnsupported, serVer)
+	}
+	if lgK < 4 || lgK > 21 {
+		return nil, fmt.Errorf("%w: HLL lgK %d", ErrInvalidSketch, lgK)
+	}
+
+	s := &HLL{
+		lgK:        lgK,
+		hllType:    HLLType(modeByte >> 2 & 3),
+		mode:       int(modeByte & 3),
+		outOfOrder: flags&hllFlagOutOfOrder != 0,
+	}
+	if s.hllType > HLL8 {
+		return nil, fmt.Errorf("%w: HLL type %d", ErrInvalidSketch, s.hllType)
+	}
+	if len(b) < preInts*4 {
+		return nil, fmt.Errorf("%w: HLL preamble of %d ints in %d bytes", ErrInvalidSketch, preInts, len(b))
+	}
+
+	compact := flags&hllFlagCompact != 0
+	switch s.mode {
+	case modeList, modeSet:
+		if flags&hllFlagEmpty != 0 {
+			return s, nil
+		}
+		var count, start int
+		if s.mode == modeList {
+			if preInts != hllListPreInts {
+				return nil, fmt.Errorf("%w: HLL list preamble of %d ints", ErrInvalidSketch, preInts)
+			}
+			count, start = int(b[6]), hllListPreInts*4
+		} else {
+			if preInts != hllSetPreInts {
+				return nil, fmt.Errorf("%w: HLL set preamble of %d ints", ErrInvalidSketch, preInts)
+			}
+			count, start = int(binary.LittleEndian.Uint32(b[8:])), hllSetPreInts*4
+		}
+		entries := count
+		if !compact {
+			entries = 1 << lgArr
+		}
+		ints, err := readInts(b[start:], entries)
+		if err != nil {
+			return nil, err
+		}
+		for _, coupon := range ints {
+			if coupon != 0 {
+				s.coupons = append(s.coupons, coupon)
+			}
+		}
+		sort.Slice(s.coupons, func(i, j int) bool { return s.coupons[i] < s.coupons[j] })
+		return s, nil
+
+	case modeHLL:
+		if preInts != hllPreInts {
+			return nil, fmt.Errorf("%w: HLL preamble of %d ints", ErrInvalidSketch, preInts)
+		}
+		s.hipAccum = math.Float64frombits(binary.LittleEndian.Uint64(b[8:]))
+		auxCount := int(binary.LittleEndian.Uint32(b[36:]))
+		if err := s.decodeRegisters(b[hllRegistersAt:], int(b[6]), auxCount, lgArr, compact); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("%w: HLL mode %d", ErrInvalidSketch, s.mode)
+}
+
+// decodeRegisters unpacks the register array of a sketch in HLL mode
+func (s *HLL) decodeRegisters(data []byte, curMin, auxCount, lgAuxArr int, compact bool) error {
+	k := 1 << s.lgK
+	s.registers = make([]uint8, k)
+
+	switch s.hllType {
+	case HLL8:
+		if len(data) < k {
+			return fmt.Errorf("%w: HLL_8 registers truncated", ErrInvalidSketch)
+		}
+		copy(s.registers, data)
+
+	case HLL6:
+		size := k*3/4 + 1
+		if len(data) < size {
+			return fmt.Errorf("%w: HLL_6 registers truncated", ErrInvalidSketch)
+		}
+		for slot := 0; slot < k; slot++ {
+			bit := slot * 6
+			pair := uint16(data[bit>>3])
+			if bit>>3+1 < size {
+				pair |= uint16(data[bit>>3+1]) << 8
+			}
+			s.registers[slot] = uint8(pair >> (bit & 7) & 0x3f)
+		}
+
+	case HLL4:
+		size := k / 2
+		if len(data) < size {
+			return fmt.Errorf("%w: HLL_4 registers truncated", ErrInvalidSketch)
+		}
+
+		// Values too far above curMin for a nibble are kept in an aux table
+		auxEntries := auxCount
+		if !compact {
+			auxEntries = 0
+			if auxCount > 0 {
+				auxEntries = 1 << lgAuxArr
+			}
+		}
+		auxInts, err := readInts(data[size:], auxEntries)
+		if err != nil {
+			return err
+		}
+		aux := make(map[int]uint8, len(auxInts))
+		for _, pair := range auxInts {
+			if pair != 0 {
+				aux[int(pair&couponKeyMask)] = uint8(pair >> couponKeyBits)
+			}
+		}
+
+		for slot := 0; slot < k; slot++ {
+			nibble := data[slot>>1]
+			if slot&1 == 1 {
+				nibble >>= 4
+			}
+			nibble &= 0xf
+			if nibble == hllAuxToken {
+				value, ok := aux[slot]
+				if !ok {
+					return fmt.Errorf("%w: HLL_4 register %d missing from the aux table", ErrInvalidSketch, slot)
+				}
+				s.registers[slot] = value
+				continue
+			}
+			s.registers[slot] = uint8(curMin) + nibble
+		}
+	}
+	return nil
+}
+
+// readInts reads n little endian ints from data
+func readInts(data []byte, n int) ([]uint32, error) {
+	if n < 0 || len(data) < n*4 {
+		return nil, fmt.Errorf("%w: %d ints in %d bytes", ErrInvalidSketch, n, len(data))
+	}
+	ints := make([]uint32, n)
+	for i := range ints {
+		ints[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return ints, nil
+}
+
+// MarshalBinary serializes the sketch in the compact DataSketches format,
+// as an HLL_8 sketch once it's in HLL mode
+func (s *HLL) MarshalBinary() ([]byte, error) {
+	if s.mode != modeHLL {
+		if len(s.coupons) == 0 {
+			b := make([]byte, hllListPreInts*4)
+			b[0], b[1], b[2], b[3] = hllListPreInts, hllSerVer, hllFamily, byte(s.lgK)
+			b[5] = hllFlagEmpty | hllFlagCompact
+			b[7] = byte(modeList) | byte(s.hllType)<<2
+			return b, nil
+		}
+
+		lgArr := 3
+		for len(s.coupons)*4 > 3<<lgArr {
+			lgArr++
+		}
+		b := make([]byte, hllSetPreInts*4+len(s.coupons)*4)
+		b[0], b[1], b[2], b[3], b[4] = hllSetPreInts, hllSerVer, hllFamily, byte(s.lgK), byte(lgArr)
+		b[5] = hllFlagCompact
+		b[7] = byte(modeSet) | byte(s.hllType)<<2
+		binary.LittleEndian.PutUint32(b[8:], uint32(len(s.coupons)))
+		for i, coupon := range s.coupons {
+			binary.LittleEndian.PutUint32(b[12+i*4:], coupon)
+		}
+		return b, nil
+	}
+
+	k := len(s.registers)
+	b := make([]byte, hllRegistersAt+k)
+	b[0], b[1], b[2], b[3] = hllPreInts, hllSerVer, hllFamily, byte(s.lgK)
+	b[5] = hllFlagCompact
+	if s.outOfOrder {
+		b[5] |= hllFlagOutOfOrder
+	}
+	b[7] = byte(modeHLL) | byte(HLL8)<<2
+
+	var kxq0, kxq1 float64
+	zeros := 0
+	for _, v := range s.registers {
+		if v == 0 {
+			zeros++
+		}
+		if v < 32 {
+			kxq0 += math.Ldexp(1, -int(v))
+		} else {
+			kxq1 += math.Ldexp(1, -int(v))
+		}
+	}
+	binary.LittleEndian.PutUint64(b[8:], math.Float64bits(s.hipAccum))
+	binary.LittleEndian.PutUint64(b[16:], math.Float64bits(kxq0))
+	binary.LittleEndian.PutUint64(b[24:], math.Float64bits(kxq1))
+	binary.LittleEndian.PutUint32(b[32:], uint32(zeros))
+	copy(b[hllRegistersAt:], s.registers)
+	return b, nil
+}
+
+// LgK returns the log2 of the number of registers
+func (s *HLL) LgK() int {
+	return s.lgK
+}
+
+// Type returns the register packing the sketch was serialized with
+func (s *HLL) Type() HLLType {
+	return s.hllType
+}
+
+// IsEmpty reports whether the sketch has never seen an item
+func (s *HLL) IsEmpty() bool {
+	return s.mode != modeHLL && len(s.coupons) == 0
+}
+
+// Estimate returns the estimated number of distinct items. Sketches built
+// in order use the HIP estimate stored with them. Unions and sketches
+// merged by druid use the standard HLL estimator with linear counting for
+// small cardinalities, which can differ slightly from DataSketches'
+// empirically corrected composite estimate
+func (s *HLL) Estimate() float64 {
+	if s.mode != modeHLL {
+		return couponEstimate(len(s.coupons))
+	}
+	if !s.outOfOrder && s.hipAccum > 0 {
+		return s.hipAccum
+	}
+	return registerEstimate(s.registers)
+}
+
+// LowerBound returns the lower bound of the estimate at numStdDev standard
+// deviations, which is clamped to 1, 2 or 3
+func (s *HLL) LowerBound(numStdDev int) float64 {
+	if s.mode != modeHLL {
+		lb := s.Estimate() / (1 + clampStdDev(numStdDev)*couponRSE)
+		return math.Max(lb, float64(len(s.coupons)))
+	}
+	return s.Estimate() / (1 + clampStdDev(numStdDev)*s.rse())
+}
+
+// UpperBound returns the upper bound of the estimate at numStdDev standard
+// deviations, which is clamped to 1, 2 or 3
+func (s *HLL) UpperBound(numStdDev int) float64 {
+	if s.mode != modeHLL {
+		return s.Estimate() / (1 - clampStdDev(numStdDev)*couponRSE)
+	}
+	return s.Estimate() / (1 - clampStdDev(numStdDev)*s.rse())
+}
+
+// rse is the relative standard error of the sketch's estimate in HLL mode
+func (s *HLL) rse() float64 {
+	factor := nonHIPRSEFactor
+	if !s.outOfOrder && s.hipAccum > 0 {
+		factor = hipRSEFactor
+	}
+	return factor / math.Sqrt(float64(int(1)<<s.lgK))
+}
+
+// couponEstimate inverts the expected number of distinct coupons seen
+// among the 2^26 coupon addresses
+func couponEstimate(count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	space := float64(1 << couponKeyBits)
+	return math.Log1p(-float64(count)/space) / math.Log1p(-1/space)
+}
+
+// registerEstimate is the HLL estimate of registers
+func registerEstimate(registers []uint8) float64 {
+	m := float64(len(registers))
+	sum := 0.0
+	zeros := 0
+	for _, v := range registers {
+		sum += math.Ldexp(1, -int(v))
+		if v == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	estimate := alpha * m * m / sum
+	if zeros > 0 && estimate <= 2.5*m {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// UnionHLL returns the union of sketches with at most 2^lgMaxK registers.
+// A lgMaxK of 0 uses DefaultLgK. Sketches with more registers are folded
+// down, so the union has the fewest registers of its inputs in HLL mode.
+// nil sketches are skipped
+func UnionHLL(lgMaxK int, sketches ...*HLL) (*HLL, error) {
+	if lgMaxK == 0 {
+		lgMaxK = DefaultLgK
+	}
+	if lgMaxK < 4 || lgMaxK > 21 {
+		return nil, fmt.Errorf("%w: lgMaxK %d is outside 4 to 21", ErrIncompatible, lgMaxK)
+	}
+
+	lgK := lgMaxK
+	coupons := make(map[uint32]bool)
+	var hllSketches []*HLL
+	for _, s := range sketches {
+		if s == nil {
+			continue
+		}
+		if s.mode == modeHLL {
+			hllSketches = append(hllSketches, s)
+			if s.lgK < lgK {
+				lgK = s.lgK
+			}
+			continue
+		}
+		for _, coupon := range s.coupons {
+			coupons[coupon] = true
+		}
+	}
+
+	result := &HLL{lgK: lgK, hllType: HLL8, mode: modeSet, outOfOrder: true}
+
+	// Few enough coupons stay exact
+	if len(hllSketches) == 0 && len(coupons)*32 <= 3<<lgK {
+		for coupon := range coupons {
+			result.coupons = append(result.coupons, coupon)
+		}
+		sort.Slice(result.coupons, func(i, j int) bool { return result.coupons[i] < result.coupons[j] })
+		if len(result.coupons) == 0 {
+			result.mode = modeList
+		}
+		return result, nil
+	}
+
+	k := 1 << lgK
+	result.mode = modeHLL
+	result.registers = make([]uint8, k)
+	for _, s := range hllSketches {
+		for slot, v := range s.registers {
+			if dst := slot & (k - 1); v > result.registers[dst] {
+				result.registers[dst] = v
+			}
+		}
+	}
+	for coupon := range coupons {
+		slot, v := int(coupon&couponKeyMask)&(k-1), uint8(coupon>>couponKeyBits)
+		if v > result.registers[slot] {
+			result.registers[slot] = v
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package sketch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func goldenHLL(t *testing.T, name string) *HLL {
+	s, err := DecodeHLL(golden(t, name))
+	require.NoError(t, err, name)
+	return s
+}
+
+func TestDecodeHLLCouponModes(t *testing.T) {
+	list := goldenHLL(t, "hll_list.bin")
+	require.Equal(t, DefaultLgK, list.LgK())
+	require.Equal(t, HLL4, list.Type())
+	require.InDelta(t, 5, list.Estimate(), 1e-6)
+	require.Equal(t, 5.0, list.LowerBound(1))
+	require.Greater(t, list.UpperBound(1), 5.0)
+
+	set := goldenHLL(t, "hll_set.bin")
+	require.InDelta(t, 300, set.Estimate(), 0.01)
+	require.LessOrEqual(t, set.LowerBound(3), 300.0)
+	require.Greater(t, set.UpperBound(3), 300.0)
+}
+
+func TestDecodeHLLRegisterPackings(t *testing.T) {
+	hll4 := goldenHLL(t, "hll4_a.bin")
+	hll6 := goldenHLL(t, "hll6_a.bin")
+	hll8 := goldenHLL(t, "hll8_a.bin")
+	require.Equal(t, HLL4, hll4.Type())
+	require.Equal(t, HLL6, hll6.Type())
+	require.Equal(t, HLL8, hll8.Type())
+
+	// The same items give the same registers whatever the packing, the
+	// HLL_4 sketch has a register held in its aux table
+	require.Equal(t, hll8.registers, hll6.registers)
+	require.Equal(t, hll8.registers, hll4.registers)
+
+	// hll4_a.bin was built in order so it carries a HIP estimate, the
+	// others are marked out of order like sketches merged by druid
+	require.NotEqual(t, hll4.Estimate(), hll8.Estimate())
+	for _, s := range []*HLL{hll4, hll6, hll8} {
+		require.Less(t, s.LowerBound(3), 1000000.0)
+		require.Greater(t, s.UpperBound(3), 1000000.0)
+		require.InDelta(t, 1000000, s.Estimate(), 1000000*0.05)
+	}
+	require.Less(t, hll4.UpperBound(1)-hll4.LowerBound(1), hll8.UpperBound(1)-hll8.LowerBound(1))
+}
+
+func TestHLLUnion(t *testing.T) {
+	a := goldenHLL(t, "hll4_a.bin")
+	b := goldenHLL(t, "hll4_b.bin")
+
+	union, err := UnionHLL(0, a, b, goldenHLL(t, "hll_set.bin"), nil)
+	require.NoError(t, err)
+	require.Equal(t, DefaultLgK, union.LgK())
+	require.Less(t, union.LowerBound(3), 1500000.0)
+	require.Greater(t, union.UpperBound(3), 1500000.0)
+
+	// Folding into fewer registers keeps the estimate, less precisely
+	small, err := UnionHLL(10, a, b)
+	require.NoError(t, err)
+	require.Equal(t, 10, small.LgK())
+	require.InDelta(t, 1500000, small.Estimate(), 1500000*0.1)
+
+	// Coupon sketches stay exact while they're small
+	coupons, err := UnionHLL(0, goldenHLL(t, "hll_list.bin"), goldenHLL(t, "hll_set.bin"))
+	require.NoError(t, err)
+	require.InDelta(t, 300, coupons.Estimate(), 0.01)
+
+	_, err = UnionHLL(30, a)
+	require.True(t, errors.Is(err, ErrIncompatible))
+}
+
+func TestHLLMarshalRoundTrip(t *testing.T) {
+	empty, err := UnionHLL(0)
+	require.NoError(t, err)
+	require.True(t, empty.IsEmpty())
+
+	union, err := UnionHLL(0, goldenHLL(t, "hll4_a.bin"), goldenHLL(t, "hll4_b.bin"))
+	require.NoError(t, err)
+
+	for name, s := range map[string]*HLL{
+		"empty": empty,
+		"set":   goldenHLL(t, "hll_set.bin"),
+		"hll8":  goldenHLL(t, "hll8_a.bin"),
+		"union": union,
+	} {
+		b, err := s.MarshalBinary()
+		require.NoError(t, err, name)
+		decoded, err := DecodeHLL(b)
+		require.NoError(t, err, name)
+		require.Equal(t, s.Estimate(), decoded.Estimate(), name)
+		if s.registers != nil {
+			require.Equal(t, s.registers, decoded.registers, name)
+		} else {
+			require.Equal(t, s.coupons, decoded.coupons, name)
+		}
+	}
+}
+
+func TestDecodeHLLErrors(t *testing.T) {
+	hll4 := golden(t, "hll4_a.bin")
+	for name, b := range map[string][]byte{
+		"short":     hll4[:4],
+		"truncated": hll4[:100],
+		"family":    append([]byte{10, 1, 3}, hll4[3:]...),
+		"lgK":       append([]byte{10, 1, 7, 30}, hll4[4:]...),
+		"aux":       hll4[:len(hll4)-4],
+	} {
+		_, err := DecodeHLL(b)
+		require.True(t, errors.Is(err, ErrInvalidSketch), name)
+	}
+
+	_, err := DecodeHLL(append([]byte{10, 2}, hll4[2:]...))
+	require.True(t, errors.Is(err, ErrUnsupported))
+}
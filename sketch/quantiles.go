@@ -0,0 +1,517 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Quantiles sketch preamble layout
+const (
+	quantilesSerVer      = 3
+	quantilesFamily      = 8
+	quantilesFlagBE      = 1
+	quantilesFlagEmpty   = 4
+	quantilesFlagCompact = 8
+	quantilesDataAt      = 32
+)
+
+// KLL sketch preamble layout
+const (
+	kllFamily          = 15
+	kllSerVerFull      = 1
+	kllSerVerSingle    = 2
+	kllSerVerUpdatable = 3
+	kllPreIntsFull     = 5
+	kllFlagEmpty       = 1
+	kllFlagSingleItem  = 4
+	kllLevelsAt        = 20
+	kllSingleItemAt    = 8
+	kllDefaultM        = 8
+)
+
+// DefaultQuantilesK is the k druid gives quantiles sketches unless a query
+// sets another, DefaultKLLK the k of KLL sketches
+const (
+	DefaultQuantilesK = 128
+	DefaultKLLK       = 200
+)
+
+// Quantiles is a DataSketches quantiles or KLL sketch of a distribution of
+// values, as druid returns for DS_QUANTILES_SKETCH and DS_KLL_SKETCH
+// aggregations that aren't finalized. It's immutable, merges return new
+// sketches.
+//
+// Ranks are inclusive: the rank of a value is the fraction of values less
+// than or equal to it, as druid computes them
+type Quantiles struct {
+	k uint16
+	n uint64
+
+	min, max float64
+
+	// levels holds the retained items in ascending order, each item of
+	// level h standing for 1<<h values
+	levels [][]float64
+}
+
+// DecodeQuantiles deserializes a classic quantiles sketch of doubles in the
+// DataSketches format (serial version 3), compact or updatable
+func DecodeQuantiles(b []byte) (*Quantiles, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: %d bytes is too short for a quantiles sketch", ErrInvalidSketch, len(b))
+	}
+
+	serVer, family, flags := b[1], b[2], b[3]
+	if family != quantilesFamily {
+		return nil, fmt.Errorf("%w: family %d is not a quantiles sketch", ErrInvalidSketch, family)
+	}
+	if serVer != quantilesSerVer {
+		return nil, fmt.Errorf("%w: quantiles serial version %d", ErrUnsupported, serVer)
+	}
+	if flags&quantilesFlagBE != 0 {
+		return nil, fmt.Errorf("%w: big endian quantiles sketch", ErrUnsupported)
+	}
+
+	k := int(binary.LittleEndian.Uint16(b[4:]))
+	if k < 1 || k&(k-1) != 0 {
+		return nil, fmt.Errorf("%w: quantiles k %d", ErrInvalidSketch, k)
+	}
+	q := &Quantiles{k: uint16(k), min: math.NaN(), max: math.NaN()}
+	if flags&quantilesFlagEmpty != 0 {
+		return q, nil
+	}
+	if len(b) < quantilesDataAt {
+		return nil, fmt.Errorf("%w: quantiles preamble in %d bytes", ErrInvalidSketch, len(b))
+	}
+
+	q.n = binary.LittleEndian.Uint64(b[8:])
+	q.min = math.Float64frombits(binary.LittleEndian.Uint64(b[16:]))
+	q.max = math.Float64frombits(binary.LittleEndian.Uint64(b[24:]))
+
+	// The base buffer holds the last n % 2k values, and each bit set in
+	// n / 2k a level of k items weighing twice those of the level below
+	baseCount := int(q.n % uint64(2*k))
+	pattern := q.n / uint64(2*k)
+	data := b[quantilesDataAt:]
+
+	base, err := readDoubles(data, 0, baseCount)
+	if err != nil {
+		return nil, err
+	}
+	q.levels = [][]float64{base}
+
+	offset := baseCount
+	for level := 0; pattern>>uint(level) != 0; level++ {
+		if flags&quantilesFlagCompact == 0 {
+			// Updatable sketches keep 2k slots for the base buffer and k
+			// for every level, occupied or not
+			offset = (2 + level) * k
+		}
+		var items []float64
+		if pattern>>uint(level)&1 == 1 {
+			if items, err = readDoubles(data, offset, k); err != nil {
+				return nil, err
+			}
+			if flags&quantilesFlagCompact != 0 {
+				offset += k
+			}
+		}
+		q.levels = append(q.levels, items)
+	}
+	for _, items := range q.levels {
+		sort.Float64s(items)
+	}
+	return q, nil
+}
+
+// DecodeKLLDoubles deserializes a KLL sketch of doubles in the DataSketches
+// format, as druid's KllDoublesSketch aggregation returns
+func DecodeKLLDoubles(b []byte) (*Quantiles, error) {
+	return decodeKLL(b, 8)
+}
+
+// DecodeKLLFloats deserializes a KLL sketch of floats in the DataSketches
+// format, as druid's KllFloatsSketch aggregation returns
+func DecodeKLLFloats(b []byte) (*Quantiles, error) {
+	return decodeKLL(b, 4)
+}
+
+// decodeKLL deserializes a compact KLL sketch whose items are itemSize
+// bytes long
+func decodeKLL(b []byte, itemSize int) (*Quantiles, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: %d bytes is too short for a KLL sketch", ErrInvalidSketch, len(b))
+	}
+
+	preInts, serVer, family, flags := int(b[0]), b[1], b[2], b[3]
+	k, m := int(binary.LittleEndian.Uint16(b[4:])), int(b[6])
+	if family != kllFamily {
+		return nil, fmt.Errorf("%w: family %d is not a KLL sketch", ErrInvalidSketch, family)
+	}
+	if serVer == kllSerVerUpdatable {
+		return nil, fmt.Errorf("%w: updatable KLL sketch", ErrUnsupported)
+	}
+	if serVer != kllSerVerFull && serVer != kllSerVerSingle {
+		return nil, fmt.Errorf("%w: KLL serial version %d", ErrUnsupported, serVer)
+	}
+	if m < 2 || m > kllDefaultM || k < m {
+		return nil, fmt.Errorf("%w: KLL k %d and m %d", ErrInvalidSketch, k, m)
+	}
+
+	q := &Quantiles{k: uint16(k), min: math.NaN(), max: math.NaN()}
+	readItem := func(offset int) float64 {
+		if itemSize == 4 {
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(b[offset:])))
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[offset:]))
+	}
+
+	switch {
+	case flags&kllFlagEmpty != 0:
+		return q, nil
+
+	case serVer == kllSerVerSingle || flags&kllFlagSingleItem != 0:
+		if len(b) < kllSingleItemAt+itemSize {
+			return nil, fmt.Errorf("%w: single item KLL sketch of %d bytes", ErrInvalidSketch, len(b))
+		}
+		item := readItem(kllSingleItemAt)
+		q.n, q.min, q.max = 1, item, item
+		q.levels = [][]float64{{item}}
+		return q, nil
+	}
+
+	if preInts != kllPreIntsFull || len(b) < kllLevelsAt {
+		return nil, fmt.Errorf("%w: KLL preamble of %d ints in %d bytes", ErrInvalidSketch, preInts, len(b))
+	}
+	q.n = binary.LittleEndian.Uint64(b[8:])
+	numLevels := int(b[18])
+	if numLevels < 1 {
+		return nil, fmt.Errorf("%w: KLL sketch of no levels", ErrInvalidSketch)
+	}
+
+	// Levels are offsets into an array of the sketch's capacity whose
+	// retained items are at the end, the last offset isn't serialized
+	ints, err := readInts(b[kllLevelsAt:], numLevels)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int, numLevels+1)
+	for i, v := range ints {
+		offsets[i] = int(v)
+	}
+	offsets[numLevels] = kllCapacity(k, m, numLevels)
+	for i := 0; i < numLevels; i++ {
+		if offsets[i] < 0 || offsets[i] > offsets[i+1] {
+			return nil, fmt.Errorf("%w: KLL level offsets %v", ErrInvalidSketch, offsets)
+		}
+	}
+
+	minAt := kllLevelsAt + numLevels*4
+	itemsAt := minAt + 2*itemSize
+	if len(b) < itemsAt+(offsets[numLevels]-offsets[0])*itemSize {
+		return nil, fmt.Errorf("%w: KLL sketch of %d items in %d bytes", ErrInvalidSketch, offsets[numLevels]-offsets[0], len(b))
+	}
+	q.min, q.max = readItem(minAt), readItem(minAt+itemSize)
+
+	q.levels = make([][]float64, numLevels)
+	for level := range q.levels {
+		items := make([]float64, offsets[level+1]-offsets[level])
+		for i := range items {
+			items[i] = readItem(itemsAt + (offsets[level]-offsets[0]+i)*itemSize)
+		}
+		sort.Float64s(items)
+		q.levels[level] = items
+	}
+	return q, nil
+}
+
+// readDoubles reads count little endian doubles from data, starting at the
+// index offset
+func readDoubles(data []byte, offset, count int) ([]float64, error) {
+	if len(data) < (offset+count)*8 {
+		return nil, fmt.Errorf("%w: %d doubles in %d bytes", ErrInvalidSketch, offset+count, len(data))
+	}
+	items := make([]float64, count)
+	for i := range items {
+		items[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[(offset+i)*8:]))
+	}
+	return items, nil
+}
+
+// kllCapacity is the number of items a KLL sketch of numLevels levels can
+// hold
+func kllCapacity(k, m, numLevels int) int {
+	total := 0
+	for level := 0; level < numLevels; level++ {
+		total += kllLevelCapacity(k, m, numLevels, level)
+	}
+	return total
+}
+
+// kllLevelCapacity is the capacity of a level of a KLL sketch, k for the
+// top level and shrinking by 2/3 for each level below it, at least m
+func kllLevelCapacity(k, m, numLevels, level int) int {
+	depth := numLevels - level - 1
+	capacity := k
+	for depth > 30 {
+		capacity = kllDepthCapacity(capacity, 15)
+		depth -= 15
+	}
+	capacity = kllDepthCapacity(capacity, depth)
+	if capacity < m {
+		return m
+	}
+	return capacity
+}
+
+// kllDepthCapacity rounds k*(2/3)^depth as DataSketches does
+func kllDepthCapacity(k, depth int) int {
+	powerOfThree := int64(1)
+	for i := 0; i < depth; i++ {
+		powerOfThree *= 3
+	}
+	return int((int64(2*k)<<uint(depth)/powerOfThree + 1) >> 1)
+}
+
+// MergeQuantiles returns a sketch of the values of all sketches, which can
+// be quantiles or KLL sketches, with the smallest k of them. nil sketches
+// are skipped
+func MergeQuantiles(sketches ...*Quantiles) (*Quantiles, error) {
+	result := &Quantiles{min: math.NaN(), max: math.NaN()}
+	for _, q := range sketches {
+		if q == nil {
+			continue
+		}
+		if result.k == 0 || q.k < result.k {
+			result.k = q.k
+		}
+		if q.n == 0 {
+			continue
+		}
+		if result.n > math.MaxUint64-q.n {
+			return nil, fmt.Errorf("%w: merged sketches hold more than 2^64 values", ErrIncompatible)
+		}
+		result.n += q.n
+		result.min = nanMin(result.min, q.min)
+		result.max = nanMax(result.max, q.max)
+		for len(result.levels) < len(q.levels) {
+			result.levels = append(result.levels, nil)
+		}
+		for level, items := range q.levels {
+			result.levels[level] = mergeSorted(result.levels[level], items)
+		}
+	}
+	if result.k == 0 {
+		return nil, fmt.Errorf("%w: merge of no sketches", ErrIncompatible)
+	}
+	result.compress()
+	return result, nil
+}
+
+// compress compacts levels as KLL does until the sketch fits the capacity
+// of its k. Compacting a level promotes every other item to the level
+// above, alternating which so that the errors cancel out
+func (q *Quantiles) compress() {
+	k, odd := int(q.k), 0
+	for {
+		numLevels, retained := len(q.levels), q.Retained()
+		if retained <= kllCapacity(k, kllDefaultM, numLevels) {
+			return
+		}
+
+		for level := 0; level < numLevels; level++ {
+			items := q.levels[level]
+			if len(items) < kllLevelCapacity(k, kllDefaultM, numLevels, level) {
+				continue
+			}
+			if level+1 == len(q.levels) {
+				q.levels = append(q.levels, nil)
+			}
+
+			// An odd item out stays behind
+			kept := items[:len(items)%2]
+			promoted := make([]float64, 0, len(items)/2)
+			for i := len(kept) + odd; i < len(items); i += 2 {
+				promoted = append(promoted, items[i])
+			}
+			odd ^= 1
+
+			q.levels[level] = append([]float64(nil), kept...)
+			q.levels[level+1] = mergeSorted(q.levels[level+1], promoted)
+			break
+		}
+	}
+}
+
+// mergeSorted merges two ascending slices into a new one
+func mergeSorted(a, b []float64) []float64 {
+	out := make([]float64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] <= b[j] {
+			out = append(out, a[i])
+			i++
+		} else {
+			out = append(out, b[j])
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+func nanMin(a, b float64) float64 {
+	if math.IsNaN(a) || b < a {
+		return b
+	}
+	return a
+}
+
+func nanMax(a, b float64) float64 {
+	if math.IsNaN(a) || b > a {
+		return b
+	}
+	return a
+}
+
+// K returns the sketch's accuracy parameter, its normalized rank error is
+// about 1.7% for a quantiles sketch of k 128 and 1.33% for a KLL sketch of
+// k 200
+func (q *Quantiles) K() int {
+	return int(q.k)
+}
+
+// N returns the number of values the sketch has seen
+func (q *Quantiles) N() uint64 {
+	return q.n
+}
+
+// IsEmpty reports whether the sketch has never seen a value
+func (q *Quantiles) IsEmpty() bool {
+	return q.n == 0
+}
+
+// Retained returns how many items the sketch holds
+func (q *Quantiles) Retained() int {
+	retained := 0
+	for _, items := range q.levels {
+		retained += len(items)
+	}
+	return retained
+}
+
+// Min returns the smallest value seen, NaN when the sketch is empty
+func (q *Quantiles) Min() float64 {
+	return q.min
+}
+
+// Max returns the largest value seen, NaN when the sketch is empty
+func (q *Quantiles) Max() float64 {
+	return q.max
+}
+
+// Quantile returns the approximate value of the given rank, between 0 and
+// 1, e.g. 0.95 for the 95th percentile. Ranks 0 and 1 return the exact
+// minimum and maximum. It's NaN when the sketch is empty
+func (q *Quantiles) Quantile(rank float64) (float64, error) {
+	if rank < 0 || rank > 1 || math.IsNaN(rank) {
+		return 0, fmt.Errorf("%w: rank %v is outside [0, 1]", ErrInvalidArgument, rank)
+	}
+	switch {
+	case q.n == 0:
+		return math.NaN(), nil
+	case rank == 0:
+		return q.min, nil
+	case rank == 1:
+		return q.max, nil
+	}
+
+	items, weights := q.sortedView()
+	natural := uint64(math.Ceil(rank * float64(q.n)))
+	i := sort.Search(len(weights), func(i int) bool { return weights[i] >= natural })
+	if i == len(items) {
+		return q.max, nil
+	}
+	return items[i], nil
+}
+
+// Quantiles returns the approximate values of ranks, as Quantile does
+func (q *Quantiles) Quantiles(ranks ...float64) ([]float64, error) {
+	values := make([]float64, len(ranks))
+	for i, rank := range ranks {
+		value, err := q.Quantile(rank)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Rank returns the approximate fraction of values less than or equal to
+// value. It's NaN when the sketch is empty
+func (q *Quantiles) Rank(value float64) float64 {
+	if q.n == 0 {
+		return math.NaN()
+	}
+	items, weights := q.sortedView()
+	return q.rank(items, weights, value)
+}
+
+// rank returns the fraction of the sorted view's weight at or below value
+func (q *Quantiles) rank(items []float64, weights []uint64, value float64) float64 {
+	i := sort.Search(len(items), func(i int) bool { return items[i] > value })
+	if i == 0 {
+		return 0
+	}
+	return float64(weights[i-1]) / float64(q.n)
+}
+
+// CDF returns the approximate ranks of splitPoints, which must be unique
+// and ascending, followed by 1 for the values above the last of them. It's
+// nil when the sketch is empty
+func (q *Quantiles) CDF(splitPoints ...float64) ([]float64, error) {
+	for i, split := range splitPoints {
+		if math.IsNaN(split) || i > 0 && split <= splitPoints[i-1] {
+			return nil, fmt.Errorf("%w: split points must be unique and ascending", ErrInvalidArgument)
+		}
+	}
+	if q.n == 0 {
+		return nil, nil
+	}
+
+	items, weights := q.sortedView()
+	cdf := make([]float64, len(splitPoints)+1)
+	for i, split := range splitPoints {
+		cdf[i] = q.rank(items, weights, split)
+	}
+	cdf[len(splitPoints)] = 1
+	return cdf, nil
+}
+
+// sortedView returns the retained items in ascending order with their
+// cumulative weights
+func (q *Quantiles) sortedView() ([]float64, []uint64) {
+	type weighted struct {
+		item   float64
+		weight uint64
+	}
+	all := make([]weighted, 0, q.Retained())
+	for level, items := range q.levels {
+		for _, item := range items {
+			all = append(all, weighted{item, 1 << uint(level)})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].item < all[j].item })
+
+	items := make([]float64, len(all))
+	weights := make([]uint64, len(all))
+	var total uint64
+	for i, w := range all {
+		total += w.weight
+		items[i], weights[i] = w.item, total
+	}
+	return items, weights
+}
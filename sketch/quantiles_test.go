@@ -0,0 +1,171 @@
+package sketch
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func goldenQuantiles(t *testing.T, name string, decode func([]byte) (*Quantiles, error)) *Quantiles {
+	q, err := decode(golden(t, name))
+	require.NoError(t, err, name)
+	return q
+}
+
+// requireAccurate checks q against the values 0 to n-1, to within the
+// given normalized rank error
+func requireAccurate(t *testing.T, q *Quantiles, n int, rankError float64) {
+	require.Equal(t, uint64(n), q.N())
+	require.Equal(t, 0.0, q.Min())
+	require.Equal(t, float64(n-1), q.Max())
+
+	for _, rank := range []float64{0.01, 0.25, 0.5, 0.9, 0.95, 0.99} {
+		value, err := q.Quantile(rank)
+		require.NoError(t, err)
+		require.InDelta(t, rank*float64(n), value, rankError*float64(n)+1, "p%v", rank*100)
+		require.InDelta(t, rank, q.Rank(rank*float64(n)), rankError+1.5/float64(n), "rank of p%v", rank*100)
+	}
+
+	var weight uint64
+	for level, items := range q.levels {
+		weight += uint64(len(items)) << uint(level)
+	}
+	require.Equal(t, q.N(), weight)
+}
+
+func TestDecodeQuantiles(t *testing.T) {
+	empty := goldenQuantiles(t, "quantiles_empty.bin", DecodeQuantiles)
+	require.True(t, empty.IsEmpty())
+	require.Equal(t, DefaultQuantilesK, empty.K())
+	require.True(t, math.IsNaN(empty.Min()))
+	value, err := empty.Quantile(0.5)
+	require.NoError(t, err)
+	require.True(t, math.IsNaN(value))
+
+	// Below 2k values the sketch is exact
+	small := goldenQuantiles(t, "quantiles_small.bin", DecodeQuantiles)
+	require.Equal(t, 100, small.Retained())
+	requireAccurate(t, small, 100, 0)
+	value, err = small.Quantile(0.5)
+	require.NoError(t, err)
+	require.Equal(t, 49.0, value)
+	require.Equal(t, 0.5, small.Rank(49))
+	require.Equal(t, 0.5, small.Rank(49.5))
+	require.Equal(t, 0.0, small.Rank(-1))
+
+	a := goldenQuantiles(t, "quantiles_a.bin", DecodeQuantiles)
+	require.Less(t, a.Retained(), 2000)
+	requireAccurate(t, a, 60000, 0.02)
+
+	updatable := goldenQuantiles(t, "quantiles_updatable.bin", DecodeQuantiles)
+	require.Equal(t, a, updatable)
+}
+
+func TestDecodeKLL(t *testing.T) {
+	empty := goldenQuantiles(t, "kll_empty.bin", DecodeKLLDoubles)
+	require.True(t, empty.IsEmpty())
+	require.Equal(t, DefaultKLLK, empty.K())
+
+	single := goldenQuantiles(t, "kll_single.bin", DecodeKLLDoubles)
+	require.Equal(t, uint64(1), single.N())
+	for _, rank := range []float64{0, 0.5, 1} {
+		value, err := single.Quantile(rank)
+		require.NoError(t, err)
+		require.Equal(t, 42.0, value)
+	}
+
+	doubles := goldenQuantiles(t, "kll_doubles.bin", DecodeKLLDoubles)
+	require.Less(t, doubles.Retained(), 1000)
+	requireAccurate(t, doubles, 100000, 0.015)
+
+	floats := goldenQuantiles(t, "kll_floats.bin", DecodeKLLFloats)
+	require.Equal(t, doubles, floats)
+}
+
+func TestMergeQuantiles(t *testing.T) {
+	a := goldenQuantiles(t, "quantiles_a.bin", DecodeQuantiles)
+	b := goldenQuantiles(t, "quantiles_b.bin", DecodeQuantiles)
+
+	merged, err := MergeQuantiles(a, b, nil, goldenQuantiles(t, "quantiles_empty.bin", DecodeQuantiles))
+	require.NoError(t, err)
+	require.Equal(t, DefaultQuantilesK, merged.K())
+	require.LessOrEqual(t, merged.Retained(), kllCapacity(merged.K(), kllDefaultM, len(merged.levels)))
+	requireAccurate(t, merged, 100000, 0.02)
+
+	// Merging the p95s alone would be far off
+	p95a, _ := a.Quantile(0.95)
+	p95b, _ := b.Quantile(0.95)
+	p95, _ := merged.Quantile(0.95)
+	require.InDelta(t, 95000, p95, 2000)
+	require.Greater(t, math.Abs(95000-(p95a+p95b)/2), 10000.0)
+
+	// Quantiles and KLL sketches merge together
+	kll := goldenQuantiles(t, "kll_doubles.bin", DecodeKLLDoubles)
+	mixed, err := MergeQuantiles(kll, goldenQuantiles(t, "kll_single.bin", DecodeKLLDoubles), goldenQuantiles(t, "quantiles_small.bin", DecodeQuantiles))
+	require.NoError(t, err)
+	require.Equal(t, DefaultQuantilesK, mixed.K())
+	require.Equal(t, uint64(100101), mixed.N())
+	median, err := mixed.Quantile(0.5)
+	require.NoError(t, err)
+	require.InDelta(t, 50000, median, 2000)
+
+	_, err = MergeQuantiles()
+	require.True(t, errors.Is(err, ErrIncompatible))
+}
+
+func TestQuantilesCDF(t *testing.T) {
+	small := goldenQuantiles(t, "quantiles_small.bin", DecodeQuantiles)
+	cdf, err := small.CDF(9, 49, 89)
+	require.NoError(t, err)
+	require.Equal(t, []float64{0.1, 0.5, 0.9, 1}, cdf)
+
+	values, err := small.Quantiles(0, 0.1, 1)
+	require.NoError(t, err)
+	require.Equal(t, []float64{0, 9, 99}, values)
+
+	_, err = small.CDF(5, 5)
+	require.True(t, errors.Is(err, ErrInvalidArgument))
+	_, err = small.Quantile(1.5)
+	require.True(t, errors.Is(err, ErrInvalidArgument))
+	_, err = small.Quantiles(0.5, -1)
+	require.True(t, errors.Is(err, ErrInvalidArgument))
+
+	cdf, err = goldenQuantiles(t, "quantiles_empty.bin", DecodeQuantiles).CDF(1)
+	require.NoError(t, err)
+	require.Nil(t, cdf)
+}
+
+func TestDecodeQuantilesErrors(t *testing.T) {
+	a := golden(t, "quantiles_a.bin")
+	for name, b := range map[string][]byte{
+		"short":     a[:4],
+		"preamble":  a[:20],
+		"truncated": a[:len(a)-8],
+		"family":    append([]byte{2, 3, 15}, a[3:]...),
+		"k":         append([]byte{2, 3, 8, 0x1a, 100, 0}, a[6:]...),
+	} {
+		_, err := DecodeQuantiles(b)
+		require.True(t, errors.Is(err, ErrInvalidSketch), name)
+	}
+	_, err := DecodeQuantiles(append([]byte{2, 2}, a[2:]...))
+	require.True(t, errors.Is(err, ErrUnsupported))
+
+	kll := golden(t, "kll_doubles.bin")
+	for name, b := range map[string][]byte{
+		"short":     kll[:4],
+		"truncated": kll[:len(kll)-8],
+		"family":    append([]byte{5, 1, 8}, kll[3:]...),
+		"levels":    append(append([]byte(nil), kll[:18]...), append([]byte{0}, kll[19:]...)...),
+	} {
+		_, err := DecodeKLLDoubles(b)
+		require.True(t, errors.Is(err, ErrInvalidSketch), name)
+	}
+	_, err = DecodeKLLDoubles(append([]byte{5, 3}, kll[2:]...))
+	require.True(t, errors.Is(err, ErrUnsupported))
+
+	// Decoding doubles as floats gets the lengths wrong
+	_, err = DecodeKLLDoubles(golden(t, "kll_floats.bin"))
+	require.True(t, errors.Is(err, ErrInvalidSketch))
+}
@@ -0,0 +1,32 @@
+// Package sketch decodes the DataSketches sketches druid returns for
+// aggregations that aren't finalized, such as DS_THETA and DS_HLL scanned
+// into a []byte, so they can be estimated and combined in Go
+package sketch
+
+import "errors"
+
+var (
+	// ErrInvalidSketch is returned when bytes aren't a valid sketch
+	ErrInvalidSketch = errors.New("sketch: invalid sketch")
+
+	// ErrUnsupported is returned for sketch versions or options not supported
+	ErrUnsupported = errors.New("sketch: unsupported sketch")
+
+	// ErrIncompatible is returned when sketches can't be combined
+	ErrIncompatible = errors.New("sketch: incompatible sketches")
+
+	// ErrInvalidArgument is returned for ranks or split points out of range
+	ErrInvalidArgument = errors.New("sketch: invalid argument")
+)
+
+// clampStdDev limits a number of standard deviations to the 1 to 3
+// DataSketches supports
+func clampStdDev(numStdDev int) float64 {
+	switch {
+	case numStdDev < 1:
+		return 1
+	case numStdDev > 3:
+		return 3
+	}
+	return float64(numStdDev)
+}
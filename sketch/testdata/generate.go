@@ -0,0 +1,514 @@
+//go:build ignore
+// +build ignore
+
+// generate writes the golden sketches the sketch package is tested with.
+//
+// Druid isn't available to produce them, so each one is assembled byte by
+// byte from the DataSketches serialization spec, hashing items the way
+// DataSketches does (MurmurHash3_x64_128 of the UTF-8 bytes with seed 9001).
+// It deliberately doesn't use the sketch package. Run it from this directory
+// with go run generate.go
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+
+	"github.com/peak-ai/go-druid/internal/murmur3"
+)
+
+const (
+	seed     = 9001
+	seedHash = 0x93cc
+	lgK      = 12
+	k        = 1 << lgK
+)
+
+func main() {
+	write("theta_empty.bin", thetaEmpty())
+	write("theta_single.bin", thetaSingle("user-0"))
+	write("theta_exact.bin", thetaCompact(users(0, 1000), 4096, true))
+	write("theta_unordered.bin", thetaCompact(users(0, 1000), 4096, false))
+	write("theta_a.bin", thetaCompact(users(0, 100000), 4096, true))
+	write("theta_b.bin", thetaCompact(users(50000, 150000), 4096, true))
+	write("theta_update.bin", thetaUpdate(users(0, 100)))
+
+	write("hll_list.bin", hllList(users(0, 5)))
+	write("hll_set.bin", hllSet(users(0, 300)))
+	write("hll4_a.bin", hll(users(0, 1000000), 4, false))
+	write("hll6_a.bin", hll(users(0, 1000000), 6, true))
+	write("hll8_a.bin", hll(users(0, 1000000), 8, true))
+	write("hll4_b.bin", hll(users(500000, 1500000), 4, true))
+
+	write("quantiles_empty.bin", quantilesEmpty())
+	write("quantiles_small.bin", quantiles(values(0, 100), true))
+	write("quantiles_a.bin", quantiles(values(0, 60000), true))
+	write("quantiles_b.bin", quantiles(values(60000, 100000), true))
+	write("quantiles_updatable.bin", quantiles(values(0, 60000), false))
+
+	write("kll_empty.bin", kllEmpty())
+	write("kll_single.bin", kllSingle(42, 8))
+	write("kll_doubles.bin", kll(values(0, 100000), 8))
+	write("kll_floats.bin", kll(values(0, 100000), 4))
+}
+
+func write(name string, b []byte) {
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		panic(err)
+	}
+}
+
+func users(from, to int) []string {
+	var items []string
+	for i := from; i < to; i++ {
+		items = append(items, fmt.Sprintf("user-%d", i))
+	}
+	return items
+}
+
+// values returns from to to-1 as latencies in a random order
+func values(from, to int) []float64 {
+	var items []float64
+	for i := from; i < to; i++ {
+		items = append(items, float64(i))
+	}
+	rand.New(rand.NewSource(int64(from))).Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+	return items
+}
+
+func hash(item string) (uint64, uint64) {
+	return murmur3.Sum128([]byte(item), seed)
+}
+
+// Theta: preamble longs, serial version 3, family 3 (compact) or 2 (quick
+// select), lgNomLongs, lgArrLongs, flags, seed hash, then count and p,
+// theta, and the hashes
+
+func thetaEmpty() []byte {
+	b := make([]byte, 8)
+	b[0], b[1], b[2], b[3], b[5] = 1, 3, 3, 12, 0x1e
+	binary.LittleEndian.PutUint16(b[6:], seedHash)
+	return b
+}
+
+func thetaSingle(item string) []byte {
+	h, _ := hash(item)
+	b := make([]byte, 16)
+	b[0], b[1], b[2], b[3], b[5] = 1, 3, 3, 12, 0x3a
+	binary.LittleEndian.PutUint16(b[6:], seedHash)
+	binary.LittleEndian.PutUint64(b[8:], h>>1)
+	return b
+}
+
+func thetaHashes(items []string) []uint64 {
+	var hashes []uint64
+	for _, item := range items {
+		h, _ := hash(item)
+		hashes = append(hashes, h>>1)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+func thetaCompact(items []string, nominal int, ordered bool) []byte {
+	hashes := thetaHashes(items)
+	theta := uint64(math.MaxInt64)
+	if len(hashes) > nominal {
+		theta = hashes[nominal]
+		hashes = hashes[:nominal]
+	}
+	if !ordered {
+		rand.New(rand.NewSource(1)).Shuffle(len(hashes), func(i, j int) { hashes[i], hashes[j] = hashes[j], hashes[i] })
+	}
+
+	preLongs := 2
+	if theta < math.MaxInt64 {
+		preLongs = 3
+	}
+	flags := byte(0x0a)
+	if ordered {
+		flags |= 0x10
+	}
+
+	b := make([]byte, preLongs*8+len(hashes)*8)
+	b[0], b[1], b[2], b[3], b[5] = byte(preLongs), 3, 3, byte(bits.Len(uint(nominal))-1), flags
+	binary.LittleEndian.PutUint16(b[6:], seedHash)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(hashes)))
+	binary.LittleEndian.PutUint32(b[12:], math.Float32bits(1))
+	if preLongs == 3 {
+		binary.LittleEndian.PutUint64(b[16:], theta)
+	}
+	for i, h := range hashes {
+		binary.LittleEndian.PutUint64(b[preLongs*8+i*8:], h)
+	}
+	return b
+}
+
+// thetaUpdate lays hashes out in an open addressed table of 256 slots as
+// an update sketch does
+func thetaUpdate(items []string) []byte {
+	const lgArr = 8
+	table := make([]uint64, 1<<lgArr)
+	for _, h := range thetaHashes(items) {
+		i := h >> (63 - lgArr)
+		for table[i] != 0 {
+			i = (i + 1) & (1<<lgArr - 1)
+		}
+		table[i] = h
+	}
+
+	b := make([]byte, 24+len(table)*8)
+	b[0], b[1], b[2], b[3], b[4], b[5] = 3, 3, 2, 12, lgArr, 0
+	binary.LittleEndian.PutUint16(b[6:], seedHash)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(items)))
+	binary.LittleEndian.PutUint32(b[12:], math.Float32bits(1))
+	binary.LittleEndian.PutUint64(b[16:], math.MaxInt64)
+	for i, h := range table {
+		binary.LittleEndian.PutUint64(b[24+i*8:], h)
+	}
+	return b
+}
+
+// HLL: preamble ints, serial version 1, family 7, lgK, lgArr, flags, list
+// count or curMin, and the mode byte (mode | type << 2)
+
+// coupon is the 26 bit address and 6 bit value DataSketches derives from
+// an item's hash
+func coupon(item string) uint32 {
+	h0, h1 := hash(item)
+	value := bits.LeadingZeros64(h1)
+	if value > 62 {
+		value = 62
+	}
+	return uint32(value+1)<<26 | uint32(h0&(1<<26-1))
+}
+
+func coupons(items []string) []uint32 {
+	seen := map[uint32]bool{}
+	var out []uint32
+	for _, item := range items {
+		c := coupon(item)
+		if !seen[c] {
+			seen[c] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func hllList(items []string) []byte {
+	cs := coupons(items)
+	b := make([]byte, 8+len(cs)*4)
+	b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7] = 2, 1, 7, lgK, 3, 0x08, byte(len(cs)), 0
+	for i, c := range cs {
+		binary.LittleEndian.PutUint32(b[8+i*4:], c)
+	}
+	return b
+}
+
+func hllSet(items []string) []byte {
+	cs := coupons(items)
+	b := make([]byte, 12+len(cs)*4)
+	b[0], b[1], b[2], b[3], b[4], b[5], b[7] = 3, 1, 7, lgK, 9, 0x08, 1
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(cs)))
+	for i, c := range cs {
+		binary.LittleEndian.PutUint32(b[12+i*4:], c)
+	}
+	return b
+}
+
+func hll(items []string, width int, outOfOrder bool) []byte {
+	registers := make([]uint8, k)
+	hip, kxq := 0.0, float64(k)
+	for _, item := range items {
+		c := coupon(item)
+		slot, value := int(c&(1<<26-1))&(k-1), uint8(c>>26)
+		if value <= registers[slot] {
+			continue
+		}
+		hip += float64(k) / kxq
+		kxq += math.Ldexp(1, -int(value)) - math.Ldexp(1, -int(registers[slot]))
+		registers[slot] = value
+	}
+
+	curMin := uint8(64)
+	for _, v := range registers {
+		if v < curMin {
+			curMin = v
+		}
+	}
+	if width != 4 {
+		curMin = 0
+	}
+	numAtCurMin := 0
+	var kxq0, kxq1 float64
+	for _, v := range registers {
+		if v == curMin {
+			numAtCurMin++
+		}
+		if v < 32 {
+			kxq0 += math.Ldexp(1, -int(v))
+		} else {
+			kxq1 += math.Ldexp(1, -int(v))
+		}
+	}
+
+	var data []byte
+	var aux []uint32
+	switch width {
+	case 8:
+		data = append(data, registers...)
+	case 6:
+		data = make([]byte, k*3/4+1)
+		for slot, v := range registers {
+			bit := slot * 6
+			pair := uint16(data[bit>>3]) | uint16(data[bit>>3+1])<<8
+			pair |= uint16(v) << (bit & 7)
+			data[bit>>3], data[bit>>3+1] = byte(pair), byte(pair>>8)
+		}
+	case 4:
+		data = make([]byte, k/2)
+		for slot, v := range registers {
+			nibble := v - curMin
+			if nibble >= 15 {
+				nibble = 15
+				aux = append(aux, uint32(v)<<26|uint32(slot))
+			}
+			data[slot>>1] |= nibble << (4 * uint(slot&1))
+		}
+	}
+
+	b := make([]byte, 40, 40+len(data)+len(aux)*4)
+	flags := byte(0x08)
+	if outOfOrder {
+		flags |= 0x10
+		hip = 0
+	}
+	typ := map[int]byte{4: 0, 6: 1, 8: 2}[width]
+	b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7] = 10, 1, 7, lgK, 3, flags, curMin, 2|typ<<2
+	binary.LittleEndian.PutUint64(b[8:], math.Float64bits(hip))
+	binary.LittleEndian.PutUint64(b[16:], math.Float64bits(kxq0))
+	binary.LittleEndian.PutUint64(b[24:], math.Float64bits(kxq1))
+	binary.LittleEndian.PutUint32(b[32:], uint32(numAtCurMin))
+	binary.LittleEndian.PutUint32(b[36:], uint32(len(aux)))
+	b = append(b, data...)
+	for _, pair := range aux {
+		var v [4]byte
+		binary.LittleEndian.PutUint32(v[:], pair)
+		b = append(b, v[:]...)
+	}
+	return b
+}
+
+// Quantiles: preamble longs, serial version 3, family 8, flags, k, then n,
+// min and max, and the base buffer followed by the levels
+
+const quantilesK = 128
+
+func quantilesEmpty() []byte {
+	b := make([]byte, 8)
+	b[0], b[1], b[2], b[3] = 1, 3, 8, 0x1e
+	binary.LittleEndian.PutUint16(b[4:], quantilesK)
+	return b
+}
+
+// quantiles runs the classic quantiles update: every 2k values the sorted
+// base buffer is halved into the first level, carrying into the levels
+// above as they're occupied
+func quantiles(items []float64, compact bool) []byte {
+	rnd := rand.New(rand.NewSource(2))
+	var base []float64
+	var levels [][]float64
+	for _, item := range items {
+		base = append(base, item)
+		if len(base) < 2*quantilesK {
+			continue
+		}
+		sort.Float64s(base)
+		carry := halve(base, rnd)
+		base = nil
+		for level := 0; ; level++ {
+			if level == len(levels) {
+				levels = append(levels, nil)
+			}
+			if levels[level] == nil {
+				levels[level] = carry
+				break
+			}
+			merged := append(append([]float64(nil), levels[level]...), carry...)
+			sort.Float64s(merged)
+			carry = halve(merged, rnd)
+			levels[level] = nil
+		}
+	}
+
+	min, max := items[0], items[0]
+	for _, item := range items {
+		min, max = math.Min(min, item), math.Max(max, item)
+	}
+
+	var data []float64
+	sort.Float64s(base)
+	if compact {
+		data = append(data, base...)
+		for _, level := range levels {
+			data = append(data, level...)
+		}
+	} else {
+		data = make([]float64, (2+len(levels))*quantilesK)
+		copy(data, base)
+		for i, level := range levels {
+			copy(data[(2+i)*quantilesK:], level)
+		}
+	}
+
+	flags := byte(0)
+	if compact {
+		flags = 0x1a
+	}
+	b := make([]byte, 32+len(data)*8)
+	b[0], b[1], b[2], b[3] = 2, 3, 8, flags
+	binary.LittleEndian.PutUint16(b[4:], quantilesK)
+	binary.LittleEndian.PutUint64(b[8:], uint64(len(items)))
+	binary.LittleEndian.PutUint64(b[16:], math.Float64bits(min))
+	binary.LittleEndian.PutUint64(b[24:], math.Float64bits(max))
+	for i, v := range data {
+		binary.LittleEndian.PutUint64(b[32+i*8:], math.Float64bits(v))
+	}
+	return b
+}
+
+// halve keeps every other item of sorted items, starting at random
+func halve(items []float64, rnd *rand.Rand) []float64 {
+	var out []float64
+	for i := rnd.Intn(2); i < len(items); i += 2 {
+		out = append(out, items[i])
+	}
+	return out
+}
+
+// KLL: preamble ints, serial version 1 (2 for a single item), family 15,
+// flags, k, m, then n, min k, the number of levels, the level offsets but
+// the last, min and max, and the retained items
+
+const (
+	kllK = 200
+	kllM = 8
+)
+
+func kllEmpty() []byte {
+	b := make([]byte, 8)
+	b[0], b[1], b[2], b[3], b[6] = 2, 1, 15, 1, kllM
+	binary.LittleEndian.PutUint16(b[4:], kllK)
+	return b
+}
+
+func kllSingle(item float64, size int) []byte {
+	b := make([]byte, 8+size)
+	b[0], b[1], b[2], b[3], b[6] = 2, 2, 15, 4, kllM
+	binary.LittleEndian.PutUint16(b[4:], kllK)
+	putItem(b[8:], item, size)
+	return b
+}
+
+func putItem(b []byte, item float64, size int) {
+	if size == 4 {
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(item)))
+		return
+	}
+	binary.LittleEndian.PutUint64(b, math.Float64bits(item))
+}
+
+// kll runs the KLL update: once the sketch is full the lowest level at
+// its capacity is sorted and halved into the level above
+func kll(items []float64, size int) []byte {
+	rnd := rand.New(rand.NewSource(3))
+	levels := [][]float64{nil}
+	for _, item := range items {
+		levels[0] = append(levels[0], item)
+		for retained(levels) >= kllTotal(len(levels)) {
+			for h := range levels {
+				if len(levels[h]) < kllLevelCap(len(levels), h) {
+					continue
+				}
+				if h+1 == len(levels) {
+					levels = append(levels, nil)
+				}
+				sort.Float64s(levels[h])
+				odd := levels[h][:len(levels[h])%2]
+				merged := append(append([]float64(nil), levels[h+1]...), halve(levels[h][len(odd):], rnd)...)
+				sort.Float64s(merged)
+				levels[h], levels[h+1] = append([]float64(nil), odd...), merged
+				break
+			}
+		}
+	}
+
+	min, max := items[0], items[0]
+	for _, item := range items {
+		min, max = math.Min(min, item), math.Max(max, item)
+	}
+
+	// Offsets into an array of the total capacity, items at its end
+	numLevels := len(levels)
+	offsets := make([]int, numLevels+1)
+	offsets[numLevels] = kllTotal(numLevels)
+	for h := numLevels - 1; h >= 0; h-- {
+		offsets[h] = offsets[h+1] - len(levels[h])
+	}
+
+	b := make([]byte, 20+numLevels*4+(2+retained(levels))*size)
+	b[0], b[1], b[2], b[3], b[6] = 5, 1, 15, 0, kllM
+	binary.LittleEndian.PutUint16(b[4:], kllK)
+	binary.LittleEndian.PutUint64(b[8:], uint64(len(items)))
+	binary.LittleEndian.PutUint16(b[16:], kllK)
+	b[18] = byte(numLevels)
+	at := 20
+	for _, offset := range offsets[:numLevels] {
+		binary.LittleEndian.PutUint32(b[at:], uint32(offset))
+		at += 4
+	}
+	putItem(b[at:], min, size)
+	putItem(b[at+size:], max, size)
+	at += 2 * size
+	for _, level := range levels {
+		// Level zero is left unsorted as a sketch being updated has it
+		rnd.Shuffle(len(level), func(i, j int) { level[i], level[j] = level[j], level[i] })
+		for _, item := range level {
+			putItem(b[at:], item, size)
+			at += size
+		}
+	}
+	return b
+}
+
+func retained(levels [][]float64) int {
+	n := 0
+	for _, level := range levels {
+		n += len(level)
+	}
+	return n
+}
+
+func kllTotal(numLevels int) int {
+	total := 0
+	for h := 0; h < numLevels; h++ {
+		total += kllLevelCap(numLevels, h)
+	}
+	return total
+}
+
+// kllLevelCap is k*(2/3)^depth rounded, at least m
+func kllLevelCap(numLevels, h int) int {
+	depth := numLevels - h - 1
+	capacity := int(math.Floor(float64(kllK)*math.Pow(2.0/3, float64(depth)) + 0.5))
+	if capacity < kllM {
+		return kllM
+	}
+	return capacity
+}
@@ -0,0 +1,333 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Theta sketch families understood by DecodeTheta
+const (
+	familyAlpha       = 1
+	familyQuickSelect = 2
+	familyCompact     = 3
+)
+
+// Theta preamble flags
+const (
+	flagBigEndian  = 1
+	flagReadOnly   = 2
+	flagEmpty      = 4
+	flagCompact    = 8
+	flagOrdered    = 16
+	flagSingleItem = 32
+)
+
+// maxTheta is the theta of a sketch that has retained every hash
+const maxTheta = math.MaxInt64
+
+// DefaultNominalEntries is the size druid gives theta sketches unless a
+// query sets another
+const DefaultNominalEntries = 16384
+
+// DefaultSeedHash is the seed hash of sketches built with DataSketches'
+// default seed, which druid uses
+const DefaultSeedHash = 0x93cc
+
+// Theta is a DataSketches Theta sketch, as druid returns for DS_THETA and
+// thetaSketch aggregations that aren't finalized. It's immutable, unions
+// and intersections return new sketches
+type Theta struct {
+	// theta is the exclusive upper bound of the retained hashes
+	theta uint64
+
+	// hashes are the retained hashes in ascending order
+	hashes []uint64
+
+	seedHash uint16
+	empty    bool
+}
+
+// DecodeTheta deserializes a Theta sketch in the DataSketches format
+// (serial version 3): compact sketches as druid returns them, and update
+// sketches
+func DecodeTheta(b []byte) (*Theta, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: %d bytes is too short for a theta sketch", ErrInvalidSketch, len(b))
+	}
+
+	preLongs := int(b[0] & 0x3f)
+	serVer, family, lgArrLongs, flags := b[1], b[2], b[4], b[5]
+	if serVer != 3 {
+		return nil, fmt.Errorf("%w: theta serial version %d", ErrUnsupported, serVer)
+	}
+	if family != familyAlpha && family != familyQuickSelect && family != familyCompact {
+		return nil, fmt.Errorf("%w: family %d is not a theta sketch", ErrInvalidSketch, family)
+	}
+	if flags&flagBigEndian != 0 {
+		return nil, fmt.Errorf("%w: big endian theta sketch", ErrUnsupported)
+	}
+	if preLongs < 1 || preLongs > 3 || len(b) < preLongs*8 {
+		return nil, fmt.Errorf("%w: theta preamble of %d longs in %d bytes", ErrInvalidSketch, preLongs, len(b))
+	}
+
+	s := &Theta{theta: maxTheta, seedHash: binary.LittleEndian.Uint16(b[6:])}
+
+	if preLongs == 1 {
+		if flags&flagSingleItem != 0 && flags&flagEmpty == 0 {
+			if len(b) < 16 {
+				return nil, fmt.Errorf("%w: single item theta sketch of %d bytes", ErrInvalidSketch, len(b))
+			}
+			s.hashes = []uint64{binary.LittleEndian.Uint64(b[8:])}
+			return s, nil
+		}
+		s.empty = true
+		return s, nil
+	}
+
+	count := int(binary.LittleEndian.Uint32(b[8:]))
+	if preLongs == 3 {
+		s.theta = binary.LittleEndian.Uint64(b[16:])
+	}
+	s.empty = flags&flagEmpty != 0
+
+	// Compact sketches hold count entries, update sketches a hash table
+	// where zeros are free slots
+	entries := count
+	if family != familyCompact && flags&flagCompact == 0 {
+		entries = 1 << lgArrLongs
+	}
+	data := b[preLongs*8:]
+	if entries < 0 || len(data) < entries*8 {
+		return nil, fmt.Errorf("%w: theta sketch of %d entries in %d bytes", ErrInvalidSketch, entries, len(b))
+	}
+
+	s.hashes = make([]uint64, 0, count)
+	for i := 0; i < entries; i++ {
+		h := binary.LittleEndian.Uint64(data[i*8:])
+		if h != 0 && h < s.theta {
+			s.hashes = append(s.hashes, h)
+		}
+	}
+	if flags&flagOrdered == 0 {
+		sort.Slice(s.hashes, func(i, j int) bool { return s.hashes[i] < s.hashes[j] })
+	}
+	return s, nil
+}
+
+// MarshalBinary serializes the sketch as an ordered compact sketch, the
+// form druid stores and accepts
+func (s *Theta) MarshalBinary() ([]byte, error) {
+	flags := byte(flagReadOnly | flagCompact | flagOrdered)
+	if s.empty {
+		b := make([]byte, 8)
+		b[0], b[1], b[2], b[5] = 1, 3, familyCompact, flags|flagEmpty
+		binary.LittleEndian.PutUint16(b[6:], s.seedHash)
+		return b, nil
+	}
+
+	preLongs := 2
+	if s.theta < maxTheta {
+		preLongs = 3
+	}
+	b := make([]byte, preLongs*8+len(s.hashes)*8)
+	b[0], b[1], b[2], b[5] = byte(preLongs), 3, familyCompact, flags
+	binary.LittleEndian.PutUint16(b[6:], s.seedHash)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(s.hashes)))
+	binary.LittleEndian.PutUint32(b[12:], math.Float32bits(1))
+	if preLongs == 3 {
+		binary.LittleEndian.PutUint64(b[16:], s.theta)
+	}
+	for i, h := range s.hashes {
+		binary.LittleEndian.PutUint64(b[preLongs*8+i*8:], h)
+	}
+	return b, nil
+}
+
+// IsEmpty reports whether the sketch has never seen an item
+func (s *Theta) IsEmpty() bool {
+	return s.empty
+}
+
+// IsEstimationMode reports whether the sketch has dropped hashes, so its
+// estimate is approximate
+func (s *Theta) IsEstimationMode() bool {
+	return s.theta < maxTheta && !s.empty
+}
+
+// Theta returns the fraction of the hash space the sketch retains, 1 while
+// it's exact
+func (s *Theta) Theta() float64 {
+	if s.empty {
+		return 1
+	}
+	return float64(s.theta) / maxTheta
+}
+
+// Retained returns how many hashes the sketch holds
+func (s *Theta) Retained() int {
+	return len(s.hashes)
+}
+
+// SeedHash returns the hash of the seed the sketch was built with, only
+// sketches with the same seed can be combined
+func (s *Theta) SeedHash() uint16 {
+	return s.seedHash
+}
+
+// Estimate returns the estimated number of distinct items
+func (s *Theta) Estimate() float64 {
+	if !s.IsEstimationMode() {
+		return float64(len(s.hashes))
+	}
+	return float64(len(s.hashes)) / s.Theta()
+}
+
+// LowerBound returns the lower bound of the estimate at numStdDev standard
+// deviations, which is clamped to 1, 2 or 3
+func (s *Theta) LowerBound(numStdDev int) float64 {
+	if !s.IsEstimationMode() {
+		return float64(len(s.hashes))
+	}
+	lb := thetaBound(float64(len(s.hashes))-0.5, s.Theta(), clampStdDev(numStdDev), -1)
+	return math.Max(lb, float64(len(s.hashes)))
+}
+
+// UpperBound returns the upper bound of the estimate at numStdDev standard
+// deviations, which is clamped to 1, 2 or 3
+func (s *Theta) UpperBound(numStdDev int) float64 {
+	if !s.IsEstimationMode() {
+		return float64(len(s.hashes))
+	}
+	ub := thetaBound(float64(len(s.hashes))+0.5, s.Theta(), clampStdDev(numStdDev), 1)
+	return math.Max(ub, s.Estimate())
+}
+
+// thetaBound is the continuity corrected normal approximation of the
+// binomial bounds DataSketches uses once a sketch retains more than a few
+// hundred entries. For fewer its exact bounds are a little tighter
+func thetaBound(samples, theta float64, numStdDev float64, sign float64) float64 {
+	nHat := samples / theta
+	b := numStdDev * math.Sqrt((1-theta)/theta)
+	d := 0.5 * b * math.Sqrt(b*b+4*nHat)
+	center := nHat + 0.5*b*b
+	return center + sign*d
+}
+
+// UnionTheta returns the union of sketches, retaining at most
+// nominalEntries hashes. A nominalEntries of 0 uses DefaultNominalEntries.
+// nil sketches are skipped
+func UnionTheta(nominalEntries int, sketches ...*Theta) (*Theta, error) {
+	if nominalEntries <= 0 {
+		nominalEntries = DefaultNominalEntries
+	}
+	seedHash, err := commonSeedHash(sketches)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Theta{theta: maxTheta, seedHash: seedHash, empty: true}
+	var merged []uint64
+	for _, s := range sketches {
+		if s == nil {
+			continue
+		}
+		if !s.empty {
+			result.empty = false
+		}
+		if s.theta < result.theta {
+			result.theta = s.theta
+		}
+		merged = append(merged, s.hashes...)
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	for i, h := range merged {
+		if h >= result.theta {
+			break
+		}
+		if i > 0 && h == merged[i-1] {
+			continue
+		}
+		result.hashes = append(result.hashes, h)
+	}
+
+	if len(result.hashes) > nominalEntries {
+		result.theta = result.hashes[nominalEntries]
+		result.hashes = result.hashes[:nominalEntries]
+	}
+	return result, nil
+}
+
+// IntersectTheta returns the intersection of sketches, whose estimate is
+// the number of distinct items seen by all of them. nil sketches are skipped
+func IntersectTheta(sketches ...*Theta) (*Theta, error) {
+	seedHash, err := commonSeedHash(sketches)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Theta
+	for _, s := range sketches {
+		if s == nil {
+			continue
+		}
+		if result == nil {
+			result = &Theta{theta: s.theta, seedHash: seedHash, empty: s.empty}
+			result.hashes = append(result.hashes, s.hashes...)
+			continue
+		}
+
+		if s.empty {
+			result.empty = true
+		}
+		if s.theta < result.theta {
+			result.theta = s.theta
+		}
+		result.hashes = intersectHashes(result.hashes, s.hashes, result.theta)
+	}
+	if result == nil {
+		return nil, fmt.Errorf("%w: intersection of no sketches", ErrIncompatible)
+	}
+	if result.empty {
+		result.theta, result.hashes = maxTheta, nil
+	}
+	return result, nil
+}
+
+// intersectHashes returns the hashes below theta in both sorted slices
+func intersectHashes(a, b []uint64, theta uint64) []uint64 {
+	var out []uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] >= theta || b[j] >= theta:
+			return out
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// commonSeedHash returns the seed hash shared by every non empty sketch
+func commonSeedHash(sketches []*Theta) (uint16, error) {
+	seedHash := uint16(DefaultSeedHash)
+	seen := false
+	for _, s := range sketches {
+		if s == nil || s.empty {
+			continue
+		}
+		if seen && s.seedHash != seedHash {
+			return 0, fmt.Errorf("%w: seed hashes %#x and %#x differ", ErrIncompatible, seedHash, s.seedHash)
+		}
+		seedHash, seen = s.seedHash, true
+	}
+	return seedHash, nil
+}
@@ -0,0 +1,137 @@
+package sketch
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The golden sketches in testdata are built from the DataSketches format
+// spec by testdata/generate.go, see its doc comment
+
+func golden(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return b
+}
+
+func goldenTheta(t *testing.T, name string) *Theta {
+	s, err := DecodeTheta(golden(t, name))
+	require.NoError(t, err, name)
+	return s
+}
+
+func TestDecodeThetaExact(t *testing.T) {
+	empty := goldenTheta(t, "theta_empty.bin")
+	require.True(t, empty.IsEmpty())
+	require.Equal(t, 0.0, empty.Estimate())
+
+	single := goldenTheta(t, "theta_single.bin")
+	require.False(t, single.IsEmpty())
+	require.Equal(t, 1.0, single.Estimate())
+
+	for _, name := range []string{"theta_exact.bin", "theta_unordered.bin"} {
+		s := goldenTheta(t, name)
+		require.False(t, s.IsEstimationMode(), name)
+		require.Equal(t, 1000.0, s.Estimate(), name)
+		require.Equal(t, 1000.0, s.LowerBound(2), name)
+		require.Equal(t, 1000.0, s.UpperBound(2), name)
+		require.Equal(t, uint16(DefaultSeedHash), s.SeedHash(), name)
+	}
+	require.Equal(t, goldenTheta(t, "theta_exact.bin"), goldenTheta(t, "theta_unordered.bin"))
+
+	update := goldenTheta(t, "theta_update.bin")
+	require.Equal(t, 100.0, update.Estimate())
+}
+
+func TestDecodeThetaEstimationMode(t *testing.T) {
+	s := goldenTheta(t, "theta_a.bin")
+	require.True(t, s.IsEstimationMode())
+	require.Equal(t, 4096, s.Retained())
+	require.Less(t, s.Theta(), 0.05)
+
+	require.InDelta(t, 100000, s.Estimate(), 100000*0.05)
+	require.Less(t, s.LowerBound(3), 100000.0)
+	require.Greater(t, s.UpperBound(3), 100000.0)
+	require.Less(t, s.LowerBound(3), s.LowerBound(1))
+	require.Less(t, s.LowerBound(1), s.Estimate())
+	require.Greater(t, s.UpperBound(1), s.Estimate())
+	require.Less(t, s.UpperBound(1), s.UpperBound(3))
+}
+
+func TestThetaUnionAndIntersection(t *testing.T) {
+	a := goldenTheta(t, "theta_a.bin")
+	b := goldenTheta(t, "theta_b.bin")
+
+	union, err := UnionTheta(4096, a, b, nil, goldenTheta(t, "theta_empty.bin"))
+	require.NoError(t, err)
+	require.Equal(t, 4096, union.Retained())
+	require.Less(t, union.LowerBound(3), 150000.0)
+	require.Greater(t, union.UpperBound(3), 150000.0)
+
+	both, err := IntersectTheta(a, b)
+	require.NoError(t, err)
+	require.Less(t, both.LowerBound(3), 50000.0)
+	require.Greater(t, both.UpperBound(3), 50000.0)
+
+	// Exact sketches combine exactly
+	exact := goldenTheta(t, "theta_exact.bin")
+	update := goldenTheta(t, "theta_update.bin")
+	union, err = UnionTheta(0, exact, update)
+	require.NoError(t, err)
+	require.Equal(t, 1000.0, union.Estimate())
+	both, err = IntersectTheta(exact, update)
+	require.NoError(t, err)
+	require.Equal(t, 100.0, both.Estimate())
+
+	none, err := IntersectTheta(exact, goldenTheta(t, "theta_empty.bin"))
+	require.NoError(t, err)
+	require.True(t, none.IsEmpty())
+
+	_, err = IntersectTheta()
+	require.True(t, errors.Is(err, ErrIncompatible))
+}
+
+func TestThetaRejectsDifferentSeeds(t *testing.T) {
+	b := golden(t, "theta_exact.bin")
+	b[6], b[7] = 0x01, 0x02
+	other, err := DecodeTheta(b)
+	require.NoError(t, err)
+
+	_, err = UnionTheta(0, goldenTheta(t, "theta_exact.bin"), other)
+	require.True(t, errors.Is(err, ErrIncompatible))
+	_, err = IntersectTheta(goldenTheta(t, "theta_exact.bin"), other)
+	require.True(t, errors.Is(err, ErrIncompatible))
+}
+
+func TestThetaMarshalRoundTrip(t *testing.T) {
+	for _, name := range []string{"theta_empty.bin", "theta_single.bin", "theta_exact.bin", "theta_a.bin", "theta_update.bin"} {
+		s := goldenTheta(t, name)
+		b, err := s.MarshalBinary()
+		require.NoError(t, err, name)
+		decoded, err := DecodeTheta(b)
+		require.NoError(t, err, name)
+		require.Equal(t, s, decoded, name)
+	}
+}
+
+func TestDecodeThetaErrors(t *testing.T) {
+	exact := golden(t, "theta_exact.bin")
+	for name, b := range map[string][]byte{
+		"short":     exact[:4],
+		"truncated": exact[:100],
+		"version":   append([]byte{2, 2}, exact[2:]...),
+		"family":    append([]byte{2, 3, 7}, exact[3:]...),
+	} {
+		_, err := DecodeTheta(b)
+		require.Error(t, err, name)
+	}
+
+	bigEndian := append([]byte(nil), exact...)
+	bigEndian[5] |= flagBigEndian
+	_, err := DecodeTheta(bigEndian)
+	require.True(t, errors.Is(err, ErrUnsupported))
+}